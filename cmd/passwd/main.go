@@ -0,0 +1,129 @@
+// Command passwd creates, updates and deletes entries in a mosquitto compatible
+// password file, for use with the auth.File controller.
+//
+//	passwd [-c] [-H sha512-pbkdf2|bcrypt] [-I iterations] [-C cost] passwordfile username [password]
+//	passwd -D passwordfile username
+//
+// If the password is not given as an argument, it is read from the first line
+// of standard input.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+)
+
+func main() {
+	create := flag.Bool("c", false, "create a new password file, overwriting any existing file")
+	remove := flag.Bool("D", false, "delete the username from the password file")
+	alg := flag.String("H", "sha512-pbkdf2", "the hash algorithm to use, sha512-pbkdf2 or bcrypt")
+	iterations := flag.Int("I", auth.DefaultPBKDF2Iterations, "the number of iterations for sha512-pbkdf2 hashes")
+	cost := flag.Int("C", auth.DefaultBcryptCost, "the cost of bcrypt hashes")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-c | -D] [-H sha512-pbkdf2|bcrypt] passwordfile username [password]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 2 || len(args) > 3 || (*create && *remove) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(args, *create, *remove, *alg, *iterations, *cost, os.Stdin); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+// run updates the password file, reading the password from stdin if it is not
+// given as an argument.
+func run(args []string, create, remove bool, alg string, iterations, cost int, stdin io.Reader) error {
+	path, user := args[0], args[1]
+	if user == "" || strings.ContainsAny(user, ":\r\n") {
+		return errors.New("username must not be empty or contain ':' or line breaks")
+	}
+
+	var lines []string
+	if !create {
+		b, err := ioutil.ReadFile(path)
+		if err != nil && !(os.IsNotExist(err) && !remove) {
+			return err
+		}
+
+		if len(b) > 0 {
+			lines = strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+		}
+	}
+
+	entry := ""
+	if !remove {
+		password, err := readPassword(args, stdin)
+		if err != nil {
+			return err
+		}
+
+		var hash string
+		switch alg {
+		case "sha512-pbkdf2":
+			hash, err = auth.HashPBKDF2([]byte(password), iterations)
+		case "bcrypt":
+			hash, err = auth.HashBcrypt([]byte(password), cost)
+		default:
+			err = fmt.Errorf("unknown hash algorithm %q", alg)
+		}
+		if err != nil {
+			return err
+		}
+
+		entry = user + ":" + hash
+	}
+
+	found := false
+	out := make([]string, 0, len(lines)+1)
+	for _, line := range lines {
+		if strings.HasPrefix(line, user+":") {
+			found = true
+			if entry != "" {
+				out = append(out, entry)
+			}
+			continue
+		}
+		out = append(out, line)
+	}
+
+	if remove && !found {
+		return fmt.Errorf("user %q not found", user)
+	}
+
+	if !found && entry != "" {
+		out = append(out, entry)
+	}
+
+	return ioutil.WriteFile(path, []byte(strings.Join(out, "\n")+"\n"), 0600)
+}
+
+// readPassword returns the password argument, or the first line of stdin.
+func readPassword(args []string, stdin io.Reader) (string, error) {
+	if len(args) == 3 {
+		return args[2], nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	line = strings.TrimRight(line, "\r\n")
+	if err != nil && line == "" {
+		return "", errors.New("no password given")
+	}
+
+	return line, nil
+}
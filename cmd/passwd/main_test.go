@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+)
+
+// readEntries returns the hashes of a password file, keyed on username.
+func readEntries(t *testing.T, path string) map[string]string {
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	entries := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		user, hash, ok := strings.Cut(line, ":")
+		require.True(t, ok, line)
+		entries[user] = hash
+	}
+
+	return entries
+}
+
+func TestRunCreate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passwd")
+	require.NoError(t, run([]string{path, "mochi", "secret"}, true, false, "sha512-pbkdf2", auth.DefaultPBKDF2Iterations, auth.DefaultBcryptCost, nil))
+
+	entries := readEntries(t, path)
+	require.Len(t, entries, 1)
+	require.True(t, strings.HasPrefix(entries["mochi"], "$7$101$"))
+	require.True(t, auth.CheckPassword(entries["mochi"], []byte("secret")))
+
+	// creating again overwrites the existing file.
+	require.NoError(t, run([]string{path, "other", "secret"}, true, false, "sha512-pbkdf2", auth.DefaultPBKDF2Iterations, auth.DefaultBcryptCost, nil))
+	entries = readEntries(t, path)
+	require.Len(t, entries, 1)
+	require.Contains(t, entries, "other")
+}
+
+func TestRunAddUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passwd")
+	require.NoError(t, run([]string{path, "mochi", "secret"}, false, false, "sha512-pbkdf2", auth.DefaultPBKDF2Iterations, auth.DefaultBcryptCost, nil))
+	require.NoError(t, run([]string{path, "crypt", "hidden"}, false, false, "bcrypt", auth.DefaultPBKDF2Iterations, auth.MinBcryptCost, nil))
+
+	entries := readEntries(t, path)
+	require.Len(t, entries, 2)
+	require.True(t, strings.HasPrefix(entries["crypt"], "$2a$04$"))
+	require.True(t, auth.CheckPassword(entries["crypt"], []byte("hidden")))
+
+	require.NoError(t, run([]string{path, "mochi", "changed"}, false, false, "sha512-pbkdf2", 10, auth.DefaultBcryptCost, nil))
+	entries = readEntries(t, path)
+	require.Len(t, entries, 2)
+	require.True(t, strings.HasPrefix(entries["mochi"], "$7$10$"))
+	require.True(t, auth.CheckPassword(entries["mochi"], []byte("changed")))
+	require.False(t, auth.CheckPassword(entries["mochi"], []byte("secret")))
+}
+
+func TestRunPasswordFromStdin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passwd")
+	require.NoError(t, run([]string{path, "mochi"}, true, false, "sha512-pbkdf2", auth.DefaultPBKDF2Iterations, auth.DefaultBcryptCost, strings.NewReader("secret\r\nignored\n")))
+	require.True(t, auth.CheckPassword(readEntries(t, path)["mochi"], []byte("secret")))
+
+	err := run([]string{path, "mochi"}, true, false, "sha512-pbkdf2", auth.DefaultPBKDF2Iterations, auth.DefaultBcryptCost, strings.NewReader(""))
+	require.ErrorContains(t, err, "no password given")
+}
+
+func TestRunDelete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passwd")
+	require.NoError(t, run([]string{path, "mochi", "secret"}, true, false, "sha512-pbkdf2", auth.DefaultPBKDF2Iterations, auth.DefaultBcryptCost, nil))
+	require.NoError(t, run([]string{path, "other", "secret"}, false, false, "sha512-pbkdf2", auth.DefaultPBKDF2Iterations, auth.DefaultBcryptCost, nil))
+
+	require.NoError(t, run([]string{path, "mochi"}, false, true, "", 0, 0, nil))
+	entries := readEntries(t, path)
+	require.Len(t, entries, 1)
+	require.Contains(t, entries, "other")
+
+	err := run([]string{path, "mochi"}, false, true, "", 0, 0, nil)
+	require.ErrorContains(t, err, `user "mochi" not found`)
+
+	err = run([]string{filepath.Join(t.TempDir(), "missing"), "mochi"}, false, true, "", 0, 0, nil)
+	require.Error(t, err)
+}
+
+func TestRunInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passwd")
+	for _, user := range []string{"", "a:b", "a\nb"} {
+		err := run([]string{path, user, "secret"}, true, false, "sha512-pbkdf2", auth.DefaultPBKDF2Iterations, auth.DefaultBcryptCost, nil)
+		require.Error(t, err, user)
+	}
+
+	err := run([]string{path, "mochi", "secret"}, true, false, "md5", auth.DefaultPBKDF2Iterations, auth.DefaultBcryptCost, nil)
+	require.ErrorContains(t, err, `unknown hash algorithm "md5"`)
+
+	err = run([]string{path, "mochi", "secret"}, true, false, "sha512-pbkdf2", 0, auth.DefaultBcryptCost, nil)
+	require.ErrorIs(t, err, auth.ErrPBKDF2Iterations)
+
+	err = run([]string{path, "mochi", "secret"}, true, false, "bcrypt", auth.DefaultPBKDF2Iterations, auth.MaxBcryptCost+1, nil)
+	require.ErrorIs(t, err, auth.ErrBcryptCost)
+}
@@ -11,6 +11,7 @@ require (
 	github.com/rs/xid v1.4.0
 	github.com/stretchr/testify v1.7.1
 	go.etcd.io/bbolt v1.3.5
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
 )
 
 require (
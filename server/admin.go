@@ -0,0 +1,391 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mochi-co/mqtt/server/internal/clients"
+	"github.com/mochi-co/mqtt/server/internal/packets"
+)
+
+var (
+	// ErrClientNotFound indicates that no client or session exists for a client id.
+	ErrClientNotFound = errors.New("client not found")
+
+	// ErrClientNotConnected indicates that a client session exists, but the client
+	// is not currently connected.
+	ErrClientNotConnected = errors.New("client not connected")
+
+	// ErrClientKicked indicates that a client was forcibly disconnected by the server.
+	ErrClientKicked = errors.New("client disconnected by server")
+
+	// ErrRetainedNotFound indicates that no retained message exists for a topic.
+	ErrRetainedNotFound = errors.New("retained message not found")
+
+	// ErrInvalidRetainedTopic indicates that a retained message topic was empty or
+	// contained wildcard characters.
+	ErrInvalidRetainedTopic = errors.New("retained topic must not be empty or contain wildcards")
+
+	// ErrAdminListener indicates that the admin api was asked to remove the
+	// listener serving the request.
+	ErrAdminListener = errors.New("cannot remove the listener serving the admin api")
+)
+
+// ClientInfo is a point-in-time snapshot of a client session known by the broker.
+type ClientInfo struct {
+	ID            string          `json:"id"`            // the client id.
+	Remote        string          `json:"remote"`        // the remote address of the client.
+	Listener      string          `json:"listener"`      // the id of the listener the client connected to.
+	Username      string          `json:"username"`      // the username the client authenticated with.
+	CleanSession  bool            `json:"clean_session"` // indicates if the client expects a clean-session.
+	Connected     bool            `json:"connected"`     // indicates if the client is currently connected.
+	Keepalive     uint16          `json:"keepalive"`     // the keepalive of the connection in seconds.
+	ConnectedAt   int64           `json:"connected_at"`  // the unix time the client last connected.
+	Subscriptions map[string]byte `json:"subscriptions"` // the subscription filters and qos of the client.
+	Inflight      int             `json:"inflight"`      // the number of inflight messages for the client.
+	TrafficStats                  // the traffic counters of the client connection.
+}
+
+// TrafficStats contains the traffic counters of a client connection or listener.
+type TrafficStats struct {
+	BytesRecv      int64 `json:"bytes_recv"`              // the number of bytes received.
+	BytesSent      int64 `json:"bytes_sent"`              // the number of bytes sent.
+	MessagesRecv   int64 `json:"messages_recv"`           // the number of packets received.
+	MessagesSent   int64 `json:"messages_sent"`           // the number of packets sent.
+	PublishRecv    int64 `json:"publish_recv"`            // the number of publish packets received.
+	PublishSent    int64 `json:"publish_sent"`            // the number of publish packets sent.
+	PublishDropped int64 `json:"publish_dropped"`         // the number of outbound publish messages which were dropped.
+	LastActivity   int64 `json:"last_activity,omitempty"` // the unix time a packet was last received or sent.
+}
+
+// loadStats atomically loads a snapshot of traffic counters.
+func loadStats(s *clients.Stats) TrafficStats {
+	return TrafficStats{
+		BytesRecv:      atomic.LoadInt64(&s.BytesRecv),
+		BytesSent:      atomic.LoadInt64(&s.BytesSent),
+		MessagesRecv:   atomic.LoadInt64(&s.MessagesRecv),
+		MessagesSent:   atomic.LoadInt64(&s.MessagesSent),
+		PublishRecv:    atomic.LoadInt64(&s.PublishRecv),
+		PublishSent:    atomic.LoadInt64(&s.PublishSent),
+		PublishDropped: atomic.LoadInt64(&s.PublishDropped),
+		LastActivity:   atomic.LoadInt64(&s.LastActivity),
+	}
+}
+
+// InflightInfo is a point-in-time snapshot of an inflight message for a client.
+type InflightInfo struct {
+	PacketID uint16 `json:"packet_id"` // the id of the inflight packet.
+	Type     string `json:"type"`      // the type of the inflight packet.
+	Topic    string `json:"topic"`     // the topic of the inflight message, if a publish.
+	Qos      byte   `json:"qos"`       // the qos of the inflight message.
+	Sent     int64  `json:"sent"`      // the unix time the message was last sent.
+	Created  int64  `json:"created"`   // the unix time the inflight message was created.
+	Resends  int    `json:"resends"`   // the number of times the message was resent.
+}
+
+// RetainedInfo is a point-in-time snapshot of a retained message.
+type RetainedInfo struct {
+	Topic   string `json:"topic"`   // the topic of the retained message.
+	Qos     byte   `json:"qos"`     // the qos of the retained message.
+	Payload []byte `json:"payload"` // the payload of the retained message.
+}
+
+// ListenerInfo is a point-in-time snapshot of a listener attached to the broker.
+type ListenerInfo struct {
+	ID               string `json:"id"`                // the id of the listener.
+	Clients          int    `json:"clients"`           // the number of clients connected via the listener.
+	ConnectionsTotal int64  `json:"connections_total"` // the number of clients which have connected via the listener.
+	State            string `json:"state"`             // the lifecycle state of the listener, such as serving or failed.
+	Address          string `json:"address,omitempty"` // the network address the listener is bound to, if known.
+	Error            string `json:"error,omitempty"`   // the error which failed the listener, if any.
+	TrafficStats            // the aggregate traffic counters of the clients of the listener.
+}
+
+// clientInfo returns a snapshot of a client.
+func clientInfo(cl *clients.Client) ClientInfo {
+	cl.RLock()
+	subs := make(map[string]byte, len(cl.Subscriptions))
+	for k, v := range cl.Subscriptions {
+		subs[k] = v
+	}
+	cl.RUnlock()
+
+	info := cl.Info()
+	return ClientInfo{
+		ID:            cl.ID,
+		Remote:        info.Remote,
+		Listener:      cl.Listener,
+		Username:      string(cl.Username),
+		CleanSession:  cl.CleanSession,
+		Connected:     atomic.LoadUint32(&cl.State.Done) == 0,
+		Keepalive:     cl.Keepalive(),
+		ConnectedAt:   cl.ConnectedAt,
+		Subscriptions: subs,
+		Inflight:      cl.Inflight.Len(),
+		TrafficStats:  loadStats(cl.Stats),
+	}
+}
+
+// ListClients returns a snapshot of all the client sessions known by the broker,
+// including both connected clients and persisted sessions, sorted by client id.
+func (s *Server) ListClients() []ClientInfo {
+	all := s.Clients.GetAll()
+	out := make([]ClientInfo, 0, len(all))
+	for _, cl := range all {
+		out = append(out, clientInfo(cl))
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].ID < out[j].ID
+	})
+
+	return out
+}
+
+// GetClient returns a snapshot of a client session, if it exists.
+func (s *Server) GetClient(id string) (ClientInfo, bool) {
+	cl, ok := s.Clients.Get(id)
+	if !ok {
+		return ClientInfo{}, false
+	}
+
+	return clientInfo(cl), true
+}
+
+// ClientInflight returns a snapshot of the inflight messages of a client session,
+// sorted by packet id.
+func (s *Server) ClientInflight(id string) ([]InflightInfo, error) {
+	cl, ok := s.Clients.Get(id)
+	if !ok {
+		return nil, ErrClientNotFound
+	}
+
+	all := cl.Inflight.GetAll()
+	out := make([]InflightInfo, 0, len(all))
+	for _, in := range all {
+		out = append(out, InflightInfo{
+			PacketID: in.Packet.PacketID,
+			Type:     packets.Names[in.Packet.FixedHeader.Type],
+			Topic:    in.Packet.TopicName,
+			Qos:      in.Packet.FixedHeader.Qos,
+			Sent:     in.Sent,
+			Created:  in.Created,
+			Resends:  in.Resends,
+		})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].PacketID < out[j].PacketID
+	})
+
+	return out, nil
+}
+
+// DisconnectClient forcibly disconnects a connected client. If sendWill is false,
+// the last will and testament message of the client is discarded instead of
+// being published. Any persistent session of the client is retained.
+func (s *Server) DisconnectClient(id string, sendWill bool) error {
+	cl, ok := s.Clients.Get(id)
+	if !ok {
+		return ErrClientNotFound
+	}
+
+	if atomic.LoadUint32(&cl.State.Done) == 1 {
+		return ErrClientNotConnected
+	}
+
+	if !sendWill {
+		cl.Lock()
+		cl.LWT = clients.LWT{}
+		cl.Unlock()
+	}
+
+	s.Log.Info("disconnecting client", "client_id", id, "send_will", sendWill)
+	cl.Stop(ErrClientKicked)
+
+	return nil
+}
+
+// DiscardSession completely removes a client session from the broker, including
+// its subscriptions, inflight messages and any records in the persistent store.
+// If the client is connected, it is disconnected without publishing its will.
+func (s *Server) DiscardSession(id string) error {
+	cl, ok := s.Clients.Get(id)
+	if !ok {
+		return ErrClientNotFound
+	}
+
+	if atomic.LoadUint32(&cl.State.Done) == 0 {
+		_ = s.DisconnectClient(id, false)
+	}
+
+	cl.Lock()
+	defer cl.Unlock()
+
+	filters := make([]string, 0, len(cl.Subscriptions))
+	for filter := range cl.Subscriptions {
+		filters = append(filters, filter)
+	}
+	inflight := cl.Inflight.GetAll()
+
+	s.unsubscribeClient(cl)
+	s.clearAbandonedInflights(cl)
+	s.Clients.Delete(id)
+
+	if s.Store != nil {
+		for _, filter := range filters {
+			s.onStorage(cl, s.Store.DeleteSubscription("sub_"+id+":"+filter))
+		}
+
+		for _, in := range inflight {
+			s.onStorage(cl, s.Store.DeleteInflight(persistentID(cl, in.Packet)))
+		}
+
+		s.onStorage(cl, s.Store.DeleteClient("cl_"+id))
+	}
+
+	s.Log.Info("client session discarded", "client_id", id)
+
+	return nil
+}
+
+// RetainedMessages returns a snapshot of the retained messages matching a topic
+// filter, sorted by topic.
+func (s *Server) RetainedMessages(filter string) []RetainedInfo {
+	msgs := s.Topics.Messages(filter)
+	out := make([]RetainedInfo, 0, len(msgs))
+	for _, pk := range msgs {
+		out = append(out, RetainedInfo{
+			Topic:   pk.TopicName,
+			Qos:     pk.FixedHeader.Qos,
+			Payload: pk.Payload,
+		})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Topic < out[j].Topic
+	})
+
+	return out
+}
+
+// GetRetained returns the retained message for a topic, if it exists.
+func (s *Server) GetRetained(topic string) (RetainedInfo, bool) {
+	if !validRetainedTopic(topic) {
+		return RetainedInfo{}, false
+	}
+
+	msgs := s.RetainedMessages(topic)
+	if len(msgs) == 0 {
+		return RetainedInfo{}, false
+	}
+
+	return msgs[0], true
+}
+
+// SetRetained sets the retained message for a topic, replacing any existing
+// message. The message is not published to current subscribers; use Publish
+// with retain set to true for that.
+func (s *Server) SetRetained(topic string, payload []byte) error {
+	if !validRetainedTopic(topic) {
+		return ErrInvalidRetainedTopic
+	}
+
+	if len(payload) == 0 {
+		return s.DeleteRetained(topic)
+	}
+
+	s.retainMessage(&s.inline, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Retain: true,
+		},
+		TopicName: topic,
+		Payload:   payload,
+	})
+
+	return nil
+}
+
+// DeleteRetained removes the retained message for a topic.
+func (s *Server) DeleteRetained(topic string) error {
+	if _, ok := s.GetRetained(topic); !ok {
+		return ErrRetainedNotFound
+	}
+
+	s.retainMessage(&s.inline, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Retain: true,
+		},
+		TopicName: topic,
+	})
+
+	return nil
+}
+
+// validRetainedTopic returns true if a topic can hold a retained message.
+func validRetainedTopic(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#")
+}
+
+// ListListeners returns a snapshot of the listeners attached to the broker,
+// sorted by listener id.
+func (s *Server) ListListeners() []ListenerInfo {
+	counts := make(map[string]int)
+	for _, cl := range s.Clients.GetAll() {
+		if atomic.LoadUint32(&cl.State.Done) == 0 {
+			counts[s.owners.owner(cl)]++
+		}
+	}
+
+	ids := s.Listeners.IDs()
+	out := make([]ListenerInfo, 0, len(ids))
+	for _, id := range ids {
+		out = append(out, s.listenerInfo(id, counts[id]))
+	}
+
+	return out
+}
+
+// GetListener returns a snapshot of a listener attached to the broker, if it exists.
+func (s *Server) GetListener(id string) (ListenerInfo, bool) {
+	if _, ok := s.Listeners.Get(id); !ok {
+		return ListenerInfo{}, false
+	}
+
+	var n int
+	for _, cl := range s.Clients.GetAll() {
+		if s.owners.owner(cl) == id && atomic.LoadUint32(&cl.State.Done) == 0 {
+			n++
+		}
+	}
+
+	return s.listenerInfo(id, n), true
+}
+
+// listenerInfo returns a snapshot of a listener with n connected clients.
+func (s *Server) listenerInfo(id string, n int) ListenerInfo {
+	ls := s.listenerStats.Get(id)
+	stats := loadStats(&ls.Stats)
+	stats.LastActivity = 0
+
+	info := ListenerInfo{
+		ID:               id,
+		Clients:          n,
+		ConnectionsTotal: atomic.LoadInt64(&ls.ConnectionsTotal),
+		TrafficStats:     stats,
+	}
+
+	if state, ok := s.Listeners.State(id); ok {
+		info.State = state.Status
+		info.Address = state.Address
+		if state.Err != nil {
+			info.Error = state.Err.Error()
+		}
+	}
+
+	return info
+}
@@ -0,0 +1,407 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/mochi-co/mqtt/server/listeners"
+)
+
+const (
+	// adminDefaultLimit is the default number of items returned in a page.
+	adminDefaultLimit = 100
+
+	// adminMaxLimit is the maximum number of items which can be requested in a page.
+	adminMaxLimit = 1000
+
+	// adminMaxBodySize is the maximum size of a request body sent to the admin api.
+	adminMaxBodySize = 1 << 20
+)
+
+// adminPage is a paginated response from the admin api.
+type adminPage struct {
+	Total  int         `json:"total"`  // the total number of items matching the request.
+	Offset int         `json:"offset"` // the index of the first item in the page.
+	Limit  int         `json:"limit"`  // the maximum number of items in the page.
+	Items  interface{} `json:"items"`  // the items in the page.
+}
+
+// adminPublish is the request body for publishing a message via the admin api.
+type adminPublish struct {
+	Topic   string `json:"topic"`   // the topic to publish the message to.
+	Payload string `json:"payload"` // the payload of the message.
+	Retain  bool   `json:"retain"`  // retain the message on the topic.
+}
+
+// adminHandler serves the broker admin REST api.
+type adminHandler struct {
+	s *Server
+}
+
+// AdminHandler returns an http.Handler which serves a REST api for administering
+// the broker. The handler does not perform any authentication, and should be
+// served using a listeners.HTTPAdmin listener or behind equivalent middleware.
+//
+//	GET    /clients                        list clients (search, listener, connected, offset, limit)
+//	GET    /clients/{id}                   get a client
+//	DELETE /clients/{id}                   disconnect a client (will, discard)
+//	GET    /clients/{id}/subscriptions     list the subscriptions of a client
+//	GET    /clients/{id}/inflight          list the inflight messages of a client
+//	GET    /retained                       list retained messages (filter, offset, limit)
+//	GET    /retained/{topic}               get a retained message
+//	PUT    /retained/{topic}               set a retained message from the request body
+//	DELETE /retained/{topic}               delete a retained message
+//	POST   /publish                        publish a message
+//	GET    /listeners                      list listener status
+//	GET    /listeners/{id}                 get the status of a listener
+//	DELETE /listeners/{id}                 remove a listener other than the admin api listener (migrate)
+//	GET    /system                         get the $SYS info values
+func (s *Server) AdminHandler() http.Handler {
+	return &adminHandler{s: s}
+}
+
+// ServeHTTP routes an admin api request.
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(req.URL.EscapedPath(), "/")
+	resource, rest, _ := strings.Cut(path, "/")
+
+	switch resource {
+	case "clients":
+		h.clients(w, req, rest)
+	case "retained":
+		h.retained(w, req, rest)
+	case "publish":
+		h.publish(w, req)
+	case "listeners":
+		h.listeners(w, req, rest)
+	case "system":
+		if !allowMethods(w, req, http.MethodGet) {
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, h.s.System)
+	default:
+		writeAdminError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+// clients handles requests for the clients resource.
+func (h *adminHandler) clients(w http.ResponseWriter, req *http.Request, rest string) {
+	if rest == "" {
+		if !allowMethods(w, req, http.MethodGet) {
+			return
+		}
+
+		q := req.URL.Query()
+		search := q.Get("search")
+		listener := q.Get("listener")
+		connected := q.Get("connected")
+
+		all := h.s.ListClients()
+		matched := all[:0]
+		for _, info := range all {
+			if search != "" &&
+				!strings.Contains(info.ID, search) &&
+				!strings.Contains(info.Username, search) &&
+				!strings.Contains(info.Remote, search) {
+				continue
+			}
+
+			if listener != "" && info.Listener != listener {
+				continue
+			}
+
+			if connected != "" && strconv.FormatBool(info.Connected) != connected {
+				continue
+			}
+
+			matched = append(matched, info)
+		}
+
+		lo, hi, page, err := paginate(req, len(matched))
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		page.Items = matched[lo:hi]
+		writeAdminJSON(w, http.StatusOK, page)
+		return
+	}
+
+	escaped, sub, _ := strings.Cut(rest, "/")
+	id, err := url.PathUnescape(escaped)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch sub {
+	case "":
+		switch req.Method {
+		case http.MethodGet:
+			info, ok := h.s.GetClient(id)
+			if !ok {
+				writeAdminError(w, http.StatusNotFound, ErrClientNotFound)
+				return
+			}
+			writeAdminJSON(w, http.StatusOK, info)
+		case http.MethodDelete:
+			q := req.URL.Query()
+			if q.Get("discard") == "true" {
+				err = h.s.DiscardSession(id)
+			} else {
+				err = h.s.DisconnectClient(id, q.Get("will") == "true")
+			}
+
+			if err != nil {
+				writeAdminError(w, adminStatus(err), err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			allowMethods(w, req, http.MethodGet, http.MethodDelete)
+		}
+
+	case "subscriptions":
+		if !allowMethods(w, req, http.MethodGet) {
+			return
+		}
+
+		info, ok := h.s.GetClient(id)
+		if !ok {
+			writeAdminError(w, http.StatusNotFound, ErrClientNotFound)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, info.Subscriptions)
+
+	case "inflight":
+		if !allowMethods(w, req, http.MethodGet) {
+			return
+		}
+
+		inflight, err := h.s.ClientInflight(id)
+		if err != nil {
+			writeAdminError(w, adminStatus(err), err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, inflight)
+
+	default:
+		writeAdminError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+// listeners handles requests for the listeners resource.
+func (h *adminHandler) listeners(w http.ResponseWriter, req *http.Request, rest string) {
+	if rest == "" {
+		if !allowMethods(w, req, http.MethodGet) {
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, h.s.ListListeners())
+		return
+	}
+
+	id, err := url.PathUnescape(rest)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		info, ok := h.s.GetListener(id)
+		if !ok {
+			writeAdminError(w, http.StatusNotFound, listeners.ErrListenerNotFound)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, info)
+	case http.MethodDelete:
+		// Removing the listener serving the request would wait for the request to
+		// finish while the request waits for the removal.
+		if lid, ok := listeners.AdminListenerID(req.Context()); ok && lid == id {
+			writeAdminError(w, http.StatusConflict, ErrAdminListener)
+			return
+		}
+
+		err = h.s.RemoveListener(id, req.URL.Query().Get("migrate"))
+		if err != nil {
+			writeAdminError(w, adminStatus(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		allowMethods(w, req, http.MethodGet, http.MethodDelete)
+	}
+}
+
+// retained handles requests for the retained messages resource.
+func (h *adminHandler) retained(w http.ResponseWriter, req *http.Request, rest string) {
+	if rest == "" {
+		if !allowMethods(w, req, http.MethodGet) {
+			return
+		}
+
+		filter := req.URL.Query().Get("filter")
+		if filter == "" {
+			filter = "#"
+		}
+
+		msgs := h.s.RetainedMessages(filter)
+		lo, hi, page, err := paginate(req, len(msgs))
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		page.Items = msgs[lo:hi]
+		writeAdminJSON(w, http.StatusOK, page)
+		return
+	}
+
+	topic, err := url.PathUnescape(rest)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		msg, ok := h.s.GetRetained(topic)
+		if !ok {
+			writeAdminError(w, http.StatusNotFound, ErrRetainedNotFound)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, msg)
+	case http.MethodPut:
+		payload, err := io.ReadAll(http.MaxBytesReader(w, req.Body, adminMaxBodySize))
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if err := h.s.SetRetained(topic, payload); err != nil {
+			writeAdminError(w, adminStatus(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if err := h.s.DeleteRetained(topic); err != nil {
+			writeAdminError(w, adminStatus(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		allowMethods(w, req, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
+
+// publish handles requests to publish a message.
+func (h *adminHandler) publish(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodPost) {
+		return
+	}
+
+	var msg adminPublish
+	dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, adminMaxBodySize))
+	if err := dec.Decode(&msg); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if msg.Topic == "" || strings.ContainsAny(msg.Topic, "+#") || strings.HasPrefix(msg.Topic, "$") {
+		writeAdminError(w, http.StatusBadRequest, ErrInvalidTopic)
+		return
+	}
+
+	if err := h.s.Publish(msg.Topic, []byte(msg.Payload), msg.Retain); err != nil {
+		writeAdminError(w, adminStatus(err), err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// allowMethods writes a method not allowed response and returns false if the
+// request method is not one of the allowed methods.
+func allowMethods(w http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if req.Method == m {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeAdminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	return false
+}
+
+// paginate returns the bounds of the requested page of a collection of total items,
+// using the offset and limit query parameters.
+func paginate(req *http.Request, total int) (lo, hi int, page adminPage, err error) {
+	q := req.URL.Query()
+	page = adminPage{
+		Total: total,
+		Limit: adminDefaultLimit,
+	}
+
+	if v := q.Get("offset"); v != "" {
+		page.Offset, err = strconv.Atoi(v)
+		if err != nil || page.Offset < 0 {
+			return 0, 0, page, errors.New("invalid offset")
+		}
+	}
+
+	if v := q.Get("limit"); v != "" {
+		page.Limit, err = strconv.Atoi(v)
+		if err != nil || page.Limit < 1 {
+			return 0, 0, page, errors.New("invalid limit")
+		}
+	}
+
+	if page.Limit > adminMaxLimit {
+		page.Limit = adminMaxLimit
+	}
+
+	lo = page.Offset
+	if lo > total {
+		lo = total
+	}
+
+	hi = lo + page.Limit
+	if hi > total {
+		hi = total
+	}
+
+	return lo, hi, page, nil
+}
+
+// adminStatus returns the http status code for an admin api error.
+func adminStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrClientNotFound), errors.Is(err, ErrRetainedNotFound), errors.Is(err, listeners.ErrListenerNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrClientNotConnected):
+		return http.StatusConflict
+	case errors.Is(err, ErrInvalidTopic), errors.Is(err, ErrInvalidRetainedTopic), errors.Is(err, ErrInvalidMigrationTarget):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeAdminJSON writes a value to an http response as JSON.
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeAdminError writes an error to an http response as JSON.
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminJSON(w, status, map[string]string{"error": err.Error()})
+}
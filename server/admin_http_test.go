@@ -0,0 +1,337 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-co/mqtt/server/internal/clients"
+	"github.com/mochi-co/mqtt/server/internal/packets"
+	"github.com/mochi-co/mqtt/server/listeners"
+)
+
+func adminRequest(t *testing.T, s *Server, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	s.AdminHandler().ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminHandlerNotFound(t *testing.T) {
+	s := New()
+	w := adminRequest(t, s, http.MethodGet, "/nothing", "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.JSONEq(t, `{"error":"not found"}`, w.Body.String())
+
+	w = adminRequest(t, s, http.MethodGet, "/clients/mochi/other", "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestAdminHandlerMethodNotAllowed(t *testing.T) {
+	s := New()
+	w := adminRequest(t, s, http.MethodPost, "/clients", "")
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	require.Equal(t, "GET", w.Header().Get("Allow"))
+
+	w = adminRequest(t, s, http.MethodPost, "/retained/a/b", "")
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	require.Equal(t, "GET, PUT, DELETE", w.Header().Get("Allow"))
+
+	w = adminRequest(t, s, http.MethodGet, "/publish", "")
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestAdminHandlerListClients(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.Listener = "t1"
+	s.Clients.Add(cl)
+
+	for _, id := range []string{"a", "b", "c"} {
+		stub := clients.NewClientStub(s.System)
+		stub.ID = id
+		stub.Listener = "t2"
+		s.Clients.Add(stub)
+	}
+
+	var page struct {
+		Total  int          `json:"total"`
+		Offset int          `json:"offset"`
+		Limit  int          `json:"limit"`
+		Items  []ClientInfo `json:"items"`
+	}
+
+	w := adminRequest(t, s, http.MethodGet, "/clients", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	require.Equal(t, 4, page.Total)
+	require.Equal(t, 100, page.Limit)
+	require.Len(t, page.Items, 4)
+
+	w = adminRequest(t, s, http.MethodGet, "/clients?offset=1&limit=2", "")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	require.Equal(t, 4, page.Total)
+	require.Equal(t, 1, page.Offset)
+	require.Len(t, page.Items, 2)
+	require.Equal(t, "b", page.Items[0].ID)
+	require.Equal(t, "c", page.Items[1].ID)
+
+	w = adminRequest(t, s, http.MethodGet, "/clients?offset=10", "")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	require.Equal(t, 4, page.Total)
+	require.Len(t, page.Items, 0)
+
+	w = adminRequest(t, s, http.MethodGet, "/clients?search=moc", "")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	require.Equal(t, 1, page.Total)
+	require.Equal(t, "mochi", page.Items[0].ID)
+
+	w = adminRequest(t, s, http.MethodGet, "/clients?listener=t2&connected=false", "")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	require.Equal(t, 3, page.Total)
+
+	w = adminRequest(t, s, http.MethodGet, "/clients?connected=true", "")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	require.Equal(t, 1, page.Total)
+}
+
+func TestAdminHandlerListClientsBadPage(t *testing.T) {
+	s := New()
+	w := adminRequest(t, s, http.MethodGet, "/clients?offset=-1", "")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.JSONEq(t, `{"error":"invalid offset"}`, w.Body.String())
+
+	w = adminRequest(t, s, http.MethodGet, "/clients?limit=x", "")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = adminRequest(t, s, http.MethodGet, "/retained?limit=0", "")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestPaginateMaxLimit(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/clients?limit=5000", nil)
+	lo, hi, page, err := paginate(req, 2000)
+	require.NoError(t, err)
+	require.Equal(t, 0, lo)
+	require.Equal(t, adminMaxLimit, hi)
+	require.Equal(t, adminMaxLimit, page.Limit)
+}
+
+func TestAdminHandlerGetClient(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.ID = "a/b"
+	cl.NoteSubscription("a/b/c", 1)
+	cl.Inflight.Set(1, clients.InflightMessage{
+		Packet: packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+			PacketID:    1,
+			TopicName:   "a/b/c",
+		},
+	})
+	s.Clients.Add(cl)
+
+	w := adminRequest(t, s, http.MethodGet, "/clients/a%2Fb", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var info ClientInfo
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &info))
+	require.Equal(t, "a/b", info.ID)
+	require.True(t, info.Connected)
+
+	w = adminRequest(t, s, http.MethodGet, "/clients/a%2Fb/subscriptions", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"a/b/c":1}`, w.Body.String())
+
+	w = adminRequest(t, s, http.MethodGet, "/clients/a%2Fb/inflight", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var inflight []InflightInfo
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &inflight))
+	require.Len(t, inflight, 1)
+	require.Equal(t, "a/b/c", inflight[0].Topic)
+
+	for _, path := range []string{"/clients/x", "/clients/x/subscriptions", "/clients/x/inflight"} {
+		w = adminRequest(t, s, http.MethodGet, path, "")
+		require.Equal(t, http.StatusNotFound, w.Code, path)
+		require.JSONEq(t, `{"error":"client not found"}`, w.Body.String())
+	}
+}
+
+func TestAdminHandlerKickClient(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.LWT = clients.LWT{Topic: "a/b", Message: []byte("bye")}
+	s.Clients.Add(cl)
+
+	w := adminRequest(t, s, http.MethodDelete, "/clients/mochi", "")
+	require.Equal(t, http.StatusNoContent, w.Code)
+	require.ErrorIs(t, cl.StopCause(), ErrClientKicked)
+	require.Equal(t, clients.LWT{}, cl.LWT)
+
+	w = adminRequest(t, s, http.MethodDelete, "/clients/mochi", "")
+	require.Equal(t, http.StatusConflict, w.Code)
+
+	w = adminRequest(t, s, http.MethodDelete, "/clients/mochi?discard=true", "")
+	require.Equal(t, http.StatusNoContent, w.Code)
+	_, ok := s.Clients.Get("mochi")
+	require.False(t, ok)
+
+	w = adminRequest(t, s, http.MethodDelete, "/clients/mochi", "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestAdminHandlerKickClientSendWill(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.LWT = clients.LWT{Topic: "a/b", Message: []byte("bye")}
+	s.Clients.Add(cl)
+
+	w := adminRequest(t, s, http.MethodDelete, "/clients/mochi?will=true", "")
+	require.Equal(t, http.StatusNoContent, w.Code)
+	require.Equal(t, "a/b", cl.LWT.Topic)
+}
+
+func TestAdminHandlerRetained(t *testing.T) {
+	s := New()
+
+	w := adminRequest(t, s, http.MethodPut, "/retained/a/b", "hello")
+	require.Equal(t, http.StatusNoContent, w.Code)
+	w = adminRequest(t, s, http.MethodPut, "/retained/a/c", "world")
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	w = adminRequest(t, s, http.MethodGet, "/retained/a/b", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var msg RetainedInfo
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &msg))
+	require.Equal(t, "a/b", msg.Topic)
+	require.Equal(t, []byte("hello"), msg.Payload)
+
+	var page struct {
+		Total int            `json:"total"`
+		Items []RetainedInfo `json:"items"`
+	}
+	w = adminRequest(t, s, http.MethodGet, "/retained", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	require.Equal(t, 2, page.Total)
+
+	w = adminRequest(t, s, http.MethodGet, "/retained?filter=a/c", "")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	require.Equal(t, 1, page.Total)
+	require.Equal(t, "a/c", page.Items[0].Topic)
+
+	w = adminRequest(t, s, http.MethodDelete, "/retained/a/b", "")
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	w = adminRequest(t, s, http.MethodGet, "/retained/a/b", "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = adminRequest(t, s, http.MethodDelete, "/retained/a/b", "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = adminRequest(t, s, http.MethodPut, "/retained/a/%23", "x")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestAdminHandlerPublish(t *testing.T) {
+	s := New()
+
+	w := adminRequest(t, s, http.MethodPost, "/publish", `{"topic":"a/b","payload":"hello","retain":true}`)
+	require.Equal(t, http.StatusAccepted, w.Code)
+
+	pk := <-s.inline.pub
+	require.Equal(t, "a/b", pk.TopicName)
+	require.Equal(t, []byte("hello"), pk.Payload)
+	require.True(t, pk.FixedHeader.Retain)
+
+	_, ok := s.GetRetained("a/b")
+	require.True(t, ok)
+}
+
+func TestAdminHandlerPublishInvalid(t *testing.T) {
+	s := New()
+
+	w := adminRequest(t, s, http.MethodPost, "/publish", `{`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	for _, topic := range []string{"", "a/#", "$SYS/a"} {
+		w = adminRequest(t, s, http.MethodPost, "/publish", `{"topic":"`+topic+`"}`)
+		require.Equal(t, http.StatusBadRequest, w.Code, topic)
+	}
+}
+
+func TestAdminHandlerListeners(t *testing.T) {
+	s := New()
+	s.Listeners.Add(listeners.NewMockListener("t1", ":1882"))
+
+	w := adminRequest(t, s, http.MethodGet, "/listeners", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `[{"id":"t1","clients":0,"connections_total":0,"state":"added",
+		"bytes_recv":0,"bytes_sent":0,"messages_recv":0,"messages_sent":0,
+		"publish_recv":0,"publish_sent":0,"publish_dropped":0}]`, w.Body.String())
+}
+
+func TestAdminHandlerListener(t *testing.T) {
+	s := New()
+	s.Listeners.Add(listeners.NewMockListener("t1", ":1882"))
+
+	w := adminRequest(t, s, http.MethodGet, "/listeners/t1", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), `"state":"added"`)
+
+	w = adminRequest(t, s, http.MethodGet, "/listeners/t2", "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = adminRequest(t, s, http.MethodPost, "/listeners/t1", "")
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	w = adminRequest(t, s, http.MethodDelete, "/listeners/t1?migrate=t2", "")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = adminRequest(t, s, http.MethodDelete, "/listeners/t1", "")
+	require.Equal(t, http.StatusNoContent, w.Code)
+	require.Equal(t, 0, s.Listeners.Len())
+
+	w = adminRequest(t, s, http.MethodDelete, "/listeners/t1", "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestAdminHandlerRemoveAdminListener(t *testing.T) {
+	s := New()
+	l := listeners.NewHTTPAdmin("admin", "127.0.0.1:0", s.AdminHandler())
+	l.SetToken("abc")
+	require.NoError(t, s.AddListener(l, nil))
+	require.NoError(t, s.Serve())
+	defer s.Close()
+
+	var addr net.Addr
+	require.Eventually(t, func() bool {
+		addr = l.Addr()
+		return addr != nil
+	}, time.Second, time.Millisecond)
+
+	req, err := http.NewRequest(http.MethodDelete, "http://"+addr.String()+"/listeners/admin", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer abc")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	_, ok := s.Listeners.Get("admin")
+	require.True(t, ok)
+}
+
+func TestAdminHandlerSystem(t *testing.T) {
+	s := New()
+	w := adminRequest(t, s, http.MethodGet, "/system", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), `"version"`)
+}
+
+func TestAdminStatus(t *testing.T) {
+	require.Equal(t, http.StatusInternalServerError, adminStatus(ErrConnectionFailed))
+}
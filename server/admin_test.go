@@ -0,0 +1,313 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-co/mqtt/server/internal/clients"
+	"github.com/mochi-co/mqtt/server/internal/packets"
+	"github.com/mochi-co/mqtt/server/listeners"
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/persistence"
+)
+
+func TestServerListClients(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.ID = "zen"
+	cl.Listener = "t1"
+	cl.Username = []byte("mochi")
+	cl.NoteSubscription("a/b/c", 1)
+	s.Clients.Add(cl)
+
+	stub := clients.NewClientStub(s.System)
+	stub.ID = "alpha"
+	s.Clients.Add(stub)
+
+	list := s.ListClients()
+	require.Len(t, list, 2)
+
+	require.Equal(t, "alpha", list[0].ID)
+	require.False(t, list[0].Connected)
+	require.Equal(t, "unknown", list[0].Remote)
+
+	require.Equal(t, "zen", list[1].ID)
+	require.True(t, list[1].Connected)
+	require.Equal(t, "pipe", list[1].Remote)
+	require.Equal(t, "t1", list[1].Listener)
+	require.Equal(t, "mochi", list[1].Username)
+	require.Equal(t, map[string]byte{"a/b/c": 1}, list[1].Subscriptions)
+	require.True(t, list[1].ConnectedAt > 0)
+}
+
+func TestServerGetClient(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.Inflight.Set(1, clients.InflightMessage{Packet: packets.Packet{PacketID: 1}})
+	s.Clients.Add(cl)
+
+	info, ok := s.GetClient("mochi")
+	require.True(t, ok)
+	require.Equal(t, "mochi", info.ID)
+	require.Equal(t, 1, info.Inflight)
+	require.Equal(t, uint16(10), info.Keepalive)
+
+	_, ok = s.GetClient("missing")
+	require.False(t, ok)
+}
+
+func TestServerDisconnectClient(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.LWT = clients.LWT{
+		Topic:   "a/b/c",
+		Message: []byte("goodbye"),
+	}
+	s.Clients.Add(cl)
+
+	err := s.DisconnectClient("mochi", false)
+	require.NoError(t, err)
+	require.ErrorIs(t, cl.StopCause(), ErrClientKicked)
+	require.Equal(t, clients.LWT{}, cl.LWT)
+
+	err = s.DisconnectClient("mochi", false)
+	require.ErrorIs(t, err, ErrClientNotConnected)
+
+	err = s.DisconnectClient("missing", false)
+	require.ErrorIs(t, err, ErrClientNotFound)
+}
+
+func TestServerDisconnectClientSendWill(t *testing.T) {
+	tt := []struct {
+		desc     string
+		sendWill bool
+	}{
+		{desc: "send will", sendWill: true},
+		{desc: "drop will", sendWill: false},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			s := New()
+
+			r, w := net.Pipe()
+			o := make(chan error)
+			go func() {
+				o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+			}()
+
+			go func() {
+				w.Write([]byte{
+					byte(packets.Connect << 4), 33, // Fixed header
+					0, 4, // Protocol Name - MSB+LSB
+					'M', 'Q', 'T', 'T', // Protocol Name
+					4,     // Protocol Version
+					0x26,  // Packet Flags - clean session, will, will retain
+					0, 45, // Keepalive
+					0, 5, // Client ID - MSB+LSB
+					'm', 'o', 'c', 'h', 'i', // Client ID
+					0, 5, // Will Topic - MSB+LSB
+					'a', '/', 'b', '/', 'c', // Will Topic
+					0, 7, // Will Message - MSB+LSB
+					'g', 'o', 'o', 'd', 'b', 'y', 'e', // Will Message
+				})
+			}()
+
+			go func() {
+				_, _ = ioutil.ReadAll(w)
+			}()
+
+			require.Eventually(t, func() bool {
+				cl, ok := s.Clients.Get("mochi")
+				return ok && atomic.LoadUint32(&cl.State.Done) == 0
+			}, time.Second, time.Millisecond)
+
+			require.NoError(t, s.DisconnectClient("mochi", tx.sendWill))
+			require.ErrorIs(t, <-o, ErrClientKicked)
+			w.Close()
+
+			msgs := s.Topics.Messages("a/b/c")
+			if !tx.sendWill {
+				require.Empty(t, msgs)
+				return
+			}
+
+			require.Len(t, msgs, 1)
+			require.Equal(t, []byte("goodbye"), msgs[0].Payload)
+		})
+	}
+}
+
+func TestServerDiscardSession(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	s.Clients.Add(cl)
+
+	s.Topics.Subscribe("a/b/c", cl.ID, 1)
+	cl.NoteSubscription("a/b/c", 1)
+	s.System.Subscriptions = 1
+
+	cl.Inflight.Set(1, clients.InflightMessage{Packet: packets.Packet{PacketID: 1}})
+	s.System.Inflight = 1
+
+	err := s.DiscardSession("mochi")
+	require.NoError(t, err)
+	require.ErrorIs(t, cl.StopCause(), ErrClientKicked)
+
+	_, ok := s.Clients.Get("mochi")
+	require.False(t, ok)
+	require.Empty(t, s.Topics.Subscribers("a/b/c"))
+	require.Equal(t, int64(0), s.System.Subscriptions)
+	require.Equal(t, int64(0), s.System.Inflight)
+
+	err = s.DiscardSession("mochi")
+	require.ErrorIs(t, err, ErrClientNotFound)
+}
+
+func TestServerDiscardSessionClearedOnce(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	s.Clients.Add(cl)
+
+	cl.Inflight.Set(1, clients.InflightMessage{Packet: packets.Packet{PacketID: 1}})
+	cl.Inflight.Set(2, clients.InflightMessage{Packet: packets.Packet{PacketID: 2}})
+	s.System.Inflight = 2
+
+	err := s.DiscardSession("mochi")
+	require.NoError(t, err)
+
+	s.clearAbandonedInflights(cl) // as run by the connection teardown.
+	require.Equal(t, int64(0), s.System.Inflight)
+}
+
+func TestServerDiscardSessionStoreError(t *testing.T) {
+	s := New()
+	mock := &persistence.MockStore{
+		Fail: map[string]bool{
+			"delete_clients": true,
+		},
+	}
+	s.Store = mock
+
+	var hook errorHook
+	s.Events.OnError = hook.onError
+
+	stub := clients.NewClientStub(s.System)
+	stub.ID = "mochi"
+	s.Clients.Add(stub)
+
+	err := s.DiscardSession("mochi")
+	require.NoError(t, err)
+	require.Equal(t, "storage: test", hook.err.Error())
+}
+
+func TestServerClientInflight(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	s.Clients.Add(cl)
+
+	cl.Inflight.Set(2, clients.InflightMessage{
+		Packet: packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+			PacketID:    2,
+			TopicName:   "a/b/c",
+		},
+		Sent:    3,
+		Created: 1,
+		Resends: 2,
+	})
+	cl.Inflight.Set(1, clients.InflightMessage{
+		Packet: packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Pubrel, Qos: 1},
+			PacketID:    1,
+		},
+	})
+
+	inflight, err := s.ClientInflight("mochi")
+	require.NoError(t, err)
+	require.Equal(t, []InflightInfo{
+		{PacketID: 1, Type: "PUBREL", Qos: 1},
+		{PacketID: 2, Type: "PUBLISH", Topic: "a/b/c", Qos: 1, Sent: 3, Created: 1, Resends: 2},
+	}, inflight)
+
+	_, err = s.ClientInflight("missing")
+	require.ErrorIs(t, err, ErrClientNotFound)
+}
+
+func TestServerRetainedMessages(t *testing.T) {
+	s := New()
+	require.NoError(t, s.SetRetained("b/c", []byte("two")))
+	require.NoError(t, s.SetRetained("a/b", []byte("one")))
+	require.NoError(t, s.SetRetained("x/y", []byte("three")))
+	require.Equal(t, int64(3), s.System.Retained)
+
+	msgs := s.RetainedMessages("#")
+	require.Len(t, msgs, 3)
+	require.Equal(t, "a/b", msgs[0].Topic)
+	require.Equal(t, []byte("one"), msgs[0].Payload)
+	require.Equal(t, "b/c", msgs[1].Topic)
+	require.Equal(t, "x/y", msgs[2].Topic)
+
+	require.Len(t, s.RetainedMessages("a/#"), 1)
+}
+
+func TestServerGetRetained(t *testing.T) {
+	s := New()
+	require.NoError(t, s.SetRetained("a/b", []byte("one")))
+
+	msg, ok := s.GetRetained("a/b")
+	require.True(t, ok)
+	require.Equal(t, []byte("one"), msg.Payload)
+
+	_, ok = s.GetRetained("a/#")
+	require.False(t, ok)
+
+	_, ok = s.GetRetained("a/c")
+	require.False(t, ok)
+}
+
+func TestServerSetRetainedInvalid(t *testing.T) {
+	s := New()
+	require.ErrorIs(t, s.SetRetained("", []byte("one")), ErrInvalidRetainedTopic)
+	require.ErrorIs(t, s.SetRetained("a/+", []byte("one")), ErrInvalidRetainedTopic)
+	require.ErrorIs(t, s.SetRetained("a/b", nil), ErrRetainedNotFound)
+}
+
+func TestServerSetRetainedStore(t *testing.T) {
+	s := New()
+	mock := new(persistence.MockStore)
+	s.Store = mock
+
+	require.NoError(t, s.SetRetained("a/b", []byte("one")))
+	require.Equal(t, int64(1), s.System.Retained)
+}
+
+func TestServerDeleteRetained(t *testing.T) {
+	s := New()
+	require.NoError(t, s.SetRetained("a/b", []byte("one")))
+	require.NoError(t, s.DeleteRetained("a/b"))
+	require.Equal(t, int64(0), s.System.Retained)
+
+	_, ok := s.GetRetained("a/b")
+	require.False(t, ok)
+
+	require.ErrorIs(t, s.DeleteRetained("a/b"), ErrRetainedNotFound)
+}
+
+func TestServerListListeners(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.Listener = "t1"
+	s.Clients.Add(cl)
+
+	stub := clients.NewClientStub(s.System)
+	stub.ID = "stub"
+	stub.Listener = "t1"
+	s.Clients.Add(stub)
+
+	s.Listeners.Add(listeners.NewMockListener("t2", ":1882"))
+	s.Listeners.Add(listeners.NewMockListener("t1", ":1883"))
+
+	require.Equal(t, []ListenerInfo{
+		{ID: "t1", Clients: 1, State: listeners.StateAdded},
+		{ID: "t2", Clients: 0, State: listeners.StateAdded},
+	}, s.ListListeners())
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/mochi-co/mqtt/server/internal/clients"
+	"github.com/mochi-co/mqtt/server/internal/packets"
+)
+
+const (
+	// ClientEventsPrefix is the topic prefix for client event messages, which are
+	// published to ClientEventsPrefix+"<clientid>/<event>". Events are not published
+	// for client ids which cannot be used as a single topic level.
+	ClientEventsPrefix = "$SYS/brokers/clients/"
+)
+
+// validEventClientID returns true if a client id can be used as a single level
+// of a client event topic without adding levels or wildcards.
+func validEventClientID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, "/+#\x00")
+}
+
+// ConnectedEvent is the JSON payload of a client connected event message.
+type ConnectedEvent struct {
+	ClientID        string `json:"clientid"`         // the client id.
+	Username        string `json:"username"`         // the username the client authenticated with.
+	Remote          string `json:"remote"`           // the remote address of the client.
+	Listener        string `json:"listener"`         // the id of the listener the client connected to.
+	ProtocolVersion byte   `json:"protocol_version"` // the mqtt protocol version of the connection.
+	CleanSession    bool   `json:"clean_session"`    // indicates if the client requested a clean session.
+	SessionPresent  bool   `json:"session_present"`  // indicates if an existing session was resumed.
+	Keepalive       uint16 `json:"keepalive"`        // the keepalive of the connection in seconds.
+	Timestamp       int64  `json:"ts"`               // the unix time of the event in milliseconds.
+}
+
+// DisconnectedEvent is the JSON payload of a client disconnected event message.
+type DisconnectedEvent struct {
+	ClientID  string `json:"clientid"` // the client id.
+	Username  string `json:"username"` // the username the client authenticated with.
+	Remote    string `json:"remote"`   // the remote address of the client.
+	Listener  string `json:"listener"` // the id of the listener the client connected to.
+	Reason    string `json:"reason"`   // the cause of the disconnection, if any.
+	Timestamp int64  `json:"ts"`       // the unix time of the event in milliseconds.
+}
+
+// SubscriptionEvent is the JSON payload of a client subscribed or unsubscribed
+// event message.
+type SubscriptionEvent struct {
+	ClientID  string `json:"clientid"` // the client id.
+	Username  string `json:"username"` // the username the client authenticated with.
+	Filter    string `json:"topic"`    // the subscription filter.
+	Qos       byte   `json:"qos"`      // the granted qos of the subscription.
+	Timestamp int64  `json:"ts"`       // the unix time of the event in milliseconds.
+}
+
+// publishClientEvent publishes a client event message as JSON to subscribers
+// of the client's event topic.
+func (s *Server) publishClientEvent(cl *clients.Client, event string, v interface{}) {
+	if !validEventClientID(cl.ID) {
+		s.Log.Warn("client id not valid for event topic", "client_id", cl.ID, "event", event)
+		return
+	}
+
+	payload, err := json.Marshal(v)
+	if err != nil {
+		s.Log.Warn("failed to encode client event", "client_id", cl.ID, "event", event, "error", err)
+		return
+	}
+
+	s.publishToSubscribers(packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: ClientEventsPrefix + cl.ID + "/" + event,
+		Payload:   payload,
+	})
+}
+
+// onClientConnected publishes a client connected event.
+func (s *Server) onClientConnected(cl *clients.Client, sessionPresent bool) {
+	if !s.Options.ClientEvents {
+		return
+	}
+
+	s.publishClientEvent(cl, "connected", ConnectedEvent{
+		ClientID:        cl.ID,
+		Username:        string(cl.Username),
+		Remote:          cl.Info().Remote,
+		Listener:        cl.Listener,
+		ProtocolVersion: cl.ProtocolVersion,
+		CleanSession:    cl.CleanSession,
+		SessionPresent:  sessionPresent,
+		Keepalive:       cl.Keepalive(),
+		Timestamp:       time.Now().UnixNano() / int64(time.Millisecond),
+	})
+}
+
+// onClientDisconnected publishes a client disconnected event.
+func (s *Server) onClientDisconnected(cl *clients.Client, cause error) {
+	if !s.Options.ClientEvents {
+		return
+	}
+
+	var reason string
+	if cause != nil {
+		reason = cause.Error()
+	}
+
+	s.publishClientEvent(cl, "disconnected", DisconnectedEvent{
+		ClientID:  cl.ID,
+		Username:  string(cl.Username),
+		Remote:    cl.Info().Remote,
+		Listener:  cl.Listener,
+		Reason:    reason,
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+	})
+}
+
+// onClientSubscription publishes a client subscribed or unsubscribed event.
+func (s *Server) onClientSubscription(cl *clients.Client, event, filter string, qos byte) {
+	if !s.Options.ClientEvents {
+		return
+	}
+
+	s.publishClientEvent(cl, event, SubscriptionEvent{
+		ClientID:  cl.ID,
+		Username:  string(cl.Username),
+		Filter:    filter,
+		Qos:       qos,
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+	})
+}
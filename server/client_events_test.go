@@ -0,0 +1,201 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-co/mqtt/server/internal/circ"
+	"github.com/mochi-co/mqtt/server/internal/clients"
+	"github.com/mochi-co/mqtt/server/internal/packets"
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+)
+
+// setupEventWatcher subscribes a client to all client events, returning a
+// channel which receives the decoded publish packets written to it.
+func setupEventWatcher(t *testing.T, s *Server) (chan packets.Packet, net.Conn) {
+	r, w := net.Pipe()
+	watcher := clients.NewClient(w, circ.NewReader(256, 8), circ.NewWriter(1024, 8), s.System)
+	watcher.ID = "watcher"
+	watcher.AC = new(auth.Allow)
+	watcher.Start()
+	s.Clients.Add(watcher)
+	s.Topics.Subscribe(ClientEventsPrefix+"#", watcher.ID, 0)
+
+	recv := make(chan packets.Packet, 8)
+	go func() {
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+
+		for len(buf) > 0 {
+			fh := new(packets.FixedHeader)
+			err := fh.Decode(buf[0])
+			require.NoError(t, err)
+			rem, n := decodeRemaining(buf[1:])
+			fh.Remaining = rem
+			pk := packets.Packet{FixedHeader: *fh}
+			require.NoError(t, pk.PublishDecode(buf[1+n:1+n+rem]))
+			recv <- pk
+			buf = buf[1+n+rem:]
+		}
+		close(recv)
+	}()
+
+	return recv, w
+}
+
+// decodeRemaining decodes a variable byte integer, returning the value and
+// the number of bytes read.
+func decodeRemaining(b []byte) (int, int) {
+	var v, mul, i int
+	mul = 1
+	for {
+		v += int(b[i]&127) * mul
+		mul *= 128
+		i++
+		if b[i-1]&128 == 0 {
+			return v, i
+		}
+	}
+}
+
+func TestServerClientEventsDisabled(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	recv, w := setupEventWatcher(t, s)
+
+	s.onClientConnected(cl, false)
+	s.onClientDisconnected(cl, nil)
+	s.onClientSubscription(cl, "subscribed", "a/b", 1)
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+
+	_, ok := <-recv
+	require.False(t, ok)
+}
+
+func TestServerClientEventConnected(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	s.Options.ClientEvents = true
+	cl.Listener = "t1"
+	cl.Username = []byte("user")
+	cl.CleanSession = true
+	cl.ProtocolVersion = 4
+	recv, w := setupEventWatcher(t, s)
+
+	s.onClientConnected(cl, true)
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+
+	pk := <-recv
+	require.Equal(t, "$SYS/brokers/clients/mochi/connected", pk.TopicName)
+
+	var ev ConnectedEvent
+	require.NoError(t, json.Unmarshal(pk.Payload, &ev))
+	require.Equal(t, "mochi", ev.ClientID)
+	require.Equal(t, "user", ev.Username)
+	require.Equal(t, "pipe", ev.Remote)
+	require.Equal(t, "t1", ev.Listener)
+	require.Equal(t, byte(4), ev.ProtocolVersion)
+	require.True(t, ev.CleanSession)
+	require.True(t, ev.SessionPresent)
+	require.Equal(t, uint16(10), ev.Keepalive)
+	require.True(t, ev.Timestamp > 0)
+}
+
+func TestServerClientEventInvalidClientID(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	s.Options.ClientEvents = true
+	recv, w := setupEventWatcher(t, s)
+
+	for _, id := range []string{"other/connected", "+", "#", "a/+/b", ""} {
+		cl.ID = id
+		s.onClientConnected(cl, false)
+		s.onClientDisconnected(cl, nil)
+		s.onClientSubscription(cl, "subscribed", "a/b", 1)
+	}
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+
+	_, ok := <-recv
+	require.False(t, ok)
+}
+
+func TestServerClientEventDisconnected(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	s.Options.ClientEvents = true
+	recv, w := setupEventWatcher(t, s)
+
+	s.onClientDisconnected(cl, errors.New("test"))
+	s.onClientDisconnected(cl, nil)
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+
+	pk := <-recv
+	require.Equal(t, "$SYS/brokers/clients/mochi/disconnected", pk.TopicName)
+	var ev DisconnectedEvent
+	require.NoError(t, json.Unmarshal(pk.Payload, &ev))
+	require.Equal(t, "mochi", ev.ClientID)
+	require.Equal(t, "test", ev.Reason)
+
+	pk = <-recv
+	ev = DisconnectedEvent{}
+	require.NoError(t, json.Unmarshal(pk.Payload, &ev))
+	require.Equal(t, "", ev.Reason)
+}
+
+func TestServerClientEventSubscriptions(t *testing.T) {
+	s, cl, r, w := setupClient()
+	s.Options.ClientEvents = true
+	s.Clients.Add(cl)
+	recv, ww := setupEventWatcher(t, s)
+
+	go func() {
+		ioutil.ReadAll(r)
+	}()
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Subscribe,
+		},
+		PacketID: 10,
+		Topics:   []string{"a/b/c"},
+		Qoss:     []byte{1},
+	})
+	require.NoError(t, err)
+
+	err = s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Unsubscribe,
+		},
+		PacketID: 11,
+		Topics:   []string{"a/b/c", "d/e/f"},
+	})
+	require.NoError(t, err)
+
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+	ww.Close()
+
+	pk := <-recv
+	require.Equal(t, "$SYS/brokers/clients/mochi/subscribed", pk.TopicName)
+	var ev SubscriptionEvent
+	require.NoError(t, json.Unmarshal(pk.Payload, &ev))
+	require.Equal(t, "a/b/c", ev.Filter)
+	require.Equal(t, byte(1), ev.Qos)
+
+	pk = <-recv
+	require.Equal(t, "$SYS/brokers/clients/mochi/unsubscribed", pk.TopicName)
+	ev = SubscriptionEvent{}
+	require.NoError(t, json.Unmarshal(pk.Payload, &ev))
+	require.Equal(t, "a/b/c", ev.Filter)
+
+	_, ok := <-recv
+	require.False(t, ok)
+}
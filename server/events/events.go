@@ -1,6 +1,9 @@
 package events
 
 import (
+	"crypto/x509"
+	"time"
+
 	"github.com/mochi-co/mqtt/server/internal/packets"
 )
 
@@ -13,6 +16,12 @@ type Events struct {
 	OnDisconnect     // client disconnected.
 	OnSubscribe      // topic subscription created.
 	OnUnsubscribe    // topic subscription removed.
+	OnQosComplete    // outbound qos flow completed.
+	OnQosDropped     // outbound qos message dropped.
+	OnRetainMessage  // retained message set or cleared.
+	OnWillSent       // last will and testament published.
+	OnPacketRead     // packet read from a client.
+	OnPacketSent     // packet written to a client.
 }
 
 // Packets is an alias for packets.Packet.
@@ -25,6 +34,9 @@ type Client struct {
 	Listener     string
 	Username     []byte
 	CleanSession bool
+
+	// PeerCertificates are the certificates presented by a tls client, if any.
+	PeerCertificates []*x509.Certificate
 }
 
 // Clientlike is an interface for Clients and client-like objects that
@@ -76,3 +88,36 @@ type OnSubscribe func(filter string, cl Client, qos byte)
 
 // OnUnsubscribe is called when an existing subscription filter for a client is removed.
 type OnUnsubscribe func(filter string, cl Client)
+
+// OnQosComplete is called when an outbound QoS 1 or 2 message has been fully
+// acknowledged by the receiving client (PUBACK or PUBCOMP). The function receives
+// the client the message was delivered to, the packet id, the topic of the
+// message and the time elapsed since the most recent send attempt.
+type OnQosComplete func(cl Client, packetID uint16, topic string, latency time.Duration)
+
+// OnQosDropped is called when an outbound QoS 1 or 2 message is abandoned before
+// being acknowledged, for example because the resend attempts were exhausted,
+// the message expired, or the client's queue was full. The reason for the drop
+// is passed as an error.
+type OnQosDropped func(cl Client, pk Packet, reason error)
+
+// OnRetainMessage is called when a retained message is set or cleared for a topic.
+// The value r is 1 if a retained message was stored, and -1 if an existing
+// retained message was removed.
+type OnRetainMessage func(cl Client, pk Packet, r int64)
+
+// OnWillSent is called after the last will and testament message of a client
+// has been published. It is not called if the will was denied or rejected.
+type OnWillSent func(cl Client, pk Packet)
+
+// OnPacketRead is called when any packet has been read and decoded from a client
+// connection, before it is processed by the server. The function receives the
+// decoded packet and the number of bytes it occupied on the wire. If the
+// `mqtt.ErrRejectPacket` error is returned, the packet is silently dropped. Any
+// other error will disconnect the client. See also server.InspectPackets.
+type OnPacketRead func(cl Client, pk Packet, n int) error
+
+// OnPacketSent is called when any packet has been encoded and written to the
+// outgoing buffer of a client. The function receives the packet and the number
+// of bytes written.
+type OnPacketSent func(cl Client, pk Packet, n int)
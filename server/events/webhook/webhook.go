@@ -0,0 +1,448 @@
+// package webhook provides an event hook which delivers broker events as JSON
+// POST requests to one or more HTTP endpoints.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mochi-co/mqtt/server/events"
+	"github.com/mochi-co/mqtt/server/internal/topics"
+	"github.com/mochi-co/mqtt/server/logger"
+)
+
+const (
+	// SignatureHeader is the request header containing the hex encoded
+	// HMAC-SHA256 signature of the request body, prefixed with "sha256=".
+	SignatureHeader = "X-Mochi-Signature"
+
+	// defaultQueueSize is the default maximum number of undelivered events.
+	defaultQueueSize = 1024
+
+	// defaultBatchSize is the default maximum number of events in a request.
+	defaultBatchSize = 50
+
+	// defaultFlushInterval is the default maximum time an event waits to be batched.
+	defaultFlushInterval = time.Second
+
+	// defaultMaxRetries is the default number of times a failed request is retried.
+	defaultMaxRetries = 3
+
+	// defaultRetryBackoff is the default delay before the first retry.
+	defaultRetryBackoff = 500 * time.Millisecond
+
+	// defaultTimeout is the default timeout of a single request.
+	defaultTimeout = 5 * time.Second
+
+	// filterClient is the pseudo client id used to index publish topic filters.
+	filterClient = "webhook"
+)
+
+// Event types sent in the type field of an event.
+const (
+	EventConnected      = "connected"
+	EventDisconnected   = "disconnected"
+	EventSubscribed     = "subscribed"
+	EventUnsubscribed   = "unsubscribed"
+	EventPublished      = "published"
+	EventMessageDropped = "message_dropped"
+)
+
+var (
+	// ErrNoURLs indicates the webhook was created without any endpoint urls.
+	ErrNoURLs = errors.New("no webhook urls configured")
+
+	// ErrUnexpectedStatus indicates an endpoint responded with a non-2xx status.
+	ErrUnexpectedStatus = errors.New("unexpected webhook response status")
+)
+
+// Options contains configuration settings for the webhook.
+type Options struct {
+	// URLs are the endpoints to which every batch of events is posted.
+	URLs []string
+
+	// Secret is the key used to sign request bodies with HMAC-SHA256. If empty,
+	// requests are not signed.
+	Secret []byte
+
+	// Topics are the topic filters of published messages which are sent as
+	// events. If empty, no publish events are sent.
+	Topics []string
+
+	// QueueSize is the maximum number of events waiting to be delivered. Events
+	// beyond the limit are dropped so the broker is never blocked.
+	QueueSize int
+
+	// BatchSize is the maximum number of events sent in a single request.
+	BatchSize int
+
+	// FlushInterval is the maximum time an event is held waiting for a batch to fill.
+	FlushInterval time.Duration
+
+	// MaxRetries is the number of times a failed request is retried.
+	MaxRetries int
+
+	// RetryBackoff is the delay before the first retry, doubling for each
+	// subsequent attempt.
+	RetryBackoff time.Duration
+
+	// Timeout is the timeout of a single request, used if Client is nil.
+	Timeout time.Duration
+
+	// Client is the http client used to send requests.
+	Client *http.Client
+}
+
+// Event is a broker event delivered to the webhook endpoints.
+type Event struct {
+	Type      string `json:"type"`               // the type of event.
+	ClientID  string `json:"clientid"`           // the id of the client.
+	Username  string `json:"username,omitempty"` // the username of the client.
+	Remote    string `json:"remote,omitempty"`   // the remote address of the client.
+	Listener  string `json:"listener,omitempty"` // the listener the client connected to.
+	Topic     string `json:"topic,omitempty"`    // the message topic or subscription filter.
+	Qos       byte   `json:"qos"`                // the qos of the message or subscription.
+	Retain    bool   `json:"retain,omitempty"`   // the retain flag of a published message.
+	Payload   []byte `json:"payload,omitempty"`  // the message payload, base64 encoded.
+	Reason    string `json:"reason,omitempty"`   // the reason for a disconnect or dropped message.
+	Timestamp int64  `json:"ts"`                 // the unix time of the event in milliseconds.
+}
+
+// Stats contains counters for the delivery of webhook events.
+type Stats struct {
+	Sent    int64 `json:"sent"`    // the number of events successfully delivered.
+	Failed  int64 `json:"failed"`  // the number of events which could not be delivered.
+	Dropped int64 `json:"dropped"` // the number of events dropped because the queue was full.
+}
+
+// Webhook queues broker events and posts them in batches to http endpoints.
+type Webhook struct {
+	sent    int64            // the number of events successfully delivered.
+	failed  int64            // the number of events which could not be delivered.
+	dropped int64            // the number of events dropped because the queue was full.
+	end     uint32           // ensure the close method is only called once.
+	opts    Options          // configuration settings for the webhook.
+	filters *topics.Index    // an index of the publish topic filters.
+	queue   chan Event       // events waiting to be delivered.
+	done    chan struct{}    // closed to stop the delivery worker.
+	wg      sync.WaitGroup   // waits for the delivery worker to exit.
+	log     logger.Logger    // a logger for delivery failures.
+	now     func() time.Time // the clock used to timestamp events.
+}
+
+// New returns a new webhook with the given options. Defaults are used for any
+// zero values. The delivery worker starts immediately, and should be stopped
+// with Close.
+func New(opts Options) (*Webhook, error) {
+	if len(opts.URLs) == 0 {
+		return nil, ErrNoURLs
+	}
+
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defaultQueueSize
+	}
+
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultFlushInterval
+	}
+
+	if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	} else if opts.MaxRetries == 0 {
+		opts.MaxRetries = defaultMaxRetries
+	}
+
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = defaultRetryBackoff
+	}
+
+	if opts.Client == nil {
+		if opts.Timeout <= 0 {
+			opts.Timeout = defaultTimeout
+		}
+		opts.Client = &http.Client{
+			Timeout: opts.Timeout,
+		}
+	}
+
+	w := &Webhook{
+		opts:    opts,
+		filters: topics.New(),
+		queue:   make(chan Event, opts.QueueSize),
+		done:    make(chan struct{}),
+		log:     new(logger.Nop),
+		now:     time.Now,
+	}
+
+	for _, filter := range opts.Topics {
+		w.filters.Subscribe(filter, filterClient, 0)
+	}
+
+	w.wg.Add(1)
+	go w.run()
+
+	return w, nil
+}
+
+// SetLogger sets the logger used to report delivery failures.
+func (w *Webhook) SetLogger(log logger.Logger) {
+	w.log = log
+}
+
+// Attach sets the webhook handlers on a set of server event hooks. Any handlers
+// which were already set are preserved and called before the webhook.
+func (w *Webhook) Attach(e *events.Events) {
+	onConnect := e.OnConnect
+	e.OnConnect = func(cl events.Client, pk events.Packet) {
+		if onConnect != nil {
+			onConnect(cl, pk)
+		}
+		w.Enqueue(w.event(EventConnected, cl))
+	}
+
+	onDisconnect := e.OnDisconnect
+	e.OnDisconnect = func(cl events.Client, err error) {
+		if onDisconnect != nil {
+			onDisconnect(cl, err)
+		}
+		ev := w.event(EventDisconnected, cl)
+		if err != nil {
+			ev.Reason = err.Error()
+		}
+		w.Enqueue(ev)
+	}
+
+	onSubscribe := e.OnSubscribe
+	e.OnSubscribe = func(filter string, cl events.Client, qos byte) {
+		if onSubscribe != nil {
+			onSubscribe(filter, cl, qos)
+		}
+		ev := w.event(EventSubscribed, cl)
+		ev.Topic = filter
+		ev.Qos = qos
+		w.Enqueue(ev)
+	}
+
+	onUnsubscribe := e.OnUnsubscribe
+	e.OnUnsubscribe = func(filter string, cl events.Client) {
+		if onUnsubscribe != nil {
+			onUnsubscribe(filter, cl)
+		}
+		ev := w.event(EventUnsubscribed, cl)
+		ev.Topic = filter
+		w.Enqueue(ev)
+	}
+
+	onMessage := e.OnMessage
+	e.OnMessage = func(cl events.Client, pk events.Packet) (events.Packet, error) {
+		if onMessage != nil {
+			pkx, err := onMessage(cl, pk)
+			if err == nil {
+				pk = pkx
+			}
+		}
+
+		if w.matches(pk.TopicName) {
+			ev := w.event(EventPublished, cl)
+			ev.Topic = pk.TopicName
+			ev.Qos = pk.FixedHeader.Qos
+			ev.Retain = pk.FixedHeader.Retain
+			ev.Payload = pk.Payload
+			w.Enqueue(ev)
+		}
+
+		return pk, nil
+	}
+
+	onQosDropped := e.OnQosDropped
+	e.OnQosDropped = func(cl events.Client, pk events.Packet, reason error) {
+		if onQosDropped != nil {
+			onQosDropped(cl, pk, reason)
+		}
+		ev := w.event(EventMessageDropped, cl)
+		ev.Topic = pk.TopicName
+		ev.Qos = pk.FixedHeader.Qos
+		if reason != nil {
+			ev.Reason = reason.Error()
+		}
+		w.Enqueue(ev)
+	}
+}
+
+// event returns a new event of a type for a client.
+func (w *Webhook) event(typ string, cl events.Client) Event {
+	return Event{
+		Type:      typ,
+		ClientID:  cl.ID,
+		Username:  string(cl.Username),
+		Remote:    cl.Remote,
+		Listener:  cl.Listener,
+		Timestamp: w.now().UnixNano() / int64(time.Millisecond),
+	}
+}
+
+// matches returns true if a topic matches any of the publish topic filters.
+func (w *Webhook) matches(topic string) bool {
+	return len(w.opts.Topics) > 0 && len(w.filters.Subscribers(topic)) > 0
+}
+
+// Enqueue adds an event to the delivery queue without blocking. It returns false
+// if the event was dropped because the queue is full or the webhook is closed.
+func (w *Webhook) Enqueue(ev Event) bool {
+	if atomic.LoadUint32(&w.end) == 1 {
+		return false
+	}
+
+	select {
+	case w.queue <- ev:
+		return true
+	default:
+		atomic.AddInt64(&w.dropped, 1)
+		return false
+	}
+}
+
+// Stats returns the delivery counters of the webhook.
+func (w *Webhook) Stats() Stats {
+	return Stats{
+		Sent:    atomic.LoadInt64(&w.sent),
+		Failed:  atomic.LoadInt64(&w.failed),
+		Dropped: atomic.LoadInt64(&w.dropped),
+	}
+}
+
+// Close stops accepting events, delivers any queued events, and waits for the
+// delivery worker to exit.
+func (w *Webhook) Close() {
+	if atomic.CompareAndSwapUint32(&w.end, 0, 1) {
+		close(w.done)
+	}
+	w.wg.Wait()
+}
+
+// run collects queued events into batches and delivers them until the webhook
+// is closed.
+func (w *Webhook) run() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Event, 0, w.opts.BatchSize)
+	for {
+		select {
+		case ev := <-w.queue:
+			batch = append(batch, ev)
+			if len(batch) >= w.opts.BatchSize {
+				w.deliver(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				w.deliver(batch)
+				batch = batch[:0]
+			}
+		case <-w.done:
+			for {
+				select {
+				case ev := <-w.queue:
+					batch = append(batch, ev)
+					if len(batch) >= w.opts.BatchSize {
+						w.deliver(batch)
+						batch = batch[:0]
+					}
+				default:
+					if len(batch) > 0 {
+						w.deliver(batch)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver posts a batch of events to every endpoint.
+func (w *Webhook) deliver(batch []Event) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		w.log.Error("failed to encode webhook events", "error", err)
+		atomic.AddInt64(&w.failed, int64(len(batch)))
+		return
+	}
+
+	for _, url := range w.opts.URLs {
+		if err := w.post(url, body); err != nil {
+			w.log.Warn("failed to deliver webhook events", "url", url, "events", len(batch), "error", err)
+			atomic.AddInt64(&w.failed, int64(len(batch)))
+			continue
+		}
+		atomic.AddInt64(&w.sent, int64(len(batch)))
+	}
+}
+
+// post sends a request body to a url, retrying with an exponential backoff. Once
+// the webhook is closed, failed requests are no longer retried.
+func (w *Webhook) post(url string, body []byte) error {
+	backoff := w.opts.RetryBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = w.send(url, body)
+		if err == nil || attempt >= w.opts.MaxRetries {
+			return err
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-w.done:
+			return err
+		}
+	}
+}
+
+// send makes a single signed request to a url.
+func (w *Webhook) send(url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.opts.Secret) > 0 {
+		req.Header.Set(SignatureHeader, Sign(w.opts.Secret, body))
+	}
+
+	resp, err := w.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%w: %d", ErrUnexpectedStatus, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Sign returns the value of the signature header for a request body signed with
+// a secret, which receivers can use to verify the request.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,382 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-co/mqtt/server/events"
+	"github.com/mochi-co/mqtt/server/internal/packets"
+)
+
+// receiver is a test endpoint which records the events posted to it.
+type receiver struct {
+	sync.Mutex
+	batches  [][]Event
+	bodies   [][]byte
+	sigs     []string
+	requests int64
+	fail     int64 // the number of requests to fail before succeeding.
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	atomic.AddInt64(&r.requests, 1)
+	if atomic.AddInt64(&r.fail, -1) >= 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(req.Body)
+	var batch []Event
+	if err := json.Unmarshal(body, &batch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	r.Lock()
+	r.batches = append(r.batches, batch)
+	r.bodies = append(r.bodies, body)
+	r.sigs = append(r.sigs, req.Header.Get(SignatureHeader))
+	r.Unlock()
+}
+
+func (r *receiver) events() []Event {
+	r.Lock()
+	defer r.Unlock()
+	var evs []Event
+	for _, b := range r.batches {
+		evs = append(evs, b...)
+	}
+	return evs
+}
+
+func newReceiver(fail int64) (*receiver, *httptest.Server) {
+	r := &receiver{fail: fail}
+	return r, httptest.NewServer(r)
+}
+
+var testClient = events.Client{
+	ID:       "mochi",
+	Remote:   "127.0.0.1",
+	Listener: "t1",
+	Username: []byte("user"),
+}
+
+func TestNew(t *testing.T) {
+	w, err := New(Options{URLs: []string{"http://localhost"}})
+	require.NoError(t, err)
+	defer w.Close()
+	require.Equal(t, defaultQueueSize, cap(w.queue))
+	require.Equal(t, defaultBatchSize, w.opts.BatchSize)
+	require.Equal(t, defaultFlushInterval, w.opts.FlushInterval)
+	require.Equal(t, defaultMaxRetries, w.opts.MaxRetries)
+	require.Equal(t, defaultRetryBackoff, w.opts.RetryBackoff)
+	require.Equal(t, defaultTimeout, w.opts.Client.Timeout)
+}
+
+func TestNewNoURLs(t *testing.T) {
+	_, err := New(Options{})
+	require.ErrorIs(t, err, ErrNoURLs)
+}
+
+func TestAttachEvents(t *testing.T) {
+	r, ts := newReceiver(0)
+	defer ts.Close()
+
+	w, err := New(Options{
+		URLs:          []string{ts.URL},
+		Topics:        []string{"a/+/c"},
+		FlushInterval: time.Millisecond * 5,
+	})
+	require.NoError(t, err)
+
+	var called int64
+	e := events.Events{
+		OnConnect: func(events.Client, events.Packet) {
+			atomic.AddInt64(&called, 1)
+		},
+		OnMessage: func(cl events.Client, pk events.Packet) (events.Packet, error) {
+			pk.Payload = []byte("modified")
+			return pk, nil
+		},
+	}
+	w.Attach(&e)
+
+	e.OnConnect(testClient, events.Packet{})
+	e.OnSubscribe("a/b/c", testClient, 1)
+	e.OnUnsubscribe("a/b/c", testClient)
+
+	pk := events.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1, Retain: true},
+		TopicName:   "a/b/c",
+		Payload:     []byte("hello"),
+	}
+	out, err := e.OnMessage(testClient, pk)
+	require.NoError(t, err)
+	require.Equal(t, []byte("modified"), out.Payload)
+
+	pk.TopicName = "d/e/f"
+	_, err = e.OnMessage(testClient, pk)
+	require.NoError(t, err)
+
+	e.OnQosDropped(testClient, events.Packet{TopicName: "a/b/c"}, errors.New("expired"))
+	e.OnDisconnect(testClient, errors.New("closed"))
+	w.Close()
+
+	require.Equal(t, int64(1), atomic.LoadInt64(&called))
+
+	evs := r.events()
+	require.Len(t, evs, 6)
+	require.Equal(t, EventConnected, evs[0].Type)
+	require.Equal(t, "mochi", evs[0].ClientID)
+	require.Equal(t, "user", evs[0].Username)
+	require.Equal(t, "127.0.0.1", evs[0].Remote)
+	require.Equal(t, "t1", evs[0].Listener)
+	require.True(t, evs[0].Timestamp > 0)
+
+	require.Equal(t, EventSubscribed, evs[1].Type)
+	require.Equal(t, "a/b/c", evs[1].Topic)
+	require.Equal(t, byte(1), evs[1].Qos)
+
+	require.Equal(t, EventUnsubscribed, evs[2].Type)
+
+	require.Equal(t, EventPublished, evs[3].Type)
+	require.Equal(t, "a/b/c", evs[3].Topic)
+	require.Equal(t, []byte("modified"), evs[3].Payload)
+	require.True(t, evs[3].Retain)
+
+	require.Equal(t, EventMessageDropped, evs[4].Type)
+	require.Equal(t, "expired", evs[4].Reason)
+
+	require.Equal(t, EventDisconnected, evs[5].Type)
+	require.Equal(t, "closed", evs[5].Reason)
+
+	require.Equal(t, Stats{Sent: 6}, w.Stats())
+}
+
+func TestNoPublishWithoutTopics(t *testing.T) {
+	w, err := New(Options{URLs: []string{"http://localhost"}})
+	require.NoError(t, err)
+	defer w.Close()
+	require.False(t, w.matches("a/b/c"))
+}
+
+func TestBatching(t *testing.T) {
+	r, ts := newReceiver(0)
+	defer ts.Close()
+
+	w, err := New(Options{
+		URLs:          []string{ts.URL},
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		require.True(t, w.Enqueue(Event{Type: EventConnected}))
+	}
+
+	w.Close()
+	require.Len(t, r.batches, 3)
+	require.Len(t, r.batches[0], 2)
+	require.Len(t, r.batches[1], 2)
+	require.Len(t, r.batches[2], 1)
+}
+
+func TestFlushInterval(t *testing.T) {
+	r, ts := newReceiver(0)
+	defer ts.Close()
+
+	w, err := New(Options{
+		URLs:          []string{ts.URL},
+		FlushInterval: time.Millisecond * 5,
+	})
+	require.NoError(t, err)
+	defer w.Close()
+
+	w.Enqueue(Event{Type: EventConnected})
+	require.Eventually(t, func() bool {
+		return len(r.events()) == 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestSignature(t *testing.T) {
+	r, ts := newReceiver(0)
+	defer ts.Close()
+
+	secret := []byte("secret")
+	w, err := New(Options{
+		URLs:   []string{ts.URL},
+		Secret: secret,
+	})
+	require.NoError(t, err)
+
+	w.Enqueue(Event{Type: EventConnected})
+	w.Close()
+
+	require.Len(t, r.sigs, 1)
+	require.Equal(t, Sign(secret, r.bodies[0]), r.sigs[0])
+	require.Equal(t, "sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8", Sign([]byte("key"), []byte("The quick brown fox jumps over the lazy dog")))
+}
+
+func TestRetry(t *testing.T) {
+	r, ts := newReceiver(2)
+	defer ts.Close()
+
+	w, err := New(Options{
+		URLs:          []string{ts.URL},
+		FlushInterval: time.Millisecond,
+		RetryBackoff:  time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	w.Enqueue(Event{Type: EventConnected})
+	require.Eventually(t, func() bool {
+		return len(r.events()) == 1
+	}, time.Second, time.Millisecond)
+	w.Close()
+
+	require.Equal(t, int64(3), atomic.LoadInt64(&r.requests))
+	require.Equal(t, Stats{Sent: 1}, w.Stats())
+}
+
+func TestRetryExhausted(t *testing.T) {
+	r, ts := newReceiver(10)
+	defer ts.Close()
+
+	w, err := New(Options{
+		URLs:          []string{ts.URL},
+		FlushInterval: time.Millisecond,
+		MaxRetries:    1,
+		RetryBackoff:  time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	w.Enqueue(Event{Type: EventConnected})
+	require.Eventually(t, func() bool {
+		return w.Stats().Failed == 1
+	}, time.Second, time.Millisecond)
+	w.Close()
+
+	require.Equal(t, int64(2), atomic.LoadInt64(&r.requests))
+	require.Len(t, r.events(), 0)
+}
+
+func TestNoRetry(t *testing.T) {
+	r, ts := newReceiver(10)
+	defer ts.Close()
+
+	w, err := New(Options{
+		URLs:       []string{ts.URL},
+		MaxRetries: -1,
+	})
+	require.NoError(t, err)
+
+	w.Enqueue(Event{Type: EventConnected})
+	w.Close()
+
+	require.Equal(t, int64(1), atomic.LoadInt64(&r.requests))
+	require.Equal(t, Stats{Failed: 1}, w.Stats())
+}
+
+func TestMultipleURLs(t *testing.T) {
+	r1, ts1 := newReceiver(0)
+	defer ts1.Close()
+	r2, ts2 := newReceiver(0)
+	defer ts2.Close()
+
+	w, err := New(Options{
+		URLs: []string{ts1.URL, ts2.URL},
+	})
+	require.NoError(t, err)
+
+	w.Enqueue(Event{Type: EventConnected})
+	w.Close()
+
+	require.Len(t, r1.events(), 1)
+	require.Len(t, r2.events(), 1)
+	require.Equal(t, Stats{Sent: 2}, w.Stats())
+}
+
+func TestEnqueueQueueFull(t *testing.T) {
+	block := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer ts.Close()
+
+	w, err := New(Options{
+		URLs:      []string{ts.URL},
+		QueueSize: 1,
+		BatchSize: 1,
+	})
+	require.NoError(t, err)
+
+	// the first event is taken by the worker, which blocks on the request.
+	require.True(t, w.Enqueue(Event{Type: EventConnected}))
+	require.Eventually(t, func() bool {
+		return len(w.queue) == 0
+	}, time.Second, time.Millisecond)
+
+	require.True(t, w.Enqueue(Event{Type: EventConnected}))
+	require.False(t, w.Enqueue(Event{Type: EventConnected}))
+	require.Equal(t, int64(1), w.Stats().Dropped)
+
+	close(block)
+	w.Close()
+	require.False(t, w.Enqueue(Event{Type: EventConnected}))
+}
+
+func TestCloseStopsRetry(t *testing.T) {
+	r, ts := newReceiver(10)
+	defer ts.Close()
+
+	w, err := New(Options{
+		URLs:          []string{ts.URL},
+		FlushInterval: time.Millisecond,
+		RetryBackoff:  time.Hour,
+	})
+	require.NoError(t, err)
+
+	w.Enqueue(Event{Type: EventConnected})
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&r.requests) == 1
+	}, time.Second, time.Millisecond)
+
+	w.Close()
+	w.Close()
+	require.Equal(t, Stats{Failed: 1}, w.Stats())
+}
+
+func TestInvalidURL(t *testing.T) {
+	w, err := New(Options{
+		URLs:       []string{"://invalid"},
+		MaxRetries: -1,
+	})
+	require.NoError(t, err)
+
+	w.Enqueue(Event{Type: EventConnected})
+	w.Close()
+	require.Equal(t, Stats{Failed: 1}, w.Stats())
+}
+
+func BenchmarkEnqueue(b *testing.B) {
+	w, _ := New(Options{
+		URLs:      []string{"http://localhost"},
+		QueueSize: 1,
+		BatchSize: 1 << 30,
+	})
+	defer w.Close()
+	ev := Event{Type: EventConnected}
+	for n := 0; n < b.N; n++ {
+		w.Enqueue(ev)
+	}
+}
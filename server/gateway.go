@@ -0,0 +1,451 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/xid"
+
+	"github.com/mochi-co/mqtt/server/events"
+	"github.com/mochi-co/mqtt/server/internal/packets"
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+)
+
+const (
+	// gatewayMaxBodySize is the maximum size of a message published via the gateway.
+	gatewayMaxBodySize = 1 << 20
+
+	// gatewayStreamBuffer is the number of messages which may be queued for a
+	// stream before further messages are dropped.
+	gatewayStreamBuffer = 256
+)
+
+var (
+	// ErrGatewayFilterRequired indicates that a gateway subscription did not
+	// include any topic filters.
+	ErrGatewayFilterRequired = errors.New("at least one filter is required")
+
+	// ErrGatewayForbidden indicates that a gateway request was denied by the
+	// listener ACL or rejected by an event hook.
+	ErrGatewayForbidden = errors.New("forbidden")
+
+	// gatewayKeepalive is the interval between comments sent to keep idle
+	// streams open through proxies.
+	gatewayKeepalive = 30 * time.Second
+)
+
+// GatewayMessage is a message streamed to a gateway subscriber.
+type GatewayMessage struct {
+	Topic   string `json:"topic"`   // the topic of the message.
+	Qos     byte   `json:"qos"`     // the qos the message was published with.
+	Retain  bool   `json:"retain"`  // true if the message is a retained message.
+	Payload []byte `json:"payload"` // the payload of the message, base64 encoded.
+}
+
+// gatewayClient is a pseudo-client for a request made to the gateway, to which
+// retained messages can be assigned.
+type gatewayClient struct {
+	info events.Client // the identity of the http client.
+}
+
+// Info returns the identity of the http client.
+func (c *gatewayClient) Info() events.Client {
+	return c.info
+}
+
+// gatewayStream is an http client streaming the messages which match a set of
+// topic filters.
+type gatewayStream struct {
+	filters  []string            // the topic filters of the stream.
+	messages chan packets.Packet // messages waiting to be sent to the client.
+}
+
+// gatewayStreams contains the open streams of all gateway listeners.
+type gatewayStreams struct {
+	sync.RWMutex
+	internal map[*gatewayStream]struct{}
+}
+
+// newGatewayStreams returns a new instance of gatewayStreams.
+func newGatewayStreams() *gatewayStreams {
+	return &gatewayStreams{
+		internal: make(map[*gatewayStream]struct{}),
+	}
+}
+
+// add adds a stream.
+func (g *gatewayStreams) add(st *gatewayStream) {
+	g.Lock()
+	g.internal[st] = struct{}{}
+	g.Unlock()
+}
+
+// remove removes a stream.
+func (g *gatewayStreams) remove(st *gatewayStream) {
+	g.Lock()
+	delete(g.internal, st)
+	g.Unlock()
+}
+
+// publish queues a message for each stream with a matching filter, and returns
+// the number of streams the message was dropped for because their queue was full.
+func (g *gatewayStreams) publish(pk packets.Packet) (dropped int64) {
+	g.RLock()
+	defer g.RUnlock()
+
+	for st := range g.internal {
+		for _, filter := range st.filters {
+			if !auth.FilterCovers(filter, pk.TopicName) {
+				continue
+			}
+
+			select {
+			case st.messages <- pk:
+			default:
+				dropped++
+			}
+			break
+		}
+	}
+
+	return dropped
+}
+
+// gatewayHandler serves the http publish and subscribe gateway of a listener.
+type gatewayHandler struct {
+	s  *Server               // the server to publish and subscribe on.
+	id string                // the id of the listener.
+	ac auth.ClientController // the auth controller of the listener.
+}
+
+// GatewayHandler returns an http.Handler which publishes and subscribes on behalf
+// of http clients of a listener. Requests are authenticated with basic auth
+// credentials, and publishes and subscriptions are checked against the ACLs of
+// the auth controller in the same way as those of MQTT clients. An optional
+// client_id query parameter sets the client id used by the auth controller. It
+// is usually served using a listeners.HTTPGateway listener.
+//
+//	POST /topics/{topic}     publish the request body (qos, retain)
+//	GET  /topics/{topic}     get the payload of the retained message of a topic
+//	GET  /subscribe          stream messages matching filters as server-sent events (filter)
+func (s *Server) GatewayHandler(lid string, ac auth.Controller) http.Handler {
+	return &gatewayHandler{
+		s:  s,
+		id: lid,
+		ac: auth.Adapt(ac),
+	}
+}
+
+// ServeHTTP authenticates and routes a gateway request.
+func (h *gatewayHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	cl, ok := h.authenticate(req)
+	if !ok {
+		h.s.Log.Warn("gateway request unauthorized", "listener", h.id, "remote", req.RemoteAddr, "path", req.URL.Path)
+		w.Header().Set("WWW-Authenticate", `Basic realm="mochi"`)
+		writeAdminError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+
+	if d, ok := h.ac.(auth.Disconnector); ok {
+		defer d.ClientDisconnected(cl)
+	}
+
+	path := strings.TrimPrefix(req.URL.EscapedPath(), "/")
+	resource, rest, _ := strings.Cut(path, "/")
+
+	switch resource {
+	case "topics":
+		topic, err := url.PathUnescape(rest)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		switch req.Method {
+		case http.MethodPost:
+			h.publish(w, req, cl, topic)
+		case http.MethodGet:
+			h.retained(w, cl, topic)
+		default:
+			allowMethods(w, req, http.MethodGet, http.MethodPost)
+		}
+	case "subscribe":
+		if !allowMethods(w, req, http.MethodGet) {
+			return
+		}
+		h.subscribe(w, req, cl)
+	default:
+		writeAdminError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+// authenticate returns the identity of the client making a request, and true
+// if the auth controller accepts its basic auth credentials.
+func (h *gatewayHandler) authenticate(req *http.Request) (auth.Client, bool) {
+	user, pass, _ := req.BasicAuth()
+	cl := auth.Client{
+		ID:       req.URL.Query().Get("client_id"),
+		ConnID:   xid.New().String(),
+		Remote:   req.RemoteAddr,
+		Listener: h.id,
+		Username: []byte(user),
+		Header:   req.Header,
+	}
+
+	if req.TLS != nil {
+		cl.PeerCertificates = req.TLS.PeerCertificates
+	}
+
+	return cl, h.ac.AuthenticateClient(cl, []byte(pass))
+}
+
+// publish handles requests to publish a message.
+func (h *gatewayHandler) publish(w http.ResponseWriter, req *http.Request, cl auth.Client, topic string) {
+	if topic == "" || strings.ContainsAny(topic, "+#") || strings.HasPrefix(topic, "$") {
+		writeAdminError(w, http.StatusBadRequest, ErrInvalidTopic)
+		return
+	}
+
+	q := req.URL.Query()
+	var qos uint64
+	if v := q.Get("qos"); v != "" {
+		var err error
+		qos, err = strconv.ParseUint(v, 10, 8)
+		if err != nil || qos > 2 {
+			writeAdminError(w, http.StatusBadRequest, errors.New("invalid qos"))
+			return
+		}
+	}
+
+	var retain bool
+	if v := q.Get("retain"); v != "" {
+		var err error
+		retain, err = strconv.ParseBool(v)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, errors.New("invalid retain"))
+			return
+		}
+	}
+
+	if !h.ac.ClientACL(cl, auth.Access{
+		Topic:  topic,
+		Write:  true,
+		Qos:    byte(qos),
+		Retain: retain,
+	}) {
+		h.s.Log.Debug("gateway publish denied by acl", "listener", h.id, "remote", cl.Remote, "topic", topic)
+		writeAdminError(w, http.StatusForbidden, ErrGatewayForbidden)
+		return
+	}
+
+	payload, err := io.ReadAll(http.MaxBytesReader(w, req.Body, gatewayMaxBodySize))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    byte(qos),
+			Retain: retain,
+		},
+		TopicName: topic,
+		Payload:   payload,
+	}
+
+	if !h.s.gatewayPublish(events.Client{
+		ID:               cl.ID,
+		Remote:           cl.Remote,
+		Listener:         cl.Listener,
+		Username:         cl.Username,
+		PeerCertificates: cl.PeerCertificates,
+	}, pk) {
+		writeAdminError(w, http.StatusForbidden, ErrGatewayForbidden)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// retained handles requests for the retained message of a topic.
+func (h *gatewayHandler) retained(w http.ResponseWriter, cl auth.Client, topic string) {
+	if !validRetainedTopic(topic) {
+		writeAdminError(w, http.StatusBadRequest, ErrInvalidRetainedTopic)
+		return
+	}
+
+	if !h.ac.ClientACL(cl, auth.Access{Topic: topic}) {
+		h.s.Log.Debug("gateway read denied by acl", "listener", h.id, "remote", cl.Remote, "topic", topic)
+		writeAdminError(w, http.StatusForbidden, ErrGatewayForbidden)
+		return
+	}
+
+	msg, ok := h.s.GetRetained(topic)
+	if !ok {
+		writeAdminError(w, http.StatusNotFound, ErrRetainedNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-MQTT-QoS", strconv.Itoa(int(msg.Qos)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(msg.Payload)
+}
+
+// subscribe streams the messages matching the filter query parameters as
+// server-sent events, beginning with any matching retained messages.
+func (h *gatewayHandler) subscribe(w http.ResponseWriter, req *http.Request, cl auth.Client) {
+	filters := req.URL.Query()["filter"]
+	if len(filters) == 0 {
+		writeAdminError(w, http.StatusBadRequest, ErrGatewayFilterRequired)
+		return
+	}
+
+	for _, filter := range filters {
+		if !validFilter(filter) {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid filter %q", filter))
+			return
+		}
+
+		if !h.ac.ClientACL(cl, auth.Access{Topic: filter}) {
+			h.s.Log.Debug("gateway subscribe denied by acl", "listener", h.id, "remote", cl.Remote, "filter", filter)
+			writeAdminError(w, http.StatusForbidden, ErrGatewayForbidden)
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAdminError(w, http.StatusInternalServerError, errors.New("streaming unsupported"))
+		return
+	}
+
+	st := &gatewayStream{
+		filters:  filters,
+		messages: make(chan packets.Packet, gatewayStreamBuffer),
+	}
+	h.s.gateway.add(st)
+	defer h.s.gateway.remove(st)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	for _, filter := range filters {
+		for _, pk := range h.s.Topics.Messages(filter) {
+			writeGatewayEvent(w, pk)
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(gatewayKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case pk := <-st.messages:
+			if err := writeGatewayEvent(w, pk); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		case <-h.s.done:
+			return
+		}
+	}
+}
+
+// gatewayPublish publishes a message on behalf of an http client of the gateway,
+// calling the same event hooks as an MQTT publish. It returns false if the
+// message was rejected by the OnProcessMessage hook.
+func (s *Server) gatewayPublish(cl events.Client, pk packets.Packet) bool {
+	start := time.Now()
+	atomic.AddInt64(&s.System.PublishRecv, 1)
+
+	pk, ok := s.onProcessMessage(cl, pk)
+	if !ok {
+		return false
+	}
+
+	if pk.FixedHeader.Retain {
+		s.retainMessage(&gatewayClient{info: cl}, pk)
+	}
+
+	pk = s.onMessage(cl, pk)
+	s.publishToSubscribers(pk)
+	s.metrics.publishLatency.Observe(time.Since(start).Seconds())
+
+	return true
+}
+
+// publishFrom publishes a message on behalf of a client of a listener which is
+// not connected to the server, such as an MQTT-SN qos -1 publish. The listener
+// is responsible for checking the ACLs of the client.
+func (s *Server) publishFrom(cl auth.Client, topic string, payload []byte, retain bool) bool {
+	return s.gatewayPublish(events.Client{
+		ID:       cl.ID,
+		Remote:   cl.Remote,
+		Listener: cl.Listener,
+		Username: cl.Username,
+	}, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Retain: retain,
+		},
+		TopicName: topic,
+		Payload:   payload,
+	})
+}
+
+// writeGatewayEvent writes a message to a stream as a server-sent event.
+func writeGatewayEvent(w io.Writer, pk packets.Packet) error {
+	b, err := json.Marshal(GatewayMessage{
+		Topic:   pk.TopicName,
+		Qos:     pk.FixedHeader.Qos,
+		Retain:  pk.FixedHeader.Retain,
+		Payload: pk.Payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "event: message\ndata: %s\n\n", b)
+	return err
+}
+
+// validFilter returns true if a topic filter is well formed, with multi-level
+// wildcards only as the last level and wildcards occupying entire levels.
+func validFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+
+	return true
+}
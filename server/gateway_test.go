@@ -0,0 +1,375 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-co/mqtt/server/events"
+	"github.com/mochi-co/mqtt/server/internal/packets"
+	"github.com/mochi-co/mqtt/server/listeners"
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/logger"
+)
+
+// gatewayAuth accepts a single user, which may access topics beginning with
+// allowed/, and records the acl checks it makes.
+type gatewayAuth struct {
+	clients  []auth.Client
+	accesses []auth.Access
+}
+
+func (a *gatewayAuth) AuthenticateClient(cl auth.Client, password []byte) bool {
+	return string(cl.Username) == "user" && string(password) == "pass"
+}
+
+func (a *gatewayAuth) ClientACL(cl auth.Client, access auth.Access) bool {
+	a.clients = append(a.clients, cl)
+	a.accesses = append(a.accesses, access)
+	return strings.HasPrefix(access.Topic, "allowed/")
+}
+
+func gatewayRequest(t *testing.T, h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.SetBasicAuth("user", "pass")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestGatewayHandlerUnauthorized(t *testing.T) {
+	s := New()
+	log := new(logger.Mock)
+	s.Log = log
+	h := s.GatewayHandler("gw", auth.Wrap(new(gatewayAuth)))
+
+	req := httptest.NewRequest(http.MethodGet, "/topics/allowed/a", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.Equal(t, `Basic realm="mochi"`, w.Header().Get("WWW-Authenticate"))
+
+	_, ok := log.Find("gateway request unauthorized")
+	require.True(t, ok)
+}
+
+func TestGatewayHandlerNotFound(t *testing.T) {
+	s := New()
+	h := s.GatewayHandler("gw", auth.Wrap(new(gatewayAuth)))
+
+	w := gatewayRequest(t, h, http.MethodGet, "/nothing", "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.JSONEq(t, `{"error":"not found"}`, w.Body.String())
+}
+
+func TestGatewayHandlerMethodNotAllowed(t *testing.T) {
+	s := New()
+	h := s.GatewayHandler("gw", auth.Wrap(new(gatewayAuth)))
+
+	w := gatewayRequest(t, h, http.MethodDelete, "/topics/allowed/a", "")
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	require.Equal(t, "GET, POST", w.Header().Get("Allow"))
+
+	w = gatewayRequest(t, h, http.MethodPost, "/subscribe", "")
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	require.Equal(t, "GET", w.Header().Get("Allow"))
+}
+
+func TestGatewayHandlerPublish(t *testing.T) {
+	s, cl, r, w := setupClient()
+	s.Clients.Add(cl)
+	s.Topics.Subscribe("allowed/+", cl.ID, 1)
+	ac := new(gatewayAuth)
+	h := s.GatewayHandler("gw", auth.Wrap(ac))
+
+	var hooked events.Client
+	s.Events.OnMessage = func(cl events.Client, pk events.Packet) (events.Packet, error) {
+		hooked = cl
+		return pk, nil
+	}
+
+	recv := make(chan []byte)
+	go func() {
+		buf := make([]byte, 20)
+		n, _ := r.Read(buf)
+		recv <- buf[:n]
+	}()
+
+	resp := gatewayRequest(t, h, http.MethodPost, "/topics/allowed/a?qos=1&client_id=script", "hello")
+	require.Equal(t, http.StatusNoContent, resp.Code)
+	require.Equal(t, []byte{
+		byte(packets.Publish<<4) | 2, 18, // Fixed header
+		0, 9, // Topic Name - LSB+MSB
+		'a', 'l', 'l', 'o', 'w', 'e', 'd', '/', 'a', // Topic Name
+		0, 1, // Packet ID - LSB+MSB
+		'h', 'e', 'l', 'l', 'o', // Payload
+	}, <-recv)
+
+	require.Equal(t, []auth.Access{{Topic: "allowed/a", Write: true, Qos: 1}}, ac.accesses)
+	require.Equal(t, "script", ac.clients[0].ID)
+	require.Equal(t, "gw", ac.clients[0].Listener)
+	require.Equal(t, []byte("user"), ac.clients[0].Username)
+	require.Equal(t, "script", hooked.ID)
+	require.Equal(t, "gw", hooked.Listener)
+	require.Equal(t, int64(1), s.System.PublishRecv)
+
+	w.Close()
+}
+
+func TestGatewayHandlerPublishRetained(t *testing.T) {
+	s := New()
+	h := s.GatewayHandler("gw", auth.Wrap(new(gatewayAuth)))
+
+	resp := gatewayRequest(t, h, http.MethodPost, "/topics/allowed/a?retain=true", "hello")
+	require.Equal(t, http.StatusNoContent, resp.Code)
+
+	resp = gatewayRequest(t, h, http.MethodGet, "/topics/allowed/a", "")
+	require.Equal(t, http.StatusOK, resp.Code)
+	require.Equal(t, "application/octet-stream", resp.Header().Get("Content-Type"))
+	require.Equal(t, "0", resp.Header().Get("X-MQTT-QoS"))
+	require.Equal(t, "hello", resp.Body.String())
+
+	resp = gatewayRequest(t, h, http.MethodGet, "/topics/allowed/b", "")
+	require.Equal(t, http.StatusNotFound, resp.Code)
+
+	resp = gatewayRequest(t, h, http.MethodGet, "/topics/allowed/%2B", "")
+	require.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestGatewayHandlerPublishInvalid(t *testing.T) {
+	s := New()
+	h := s.GatewayHandler("gw", auth.Wrap(new(gatewayAuth)))
+
+	tt := []struct {
+		target string
+		code   int
+	}{
+		{target: "/topics/", code: http.StatusBadRequest},
+		{target: "/topics/allowed/%23", code: http.StatusBadRequest},
+		{target: "/topics/$SYS/a", code: http.StatusBadRequest},
+		{target: "/topics/allowed/a?qos=3", code: http.StatusBadRequest},
+		{target: "/topics/allowed/a?qos=x", code: http.StatusBadRequest},
+		{target: "/topics/allowed/a?retain=x", code: http.StatusBadRequest},
+		{target: "/topics/denied/a", code: http.StatusForbidden},
+	}
+
+	for _, tx := range tt {
+		resp := gatewayRequest(t, h, http.MethodPost, tx.target, "hello")
+		require.Equal(t, tx.code, resp.Code, tx.target)
+	}
+
+	resp := gatewayRequest(t, h, http.MethodPost, "/topics/allowed/a", strings.Repeat("a", gatewayMaxBodySize+1))
+	require.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestGatewayHandlerPublishRejected(t *testing.T) {
+	s := New()
+	h := s.GatewayHandler("gw", auth.Wrap(new(gatewayAuth)))
+	s.Events.OnProcessMessage = func(cl events.Client, pk events.Packet) (events.Packet, error) {
+		return pk, ErrRejectPacket
+	}
+
+	resp := gatewayRequest(t, h, http.MethodPost, "/topics/allowed/a?retain=true", "hello")
+	require.Equal(t, http.StatusForbidden, resp.Code)
+	require.Empty(t, s.Topics.Messages("allowed/a"))
+}
+
+func TestGatewayHandlerRetainedDenied(t *testing.T) {
+	s := New()
+	require.NoError(t, s.SetRetained("denied/a", []byte("hello")))
+	h := s.GatewayHandler("gw", auth.Wrap(new(gatewayAuth)))
+
+	resp := gatewayRequest(t, h, http.MethodGet, "/topics/denied/a", "")
+	require.Equal(t, http.StatusForbidden, resp.Code)
+}
+
+func TestGatewayHandlerSubscribeInvalid(t *testing.T) {
+	s := New()
+	ac := new(gatewayAuth)
+	h := s.GatewayHandler("gw", auth.Wrap(ac))
+
+	resp := gatewayRequest(t, h, http.MethodGet, "/subscribe", "")
+	require.Equal(t, http.StatusBadRequest, resp.Code)
+
+	resp = gatewayRequest(t, h, http.MethodGet, "/subscribe?filter=allowed/%23/a", "")
+	require.Equal(t, http.StatusBadRequest, resp.Code)
+
+	resp = gatewayRequest(t, h, http.MethodGet, "/subscribe?filter=allowed/%23&filter=denied/%23", "")
+	require.Equal(t, http.StatusForbidden, resp.Code)
+	require.Equal(t, []auth.Access{{Topic: "allowed/#"}, {Topic: "denied/#"}}, ac.accesses)
+}
+
+func TestGatewayHandlerSubscribe(t *testing.T) {
+	s := New()
+	require.NoError(t, s.SetRetained("allowed/retained", []byte("old")))
+	h := s.GatewayHandler("gw", auth.Wrap(new(gatewayAuth)))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/subscribe?filter=allowed/%23", nil)
+	require.NoError(t, err)
+	req.SetBasicAuth("user", "pass")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	events := bufio.NewReader(resp.Body)
+	next := func() GatewayMessage {
+		line, err := events.ReadString('\n')
+		require.NoError(t, err)
+		require.Equal(t, "event: message\n", line)
+
+		line, err = events.ReadString('\n')
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(line, "data: "))
+
+		var msg GatewayMessage
+		require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &msg))
+
+		line, err = events.ReadString('\n')
+		require.NoError(t, err)
+		require.Equal(t, "\n", line)
+		return msg
+	}
+
+	require.Equal(t, GatewayMessage{Topic: "allowed/retained", Retain: true, Payload: []byte("old")}, next())
+
+	require.Eventually(t, func() bool {
+		s.gateway.RLock()
+		defer s.gateway.RUnlock()
+		return len(s.gateway.internal) == 1
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, s.Publish("denied/a", []byte("no"), false))
+	pub := gatewayRequest(t, h, http.MethodPost, "/topics/allowed/a?qos=2", "new")
+	require.Equal(t, http.StatusNoContent, pub.Code)
+	require.Equal(t, GatewayMessage{Topic: "allowed/a", Qos: 2, Payload: []byte("new")}, next())
+}
+
+func TestGatewayHandlerSubscribeEnds(t *testing.T) {
+	s := New()
+	h := s.GatewayHandler("gw", auth.Wrap(new(gatewayAuth)))
+
+	old := gatewayKeepalive
+	gatewayKeepalive = time.Millisecond
+	defer func() {
+		gatewayKeepalive = old
+	}()
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/subscribe?filter=allowed/a", nil)
+	req.SetBasicAuth("user", "pass")
+
+	o := make(chan bool)
+	go func() {
+		h.ServeHTTP(w, req)
+		o <- true
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	close(s.done)
+	<-o
+
+	require.Contains(t, w.Body.String(), ": keepalive\n\n")
+	require.Empty(t, s.gateway.internal)
+}
+
+func TestGatewayStreamsPublishDropped(t *testing.T) {
+	g := newGatewayStreams()
+	st := &gatewayStream{
+		filters:  []string{"a/+", "a/#"},
+		messages: make(chan packets.Packet, 1),
+	}
+	g.add(st)
+
+	pk := packets.Packet{TopicName: "a/b"}
+	require.Equal(t, int64(0), g.publish(pk))
+	require.Equal(t, int64(1), g.publish(pk))
+	require.Equal(t, int64(0), g.publish(packets.Packet{TopicName: "b/c"}))
+	require.Len(t, st.messages, 1)
+
+	g.remove(st)
+	require.Empty(t, g.internal)
+}
+
+func TestServerPublishToGatewayDropped(t *testing.T) {
+	s := New()
+	st := &gatewayStream{
+		filters:  []string{"#"},
+		messages: make(chan packets.Packet),
+	}
+	s.gateway.add(st)
+
+	s.publishToSubscribers(packets.Packet{TopicName: "a/b"})
+	require.Equal(t, int64(1), s.System.PublishDropped)
+
+	// messages for selected clients are not streamed.
+	s.publishToSubscribers(packets.Packet{TopicName: "a/b", AllowClients: []string{"mochi"}})
+	require.Equal(t, int64(1), s.System.PublishDropped)
+}
+
+func TestServerPublishFrom(t *testing.T) {
+	s := New()
+
+	var hooked events.Client
+	s.Events.OnMessage = func(cl events.Client, pk events.Packet) (events.Packet, error) {
+		hooked = cl
+		return pk, nil
+	}
+
+	ok := s.publishFrom(auth.Client{ID: "sensor", Remote: "127.0.0.1", Listener: "sn"}, "a/b", []byte("hi"), true)
+	require.True(t, ok)
+	require.Equal(t, events.Client{ID: "sensor", Remote: "127.0.0.1", Listener: "sn"}, hooked)
+	require.Equal(t, int64(1), s.System.PublishRecv)
+
+	msgs := s.Topics.Messages("a/b")
+	require.Len(t, msgs, 1)
+	require.Equal(t, []byte("hi"), msgs[0].Payload)
+}
+
+func TestServerAddListenerPublisher(t *testing.T) {
+	s := New()
+	l := listeners.NewMQTTSN("sn", "127.0.0.1:0")
+	require.NoError(t, s.AddListener(l, nil))
+	defer l.Close(listeners.MockCloser)
+}
+
+func TestValidFilter(t *testing.T) {
+	require.True(t, validFilter("a/b"))
+	require.True(t, validFilter("#"))
+	require.True(t, validFilter("a/+/c/#"))
+	require.False(t, validFilter(""))
+	require.False(t, validFilter("a/#/c"))
+	require.False(t, validFilter("a/b#"))
+	require.False(t, validFilter("a/b+/c"))
+}
+
+func TestServerAddListenerGateway(t *testing.T) {
+	s := New()
+	l := listeners.NewHTTPGateway("gw", defaultPort)
+	require.NoError(t, s.AddListener(l, nil))
+	defer l.Close(listeners.MockCloser)
+}
+
+func BenchmarkGatewayStreamsPublish(b *testing.B) {
+	g := newGatewayStreams()
+	for i := 0; i < 10; i++ {
+		g.add(&gatewayStream{
+			filters:  []string{"a/b/" + string(rune('a'+i)), "c/#"},
+			messages: make(chan packets.Packet, 1),
+		})
+	}
+
+	pk := packets.Packet{TopicName: "a/b/z"}
+	for n := 0; n < b.N; n++ {
+		g.publish(pk)
+	}
+}
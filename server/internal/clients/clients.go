@@ -2,10 +2,13 @@ package clients
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -17,6 +20,7 @@ import (
 	"github.com/mochi-co/mqtt/server/internal/packets"
 	"github.com/mochi-co/mqtt/server/internal/topics"
 	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/logger"
 	"github.com/mochi-co/mqtt/server/system"
 )
 
@@ -98,23 +102,58 @@ func (cl *Clients) GetByListener(id string) []*Client {
 
 // Client contains information about a client known by the broker.
 type Client struct {
-	State         State                // the operational state of the client.
-	LWT           LWT                  // the last will and testament for the client.
-	Inflight      *Inflight            // a map of in-flight qos messages.
-	sync.RWMutex                       // mutex
-	Username      []byte               // the username the client authenticated with.
-	AC            auth.Controller      // an auth controller inherited from the listener.
-	Listener      string               // the id of the listener the client is connected to.
-	ID            string               // the client id.
-	conn          net.Conn             // the net.Conn used to establish the connection.
-	R             *circ.Reader         // a reader for reading incoming bytes.
-	W             *circ.Writer         // a writer for writing outgoing bytes.
-	Subscriptions topics.Subscriptions // a map of the subscription filters a client maintains.
-	systemInfo    *system.Info         // pointers to server system info.
-	packetID      uint32               // the current highest packetID.
-	keepalive     uint16               // the number of seconds the connection can wait.
-	CleanSession  bool                 // indicates if the client expects a clean-session.
-}
+	Stats            *Stats                // traffic counters for the client connection.
+	ListenerStats    *Stats                // aggregate traffic counters for the listener, if any.
+	State            State                 // the operational state of the client.
+	LWT              LWT                   // the last will and testament for the client.
+	Inflight         *Inflight             // a map of in-flight qos messages.
+	sync.RWMutex                           // mutex
+	Username         []byte                // the username the client authenticated with.
+	AC               auth.ClientController // an auth controller inherited from the listener.
+	Log              logger.Logger         // a logger inherited from the server.
+	Listener         string                // the id of the listener the client is connected to.
+	ID               string                // the client id.
+	ConnID           string                // a unique id for the client connection.
+	conn             net.Conn              // the net.Conn used to establish the connection.
+	R                *circ.Reader          // a reader for reading incoming bytes.
+	W                *circ.Writer          // a writer for writing outgoing bytes.
+	Subscriptions    topics.Subscriptions  // a map of the subscription filters a client maintains.
+	systemInfo       *system.Info          // pointers to server system info.
+	ConnectedAt      int64                 // the unix time the client connection was established.
+	packetID         uint32                // the current highest packetID.
+	keepalive        uint16                // the number of seconds the connection can wait.
+	CleanSession     bool                  // indicates if the client expects a clean-session.
+	ProtocolVersion  byte                  // the mqtt protocol version of the connection.
+	PeerCertificates []*x509.Certificate   // the certificates presented by a tls client, if any.
+	PeerCredentials  *auth.PeerCredentials // the credentials of a unix socket client, if known.
+	Header           http.Header           // the http request headers of a websocket client, if any.
+}
+
+// Stats contains atomic counters for the traffic of a client connection. The same
+// counters are used to aggregate the traffic of all the clients of a listener.
+type Stats struct {
+	BytesRecv      int64 // the number of bytes received from the client.
+	BytesSent      int64 // the number of bytes sent to the client.
+	MessagesRecv   int64 // the number of packets received from the client.
+	MessagesSent   int64 // the number of packets sent to the client.
+	PublishRecv    int64 // the number of publish packets received from the client.
+	PublishSent    int64 // the number of publish packets sent to the client.
+	PublishDropped int64 // the number of publish messages for the client which were dropped.
+	LastActivity   int64 // the unix time a packet was last received from or sent to the client.
+}
+
+// statField selects a counter from a Stats.
+type statField func(s *Stats) *int64
+
+var (
+	statBytesRecv      statField = func(s *Stats) *int64 { return &s.BytesRecv }
+	statBytesSent      statField = func(s *Stats) *int64 { return &s.BytesSent }
+	statMessagesRecv   statField = func(s *Stats) *int64 { return &s.MessagesRecv }
+	statMessagesSent   statField = func(s *Stats) *int64 { return &s.MessagesSent }
+	statPublishRecv    statField = func(s *Stats) *int64 { return &s.PublishRecv }
+	statPublishSent    statField = func(s *Stats) *int64 { return &s.PublishSent }
+	statPublishDropped statField = func(s *Stats) *int64 { return &s.PublishDropped }
+)
 
 // State tracks the state of the client.
 type State struct {
@@ -129,11 +168,15 @@ type State struct {
 // NewClient returns a new instance of Client.
 func NewClient(c net.Conn, r *circ.Reader, w *circ.Writer, s *system.Info) *Client {
 	cl := &Client{
-		conn:       c,
-		R:          r,
-		W:          w,
-		systemInfo: s,
-		keepalive:  defaultKeepalive,
+		conn:        c,
+		R:           r,
+		W:           w,
+		systemInfo:  s,
+		keepalive:   defaultKeepalive,
+		Log:         new(logger.Nop),
+		Stats:       new(Stats),
+		ConnectedAt: time.Now().Unix(),
+		ConnID:      xid.New().String(),
 		Inflight: &Inflight{
 			internal: make(map[uint16]InflightMessage),
 		},
@@ -145,6 +188,7 @@ func NewClient(c net.Conn, r *circ.Reader, w *circ.Writer, s *system.Info) *Clie
 		},
 	}
 
+	cl.Stats.LastActivity = cl.ConnectedAt
 	cl.refreshDeadline(cl.keepalive)
 
 	return cl
@@ -154,6 +198,8 @@ func NewClient(c net.Conn, r *circ.Reader, w *circ.Writer, s *system.Info) *Clie
 // method is typically called by the persistence restoration system.
 func NewClientStub(s *system.Info) *Client {
 	return &Client{
+		Log:   new(logger.Nop),
+		Stats: new(Stats),
 		Inflight: &Inflight{
 			internal: make(map[uint16]InflightMessage),
 		},
@@ -167,7 +213,19 @@ func NewClientStub(s *system.Info) *Client {
 // Identify sets the identification values of a client instance.
 func (cl *Client) Identify(lid string, pk packets.Packet, ac auth.Controller) {
 	cl.Listener = lid
-	cl.AC = ac
+	cl.AC = auth.Adapt(ac)
+
+	if tc, ok := cl.conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		cl.PeerCertificates = tc.ConnectionState().PeerCertificates
+	}
+
+	if uc, ok := cl.conn.(interface{ PeerCredentials() *auth.PeerCredentials }); ok {
+		cl.PeerCredentials = uc.PeerCredentials()
+	}
+
+	if hc, ok := cl.conn.(interface{ Header() http.Header }); ok {
+		cl.Header = hc.Header()
+	}
 
 	cl.ID = pk.ClientIdentifier
 	if cl.ID == "" {
@@ -179,6 +237,7 @@ func (cl *Client) Identify(lid string, pk packets.Packet, ac auth.Controller) {
 
 	cl.Username = pk.Username
 	cl.CleanSession = pk.CleanSession
+	cl.ProtocolVersion = pk.ProtocolVersion
 	cl.keepalive = pk.Keepalive
 
 	if pk.WillFlag {
@@ -211,14 +270,35 @@ func (cl *Client) Info() events.Client {
 		addr = cl.conn.RemoteAddr().String()
 	}
 	return events.Client{
-		ID:           cl.ID,
-		Remote:       addr,
-		Username:     cl.Username,
-		CleanSession: cl.CleanSession,
-		Listener:     cl.Listener,
+		ID:               cl.ID,
+		Remote:           addr,
+		Username:         cl.Username,
+		CleanSession:     cl.CleanSession,
+		Listener:         cl.Listener,
+		PeerCertificates: cl.PeerCertificates,
 	}
 }
 
+// AuthInfo returns the identity of the client used by auth controllers.
+func (cl *Client) AuthInfo() auth.Client {
+	info := cl.Info()
+	return auth.Client{
+		ID:               info.ID,
+		ConnID:           cl.ConnID,
+		Remote:           info.Remote,
+		Listener:         info.Listener,
+		Username:         info.Username,
+		PeerCertificates: info.PeerCertificates,
+		PeerCredentials:  cl.PeerCredentials,
+		Header:           cl.Header,
+	}
+}
+
+// Keepalive returns the keepalive value of the client in seconds.
+func (cl *Client) Keepalive() uint16 {
+	return cl.keepalive
+}
+
 // NextPacketID returns the next packet id for a client, looping back to 0
 // if the maximum ID has been reached.
 func (cl *Client) NextPacketID() uint32 {
@@ -303,6 +383,8 @@ func (cl *Client) Stop(err error) {
 			err = ErrConnectionClosed
 		}
 		cl.State.stopCause.Store(err)
+
+		cl.Log.Debug("client stopped", "client_id", cl.ID, "listener", cl.Listener, "remote", cl.Info().Remote, "error", err)
 	})
 }
 
@@ -359,6 +441,7 @@ func (cl *Client) ReadFixedHeader(fh *packets.FixedHeader) error {
 	// Having successfully read n bytes, commit the tail forward.
 	cl.R.CommitTail(n)
 	atomic.AddInt64(&cl.systemInfo.BytesRecv, int64(n))
+	cl.addStat(statBytesRecv, int64(n))
 
 	return nil
 }
@@ -393,6 +476,8 @@ func (cl *Client) Read(packetHandler func(*Client, packets.Packet) error) error
 // ReadPacket reads the remaining buffer into an MQTT packet.
 func (cl *Client) ReadPacket(fh *packets.FixedHeader) (pk packets.Packet, err error) {
 	atomic.AddInt64(&cl.systemInfo.MessagesRecv, 1)
+	cl.addStat(statMessagesRecv, 1)
+	atomic.StoreInt64(&cl.Stats.LastActivity, time.Now().Unix())
 
 	pk.FixedHeader = *fh
 	if pk.FixedHeader.Remaining == 0 {
@@ -404,6 +489,7 @@ func (cl *Client) ReadPacket(fh *packets.FixedHeader) (pk packets.Packet, err er
 		return pk, err
 	}
 	atomic.AddInt64(&cl.systemInfo.BytesRecv, int64(len(p)))
+	cl.addStat(statBytesRecv, int64(len(p)))
 
 	// Decode the remaining packet values using a fresh copy of the bytes,
 	// otherwise the next packet will change the data of this one.
@@ -418,6 +504,7 @@ func (cl *Client) ReadPacket(fh *packets.FixedHeader) (pk packets.Packet, err er
 		err = pk.PublishDecode(px)
 		if err == nil {
 			atomic.AddInt64(&cl.systemInfo.PublishRecv, 1)
+			cl.addStat(statPublishRecv, 1)
 		}
 	case packets.Puback:
 		err = pk.PubackDecode(px)
@@ -466,6 +553,7 @@ func (cl *Client) WritePacket(pk packets.Packet) (n int, err error) {
 		err = pk.PublishEncode(buf)
 		if err == nil {
 			atomic.AddInt64(&cl.systemInfo.PublishSent, 1)
+			cl.addStat(statPublishSent, 1)
 		}
 	case packets.Puback:
 		err = pk.PubackEncode(buf)
@@ -504,12 +592,29 @@ func (cl *Client) WritePacket(pk packets.Packet) (n int, err error) {
 
 	atomic.AddInt64(&cl.systemInfo.BytesSent, int64(n))
 	atomic.AddInt64(&cl.systemInfo.MessagesSent, 1)
+	cl.addStat(statBytesSent, int64(n))
+	cl.addStat(statMessagesSent, 1)
+	atomic.StoreInt64(&cl.Stats.LastActivity, time.Now().Unix())
 
 	cl.refreshDeadline(cl.keepalive)
 
 	return
 }
 
+// addStat atomically adds n to a traffic counter of the client, and of the
+// listener the client is connected to.
+func (cl *Client) addStat(field statField, n int64) {
+	atomic.AddInt64(field(cl.Stats), n)
+	if cl.ListenerStats != nil {
+		atomic.AddInt64(field(cl.ListenerStats), n)
+	}
+}
+
+// NoteDropped records that an outbound publish message for the client was dropped.
+func (cl *Client) NoteDropped() {
+	cl.addStat(statPublishDropped, 1)
+}
+
 // LWT contains the last will and testament details for a client connection.
 type LWT struct {
 	Message []byte // the message that shall be sent when the client disconnects.
@@ -520,10 +625,11 @@ type LWT struct {
 
 // InflightMessage contains data about a packet which is currently in-flight.
 type InflightMessage struct {
-	Packet  packets.Packet // the packet currently in-flight.
-	Sent    int64          // the last time the message was sent (for retries) in unixtime.
-	Created int64          // the unix timestamp when the inflight message was created.
-	Resends int            // the number of times the message was attempted to be sent.
+	Packet   packets.Packet // the packet currently in-flight.
+	Sent     int64          // the last time the message was sent (for retries) in unixtime.
+	SentNano int64          // the last time the message was sent in unix nanoseconds, for measuring latency.
+	Created  int64          // the unix timestamp when the inflight message was created.
+	Resends  int            // the number of times the message was attempted to be sent.
 }
 
 // Inflight is a map of InflightMessage keyed on packet id.
@@ -584,13 +690,19 @@ func (i *Inflight) Delete(key uint16) bool {
 // ClearExpired deletes any inflight messages that have remained longer than
 // the servers InflightTTL duration. Returns number of deleted inflights.
 func (i *Inflight) ClearExpired(expiry int64) int64 {
+	return int64(len(i.DeleteExpired(expiry)))
+}
+
+// DeleteExpired deletes any inflight messages that have remained longer than
+// the servers InflightTTL duration, and returns the deleted messages.
+func (i *Inflight) DeleteExpired(expiry int64) []InflightMessage {
 	i.Lock()
 	defer i.Unlock()
-	var deleted int64
+	var deleted []InflightMessage
 	for k, m := range i.internal {
 		if m.Created < expiry || m.Created == 0 {
 			delete(i.internal, k)
-			deleted++
+			deleted = append(deleted, m)
 		}
 	}
 
@@ -1,10 +1,13 @@
 package clients
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -13,6 +16,7 @@ import (
 	"github.com/mochi-co/mqtt/server/internal/circ"
 	"github.com/mochi-co/mqtt/server/internal/packets"
 	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/logger"
 	"github.com/mochi-co/mqtt/server/system"
 	"github.com/stretchr/testify/require"
 )
@@ -165,9 +169,19 @@ func TestNewClient(t *testing.T) {
 	require.NotNil(t, cl.Subscriptions)
 	require.NotNil(t, cl.R)
 	require.NotNil(t, cl.W)
+	require.NotNil(t, cl.Stats)
+	require.True(t, cl.ConnectedAt > 0)
+	require.Equal(t, cl.ConnectedAt, cl.Stats.LastActivity)
 	require.Nil(t, cl.StopCause())
 }
 
+func TestClientKeepalive(t *testing.T) {
+	cl := genClient()
+	require.Equal(t, defaultKeepalive, cl.Keepalive())
+	cl.keepalive = 30
+	require.Equal(t, uint16(30), cl.Keepalive())
+}
+
 func TestClientInfoUnknown(t *testing.T) {
 	cl := genClient()
 	cl.ID = "testid"
@@ -237,6 +251,7 @@ func TestClientIdentify(t *testing.T) {
 	cl.Identify("tcp1", pk, new(auth.Allow))
 	require.Equal(t, pk.Keepalive, cl.keepalive)
 	require.Equal(t, pk.CleanSession, cl.CleanSession)
+	require.Equal(t, pk.ProtocolVersion, cl.ProtocolVersion)
 	require.Equal(t, pk.ClientIdentifier, cl.ID)
 }
 
@@ -305,6 +320,106 @@ func TestClientIdentifyLWT(t *testing.T) {
 	require.Equal(t, pk.WillRetain, cl.LWT.Retain)
 }
 
+func TestClientIdentifyAdaptsController(t *testing.T) {
+	cl := genClient()
+	cl.Identify("tcp1", packets.Packet{ClientIdentifier: "mochi"}, auth.Wrap(new(auth.Disallow)))
+	require.False(t, cl.AC.AuthenticateClient(cl.AuthInfo(), nil))
+	require.False(t, cl.AC.ClientACL(cl.AuthInfo(), auth.Access{Topic: "a/b/c"}))
+}
+
+func TestClientAuthInfo(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	cl := genClient()
+	cl.conn = c1
+	cl.Identify("tcp1", packets.Packet{ClientIdentifier: "mochi", Username: []byte("user")}, new(auth.Allow))
+
+	require.Equal(t, auth.Client{
+		ID:       "mochi",
+		ConnID:   cl.ConnID,
+		Remote:   c1.RemoteAddr().String(),
+		Listener: "tcp1",
+		Username: []byte("user"),
+	}, cl.AuthInfo())
+	require.NotEmpty(t, cl.ConnID)
+	require.NotEqual(t, cl.ConnID, genClient().ConnID)
+}
+
+// certConn is a connection with client certificates.
+type certConn struct {
+	net.Conn
+	certs []*x509.Certificate
+}
+
+func (c *certConn) ConnectionState() tls.ConnectionState {
+	return tls.ConnectionState{PeerCertificates: c.certs}
+}
+
+func TestClientIdentifyPeerCertificates(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	certs := []*x509.Certificate{new(x509.Certificate)}
+	cl := genClient()
+	cl.conn = &certConn{Conn: c1, certs: certs}
+	cl.Identify("tls", packets.Packet{ClientIdentifier: "mochi"}, new(auth.Allow))
+
+	require.Equal(t, certs, cl.PeerCertificates)
+	require.Equal(t, certs, cl.Info().PeerCertificates)
+	require.Equal(t, certs, cl.AuthInfo().PeerCertificates)
+}
+
+// credConn is a unix socket connection with peer credentials.
+type credConn struct {
+	net.Conn
+	creds *auth.PeerCredentials
+}
+
+func (c *credConn) PeerCredentials() *auth.PeerCredentials {
+	return c.creds
+}
+
+func TestClientIdentifyPeerCredentials(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	creds := &auth.PeerCredentials{PID: 10, UID: 1000, GID: 1000}
+	cl := genClient()
+	cl.conn = &credConn{Conn: c1, creds: creds}
+	cl.Identify("unix", packets.Packet{ClientIdentifier: "mochi"}, new(auth.Allow))
+
+	require.Equal(t, creds, cl.PeerCredentials)
+	require.Equal(t, creds, cl.AuthInfo().PeerCredentials)
+}
+
+// headerConn is a websocket connection with request headers.
+type headerConn struct {
+	net.Conn
+	header http.Header
+}
+
+func (c *headerConn) Header() http.Header {
+	return c.header
+}
+
+func TestClientIdentifyHeader(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	header := http.Header{"Cookie": {"session=abc"}}
+	cl := genClient()
+	cl.conn = &headerConn{Conn: c1, header: header}
+	cl.Identify("ws", packets.Packet{ClientIdentifier: "mochi"}, new(auth.Allow))
+
+	require.Equal(t, header, cl.Header)
+	require.Equal(t, header, cl.AuthInfo().Header)
+}
+
 func TestClientNextPacketID(t *testing.T) {
 	cl := genClient()
 
@@ -532,6 +647,23 @@ func TestClientClearBuffers(t *testing.T) {
 	require.Nil(t, cl.R)
 }
 
+func TestClientStopLog(t *testing.T) {
+	cl := genClient()
+	cl.ID = "mochi"
+	log := new(logger.Mock)
+	cl.Log = log
+	cl.Start()
+	cl.Stop(errClientStop)
+
+	e, ok := log.Find("client stopped")
+	require.True(t, ok)
+	require.Equal(t, logger.LevelDebug, e.Level)
+	v, _ := e.Value("client_id")
+	require.Equal(t, "mochi", v)
+	v, _ = e.Value("error")
+	require.Equal(t, errClientStop, v)
+}
+
 func TestClientReadDone(t *testing.T) {
 	cl := genClient()
 	cl.Start()
@@ -650,6 +782,48 @@ func TestClientReadPacketOK(t *testing.T) {
 		TopicName: "d/e/f",
 		Payload:   []byte("yeah"),
 	}, pk)
+
+	require.Equal(t, int64(13), atomic.LoadInt64(&cl.Stats.BytesRecv))
+	require.Equal(t, int64(1), atomic.LoadInt64(&cl.Stats.MessagesRecv))
+	require.Equal(t, int64(1), atomic.LoadInt64(&cl.Stats.PublishRecv))
+	require.True(t, atomic.LoadInt64(&cl.Stats.LastActivity) > 0)
+}
+
+func TestClientReadPacketListenerStats(t *testing.T) {
+	cl := genClient()
+	cl.ListenerStats = new(Stats)
+
+	err := cl.R.Set([]byte{
+		byte(packets.Publish << 4), 11, // Fixed header
+		0, 5, // Topic Name - LSB+MSB
+		'd', '/', 'e', '/', 'f', // Topic Name
+		'y', 'e', 'a', 'h', // Payload
+	}, 0, 13)
+	require.NoError(t, err)
+	cl.R.SetPos(0, 13)
+
+	fh := new(packets.FixedHeader)
+	err = cl.ReadFixedHeader(fh)
+	require.NoError(t, err)
+
+	_, err = cl.ReadPacket(fh)
+	require.NoError(t, err)
+
+	require.Equal(t, int64(13), atomic.LoadInt64(&cl.ListenerStats.BytesRecv))
+	require.Equal(t, int64(1), atomic.LoadInt64(&cl.ListenerStats.MessagesRecv))
+	require.Equal(t, int64(1), atomic.LoadInt64(&cl.ListenerStats.PublishRecv))
+	require.Equal(t, int64(0), atomic.LoadInt64(&cl.ListenerStats.LastActivity))
+}
+
+func TestClientNoteDropped(t *testing.T) {
+	cl := genClient()
+	cl.NoteDropped()
+	require.Equal(t, int64(1), cl.Stats.PublishDropped)
+
+	cl.ListenerStats = new(Stats)
+	cl.NoteDropped()
+	require.Equal(t, int64(2), cl.Stats.PublishDropped)
+	require.Equal(t, int64(1), cl.ListenerStats.PublishDropped)
 }
 
 func TestClientReadPacket(t *testing.T) {
@@ -757,9 +931,12 @@ func TestClientWritePacket(t *testing.T) {
 				errors.Is(err, io.ErrClosedPipe))
 
 		require.Equal(t, int64(n), atomic.LoadInt64(&cl.systemInfo.BytesSent))
+		require.Equal(t, int64(n), atomic.LoadInt64(&cl.Stats.BytesSent))
 		require.Equal(t, int64(1), atomic.LoadInt64(&cl.systemInfo.MessagesSent))
+		require.Equal(t, int64(1), atomic.LoadInt64(&cl.Stats.MessagesSent))
 		if tt.packet.FixedHeader.Type == packets.Publish {
 			require.Equal(t, int64(1), atomic.LoadInt64(&cl.systemInfo.PublishSent))
+			require.Equal(t, int64(1), atomic.LoadInt64(&cl.Stats.PublishSent))
 		}
 	}
 }
@@ -926,6 +1103,25 @@ func TestInflightClearExpired(t *testing.T) {
 	require.Equal(t, int64(2), deleted)
 }
 
+func TestInflightDeleteExpired(t *testing.T) {
+	n := time.Now().Unix()
+
+	cl := genClient()
+	cl.Inflight.Set(1, InflightMessage{
+		Packet:  packets.Packet{PacketID: 1},
+		Created: n - 1,
+	})
+	cl.Inflight.Set(3, InflightMessage{
+		Packet:  packets.Packet{PacketID: 3},
+		Created: n - 3,
+	})
+
+	deleted := cl.Inflight.DeleteExpired(n - 2)
+	require.Len(t, deleted, 1)
+	require.Equal(t, uint16(3), deleted[0].Packet.PacketID)
+	require.Equal(t, 1, cl.Inflight.Len())
+}
+
 var (
 	pkTable = []struct {
 		bytes  []byte
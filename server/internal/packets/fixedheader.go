@@ -43,6 +43,20 @@ func (fh *FixedHeader) Decode(headerByte byte) error {
 	return nil
 }
 
+// Size returns the total number of bytes occupied by a packet with this fixed
+// header, including the header byte and the remaining length indicator.
+func (fh *FixedHeader) Size() int {
+	n := 1 + fh.Remaining
+	for length := fh.Remaining; ; length /= 128 {
+		n++
+		if length < 128 {
+			break
+		}
+	}
+
+	return n
+}
+
 // encodeLength writes length bits for the header.
 func encodeLength(buf *bytes.Buffer, length int64) {
 	for {
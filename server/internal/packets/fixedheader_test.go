@@ -190,6 +190,13 @@ func BenchmarkFixedHeaderDecode(b *testing.B) {
 	}
 }
 
+func TestFixedHeaderSize(t *testing.T) {
+	require.Equal(t, 2, (&FixedHeader{Remaining: 0}).Size())
+	require.Equal(t, 129, (&FixedHeader{Remaining: 127}).Size())
+	require.Equal(t, 131, (&FixedHeader{Remaining: 128}).Size())
+	require.Equal(t, 16388, (&FixedHeader{Remaining: 16384}).Size())
+}
+
 func TestEncodeLength(t *testing.T) {
 	tt := []struct {
 		have int64
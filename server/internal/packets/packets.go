@@ -37,6 +37,26 @@ const (
 	ErrSubAckNetworkError         byte = 0x80
 )
 
+// Names is a map that provides human-readable names for the different
+// MQTT packet types based on their ids.
+var Names = map[byte]string{
+	Reserved:    "RESERVED",
+	Connect:     "CONNECT",
+	Connack:     "CONNACK",
+	Publish:     "PUBLISH",
+	Puback:      "PUBACK",
+	Pubrec:      "PUBREC",
+	Pubrel:      "PUBREL",
+	Pubcomp:     "PUBCOMP",
+	Subscribe:   "SUBSCRIBE",
+	Suback:      "SUBACK",
+	Unsubscribe: "UNSUBSCRIBE",
+	Unsuback:    "UNSUBACK",
+	Pingreq:     "PINGREQ",
+	Pingresp:    "PINGRESP",
+	Disconnect:  "DISCONNECT",
+}
+
 var (
 	// CONNECT
 	ErrMalformedProtocolName    = errors.New("malformed packet: protocol name")
@@ -10,6 +10,12 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+func TestNames(t *testing.T) {
+	require.Len(t, Names, 15)
+	require.Equal(t, "CONNECT", Names[Connect])
+	require.Equal(t, "DISCONNECT", Names[Disconnect])
+}
+
 func TestConnectEncode(t *testing.T) {
 	require.Contains(t, expectedPackets, Connect)
 	for i, wanted := range expectedPackets[Connect] {
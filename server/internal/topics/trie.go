@@ -3,6 +3,7 @@ package topics
 import (
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/mochi-co/mqtt/server/internal/packets"
 )
@@ -12,8 +13,9 @@ type Subscriptions map[string]byte
 
 // Index is a prefix/trie tree containing topic subscribers and retained messages.
 type Index struct {
-	mu   sync.RWMutex // a mutex for locking the whole index.
-	Root *Leaf        // a leaf containing a message and more leaves.
+	mu            sync.RWMutex // a mutex for locking the whole index.
+	Root          *Leaf        // a leaf containing a message and more leaves.
+	retainedBytes int64        // the total size of all retained message payloads.
 }
 
 // New returns a pointer to a new instance of Index.
@@ -33,6 +35,7 @@ func (x *Index) RetainMessage(msg packets.Packet) int64 {
 	x.mu.Lock()
 	defer x.mu.Unlock()
 	n := x.poperate(msg.TopicName)
+	atomic.AddInt64(&x.retainedBytes, int64(len(msg.Payload)-len(n.Message.Payload)))
 
 	// If there is a payload, we can store it.
 	if len(msg.Payload) > 0 {
@@ -51,6 +54,11 @@ func (x *Index) RetainMessage(msg packets.Packet) int64 {
 	return r
 }
 
+// RetainedBytes returns the total size of all retained message payloads in bytes.
+func (x *Index) RetainedBytes() int64 {
+	return atomic.LoadInt64(&x.retainedBytes)
+}
+
 // Subscribe creates a subscription filter for a client. Returns true if the
 // subscription was new.
 func (x *Index) Subscribe(filter, client string, qos byte) bool {
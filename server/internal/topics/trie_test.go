@@ -138,6 +138,25 @@ func TestRetainMessage(t *testing.T) {
 
 }
 
+func TestRetainedBytes(t *testing.T) {
+	index := New()
+	require.Equal(t, int64(0), index.RetainedBytes())
+
+	index.RetainMessage(packets.Packet{TopicName: "a/b", Payload: []byte("hello")})
+	index.RetainMessage(packets.Packet{TopicName: "a/c", Payload: []byte("hi")})
+	require.Equal(t, int64(7), index.RetainedBytes())
+
+	// Replacing a message only counts the new payload.
+	index.RetainMessage(packets.Packet{TopicName: "a/b", Payload: []byte("hello world")})
+	require.Equal(t, int64(13), index.RetainedBytes())
+
+	index.RetainMessage(packets.Packet{TopicName: "a/b"})
+	require.Equal(t, int64(2), index.RetainedBytes())
+
+	index.RetainMessage(packets.Packet{TopicName: "a/b"})
+	require.Equal(t, int64(2), index.RetainedBytes())
+}
+
 func BenchmarkRetainMessage(b *testing.B) {
 	index := New()
 	pk := packets.Packet{TopicName: "path/to/another/mqtt"}
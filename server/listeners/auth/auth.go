@@ -1,5 +1,11 @@
 package auth
 
+import (
+	"crypto/x509"
+	"net/http"
+	"time"
+)
+
 // Controller is an interface for authentication controllers.
 type Controller interface {
 
@@ -10,3 +16,157 @@ type Controller interface {
 	// ACL returns true if a user has read or write access to a given topic.
 	ACL(user []byte, topic string, write bool) bool
 }
+
+// Client contains information about the client making an auth request.
+type Client struct {
+	ID               string              // the client id.
+	ConnID           string              // a unique id for the connection of the client, if known.
+	Remote           string              // the remote address of the client.
+	Listener         string              // the id of the listener the client connected to.
+	Username         []byte              // the username the client connected with.
+	PeerCertificates []*x509.Certificate // the certificates presented by a tls client, if any.
+	PeerCredentials  *PeerCredentials    // the credentials of a unix socket client, if known.
+	Header           http.Header         // the http request headers of a websocket client, if any.
+}
+
+// PeerCredentials are the credentials of the process which connected to a unix
+// domain socket.
+type PeerCredentials struct {
+	PID int32  // the process id.
+	UID uint32 // the user id of the process.
+	GID uint32 // the group id of the process.
+}
+
+// Access describes a request to publish or subscribe to a topic.
+type Access struct {
+	Topic  string // the topic of a publish, or the filter of a subscription.
+	Write  bool   // true if publishing, false if subscribing.
+	Qos    byte   // the qos of the publish or the requested subscription qos.
+	Retain bool   // the retain flag of a publish.
+}
+
+// ClientController is an interface for authentication controllers which make
+// decisions using the identity of a client, such as its client id, remote
+// address or tls certificate. A Controller can be used as a ClientController
+// with Adapt, and a ClientController can be used in a listener config with Wrap.
+type ClientController interface {
+
+	// AuthenticateClient authenticates a client on CONNECT and returns true if
+	// the client is allowed to join the server.
+	AuthenticateClient(cl Client, password []byte) bool
+
+	// ClientACL returns true if a client may publish or subscribe to a topic.
+	ClientACL(cl Client, access Access) bool
+}
+
+// Adapt returns a ClientController which makes decisions using a Controller. If
+// the controller already implements ClientController, it is returned unchanged.
+func Adapt(ac Controller) ClientController {
+	if w, ok := ac.(*wrapper); ok {
+		return w.ClientController // return the original, with any optional interfaces.
+	}
+
+	if cc, ok := ac.(ClientController); ok {
+		return cc
+	}
+
+	return &adapter{ac: ac}
+}
+
+// adapter calls the methods of a Controller for a ClientController.
+type adapter struct {
+	ac Controller
+}
+
+// AuthenticateClient authenticates the username and password of a client.
+func (a *adapter) AuthenticateClient(cl Client, password []byte) bool {
+	return a.ac.Authenticate(cl.Username, password)
+}
+
+// ClientACL checks the topic access of the username of a client.
+func (a *adapter) ClientACL(cl Client, access Access) bool {
+	return a.ac.ACL(cl.Username, access.Topic, access.Write)
+}
+
+// ClientExpiry returns the credential expiry of a client if the Controller is
+// an Expirer, or the zero time.
+func (a *adapter) ClientExpiry(cl Client) time.Time {
+	return clientExpiry(a.ac, cl)
+}
+
+// ClientDisconnected passes a disconnect to the Controller if it is a
+// Disconnector.
+func (a *adapter) ClientDisconnected(cl Client) {
+	clientDisconnected(a.ac, cl)
+}
+
+// Wrap returns a Controller for a ClientController, so it can be used in a
+// listener config. The server calls the ClientController methods directly.
+func Wrap(cc ClientController) Controller {
+	return &wrapper{cc}
+}
+
+// wrapper implements Controller for a ClientController. If the Controller methods
+// are called directly, only the username of the client is known.
+type wrapper struct {
+	ClientController
+}
+
+// Authenticate authenticates a client with only a username and password.
+func (w *wrapper) Authenticate(user, password []byte) bool {
+	return w.AuthenticateClient(Client{Username: user}, password)
+}
+
+// ACL checks the topic access of a client with only a username.
+func (w *wrapper) ACL(user []byte, topic string, write bool) bool {
+	return w.ClientACL(Client{Username: user}, Access{Topic: topic, Write: write})
+}
+
+// ClientExpiry returns the credential expiry of a client if the ClientController
+// is an Expirer, or the zero time.
+func (w *wrapper) ClientExpiry(cl Client) time.Time {
+	return clientExpiry(w.ClientController, cl)
+}
+
+// ClientDisconnected passes a disconnect to the ClientController if it is a
+// Disconnector.
+func (w *wrapper) ClientDisconnected(cl Client) {
+	clientDisconnected(w.ClientController, cl)
+}
+
+// Disconnector is an optional interface for auth controllers which keep state
+// for each client connection. If implemented, ClientDisconnected is called when
+// an authenticated client disconnects.
+type Disconnector interface {
+
+	// ClientDisconnected is called when the connection of a client has ended.
+	ClientDisconnected(cl Client)
+}
+
+// Expirer is an optional interface for auth controllers which grant access for
+// a limited time. If implemented, clients are disconnected when their
+// credentials expire.
+type Expirer interface {
+
+	// ClientExpiry returns the time at which the credentials a client connection
+	// authenticated with expire, or the zero time if they do not expire. It is
+	// called after the client has been authenticated.
+	ClientExpiry(cl Client) time.Time
+}
+
+// clientExpiry returns the credential expiry of a client if a controller is an
+// Expirer, or the zero time.
+func clientExpiry(ac interface{}, cl Client) time.Time {
+	if ex, ok := ac.(Expirer); ok {
+		return ex.ClientExpiry(cl)
+	}
+
+	return time.Time{}
+}
+
+// clientDisconnected passes a disconnect to a controller if it is a Disconnector.
+func clientDisconnected(ac interface{}, cl Client) {
+	if d, ok := ac.(Disconnector); ok {
+		d.ClientDisconnected(cl)
+	}
+}
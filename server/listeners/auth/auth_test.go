@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// userOnly is a Controller which allows a single username.
+type userOnly struct{}
+
+func (a *userOnly) Authenticate(user, password []byte) bool {
+	return string(user) == "mochi"
+}
+
+func (a *userOnly) ACL(user []byte, topic string, write bool) bool {
+	return string(user) == "mochi" && !write
+}
+
+// clientOnly is a ClientController which allows a single client id.
+type clientOnly struct{}
+
+func (a *clientOnly) AuthenticateClient(cl Client, password []byte) bool {
+	return cl.ID == "c1"
+}
+
+func (a *clientOnly) ClientACL(cl Client, access Access) bool {
+	return cl.ID == "c1" && access.Qos < 2 && !access.Retain
+}
+
+func TestAdapt(t *testing.T) {
+	cc := Adapt(new(userOnly))
+	require.True(t, cc.AuthenticateClient(Client{ID: "any", Username: []byte("mochi")}, nil))
+	require.False(t, cc.AuthenticateClient(Client{ID: "any", Username: []byte("other")}, nil))
+	require.True(t, cc.ClientACL(Client{Username: []byte("mochi")}, Access{Topic: "a/b", Qos: 2}))
+	require.False(t, cc.ClientACL(Client{Username: []byte("mochi")}, Access{Topic: "a/b", Write: true}))
+}
+
+func TestAdaptClientController(t *testing.T) {
+	ac := new(Allow)
+	require.Equal(t, ac, Adapt(ac))
+
+	cc := new(clientOnly)
+	require.Same(t, cc, Adapt(Wrap(cc)))
+}
+
+func TestWrap(t *testing.T) {
+	cc := new(clientOnly)
+	ac := Wrap(cc)
+	require.False(t, ac.Authenticate([]byte("mochi"), nil))
+	require.False(t, ac.ACL([]byte("mochi"), "a/b", false))
+
+	require.True(t, Adapt(ac).AuthenticateClient(Client{ID: "c1"}, nil))
+	require.True(t, Adapt(ac).ClientACL(Client{ID: "c1"}, Access{Topic: "a/b", Qos: 1}))
+	require.False(t, Adapt(ac).ClientACL(Client{ID: "c1"}, Access{Topic: "a/b", Qos: 2}))
+	require.False(t, Adapt(ac).ClientACL(Client{ID: "c1"}, Access{Topic: "a/b", Retain: true}))
+}
+
+// expiringUser is a Controller with credentials which expire, which records
+// disconnected clients.
+type expiringUser struct {
+	userOnly
+	disconnected []Client
+}
+
+func (a *expiringUser) ClientExpiry(cl Client) time.Time {
+	return time.Unix(100, 0)
+}
+
+func (a *expiringUser) ClientDisconnected(cl Client) {
+	a.disconnected = append(a.disconnected, cl)
+}
+
+// expiringClient is a ClientController with credentials which expire.
+type expiringClient struct {
+	clientOnly
+	expiringUser
+}
+
+func TestAdaptForwards(t *testing.T) {
+	ac := new(expiringUser)
+	cc := Adapt(ac)
+	require.Equal(t, time.Unix(100, 0), cc.(Expirer).ClientExpiry(Client{ID: "c1"}))
+	cc.(Disconnector).ClientDisconnected(Client{ID: "c1"})
+	require.Equal(t, []Client{{ID: "c1"}}, ac.disconnected)
+
+	cc = Adapt(new(userOnly))
+	require.True(t, cc.(Expirer).ClientExpiry(Client{ID: "c1"}).IsZero())
+	cc.(Disconnector).ClientDisconnected(Client{ID: "c1"})
+}
+
+func TestWrapForwards(t *testing.T) {
+	cc := new(expiringClient)
+	ac := Wrap(cc)
+	require.Equal(t, time.Unix(100, 0), ac.(Expirer).ClientExpiry(Client{ID: "c1"}))
+	ac.(Disconnector).ClientDisconnected(Client{ID: "c1"})
+	require.Equal(t, []Client{{ID: "c1"}}, cc.disconnected)
+
+	ac = Wrap(new(clientOnly))
+	require.True(t, ac.(Expirer).ClientExpiry(Client{ID: "c1"}).IsZero())
+	ac.(Disconnector).ClientDisconnected(Client{ID: "c1"})
+}
+
+func BenchmarkAdaptClientACL(b *testing.B) {
+	cc := Adapt(new(userOnly))
+	cl := Client{ID: "c1", Username: []byte("mochi")}
+	for n := 0; n < b.N; n++ {
+		cc.ClientACL(cl, Access{Topic: "a/b"})
+	}
+}
@@ -15,6 +15,16 @@ func (a *Allow) ACL(user []byte, topic string, write bool) bool {
 	return true
 }
 
+// AuthenticateClient returns true if a client is acceptable. Allow always returns true.
+func (a *Allow) AuthenticateClient(cl Client, password []byte) bool {
+	return true
+}
+
+// ClientACL returns true if a client may access a topic. Allow always returns true.
+func (a *Allow) ClientACL(cl Client, access Access) bool {
+	return true
+}
+
 // Disallow is an auth controller which disallows access to all connections and topics.
 type Disallow struct{}
 
@@ -29,3 +39,15 @@ func (d *Disallow) Authenticate(user, password []byte) bool {
 func (d *Disallow) ACL(user []byte, topic string, write bool) bool {
 	return false
 }
+
+// AuthenticateClient returns true if a client is acceptable. Disallow always
+// returns false.
+func (d *Disallow) AuthenticateClient(cl Client, password []byte) bool {
+	return false
+}
+
+// ClientACL returns true if a client may access a topic. Disallow always
+// returns false.
+func (d *Disallow) ClientACL(cl Client, access Access) bool {
+	return false
+}
@@ -53,3 +53,15 @@ func BenchmarkDisallowACL(b *testing.B) {
 		ac.ACL([]byte("user"), "pass", true)
 	}
 }
+
+func TestAllowClient(t *testing.T) {
+	ac := new(Allow)
+	require.Equal(t, true, ac.AuthenticateClient(Client{ID: "id"}, []byte("pass")))
+	require.Equal(t, true, ac.ClientACL(Client{ID: "id"}, Access{Topic: "topic", Write: true}))
+}
+
+func TestDisallowClient(t *testing.T) {
+	ac := new(Disallow)
+	require.Equal(t, false, ac.AuthenticateClient(Client{ID: "id"}, []byte("pass")))
+	require.Equal(t, false, ac.ClientACL(Client{ID: "id"}, Access{Topic: "topic", Write: true}))
+}
@@ -0,0 +1,502 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mochi-co/mqtt/server/logger"
+)
+
+// Access values of an ACL file rule.
+const (
+	accessRead  byte = 1 << iota // the topic may be subscribed to.
+	accessWrite                  // the topic may be published to.
+	accessDeny                   // all access to the topic is refused.
+)
+
+// FileOptions contains configuration settings for the file auth controller.
+type FileOptions struct {
+	// PasswordFile is the path of a mosquitto format password file, containing
+	// username:hash lines. If empty, no passwords can be checked, and clients are
+	// only accepted if AllowAnonymous is set.
+	PasswordFile string
+
+	// ACLFile is the path of a mosquitto format ACL file. If empty, all
+	// authenticated clients may access all topics.
+	ACLFile string
+
+	// AllowAnonymous allows clients to connect without a username, or with any
+	// username if there is no password file.
+	AllowAnonymous bool
+
+	// WatchInterval is how often the files are checked for changes, and
+	// reloaded if they have been modified. If 0, the files are not watched.
+	WatchInterval time.Duration
+
+	// ReloadOnSignal reloads the files when the process receives SIGHUP.
+	ReloadOnSignal bool
+}
+
+// aclRule is a single topic rule in an ACL file.
+type aclRule struct {
+	topic  string // the topic filter, which may contain %u and %c for patterns.
+	access byte   // the access granted or denied by the rule.
+}
+
+// aclFile contains the parsed rules of an ACL file.
+type aclFile struct {
+	anonymous []aclRule            // rules for clients without a username.
+	users     map[string][]aclRule // rules for specific usernames.
+	patterns  []aclRule            // rules for all clients, with substitutions.
+}
+
+// File is an auth controller which loads usernames, password hashes and topic
+// access rules from mosquitto compatible password and ACL files. Passwords may
+// be hashed with PBKDF2-SHA512 ($7$), salted SHA512 ($6$) or bcrypt ($2b$).
+//
+// The ACL file contains `user <username>` lines, followed by the
+// `topic [read|write|readwrite|deny] <filter>` rules for that user. Topic rules
+// before the first user line apply to anonymous clients. Rules of the form
+// `pattern [read|write|readwrite|deny] <filter>` apply to all clients, with %u
+// replaced by the username and %c by the client id. If the access type is
+// omitted, readwrite is used. A matching deny rule always refuses access.
+type File struct {
+	sync.RWMutex
+	opts      FileOptions          // configuration settings for the controller.
+	passwords map[string]string    // password hashes, keyed on username.
+	acl       *aclFile             // the parsed acl rules, or nil if there is no acl file.
+	modified  map[string]time.Time // the last modified time of each loaded file.
+	log       logger.Logger        // a logger for reload events.
+	sigs      chan os.Signal       // receives signals which trigger a reload.
+	done      chan struct{}        // closed to stop watching for changes.
+	end       sync.Once            // ensures the watcher is only stopped once.
+	wg        sync.WaitGroup       // waits for the watcher to exit.
+}
+
+// NewFile returns a new file auth controller, loading the configured files. If
+// the files are watched for changes or reloaded on SIGHUP, Close should be
+// called when the controller is no longer used.
+func NewFile(opts FileOptions) (*File, error) {
+	a := &File{
+		opts:     opts,
+		modified: make(map[string]time.Time),
+		log:      new(logger.Nop),
+		done:     make(chan struct{}),
+	}
+
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+
+	if opts.ReloadOnSignal {
+		a.sigs = make(chan os.Signal, 1)
+		signal.Notify(a.sigs, syscall.SIGHUP)
+	}
+
+	if opts.WatchInterval > 0 || opts.ReloadOnSignal {
+		a.wg.Add(1)
+		go a.watch()
+	}
+
+	return a, nil
+}
+
+// SetLogger sets the logger used to report reloads and reload failures.
+func (a *File) SetLogger(log logger.Logger) {
+	a.Lock()
+	a.log = log
+	a.Unlock()
+}
+
+// Reload reads the password and ACL files. If either file is invalid, an error
+// is returned and the existing credentials and rules remain in use.
+func (a *File) Reload() error {
+	modified := make(map[string]time.Time)
+
+	var passwords map[string]string
+	if a.opts.PasswordFile != "" {
+		b, mod, err := readFile(a.opts.PasswordFile)
+		if err != nil {
+			return err
+		}
+
+		passwords, err = parsePasswordFile(b)
+		if err != nil {
+			return fmt.Errorf("%s: %w", a.opts.PasswordFile, err)
+		}
+		modified[a.opts.PasswordFile] = mod
+	}
+
+	var acl *aclFile
+	if a.opts.ACLFile != "" {
+		b, mod, err := readFile(a.opts.ACLFile)
+		if err != nil {
+			return err
+		}
+
+		acl, err = parseACLFile(b)
+		if err != nil {
+			return fmt.Errorf("%s: %w", a.opts.ACLFile, err)
+		}
+		modified[a.opts.ACLFile] = mod
+	}
+
+	a.Lock()
+	a.passwords = passwords
+	a.acl = acl
+	a.modified = modified
+	a.Unlock()
+
+	return nil
+}
+
+// Close stops watching the files for changes.
+func (a *File) Close() {
+	a.end.Do(func() {
+		close(a.done)
+	})
+	a.wg.Wait()
+}
+
+// watch reloads the files when they are modified or SIGHUP is received, until
+// the controller is closed.
+func (a *File) watch() {
+	defer a.wg.Done()
+
+	var tick <-chan time.Time
+	if a.opts.WatchInterval > 0 {
+		ticker := time.NewTicker(a.opts.WatchInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	if a.sigs != nil {
+		defer signal.Stop(a.sigs)
+	}
+
+	for {
+		select {
+		case <-tick:
+			if a.changed() {
+				a.reload("file changed")
+			}
+		case <-a.sigs:
+			a.reload("signal received")
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// reload reloads the files, logging the outcome.
+func (a *File) reload(reason string) {
+	a.RLock()
+	log := a.log
+	a.RUnlock()
+
+	if err := a.Reload(); err != nil {
+		log.Error("failed to reload auth files", "reason", reason, "error", err)
+		return
+	}
+
+	log.Info("auth files reloaded", "reason", reason)
+}
+
+// changed returns true if the modified time of any file has changed.
+func (a *File) changed() bool {
+	a.RLock()
+	defer a.RUnlock()
+
+	for _, path := range []string{a.opts.PasswordFile, a.opts.ACLFile} {
+		if path == "" {
+			continue
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue // keep the existing contents until the file returns.
+		}
+
+		if !fi.ModTime().Equal(a.modified[path]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Authenticate returns true if a username and password match an entry in the
+// password file. Clients without a username, or any client if there is no
+// password file, are only accepted if anonymous access is allowed.
+func (a *File) Authenticate(user, password []byte) bool {
+	if len(user) == 0 || a.opts.PasswordFile == "" {
+		return a.opts.AllowAnonymous
+	}
+
+	a.RLock()
+	hash, ok := a.passwords[string(user)]
+	a.RUnlock()
+	if !ok {
+		return false
+	}
+
+	return CheckPassword(hash, password)
+}
+
+// ACL returns true if the ACL file grants a user read or write access to a topic.
+func (a *File) ACL(user []byte, topic string, write bool) bool {
+	return a.aclCheck("", string(user), topic, write)
+}
+
+// AuthenticateClient returns true if the username and password of a client
+// match an entry in the password file.
+func (a *File) AuthenticateClient(cl Client, password []byte) bool {
+	return a.Authenticate(cl.Username, password)
+}
+
+// ClientACL returns true if the ACL file grants a client access to a topic,
+// including patterns using the client id.
+func (a *File) ClientACL(cl Client, access Access) bool {
+	return a.aclCheck(cl.ID, string(cl.Username), access.Topic, access.Write)
+}
+
+// aclCheck returns true if the ACL file grants a client read or write access to
+// a topic. Patterns containing %c are only matched if the client id is known.
+func (a *File) aclCheck(clientID, user, topic string, write bool) bool {
+	a.RLock()
+	acl := a.acl
+	a.RUnlock()
+
+	if acl == nil {
+		return true
+	}
+
+	want := accessRead
+	if write {
+		want = accessWrite
+	}
+
+	rules := acl.anonymous
+	if user != "" {
+		rules = acl.users[user]
+	}
+
+	// A rule grants access if it covers every topic matched by the topic filter,
+	// but denies access if it matches any of them, so subscriptions using
+	// wildcards cannot reach denied topics.
+	allowed := false
+	check := func(filter string, access byte) bool {
+		if access&accessDeny > 0 {
+			return !filtersOverlap(filter, topic)
+		}
+
+		if access&want > 0 && FilterCovers(filter, topic) {
+			allowed = true
+		}
+
+		return true
+	}
+
+	for _, rule := range rules {
+		if !check(rule.topic, rule.access) {
+			return false
+		}
+	}
+
+	for _, rule := range acl.patterns {
+		filter, ok := substitutePattern(rule.topic, clientID, user)
+		if ok && !check(filter, rule.access) {
+			return false
+		}
+	}
+
+	return allowed
+}
+
+// filtersOverlap returns true if any topic is matched by both filter a and filter
+// b. Per [MQTT-4.7.2-1], wildcards in the first level of a filter do not match
+// topics beginning with $.
+func filtersOverlap(a, b string) bool {
+	ap := strings.Split(a, "/")
+	bp := strings.Split(b, "/")
+	if (isWildcard(ap[0]) && strings.HasPrefix(bp[0], "$")) || (isWildcard(bp[0]) && strings.HasPrefix(ap[0], "$")) {
+		return false
+	}
+
+	for i := 0; i < len(ap) || i < len(bp); i++ {
+		switch {
+		case i < len(ap) && ap[i] == "#", i < len(bp) && bp[i] == "#":
+			return true // # also matches the parent level, so the shorter filter may end here.
+		case i >= len(ap) || i >= len(bp):
+			return false
+		case ap[i] == "+" || bp[i] == "+":
+			continue
+		case ap[i] != bp[i]:
+			return false
+		}
+	}
+
+	return true
+}
+
+// isWildcard returns true if a topic level is a single or multi-level wildcard.
+func isWildcard(level string) bool {
+	return level == "+" || level == "#"
+}
+
+// substitutePattern replaces %u and %c in a pattern filter. A pattern cannot be
+// used if a value it requires is unknown or contains topic separators or wildcards.
+func substitutePattern(filter, clientID, user string) (string, bool) {
+	for _, sub := range []struct {
+		token string
+		value string
+	}{
+		{"%u", user},
+		{"%c", clientID},
+	} {
+		if !strings.Contains(filter, sub.token) {
+			continue
+		}
+
+		if sub.value == "" || strings.ContainsAny(sub.value, "/+#") {
+			return "", false
+		}
+
+		filter = strings.ReplaceAll(filter, sub.token, sub.value)
+	}
+
+	return filter, true
+}
+
+// readFile reads a file and returns its contents and modified time.
+func readFile(path string) ([]byte, time.Time, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return b, fi.ModTime(), nil
+}
+
+// parsePasswordFile parses username:hash lines of a password file.
+func parsePasswordFile(b []byte) (map[string]string, error) {
+	passwords := make(map[string]string)
+	err := scanLines(b, func(n int, line string) error {
+		i := strings.IndexByte(line, ':')
+		if i < 1 || i == len(line)-1 {
+			return fmt.Errorf("line %d: expected username:hash", n)
+		}
+
+		passwords[line[:i]] = line[i+1:]
+		return nil
+	})
+
+	return passwords, err
+}
+
+// parseACLFile parses the user, topic and pattern lines of an acl file.
+func parseACLFile(b []byte) (*aclFile, error) {
+	acl := &aclFile{
+		users: make(map[string][]aclRule),
+	}
+
+	user := ""
+	err := scanLines(b, func(n int, line string) error {
+		keyword, rest := splitField(line)
+		switch keyword {
+		case "user":
+			if rest == "" {
+				return fmt.Errorf("line %d: missing username", n)
+			}
+			user = rest
+			if _, ok := acl.users[user]; !ok {
+				acl.users[user] = []aclRule{}
+			}
+		case "topic", "pattern":
+			rule, err := parseACLRule(rest)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", n, err)
+			}
+
+			switch {
+			case keyword == "pattern":
+				acl.patterns = append(acl.patterns, rule)
+			case user == "":
+				acl.anonymous = append(acl.anonymous, rule)
+			default:
+				acl.users[user] = append(acl.users[user], rule)
+			}
+		default:
+			return fmt.Errorf("line %d: unknown keyword %q", n, keyword)
+		}
+
+		return nil
+	})
+
+	return acl, err
+}
+
+// parseACLRule parses the optional access type and topic filter of a rule.
+func parseACLRule(s string) (aclRule, error) {
+	access, topic := splitField(s)
+	rule := aclRule{topic: topic}
+	switch access {
+	case "read":
+		rule.access = accessRead
+	case "write":
+		rule.access = accessWrite
+	case "readwrite":
+		rule.access = accessRead | accessWrite
+	case "deny":
+		rule.access = accessDeny
+	default:
+		rule.access = accessRead | accessWrite
+		rule.topic = s
+	}
+
+	if rule.topic == "" {
+		return rule, fmt.Errorf("missing topic")
+	}
+
+	return rule, nil
+}
+
+// splitField splits the first space separated field from the rest of a line.
+func splitField(s string) (string, string) {
+	i := strings.IndexAny(s, " \t")
+	if i == -1 {
+		return s, ""
+	}
+
+	return s[:i], strings.TrimSpace(s[i+1:])
+}
+
+// scanLines calls fn with each non-empty, non-comment line of a file.
+func scanLines(b []byte, fn func(n int, line string) error) error {
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if err := fn(n, line); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package auth
+
+import (
+	"io/ioutil"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileReloadOnSignal(t *testing.T) {
+	a := newTestFile(t, FileOptions{ReloadOnSignal: true})
+	require.NoError(t, ioutil.WriteFile(a.opts.PasswordFile, []byte("new:"+bcryptVectors[0].hash), 0600))
+	require.NoError(t, syscall.Kill(syscall.Getpid(), syscall.SIGHUP))
+
+	require.Eventually(t, func() bool {
+		return a.Authenticate([]byte("new"), []byte("U*U"))
+	}, time.Second, time.Millisecond)
+
+	a.Close()
+	a.Close()
+}
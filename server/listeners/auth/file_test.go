@@ -0,0 +1,287 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	// testPasswordFile contains the passwords mochi:mochi (PBKDF2-SHA512), other:mochi
+	// (SHA512) and crypt:U*U (bcrypt).
+	testPasswordFile = `# users
+mochi:$7$101$MDEyMzQ1Njc4OWFi$j6Dw8u5SrikklezQHoADfUPjPJIR74jLw62NN15H4Pqy/Q4YKBL3Uxj0vRPLeoUEh89D5acr73xQipCfuDaaZg==
+other:$6$MDEyMzQ1Njc4OWFi$JdvpRZmh68cJZgwOYAihT2fa1tnh0e70dC5+1K/efvPA3ESdYrwBZYfreaAV33bo0aAgqV2Wjt0h+Hj14/32Ew==
+
+crypt:$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW
+`
+
+	testACLFile = `# anonymous
+topic read public/#
+
+user mochi
+topic readwrite devices/mochi/#
+topic deny devices/mochi/secret
+topic read commands/+
+
+user other
+topic write a/b/c
+
+user wild
+topic read #
+topic deny secret/#
+
+# all users
+pattern write clients/%u/status
+pattern read clients/%c/commands/#
+`
+)
+
+func writeTestFile(t *testing.T, name, data string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, ioutil.WriteFile(path, []byte(data), 0600))
+	return path
+}
+
+func newTestFile(t *testing.T, opts FileOptions) *File {
+	if opts.PasswordFile == "" {
+		opts.PasswordFile = writeTestFile(t, "passwd", testPasswordFile)
+	}
+
+	if opts.ACLFile == "" {
+		opts.ACLFile = writeTestFile(t, "acl", testACLFile)
+	}
+
+	a, err := NewFile(opts)
+	require.NoError(t, err)
+	t.Cleanup(a.Close)
+	return a
+}
+
+func TestNewFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	_, err := NewFile(FileOptions{PasswordFile: filepath.Join(dir, "missing")})
+	require.Error(t, err)
+
+	_, err = NewFile(FileOptions{ACLFile: filepath.Join(dir, "missing")})
+	require.Error(t, err)
+
+	_, err = NewFile(FileOptions{PasswordFile: writeTestFile(t, "passwd", "mochi")})
+	require.ErrorContains(t, err, "line 1")
+
+	_, err = NewFile(FileOptions{ACLFile: writeTestFile(t, "acl", "user mochi\ntopic")})
+	require.ErrorContains(t, err, "line 2")
+}
+
+func TestFileAuthenticate(t *testing.T) {
+	a := newTestFile(t, FileOptions{})
+	require.True(t, a.Authenticate([]byte("mochi"), []byte("mochi")))
+	require.False(t, a.Authenticate([]byte("mochi"), []byte("wrong")))
+	require.True(t, a.Authenticate([]byte("other"), []byte("mochi")))
+	require.True(t, a.Authenticate([]byte("crypt"), []byte("U*U")))
+	require.False(t, a.Authenticate([]byte("unknown"), []byte("mochi")))
+	require.False(t, a.Authenticate(nil, nil))
+
+	a = newTestFile(t, FileOptions{AllowAnonymous: true})
+	require.True(t, a.Authenticate(nil, nil))
+}
+
+func TestFileAuthenticateNoPasswordFile(t *testing.T) {
+	a, err := NewFile(FileOptions{})
+	require.NoError(t, err)
+	require.False(t, a.Authenticate([]byte("anyone"), []byte("anything")))
+	require.False(t, a.Authenticate(nil, nil))
+	require.True(t, a.ACL([]byte("anyone"), "a/b/c", true))
+
+	a, err = NewFile(FileOptions{AllowAnonymous: true})
+	require.NoError(t, err)
+	require.True(t, a.Authenticate([]byte("anyone"), []byte("anything")))
+	require.True(t, a.Authenticate(nil, nil))
+}
+
+func TestFileACL(t *testing.T) {
+	a := newTestFile(t, FileOptions{})
+
+	tt := []struct {
+		user  string
+		topic string
+		write bool
+		want  bool
+	}{
+		{"", "public/news", false, true},
+		{"", "public/news", true, false},
+		{"mochi", "public/news", false, false},
+		{"mochi", "devices/mochi/temp", true, true},
+		{"mochi", "devices/mochi/temp", false, true},
+		{"mochi", "devices/mochi/#", false, false},
+		{"mochi", "devices/mochi/+", false, false},
+		{"mochi", "devices/mochi/+/temp", false, true},
+		{"mochi", "devices/mochi/secret", false, false},
+		{"mochi", "devices/mochi/secret", true, false},
+		{"mochi", "devices/other/temp", true, false},
+		{"mochi", "commands/reboot", false, true},
+		{"mochi", "commands/reboot", true, false},
+		{"mochi", "commands/#", false, false},
+		{"other", "a/b/c", true, true},
+		{"other", "a/b/c", false, false},
+		{"mochi", "clients/mochi/status", true, true},
+		{"other", "clients/other/status", true, true},
+		{"other", "clients/mochi/status", true, false},
+		{"", "clients//status", true, false},
+		{"unknown", "clients/unknown/status", true, true},
+		{"unknown", "a/b/c", true, false},
+		{"wild", "public/news", false, true},
+		{"wild", "public/#", false, true},
+		{"wild", "a/+/b", false, true},
+		{"wild", "secret/plans", false, false},
+		{"wild", "secret", false, false},
+		{"wild", "#", false, false},
+		{"wild", "+", false, false},
+		{"wild", "+/x", false, false},
+		{"wild", "+/+/x", false, false},
+		{"wild", "secret/+", false, false},
+		{"wild", "secret/#", false, false},
+		{"wild", "$SYS/#", false, false},
+	}
+
+	for _, tx := range tt {
+		require.Equal(t, tx.want, a.ACL([]byte(tx.user), tx.topic, tx.write), "%s %s %v", tx.user, tx.topic, tx.write)
+	}
+}
+
+func TestFileACLClientPattern(t *testing.T) {
+	a := newTestFile(t, FileOptions{})
+	require.False(t, a.ACL([]byte("mochi"), "clients/c1/commands/reboot", false))
+	require.True(t, a.aclCheck("c1", "mochi", "clients/c1/commands/reboot", false))
+	require.False(t, a.aclCheck("c2", "mochi", "clients/c1/commands/reboot", false))
+	require.False(t, a.aclCheck("c/#", "mochi", "clients/c/#/commands/reboot", false))
+}
+
+func TestFileClient(t *testing.T) {
+	a := newTestFile(t, FileOptions{})
+	cl := Client{ID: "c1", Username: []byte("mochi")}
+	require.True(t, a.AuthenticateClient(cl, []byte("mochi")))
+	require.False(t, a.AuthenticateClient(cl, []byte("wrong")))
+	require.True(t, a.ClientACL(cl, Access{Topic: "clients/c1/commands/reboot"}))
+	require.False(t, a.ClientACL(cl, Access{Topic: "clients/c2/commands/reboot"}))
+	require.True(t, a.ClientACL(cl, Access{Topic: "devices/mochi/temp", Write: true}))
+}
+
+func TestFiltersOverlap(t *testing.T) {
+	tt := []struct {
+		a    string
+		b    string
+		want bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/#", "#", true},
+		{"a/#", "a", true},
+		{"a/#", "+/x", true},
+		{"a/#", "b/#", false},
+		{"a/+", "+/b", true},
+		{"a/+", "a", false},
+		{"a/+", "a/b/c", false},
+		{"a/+/c", "a/b/+", true},
+		{"+", "a/b", false},
+		{"+/+", "a/#", true},
+		{"$SYS/#", "#", false},
+		{"$SYS/#", "+/uptime", false},
+		{"#", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/+", true},
+	}
+
+	for _, tx := range tt {
+		require.Equal(t, tx.want, filtersOverlap(tx.a, tx.b), "%s %s", tx.a, tx.b)
+		require.Equal(t, tx.want, filtersOverlap(tx.b, tx.a), "%s %s", tx.b, tx.a)
+	}
+}
+
+func TestSubstitutePattern(t *testing.T) {
+	f, ok := substitutePattern("a/%u/%c/%u", "cl", "us")
+	require.True(t, ok)
+	require.Equal(t, "a/us/cl/us", f)
+
+	_, ok = substitutePattern("a/%u", "cl", "")
+	require.False(t, ok)
+
+	_, ok = substitutePattern("a/%u", "cl", "u+")
+	require.False(t, ok)
+
+	f, ok = substitutePattern("a/b", "", "")
+	require.True(t, ok)
+	require.Equal(t, "a/b", f)
+}
+
+func TestParseACLFile(t *testing.T) {
+	acl, err := parseACLFile([]byte(testACLFile + "user empty\n"))
+	require.NoError(t, err)
+	require.Equal(t, []aclRule{{topic: "public/#", access: accessRead}}, acl.anonymous)
+	require.Equal(t, []aclRule{
+		{topic: "devices/mochi/#", access: accessRead | accessWrite},
+		{topic: "devices/mochi/secret", access: accessDeny},
+		{topic: "commands/+", access: accessRead},
+	}, acl.users["mochi"])
+	require.Equal(t, []aclRule{}, acl.users["empty"])
+	require.Len(t, acl.patterns, 2)
+
+	acl, err = parseACLFile([]byte("topic a b/c"))
+	require.NoError(t, err)
+	require.Equal(t, []aclRule{{topic: "a b/c", access: accessRead | accessWrite}}, acl.anonymous)
+
+	for _, in := range []string{"user", "topic", "topic read", "other a/b"} {
+		_, err = parseACLFile([]byte(in))
+		require.Error(t, err, in)
+	}
+}
+
+func TestFileReload(t *testing.T) {
+	a := newTestFile(t, FileOptions{})
+	require.False(t, a.Authenticate([]byte("new"), []byte("mochi")))
+
+	require.NoError(t, ioutil.WriteFile(a.opts.PasswordFile, []byte(testPasswordFile+"new:"+bcryptVectors[0].hash), 0600))
+	require.NoError(t, a.Reload())
+	require.True(t, a.Authenticate([]byte("new"), []byte("U*U")))
+
+	// invalid files are not loaded.
+	require.NoError(t, ioutil.WriteFile(a.opts.ACLFile, []byte("invalid"), 0600))
+	require.Error(t, a.Reload())
+	require.True(t, a.ACL([]byte("mochi"), "devices/mochi/temp", true))
+}
+
+func TestFileWatch(t *testing.T) {
+	a := newTestFile(t, FileOptions{WatchInterval: time.Millisecond})
+	require.False(t, a.Authenticate([]byte("new"), []byte("U*U")))
+
+	require.NoError(t, ioutil.WriteFile(a.opts.PasswordFile, []byte("new:"+bcryptVectors[0].hash), 0600))
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(a.opts.PasswordFile, future, future))
+
+	require.Eventually(t, func() bool {
+		return a.Authenticate([]byte("new"), []byte("U*U"))
+	}, time.Second, time.Millisecond)
+}
+
+func TestFileChanged(t *testing.T) {
+	a := newTestFile(t, FileOptions{})
+	require.False(t, a.changed())
+
+	require.NoError(t, os.Remove(a.opts.ACLFile))
+	require.False(t, a.changed())
+
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(a.opts.PasswordFile, past, past))
+	require.True(t, a.changed())
+}
+
+func BenchmarkFileACL(b *testing.B) {
+	acl, _ := parseACLFile([]byte(testACLFile))
+	a := &File{acl: acl}
+	for n := 0; n < b.N; n++ {
+		a.ACL([]byte("mochi"), "devices/mochi/temp", true)
+	}
+}
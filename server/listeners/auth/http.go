@@ -0,0 +1,335 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultHTTPTimeout is the default timeout of a single auth request.
+	defaultHTTPTimeout = 5 * time.Second
+
+	// defaultHTTPCacheSize is the default maximum number of cached results.
+	defaultHTTPCacheSize = 10000
+
+	// maxHTTPResponseSize is the maximum number of response body bytes read.
+	maxHTTPResponseSize = 4096
+)
+
+// Results which may be returned by an HTTP auth endpoint.
+const (
+	ResultAllow  = "allow"  // access is granted.
+	ResultDeny   = "deny"   // access is refused.
+	ResultIgnore = "ignore" // no decision is made, and the fallback is used.
+)
+
+// Access types sent to the HTTP ACL endpoint.
+const (
+	AccessPublish   = "publish"   // the client is publishing to the topic.
+	AccessSubscribe = "subscribe" // the client is subscribing to the topic filter.
+)
+
+// HTTPOptions contains configuration settings for the HTTP auth controller.
+type HTTPOptions struct {
+	// AuthURL is the endpoint called to authenticate connecting clients. If
+	// empty, the fallback decision is used.
+	AuthURL string
+
+	// ACLURL is the endpoint called to check topic access. If empty, the
+	// fallback decision is used.
+	ACLURL string
+
+	// JSON sends requests as a JSON object instead of a url-encoded form.
+	JSON bool
+
+	// Timeout is the timeout of a single request, used if Client is nil.
+	Timeout time.Duration
+
+	// Fallback is the decision used when an endpoint is not configured, fails,
+	// times out, or responds with ignore.
+	Fallback bool
+
+	// AuthTTL is how long authentication results are cached. If 0, results are
+	// not cached.
+	AuthTTL time.Duration
+
+	// ACLTTL is how long ACL results are cached. If 0, results are not cached.
+	ACLTTL time.Duration
+
+	// CacheSize is the maximum number of cached results.
+	CacheSize int
+
+	// Client is the http client used to send requests.
+	Client *http.Client
+}
+
+// HTTPRequest is the body of a request sent to the HTTP auth endpoints.
+type HTTPRequest struct {
+	Username string `json:"username"`           // the username of the client.
+	Password string `json:"password,omitempty"` // the password of the client, for authentication.
+	ClientID string `json:"clientid,omitempty"` // the id of the client, if known.
+	Topic    string `json:"topic,omitempty"`    // the topic or filter, for ACL checks.
+	Access   string `json:"access,omitempty"`   // the access type, for ACL checks.
+}
+
+// httpResponse is a JSON response body from an HTTP auth endpoint.
+type httpResponse struct {
+	Result string `json:"result"`
+}
+
+// httpCacheEntry is a cached HTTP auth result.
+type httpCacheEntry struct {
+	allow   bool      // the cached decision.
+	expires time.Time // the time the entry expires.
+}
+
+// HTTP is an auth controller which authenticates clients and checks topic
+// access by calling HTTP endpoints. An endpoint grants access with a 2xx
+// response with an empty body, or a body of "allow" or {"result":"allow"}. A
+// 401 or 403 response, or a body of "deny", refuses access. A body of "ignore",
+// any other response, or a failed request uses the fallback decision.
+type HTTP struct {
+	sync.Mutex
+	opts  HTTPOptions               // configuration settings for the controller.
+	cache map[string]httpCacheEntry // cached results, keyed on request values.
+	now   func() time.Time          // the clock used to expire cached results.
+}
+
+// NewHTTP returns a new HTTP auth controller.
+func NewHTTP(opts HTTPOptions) *HTTP {
+	if opts.CacheSize <= 0 {
+		opts.CacheSize = defaultHTTPCacheSize
+	}
+
+	if opts.Client == nil {
+		if opts.Timeout <= 0 {
+			opts.Timeout = defaultHTTPTimeout
+		}
+		opts.Client = &http.Client{
+			Timeout: opts.Timeout,
+		}
+	}
+
+	return &HTTP{
+		opts:  opts,
+		cache: make(map[string]httpCacheEntry),
+		now:   time.Now,
+	}
+}
+
+// Authenticate returns true if the auth endpoint accepts a username and password.
+func (a *HTTP) Authenticate(user, password []byte) bool {
+	return a.authenticate("", user, password)
+}
+
+// ACL returns true if the ACL endpoint grants a user read or write access to a topic.
+func (a *HTTP) ACL(user []byte, topic string, write bool) bool {
+	return a.acl("", user, topic, write)
+}
+
+// AuthenticateClient returns true if the auth endpoint accepts the username and
+// password of a client, sending the client id.
+func (a *HTTP) AuthenticateClient(cl Client, password []byte) bool {
+	return a.authenticate(cl.ID, cl.Username, password)
+}
+
+// ClientACL returns true if the ACL endpoint grants a client access to a topic,
+// sending the client id.
+func (a *HTTP) ClientACL(cl Client, access Access) bool {
+	return a.acl(cl.ID, cl.Username, access.Topic, access.Write)
+}
+
+// authenticate checks a username and password of a client with the auth endpoint.
+func (a *HTTP) authenticate(clientID string, user, password []byte) bool {
+	sum := sha256.Sum256(password)
+	key := "auth\x00" + clientID + "\x00" + string(user) + "\x00" + string(sum[:])
+
+	return a.decide(a.opts.AuthURL, a.opts.AuthTTL, key, HTTPRequest{
+		Username: string(user),
+		Password: string(password),
+		ClientID: clientID,
+	})
+}
+
+// acl checks the topic access of a client with the ACL endpoint.
+func (a *HTTP) acl(clientID string, user []byte, topic string, write bool) bool {
+	access := AccessSubscribe
+	if write {
+		access = AccessPublish
+	}
+
+	key := "acl\x00" + clientID + "\x00" + string(user) + "\x00" + topic + "\x00" + access
+
+	return a.decide(a.opts.ACLURL, a.opts.ACLTTL, key, HTTPRequest{
+		Username: string(user),
+		ClientID: clientID,
+		Topic:    topic,
+		Access:   access,
+	})
+}
+
+// decide returns a cached decision, or requests a new decision from an endpoint.
+// Only allow and deny results are cached.
+func (a *HTTP) decide(endpoint string, ttl time.Duration, key string, req HTTPRequest) bool {
+	if endpoint == "" {
+		return a.opts.Fallback
+	}
+
+	if ttl > 0 {
+		if allow, ok := a.cached(key); ok {
+			return allow
+		}
+	}
+
+	switch a.request(endpoint, req) {
+	case ResultAllow:
+		a.store(key, true, ttl)
+		return true
+	case ResultDeny:
+		a.store(key, false, ttl)
+		return false
+	default:
+		return a.opts.Fallback
+	}
+}
+
+// request sends a request to an endpoint and returns the result.
+func (a *HTTP) request(endpoint string, req HTTPRequest) string {
+	var body io.Reader
+	var contentType string
+	if a.opts.JSON {
+		b, err := json.Marshal(req)
+		if err != nil {
+			return ResultIgnore
+		}
+		body = bytes.NewReader(b)
+		contentType = "application/json"
+	} else {
+		form := url.Values{}
+		form.Set("username", req.Username)
+		if req.Password != "" {
+			form.Set("password", req.Password)
+		}
+		if req.ClientID != "" {
+			form.Set("clientid", req.ClientID)
+		}
+		if req.Topic != "" {
+			form.Set("topic", req.Topic)
+			form.Set("access", req.Access)
+		}
+		body = strings.NewReader(form.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	}
+
+	hreq, err := http.NewRequest(http.MethodPost, endpoint, body)
+	if err != nil {
+		return ResultIgnore
+	}
+	hreq.Header.Set("Content-Type", contentType)
+
+	resp, err := a.opts.Client.Do(hreq)
+	if err != nil {
+		return ResultIgnore
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		return ResultDeny
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return ResultIgnore
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHTTPResponseSize))
+	if err != nil {
+		return ResultIgnore
+	}
+
+	return parseHTTPResult(b)
+}
+
+// parseHTTPResult returns the result contained in a successful response body.
+func parseHTTPResult(b []byte) string {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return ResultAllow
+	}
+
+	result := string(b)
+	if b[0] == '{' {
+		var resp httpResponse
+		if err := json.Unmarshal(b, &resp); err != nil {
+			return ResultIgnore
+		}
+		result = resp.Result
+	}
+
+	switch result = strings.ToLower(strings.TrimSpace(result)); result {
+	case ResultAllow, ResultDeny:
+		return result
+	default:
+		return ResultIgnore
+	}
+}
+
+// cached returns a cached decision, if one exists and has not expired.
+func (a *HTTP) cached(key string) (allow, ok bool) {
+	a.Lock()
+	defer a.Unlock()
+
+	entry, ok := a.cache[key]
+	if !ok {
+		return false, false
+	}
+
+	if !a.now().Before(entry.expires) {
+		delete(a.cache, key)
+		return false, false
+	}
+
+	return entry.allow, true
+}
+
+// store caches a decision for a duration. If the cache is full, expired entries
+// are removed, and if it is still full, the cache is cleared.
+func (a *HTTP) store(key string, allow bool, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	now := a.now()
+	if len(a.cache) >= a.opts.CacheSize {
+		for k, entry := range a.cache {
+			if !now.Before(entry.expires) {
+				delete(a.cache, k)
+			}
+		}
+
+		if len(a.cache) >= a.opts.CacheSize {
+			a.cache = make(map[string]httpCacheEntry)
+		}
+	}
+
+	a.cache[key] = httpCacheEntry{
+		allow:   allow,
+		expires: now.Add(ttl),
+	}
+}
+
+// Flush removes all cached results.
+func (a *HTTP) Flush() {
+	a.Lock()
+	a.cache = make(map[string]httpCacheEntry)
+	a.Unlock()
+}
@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// authEndpoint is a test auth endpoint which records requests and responds
+// using a handler function.
+type authEndpoint struct {
+	sync.Mutex
+	requests []HTTPRequest
+	calls    int64
+	respond  func(w http.ResponseWriter, req HTTPRequest)
+}
+
+func (e *authEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&e.calls, 1)
+
+	var req HTTPRequest
+	if r.Header.Get("Content-Type") == "application/json" {
+		json.NewDecoder(r.Body).Decode(&req)
+	} else {
+		r.ParseForm()
+		req = HTTPRequest{
+			Username: r.PostForm.Get("username"),
+			Password: r.PostForm.Get("password"),
+			ClientID: r.PostForm.Get("clientid"),
+			Topic:    r.PostForm.Get("topic"),
+			Access:   r.PostForm.Get("access"),
+		}
+	}
+
+	e.Lock()
+	e.requests = append(e.requests, req)
+	e.Unlock()
+
+	e.respond(w, req)
+}
+
+func newAuthEndpoint(respond func(w http.ResponseWriter, req HTTPRequest)) (*authEndpoint, *httptest.Server) {
+	e := &authEndpoint{respond: respond}
+	return e, httptest.NewServer(e)
+}
+
+func TestNewHTTP(t *testing.T) {
+	a := NewHTTP(HTTPOptions{})
+	require.Equal(t, defaultHTTPTimeout, a.opts.Client.Timeout)
+	require.Equal(t, defaultHTTPCacheSize, a.opts.CacheSize)
+	require.NotNil(t, a.cache)
+}
+
+func TestHTTPAuthenticateForm(t *testing.T) {
+	e, ts := newAuthEndpoint(func(w http.ResponseWriter, req HTTPRequest) {
+		if req.Password != "pass" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	})
+	defer ts.Close()
+
+	a := NewHTTP(HTTPOptions{AuthURL: ts.URL, Fallback: true})
+	require.True(t, a.Authenticate([]byte("user"), []byte("pass")))
+	require.False(t, a.Authenticate([]byte("user"), []byte("wrong")))
+	require.Equal(t, HTTPRequest{Username: "user", Password: "pass"}, e.requests[0])
+}
+
+func TestHTTPAuthenticateJSON(t *testing.T) {
+	e, ts := newAuthEndpoint(func(w http.ResponseWriter, req HTTPRequest) {
+		w.Write([]byte(`{"result":"deny"}`))
+	})
+	defer ts.Close()
+
+	a := NewHTTP(HTTPOptions{AuthURL: ts.URL, JSON: true, Fallback: true})
+	require.False(t, a.authenticate("mochi", []byte("user"), []byte("pass")))
+	require.Equal(t, HTTPRequest{Username: "user", Password: "pass", ClientID: "mochi"}, e.requests[0])
+}
+
+func TestHTTPACL(t *testing.T) {
+	e, ts := newAuthEndpoint(func(w http.ResponseWriter, req HTTPRequest) {
+		if req.Access == AccessPublish {
+			w.Write([]byte("deny"))
+			return
+		}
+		w.Write([]byte("allow"))
+	})
+	defer ts.Close()
+
+	a := NewHTTP(HTTPOptions{ACLURL: ts.URL})
+	require.True(t, a.ACL([]byte("user"), "a/b/c", false))
+	require.False(t, a.ACL([]byte("user"), "a/b/c", true))
+	require.Equal(t, HTTPRequest{Username: "user", Topic: "a/b/c", Access: AccessSubscribe}, e.requests[0])
+	require.Equal(t, HTTPRequest{Username: "user", Topic: "a/b/c", Access: AccessPublish}, e.requests[1])
+}
+
+func TestHTTPClient(t *testing.T) {
+	e, ts := newAuthEndpoint(func(w http.ResponseWriter, req HTTPRequest) {
+		w.Write([]byte("allow"))
+	})
+	defer ts.Close()
+
+	a := NewHTTP(HTTPOptions{AuthURL: ts.URL, ACLURL: ts.URL})
+	cl := Client{ID: "mochi", Username: []byte("user")}
+	require.True(t, a.AuthenticateClient(cl, []byte("pass")))
+	require.True(t, a.ClientACL(cl, Access{Topic: "a/b/c", Write: true}))
+	require.Equal(t, HTTPRequest{Username: "user", Password: "pass", ClientID: "mochi"}, e.requests[0])
+	require.Equal(t, HTTPRequest{Username: "user", ClientID: "mochi", Topic: "a/b/c", Access: AccessPublish}, e.requests[1])
+}
+
+func TestHTTPFallback(t *testing.T) {
+	_, ts := newAuthEndpoint(func(w http.ResponseWriter, req HTTPRequest) {
+		switch req.Username {
+		case "ignore":
+			w.Write([]byte(`{"result":"ignore"}`))
+		case "error":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "slow":
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+	defer ts.Close()
+
+	for _, fallback := range []bool{true, false} {
+		a := NewHTTP(HTTPOptions{AuthURL: ts.URL, Timeout: 10 * time.Millisecond, Fallback: fallback})
+		require.Equal(t, fallback, a.Authenticate([]byte("ignore"), nil))
+		require.Equal(t, fallback, a.Authenticate([]byte("error"), nil))
+		require.Equal(t, fallback, a.Authenticate([]byte("slow"), nil))
+		require.Equal(t, fallback, a.ACL([]byte("user"), "a/b/c", true))
+	}
+
+	a := NewHTTP(HTTPOptions{AuthURL: "://invalid", Fallback: true})
+	require.True(t, a.Authenticate([]byte("user"), nil))
+}
+
+func TestHTTPCache(t *testing.T) {
+	e, ts := newAuthEndpoint(func(w http.ResponseWriter, req HTTPRequest) {
+		if req.Topic == "ignore" {
+			w.Write([]byte("ignore"))
+		}
+	})
+	defer ts.Close()
+
+	now := time.Now()
+	a := NewHTTP(HTTPOptions{ACLURL: ts.URL, AuthURL: ts.URL, ACLTTL: time.Minute})
+	a.now = func() time.Time { return now }
+
+	require.True(t, a.ACL([]byte("user"), "a/b/c", true))
+	require.True(t, a.ACL([]byte("user"), "a/b/c", true))
+	require.Equal(t, int64(1), atomic.LoadInt64(&e.calls))
+
+	require.True(t, a.ACL([]byte("user"), "a/b/c", false))
+	require.Equal(t, int64(2), atomic.LoadInt64(&e.calls))
+
+	// ignored results are not cached.
+	a.ACL([]byte("user"), "ignore", true)
+	a.ACL([]byte("user"), "ignore", true)
+	require.Equal(t, int64(4), atomic.LoadInt64(&e.calls))
+
+	// auth results are not cached without a ttl.
+	a.Authenticate([]byte("user"), []byte("pass"))
+	a.Authenticate([]byte("user"), []byte("pass"))
+	require.Equal(t, int64(6), atomic.LoadInt64(&e.calls))
+
+	now = now.Add(time.Minute)
+	require.True(t, a.ACL([]byte("user"), "a/b/c", true))
+	require.Equal(t, int64(7), atomic.LoadInt64(&e.calls))
+
+	a.Flush()
+	require.True(t, a.ACL([]byte("user"), "a/b/c", true))
+	require.Equal(t, int64(8), atomic.LoadInt64(&e.calls))
+}
+
+func TestHTTPCacheFull(t *testing.T) {
+	now := time.Now()
+	a := NewHTTP(HTTPOptions{CacheSize: 2})
+	a.now = func() time.Time { return now }
+
+	a.store("a", true, time.Second)
+	a.store("b", true, time.Minute)
+	now = now.Add(time.Second)
+	a.store("c", true, time.Minute)
+	require.Len(t, a.cache, 2)
+	require.Contains(t, a.cache, "b")
+
+	a.store("d", true, time.Minute)
+	require.Len(t, a.cache, 1)
+	require.Contains(t, a.cache, "d")
+
+	a.store("e", true, 0)
+	require.Len(t, a.cache, 1)
+}
+
+func TestHTTPNoURLs(t *testing.T) {
+	a := NewHTTP(HTTPOptions{Fallback: true})
+	require.True(t, a.Authenticate([]byte("user"), []byte("pass")))
+	require.True(t, a.ACL([]byte("user"), "a/b/c", true))
+}
+
+func TestParseHTTPResult(t *testing.T) {
+	tt := map[string]string{
+		"":                     ResultAllow,
+		"allow":                ResultAllow,
+		" DENY\n":              ResultDeny,
+		"ignore":               ResultIgnore,
+		"other":                ResultIgnore,
+		`{"result":"allow"}`:   ResultAllow,
+		`{"result":"deny"}`:    ResultDeny,
+		`{"result":"ignore"}`:  ResultIgnore,
+		`{"result":"allow"`:    ResultIgnore,
+		`{"something":"else"}`: ResultIgnore,
+	}
+
+	for in, want := range tt {
+		require.Equal(t, want, parseHTTPResult([]byte(in)), in)
+	}
+}
+
+func BenchmarkHTTPACLCached(b *testing.B) {
+	_, ts := newAuthEndpoint(func(w http.ResponseWriter, req HTTPRequest) {})
+	defer ts.Close()
+
+	a := NewHTTP(HTTPOptions{ACLURL: ts.URL, ACLTTL: time.Hour})
+	for n := 0; n < b.N; n++ {
+		a.ACL([]byte("user"), "a/b/c", true)
+	}
+}
@@ -0,0 +1,544 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultPublishClaim is the default claim containing publish topic filters.
+	defaultPublishClaim = "publish"
+
+	// defaultSubscribeClaim is the default claim containing subscribe topic filters.
+	defaultSubscribeClaim = "subscribe"
+)
+
+var (
+	// ErrJWTMalformed indicates a token could not be decoded.
+	ErrJWTMalformed = errors.New("malformed jwt")
+
+	// ErrJWTUnsupportedAlg indicates a token was signed with an unsupported algorithm.
+	ErrJWTUnsupportedAlg = errors.New("unsupported jwt signing algorithm")
+
+	// ErrJWTSignature indicates a token signature could not be verified by any key.
+	ErrJWTSignature = errors.New("invalid jwt signature")
+
+	// ErrJWTExpired indicates a token has expired.
+	ErrJWTExpired = errors.New("jwt has expired")
+
+	// ErrJWTNotYetValid indicates a token is not valid until a later time.
+	ErrJWTNotYetValid = errors.New("jwt is not yet valid")
+
+	// ErrJWTAudience indicates a token was not issued for the configured audience.
+	ErrJWTAudience = errors.New("jwt audience mismatch")
+
+	// ErrJWKSInvalid indicates a JWKS file contained an invalid key.
+	ErrJWKSInvalid = errors.New("invalid jwks key")
+)
+
+// JWTOptions contains configuration settings for the JWT auth controller.
+type JWTOptions struct {
+	// Secret is the shared secret used to verify HS256 tokens.
+	Secret []byte
+
+	// Keys are *rsa.PublicKey and *ecdsa.PublicKey keys used to verify RS256 and
+	// ES256 tokens.
+	Keys []crypto.PublicKey
+
+	// JWKSFile is the path of a JSON Web Key Set file containing RSA, EC (P-256)
+	// and oct keys used to verify tokens. The file is loaded by NewJWT, and again
+	// when Reload is called.
+	JWKSFile string
+
+	// Audience, if set, must be present in the aud claim of a token.
+	Audience string
+
+	// Leeway is the allowed clock skew when checking the exp and nbf claims.
+	Leeway time.Duration
+
+	// UsernameClaim, if set, is a claim which must be equal to the username.
+	UsernameClaim string
+
+	// PublishClaim is the claim containing the topic filters a client may
+	// publish to. Defaults to "publish".
+	PublishClaim string
+
+	// SubscribeClaim is the claim containing the topic filters a client may
+	// subscribe to. Defaults to "subscribe".
+	SubscribeClaim string
+}
+
+// jwtKey is a key which may verify token signatures.
+type jwtKey struct {
+	kid string      // the key id, if any.
+	key interface{} // a []byte secret, *rsa.PublicKey, or *ecdsa.PublicKey.
+}
+
+// jwtHeader is the decoded header of a token.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtGrant contains the topic allowances granted to a client connection by a token.
+type jwtGrant struct {
+	publish   []string  // topic filters the client may publish to.
+	subscribe []string  // topic filters the client may subscribe to.
+	expires   time.Time // the time the token expires, or zero if it does not.
+}
+
+// JWT is an auth controller which authenticates clients using a JSON Web Token
+// passed as the password, and grants publish and subscribe access to the topic
+// filters listed in the token claims. HS256, RS256 and ES256 tokens are
+// supported. Grants are stored against the connection of each client and are
+// dropped when the client disconnects, so the ACL methods of Controller, which
+// do not identify a connection, always deny access.
+type JWT struct {
+	sync.RWMutex
+	opts   JWTOptions          // configuration settings for the controller.
+	keys   []jwtKey            // the static and jwks keys used to verify tokens.
+	grants map[string]jwtGrant // topic allowances, keyed on client connection id.
+	now    func() time.Time    // the clock used to validate token times.
+}
+
+// NewJWT returns a new JWT auth controller, loading the JWKS file if configured.
+func NewJWT(opts JWTOptions) (*JWT, error) {
+	if opts.PublishClaim == "" {
+		opts.PublishClaim = defaultPublishClaim
+	}
+
+	if opts.SubscribeClaim == "" {
+		opts.SubscribeClaim = defaultSubscribeClaim
+	}
+
+	a := &JWT{
+		opts:   opts,
+		grants: make(map[string]jwtGrant),
+		now:    time.Now,
+	}
+
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Reload replaces the verification keys with the configured keys and the current
+// contents of the JWKS file.
+func (a *JWT) Reload() error {
+	var keys []jwtKey
+	if len(a.opts.Secret) > 0 {
+		keys = append(keys, jwtKey{key: a.opts.Secret})
+	}
+
+	for _, k := range a.opts.Keys {
+		switch k.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+			keys = append(keys, jwtKey{key: k})
+		default:
+			return fmt.Errorf("%w: unsupported key type %T", ErrJWKSInvalid, k)
+		}
+	}
+
+	if a.opts.JWKSFile != "" {
+		b, err := ioutil.ReadFile(a.opts.JWKSFile)
+		if err != nil {
+			return err
+		}
+
+		jwks, err := parseJWKS(b)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, jwks...)
+	}
+
+	a.Lock()
+	a.keys = keys
+	a.Unlock()
+
+	return nil
+}
+
+// Authenticate returns true if the password is a valid token for the username.
+// No topic allowances are stored, as the client connection is not known.
+func (a *JWT) Authenticate(user, password []byte) bool {
+	_, ok := a.verifyUser(user, password)
+	return ok
+}
+
+// ACL always returns false, as topic allowances are only granted to client
+// connections authenticated with AuthenticateClient.
+func (a *JWT) ACL(user []byte, topic string, write bool) bool {
+	return false
+}
+
+// AuthenticateClient returns true if the password is a valid token for the
+// username of a client, storing the topic allowances granted by the token
+// against the connection of the client.
+func (a *JWT) AuthenticateClient(cl Client, password []byte) bool {
+	claims, ok := a.verifyUser(cl.Username, password)
+	if !ok {
+		return false
+	}
+
+	if cl.ConnID == "" {
+		return true
+	}
+
+	exp, _ := claimTime(claims, "exp")
+	a.Lock()
+	a.grants[cl.ConnID] = jwtGrant{
+		publish:   claimStrings(claims, a.opts.PublishClaim),
+		subscribe: claimStrings(claims, a.opts.SubscribeClaim),
+		expires:   exp,
+	}
+	a.Unlock()
+
+	return true
+}
+
+// ClientACL returns true if the token the client connection authenticated with
+// grants publish (write) or subscribe access to a topic, and has not expired.
+func (a *JWT) ClientACL(cl Client, access Access) bool {
+	if cl.ConnID == "" {
+		return false
+	}
+
+	a.RLock()
+	grant, ok := a.grants[cl.ConnID]
+	a.RUnlock()
+	if !ok {
+		return false
+	}
+
+	if !grant.expires.IsZero() && !a.now().Before(grant.expires.Add(a.opts.Leeway)) {
+		return false
+	}
+
+	filters := grant.subscribe
+	if access.Write {
+		filters = grant.publish
+	}
+
+	for _, filter := range filters {
+		if FilterCovers(filter, access.Topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ClientDisconnected drops the topic allowances of a client connection.
+func (a *JWT) ClientDisconnected(cl Client) {
+	a.Lock()
+	delete(a.grants, cl.ConnID)
+	a.Unlock()
+}
+
+// verifyUser verifies a token and checks the username claim, returning the
+// claims of the token if it is valid for the username.
+func (a *JWT) verifyUser(user, password []byte) (map[string]interface{}, bool) {
+	claims, err := a.Verify(string(password))
+	if err != nil {
+		return nil, false
+	}
+
+	if a.opts.UsernameClaim != "" {
+		if v, ok := claims[a.opts.UsernameClaim].(string); !ok || v != string(user) {
+			return nil, false
+		}
+	}
+
+	return claims, true
+}
+
+// ClientExpiry returns the time the token a client connection authenticated
+// with expires, after which the client is disconnected. The zero time is
+// returned if the token does not expire or the connection is not known.
+func (a *JWT) ClientExpiry(cl Client) time.Time {
+	a.RLock()
+	grant, ok := a.grants[cl.ConnID]
+	a.RUnlock()
+	if !ok || grant.expires.IsZero() {
+		return time.Time{}
+	}
+
+	return grant.expires.Add(a.opts.Leeway)
+}
+
+// Verify checks the signature, exp, nbf and aud claims of a token, returning
+// the decoded claims if the token is valid.
+func (a *JWT) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrJWTMalformed
+	}
+
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrJWTMalformed
+	}
+
+	if err := a.verifySignature(header, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	now := a.now()
+	if exp, ok := claimTime(claims, "exp"); ok && !now.Before(exp.Add(a.opts.Leeway)) {
+		return nil, ErrJWTExpired
+	}
+
+	if nbf, ok := claimTime(claims, "nbf"); ok && now.Add(a.opts.Leeway).Before(nbf) {
+		return nil, ErrJWTNotYetValid
+	}
+
+	if a.opts.Audience != "" && !inStrings(claimStrings(claims, "aud"), a.opts.Audience) {
+		return nil, ErrJWTAudience
+	}
+
+	return claims, nil
+}
+
+// verifySignature verifies the signature of a token with any key suitable for
+// the algorithm, preferring keys matching the key id of the token.
+func (a *JWT) verifySignature(header jwtHeader, signed, sig []byte) error {
+	switch header.Alg {
+	case "HS256", "RS256", "ES256":
+	default:
+		return ErrJWTUnsupportedAlg
+	}
+
+	a.RLock()
+	keys := a.keys
+	a.RUnlock()
+
+	hash := sha256.Sum256(signed)
+	for _, k := range keys {
+		if header.Kid != "" && k.kid != "" && header.Kid != k.kid {
+			continue
+		}
+
+		var ok bool
+		switch header.Alg {
+		case "HS256":
+			if secret, is := k.key.([]byte); is {
+				mac := hmac.New(sha256.New, secret)
+				mac.Write(signed)
+				ok = hmac.Equal(sig, mac.Sum(nil))
+			}
+		case "RS256":
+			if pub, is := k.key.(*rsa.PublicKey); is {
+				ok = rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], sig) == nil
+			}
+		case "ES256":
+			if pub, is := k.key.(*ecdsa.PublicKey); is && pub.Curve == elliptic.P256() && len(sig) == 64 {
+				r := new(big.Int).SetBytes(sig[:32])
+				s := new(big.Int).SetBytes(sig[32:])
+				ok = ecdsa.Verify(pub, hash[:], r, s)
+			}
+		}
+
+		if ok {
+			return nil
+		}
+	}
+
+	return ErrJWTSignature
+}
+
+// decodeJWTPart decodes a base64url encoded JSON part of a token.
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return ErrJWTMalformed
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return ErrJWTMalformed
+	}
+
+	return nil
+}
+
+// claimTime returns a numeric date claim as a time.
+func claimTime(claims map[string]interface{}, name string) (time.Time, bool) {
+	v, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	sec := int64(v)
+	return time.Unix(sec, int64((v-float64(sec))*float64(time.Second))), true
+}
+
+// claimStrings returns a claim which may be a string or an array of strings.
+func claimStrings(claims map[string]interface{}, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	default:
+		return nil
+	}
+}
+
+// inStrings returns true if a string is in a slice.
+func inStrings(sl []string, s string) bool {
+	for _, v := range sl {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// jwk is a JSON Web Key.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// parseJWKS parses the RSA, EC and oct keys of a JSON Web Key Set.
+func parseJWKS(b []byte) ([]jwtKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrJWKSInvalid, err)
+	}
+
+	keys := make([]jwtKey, 0, len(set.Keys))
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("%w: kid %q: %s", ErrJWKSInvalid, k.Kid, err)
+		}
+		keys = append(keys, jwtKey{kid: k.Kid, key: key})
+	}
+
+	return keys, nil
+}
+
+// publicKey returns the verification key of a JSON Web Key.
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeJWKInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil || len(secret) == 0 {
+			return nil, errors.New("invalid secret")
+		}
+		return secret, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// decodeJWKInt decodes a base64url encoded big-endian integer.
+func decodeJWKInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// FilterCovers returns true if every topic matched by filter b is also matched
+// by filter a. A topic name is a filter which matches only itself, so FilterCovers
+// also reports whether a filter matches a topic. Per [MQTT-4.7.2-1], wildcards
+// in the first level of a do not match topics beginning with $.
+func FilterCovers(a, b string) bool {
+	if strings.HasPrefix(b, "$") && (strings.HasPrefix(a, "+") || strings.HasPrefix(a, "#")) {
+		return false
+	}
+
+	ap := strings.Split(a, "/")
+	bp := strings.Split(b, "/")
+	for i, p := range ap {
+		if p == "#" {
+			return true
+		}
+
+		if i >= len(bp) {
+			return false
+		}
+
+		switch p {
+		case "+":
+			if bp[i] == "#" {
+				return false
+			}
+		default:
+			if p != bp[i] {
+				return false
+			}
+		}
+	}
+
+	return len(ap) == len(bp)
+}
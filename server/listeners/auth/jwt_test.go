@@ -0,0 +1,400 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testRSAKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	testECKey, _  = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testSecret    = []byte("secret")
+)
+
+// signJWT returns a token with the given header values and claims, signed with
+// a []byte secret, *rsa.PrivateKey or *ecdsa.PrivateKey.
+func signJWT(t testing.TB, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hash[:])
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, hash[:])
+		require.NoError(t, err)
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// writeJWKS writes a JWKS file containing the test rsa and ec public keys.
+func writeJWKS(t *testing.T, path string, keys ...map[string]string) {
+	b, err := json.Marshal(map[string]interface{}{"keys": keys})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, b, 0600))
+}
+
+func rsaJWK(kid string, k *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"n":   base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, k *ecdsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "EC",
+		"kid": kid,
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(k.X.Bytes()),
+		"y":   base64.RawURLEncoding.EncodeToString(k.Y.Bytes()),
+	}
+}
+
+func TestNewJWT(t *testing.T) {
+	a, err := NewJWT(JWTOptions{Secret: testSecret})
+	require.NoError(t, err)
+	require.Equal(t, defaultPublishClaim, a.opts.PublishClaim)
+	require.Equal(t, defaultSubscribeClaim, a.opts.SubscribeClaim)
+	require.Len(t, a.keys, 1)
+}
+
+func TestNewJWTBadKeys(t *testing.T) {
+	_, err := NewJWT(JWTOptions{Keys: []crypto.PublicKey{"invalid"}})
+	require.ErrorIs(t, err, ErrJWKSInvalid)
+
+	_, err = NewJWT(JWTOptions{JWKSFile: filepath.Join(t.TempDir(), "missing.json")})
+	require.Error(t, err)
+}
+
+func TestJWTVerifyAlgorithms(t *testing.T) {
+	a, err := NewJWT(JWTOptions{
+		Secret: testSecret,
+		Keys:   []crypto.PublicKey{&testRSAKey.PublicKey, &testECKey.PublicKey},
+	})
+	require.NoError(t, err)
+
+	claims := map[string]interface{}{"sub": "mochi"}
+	for alg, key := range map[string]interface{}{
+		"HS256": testSecret,
+		"RS256": testRSAKey,
+		"ES256": testECKey,
+	} {
+		c, err := a.Verify(signJWT(t, alg, "", key, claims))
+		require.NoError(t, err, alg)
+		require.Equal(t, "mochi", c["sub"])
+	}
+
+	otherEC, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, err = a.Verify(signJWT(t, "ES256", "", otherEC, claims))
+	require.ErrorIs(t, err, ErrJWTSignature)
+
+	_, err = a.Verify(signJWT(t, "HS256", "", []byte("wrong"), claims))
+	require.ErrorIs(t, err, ErrJWTSignature)
+
+	// a token claiming to be hmac signed with the public rsa key must fail.
+	_, err = a.Verify(signJWT(t, "HS256", "", testRSAKey.PublicKey.N.Bytes(), claims))
+	require.ErrorIs(t, err, ErrJWTSignature)
+
+	_, err = a.Verify(signJWT(t, "none", "", testSecret, claims))
+	require.ErrorIs(t, err, ErrJWTUnsupportedAlg)
+}
+
+func TestJWTVerifyMalformed(t *testing.T) {
+	a, err := NewJWT(JWTOptions{Secret: testSecret})
+	require.NoError(t, err)
+
+	for _, token := range []string{
+		"",
+		"a.b",
+		"!!.e30.e30",
+		"e30.!!.e30",
+		"e30.e30.!!",
+		"bm90IGpzb24.e30.e30",
+	} {
+		_, err := a.Verify(token)
+		require.Error(t, err, token)
+	}
+
+	token := signJWT(t, "HS256", "", testSecret, nil)
+	_, err = a.Verify(token[:len(token)-1] + "!")
+	require.ErrorIs(t, err, ErrJWTMalformed)
+}
+
+func TestJWTVerifyTimes(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	a, err := NewJWT(JWTOptions{Secret: testSecret, Leeway: time.Second})
+	require.NoError(t, err)
+	a.now = func() time.Time { return now }
+
+	_, err = a.Verify(signJWT(t, "HS256", "", testSecret, map[string]interface{}{"exp": 1000001}))
+	require.NoError(t, err)
+
+	_, err = a.Verify(signJWT(t, "HS256", "", testSecret, map[string]interface{}{"exp": 999999}))
+	require.ErrorIs(t, err, ErrJWTExpired)
+
+	_, err = a.Verify(signJWT(t, "HS256", "", testSecret, map[string]interface{}{"nbf": 1000001}))
+	require.NoError(t, err)
+
+	_, err = a.Verify(signJWT(t, "HS256", "", testSecret, map[string]interface{}{"nbf": 1000002}))
+	require.ErrorIs(t, err, ErrJWTNotYetValid)
+}
+
+func TestJWTVerifyAudience(t *testing.T) {
+	a, err := NewJWT(JWTOptions{Secret: testSecret, Audience: "mqtt"})
+	require.NoError(t, err)
+
+	_, err = a.Verify(signJWT(t, "HS256", "", testSecret, map[string]interface{}{"aud": "mqtt"}))
+	require.NoError(t, err)
+
+	_, err = a.Verify(signJWT(t, "HS256", "", testSecret, map[string]interface{}{"aud": []string{"web", "mqtt"}}))
+	require.NoError(t, err)
+
+	_, err = a.Verify(signJWT(t, "HS256", "", testSecret, map[string]interface{}{"aud": "web"}))
+	require.ErrorIs(t, err, ErrJWTAudience)
+
+	_, err = a.Verify(signJWT(t, "HS256", "", testSecret, nil))
+	require.ErrorIs(t, err, ErrJWTAudience)
+}
+
+func TestJWTJWKSReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, rsaJWK("rsa1", &testRSAKey.PublicKey))
+
+	a, err := NewJWT(JWTOptions{JWKSFile: path})
+	require.NoError(t, err)
+
+	ecToken := signJWT(t, "ES256", "ec1", testECKey, nil)
+	_, err = a.Verify(signJWT(t, "RS256", "rsa1", testRSAKey, nil))
+	require.NoError(t, err)
+	_, err = a.Verify(ecToken)
+	require.ErrorIs(t, err, ErrJWTSignature)
+
+	writeJWKS(t, path, ecJWK("ec1", &testECKey.PublicKey), map[string]string{
+		"kty": "oct",
+		"kid": "hs1",
+		"k":   base64.RawURLEncoding.EncodeToString(testSecret),
+	})
+	require.NoError(t, a.Reload())
+
+	_, err = a.Verify(ecToken)
+	require.NoError(t, err)
+	_, err = a.Verify(signJWT(t, "HS256", "hs1", testSecret, nil))
+	require.NoError(t, err)
+	_, err = a.Verify(signJWT(t, "HS256", "other", testSecret, nil))
+	require.ErrorIs(t, err, ErrJWTSignature)
+	_, err = a.Verify(signJWT(t, "RS256", "rsa1", testRSAKey, nil))
+	require.ErrorIs(t, err, ErrJWTSignature)
+
+	// a failed reload keeps the existing keys.
+	require.NoError(t, ioutil.WriteFile(path, []byte("{"), 0600))
+	require.ErrorIs(t, a.Reload(), ErrJWKSInvalid)
+	_, err = a.Verify(ecToken)
+	require.NoError(t, err)
+}
+
+func TestParseJWKSInvalid(t *testing.T) {
+	for _, k := range []map[string]string{
+		{"kty": "RSA", "n": "!!", "e": "AQAB"},
+		{"kty": "RSA", "n": "AQAB", "e": ""},
+		{"kty": "EC", "crv": "P-384"},
+		{"kty": "EC", "crv": "P-256", "x": "!!", "y": "AQAB"},
+		{"kty": "EC", "crv": "P-256", "x": "AQAB", "y": ""},
+		{"kty": "EC", "crv": "P-256", "x": "AQAB", "y": "AQAB"},
+		{"kty": "oct", "k": ""},
+		{"kty": "OKP"},
+	} {
+		b, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{k}})
+		_, err := parseJWKS(b)
+		require.ErrorIs(t, err, ErrJWKSInvalid, k)
+	}
+}
+
+func TestJWTAuthenticateACL(t *testing.T) {
+	a, err := NewJWT(JWTOptions{Secret: testSecret, UsernameClaim: "sub"})
+	require.NoError(t, err)
+
+	token := signJWT(t, "HS256", "", testSecret, map[string]interface{}{
+		"sub":       "mochi",
+		"publish":   []string{"devices/mochi/#"},
+		"subscribe": "commands/mochi/+",
+	})
+
+	cl := Client{ID: "client1", ConnID: "c1", Username: []byte("mochi")}
+	require.False(t, a.AuthenticateClient(Client{ConnID: "c2", Username: []byte("other")}, []byte(token)))
+	require.False(t, a.AuthenticateClient(cl, []byte("invalid")))
+	require.False(t, a.ClientACL(cl, Access{Topic: "devices/mochi/temp", Write: true}))
+
+	require.True(t, a.AuthenticateClient(cl, []byte(token)))
+	require.True(t, a.ClientACL(cl, Access{Topic: "devices/mochi/temp", Write: true}))
+	require.True(t, a.ClientACL(cl, Access{Topic: "devices/mochi", Write: true}))
+	require.False(t, a.ClientACL(cl, Access{Topic: "devices/other/temp", Write: true}))
+	require.False(t, a.ClientACL(cl, Access{Topic: "devices/mochi/temp"}))
+	require.True(t, a.ClientACL(cl, Access{Topic: "commands/mochi/reboot"}))
+	require.True(t, a.ClientACL(cl, Access{Topic: "commands/mochi/+"}))
+	require.False(t, a.ClientACL(cl, Access{Topic: "commands/mochi/#"}))
+	require.False(t, a.ClientACL(Client{ConnID: "c2", Username: []byte("mochi")}, Access{Topic: "devices/mochi/temp", Write: true}))
+
+	a.ClientDisconnected(cl)
+	require.False(t, a.ClientACL(cl, Access{Topic: "devices/mochi/temp", Write: true}))
+
+	var _ ClientController = a
+	var _ Disconnector = a
+}
+
+func TestJWTControllerMethods(t *testing.T) {
+	a, err := NewJWT(JWTOptions{Secret: testSecret, UsernameClaim: "sub"})
+	require.NoError(t, err)
+
+	token := signJWT(t, "HS256", "", testSecret, map[string]interface{}{
+		"sub":     "mochi",
+		"publish": "#",
+	})
+
+	require.True(t, a.Authenticate([]byte("mochi"), []byte(token)))
+	require.False(t, a.Authenticate([]byte("other"), []byte(token)))
+	require.False(t, a.ACL([]byte("mochi"), "a/b", true))
+	require.Same(t, a, Adapt(a))
+}
+
+func TestJWTGrantsPerConnection(t *testing.T) {
+	a, err := NewJWT(JWTOptions{Secret: testSecret})
+	require.NoError(t, err)
+
+	narrow := Client{ID: "narrow", ConnID: "c1", Username: []byte("mochi")}
+	require.True(t, a.AuthenticateClient(narrow, []byte(signJWT(t, "HS256", "", testSecret, map[string]interface{}{
+		"publish": "devices/mochi/#",
+	}))))
+
+	broad := Client{ID: "broad", ConnID: "c2", Username: []byte("mochi")}
+	require.True(t, a.AuthenticateClient(broad, []byte(signJWT(t, "HS256", "", testSecret, map[string]interface{}{
+		"publish": "#",
+	}))))
+
+	require.True(t, a.ClientACL(broad, Access{Topic: "admin/reboot", Write: true}))
+	require.False(t, a.ClientACL(narrow, Access{Topic: "admin/reboot", Write: true}))
+	require.True(t, a.ClientACL(narrow, Access{Topic: "devices/mochi/temp", Write: true}))
+
+	// Clients without a known connection are never granted access.
+	require.True(t, a.AuthenticateClient(Client{Username: []byte("mochi")}, []byte(signJWT(t, "HS256", "", testSecret, map[string]interface{}{
+		"publish": "#",
+	}))))
+	require.False(t, a.ClientACL(Client{Username: []byte("mochi")}, Access{Topic: "a/b", Write: true}))
+}
+
+func TestJWTACLExpired(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	a, err := NewJWT(JWTOptions{Secret: testSecret})
+	require.NoError(t, err)
+	a.now = func() time.Time { return now }
+
+	token := signJWT(t, "HS256", "", testSecret, map[string]interface{}{
+		"exp":     1000010,
+		"publish": "#",
+	})
+	cl := Client{ConnID: "c1", Username: []byte("mochi")}
+	require.True(t, a.AuthenticateClient(cl, []byte(token)))
+	require.True(t, a.ClientACL(cl, Access{Topic: "a/b", Write: true}))
+
+	now = now.Add(10 * time.Second)
+	require.False(t, a.ClientACL(cl, Access{Topic: "a/b", Write: true}))
+}
+
+func TestJWTClientExpiry(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	a, err := NewJWT(JWTOptions{Secret: testSecret, Leeway: time.Second})
+	require.NoError(t, err)
+	a.now = func() time.Time { return now }
+
+	cl := Client{ConnID: "c1"}
+	token := signJWT(t, "HS256", "", testSecret, map[string]interface{}{"exp": 1000010})
+	require.True(t, a.AuthenticateClient(cl, []byte(token)))
+	require.Equal(t, time.Unix(1000011, 0), a.ClientExpiry(cl))
+
+	// the expiry is dropped with the grant.
+	a.ClientDisconnected(cl)
+	require.True(t, a.ClientExpiry(cl).IsZero())
+
+	token = signJWT(t, "HS256", "", testSecret, nil)
+	require.True(t, a.AuthenticateClient(cl, []byte(token)))
+	require.True(t, a.ClientExpiry(cl).IsZero())
+	require.True(t, a.ClientExpiry(Client{ConnID: "c2"}).IsZero())
+
+	var _ Expirer = a
+}
+
+func TestFilterCovers(t *testing.T) {
+	tt := []struct {
+		a, b string
+		want bool
+	}{
+		{"a/b/c", "a/b/c", true},
+		{"a/b/c", "a/b", false},
+		{"a/b", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/+/c", "a/+/c", true},
+		{"a/+/c", "a/#", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a/+/#", true},
+		{"a/b/#", "a/#", false},
+		{"#", "a/b", true},
+		{"#", "$SYS/broker", false},
+		{"+/broker", "$SYS/broker", false},
+		{"$SYS/#", "$SYS/broker", true},
+	}
+
+	for _, tx := range tt {
+		require.Equal(t, tx.want, FilterCovers(tx.a, tx.b), tx.a+" "+tx.b)
+	}
+}
+
+func BenchmarkJWTVerifyHS256(b *testing.B) {
+	a, _ := NewJWT(JWTOptions{Secret: testSecret})
+	token := signJWT(b, "HS256", "", testSecret, map[string]interface{}{"sub": "mochi"})
+	for n := 0; n < b.N; n++ {
+		a.Verify(token)
+	}
+}
+
+func BenchmarkJWTACL(b *testing.B) {
+	a, _ := NewJWT(JWTOptions{Secret: testSecret})
+	cl := Client{ConnID: "c1", Username: []byte("mochi")}
+	a.AuthenticateClient(cl, []byte(signJWT(b, "HS256", "", testSecret, map[string]interface{}{
+		"publish": []string{"a/b/c", "devices/mochi/#"},
+	})))
+	for n := 0; n < b.N; n++ {
+		a.ClientACL(cl, Access{Topic: "devices/mochi/temp", Write: true})
+	}
+}
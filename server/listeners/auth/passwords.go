@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// DefaultPBKDF2Iterations is the default number of PBKDF2 iterations used
+	// when creating hashes, matching mosquitto_passwd.
+	DefaultPBKDF2Iterations = 101
+
+	// pbkdf2SaltLen is the number of bytes in a PBKDF2 salt.
+	pbkdf2SaltLen = 12
+
+	// MinBcryptCost is the minimum allowable bcrypt cost.
+	MinBcryptCost = bcrypt.MinCost
+
+	// MaxBcryptCost is the maximum allowable bcrypt cost.
+	MaxBcryptCost = bcrypt.MaxCost
+
+	// DefaultBcryptCost is the default bcrypt cost used when creating hashes.
+	DefaultBcryptCost = bcrypt.DefaultCost
+)
+
+var (
+	// ErrPBKDF2Iterations indicates a PBKDF2 iteration count was less than 1.
+	ErrPBKDF2Iterations = errors.New("pbkdf2 iterations must be at least 1")
+
+	// ErrBcryptCost indicates a bcrypt cost was out of range.
+	ErrBcryptCost = fmt.Errorf("bcrypt cost must be between %d and %d", MinBcryptCost, MaxBcryptCost)
+)
+
+// HashPBKDF2 returns a mosquitto compatible $7$ PBKDF2-SHA512 hash of a password
+// with a random salt.
+func HashPBKDF2(password []byte, iterations int) (string, error) {
+	if iterations < 1 {
+		return "", ErrPBKDF2Iterations
+	}
+
+	salt := make([]byte, pbkdf2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	sum := pbkdf2.Key(password, salt, iterations, sha512.Size, sha512.New)
+	return "$7$" + strconv.Itoa(iterations) + "$" + base64.StdEncoding.EncodeToString(salt) + "$" + base64.StdEncoding.EncodeToString(sum), nil
+}
+
+// CheckPassword returns true if a password matches a hash. Mosquitto $7$
+// (PBKDF2-SHA512) and $6$ (salted SHA512) hashes, and $2a$, $2b$ and $2y$
+// bcrypt hashes are supported.
+func CheckPassword(hash string, password []byte) bool {
+	switch {
+	case strings.HasPrefix(hash, "$7$"):
+		parts := strings.Split(hash, "$")
+		if len(parts) != 5 {
+			return false
+		}
+
+		iterations, err := strconv.Atoi(parts[2])
+		if err != nil || iterations < 1 {
+			return false
+		}
+
+		salt, sum, ok := decodeSaltSum(parts[3], parts[4])
+		if !ok {
+			return false
+		}
+
+		return subtle.ConstantTimeCompare(pbkdf2.Key(password, salt, iterations, len(sum), sha512.New), sum) == 1
+	case strings.HasPrefix(hash, "$6$"):
+		parts := strings.Split(hash, "$")
+		if len(parts) != 4 {
+			return false
+		}
+
+		salt, sum, ok := decodeSaltSum(parts[2], parts[3])
+		if !ok {
+			return false
+		}
+
+		h := sha512.New()
+		h.Write(password)
+		h.Write(salt)
+		return subtle.ConstantTimeCompare(h.Sum(nil), sum) == 1
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), password) == nil
+	default:
+		return false
+	}
+}
+
+// decodeSaltSum decodes the base64 salt and sum of a mosquitto hash.
+func decodeSaltSum(s, h string) (salt, sum []byte, ok bool) {
+	salt, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	sum, err = base64.StdEncoding.DecodeString(h)
+	if err != nil || len(sum) == 0 {
+		return nil, nil, false
+	}
+
+	return salt, sum, true
+}
+
+// HashBcrypt returns a bcrypt hash of a password with a random salt.
+func HashBcrypt(password []byte, cost int) (string, error) {
+	if cost < MinBcryptCost || cost > MaxBcryptCost {
+		return "", ErrBcryptCost
+	}
+
+	hash, err := bcrypt.GenerateFromPassword(password, cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
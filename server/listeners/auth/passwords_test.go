@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// bcryptVectors are test vectors from the openwall crypt_blowfish implementation.
+var bcryptVectors = []struct {
+	hash     string
+	password string
+}{
+	{"$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U"},
+	{"$2a$05$CCCCCCCCCCCCCCCCCCCCC.VGOzA784oUp/Z0DY336zx7pLYAy0lwK", "U*U*"},
+	{"$2a$05$XXXXXXXXXXXXXXXXXXXXXOAcXxm9kjPGEMsLznoKqmqw7tc8WCx4a", "U*U*U"},
+	{"$2a$05$CCCCCCCCCCCCCCCCCCCCC.7uG0VCzI2bS7j6ymqJi9CdcdxiRTWNy", ""},
+}
+
+func TestCheckPassword(t *testing.T) {
+	tt := []struct {
+		hash string
+		want bool
+	}{
+		{"$7$101$MDEyMzQ1Njc4OWFi$j6Dw8u5SrikklezQHoADfUPjPJIR74jLw62NN15H4Pqy/Q4YKBL3Uxj0vRPLeoUEh89D5acr73xQipCfuDaaZg==", true},
+		{"$7$100$MDEyMzQ1Njc4OWFi$j6Dw8u5SrikklezQHoADfUPjPJIR74jLw62NN15H4Pqy/Q4YKBL3Uxj0vRPLeoUEh89D5acr73xQipCfuDaaZg==", false},
+		{"$7$0$MDEyMzQ1Njc4OWFi$j6Dw8u5SrikklezQHoADfUPjPJIR74jLw62NN15H4Pqy/Q4YKBL3Uxj0vRPLeoUEh89D5acr73xQipCfuDaaZg==", false},
+		{"$7$101$MDEyMzQ1Njc4OWFi", false},
+		{"$7$101$!!$j6Dw8u5SrikklezQHoADfUPjPJIR74jLw62NN15H4Pqy", false},
+		{"$7$101$MDEyMzQ1Njc4OWFi$!!", false},
+		{"$7$101$MDEyMzQ1Njc4OWFi$", false},
+		{"$6$MDEyMzQ1Njc4OWFi$JdvpRZmh68cJZgwOYAihT2fa1tnh0e70dC5+1K/efvPA3ESdYrwBZYfreaAV33bo0aAgqV2Wjt0h+Hj14/32Ew==", true},
+		{"$6$MDEyMzQ1Njc4OWFj$JdvpRZmh68cJZgwOYAihT2fa1tnh0e70dC5+1K/efvPA3ESdYrwBZYfreaAV33bo0aAgqV2Wjt0h+Hj14/32Ew==", false},
+		{"$6$MDEyMzQ1Njc4OWFi", false},
+		{"$6$!!$JdvpRZmh68cJZgwOYAihT2fa1tnh0e70dC5", false},
+		{"$2a$04$" + strings.Repeat(".", 53), false},
+		{"mochi", false},
+		{"", false},
+	}
+
+	for _, tx := range tt {
+		require.Equal(t, tx.want, CheckPassword(tx.hash, []byte("mochi")), tx.hash)
+	}
+
+	require.True(t, CheckPassword(bcryptVectors[0].hash, []byte(bcryptVectors[0].password)))
+}
+
+func TestCheckPasswordBcrypt(t *testing.T) {
+	for _, v := range bcryptVectors {
+		require.True(t, CheckPassword(v.hash, []byte(v.password)), v.hash)
+		require.False(t, CheckPassword(v.hash, []byte("x"+v.password)), v.hash)
+	}
+
+	hash := bcryptVectors[0].hash
+	for _, version := range []string{"2a", "2b", "2y"} {
+		require.True(t, CheckPassword("$"+version+hash[3:], []byte("U*U")), version)
+	}
+
+	for _, h := range []string{
+		"$2x" + hash[3:],
+		"$2$" + hash[4:],
+		hash[:59],
+		"$2a$03" + hash[6:],
+		hash[:7] + "!" + hash[8:],
+	} {
+		require.False(t, CheckPassword(h, []byte("U*U")), h)
+	}
+}
+
+func TestHashBcrypt(t *testing.T) {
+	hash, err := HashBcrypt([]byte("mochi"), MinBcryptCost)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(hash, "$2a$04$"))
+	require.Len(t, hash, 60)
+	require.True(t, CheckPassword(hash, []byte("mochi")))
+	require.False(t, CheckPassword(hash, []byte("other")))
+
+	other, err := HashBcrypt([]byte("mochi"), MinBcryptCost)
+	require.NoError(t, err)
+	require.NotEqual(t, hash, other)
+
+	_, err = HashBcrypt([]byte("mochi"), MinBcryptCost-1)
+	require.ErrorIs(t, err, ErrBcryptCost)
+	_, err = HashBcrypt([]byte("mochi"), MaxBcryptCost+1)
+	require.ErrorIs(t, err, ErrBcryptCost)
+}
+
+func TestHashPBKDF2(t *testing.T) {
+	hash, err := HashPBKDF2([]byte("mochi"), DefaultPBKDF2Iterations)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(hash, "$7$101$"))
+	require.True(t, CheckPassword(hash, []byte("mochi")))
+	require.False(t, CheckPassword(hash, []byte("other")))
+
+	_, err = HashPBKDF2([]byte("mochi"), 0)
+	require.ErrorIs(t, err, ErrPBKDF2Iterations)
+}
+
+func BenchmarkCheckPasswordPBKDF2(b *testing.B) {
+	hash, _ := HashPBKDF2([]byte("mochi"), DefaultPBKDF2Iterations)
+	for n := 0; n < b.N; n++ {
+		CheckPassword(hash, []byte("mochi"))
+	}
+}
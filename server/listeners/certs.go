@@ -0,0 +1,358 @@
+package listeners
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mochi-co/mqtt/server/logger"
+)
+
+var (
+	// ErrNoCertificates indicates that a certificate manager has no certificates.
+	ErrNoCertificates = errors.New("no certificates configured")
+
+	// ErrNoClientCAs indicates that a CA file contained no certificates.
+	ErrNoClientCAs = errors.New("no certificates found in client ca file")
+)
+
+// CertificateFile contains the paths of a certificate and its private key.
+type CertificateFile struct {
+	CertFile string   // the path of a PEM encoded certificate chain.
+	KeyFile  string   // the path of a PEM encoded private key.
+	Hosts    []string // the SNI hostnames served by the certificate. If empty, the names in the certificate are used.
+}
+
+// CertManagerOptions contains configuration settings for a certificate manager.
+type CertManagerOptions struct {
+	// Certificates are the server certificates. The certificate matching the
+	// SNI hostname of a client is used, and the first certificate is used if no
+	// hostname matches.
+	Certificates []CertificateFile
+
+	// ClientCAFile is the path of PEM encoded CA certificates used to verify
+	// client certificates.
+	ClientCAFile string
+
+	// ClientAuth is the client certificate policy. If ClientCAFile is set, it
+	// defaults to tls.RequireAndVerifyClientCert.
+	ClientAuth tls.ClientAuthType
+
+	// MinVersion is the minimum TLS version accepted. Defaults to TLS 1.2.
+	MinVersion uint16
+
+	// WatchInterval is how often the files are checked for changes, and
+	// reloaded if they have been modified. If 0, the files are not watched.
+	WatchInterval time.Duration
+}
+
+// certState contains the certificates loaded from the files.
+type certState struct {
+	certs  []*tls.Certificate          // the server certificates, in configured order.
+	hosts  map[string]*tls.Certificate // server certificates keyed on lowercase hostname.
+	config *tls.Config                 // the tls config used for client handshakes.
+}
+
+// CertManager loads TLS certificates and client CAs from files, and provides a
+// tls.Config which always uses the most recently loaded files. This allows
+// certificates to be rotated without restarting listeners or dropping connected
+// clients. Revoked client certificates are refused by a Revocation checker.
+type CertManager struct {
+	sync.RWMutex
+	opts     CertManagerOptions   // configuration settings for the manager.
+	state    *certState           // the currently loaded certificates.
+	modified map[string]time.Time // the last modified time of each loaded file.
+	reloaded reloadFuncs          // functions called when the files are reloaded.
+	log      logger.Logger        // a logger for reload events.
+	done     chan struct{}        // closed to stop watching for changes.
+	end      sync.Once            // ensures the watcher is only stopped once.
+	wg       sync.WaitGroup       // waits for the watcher to exit.
+}
+
+// NewCertManager returns a new certificate manager, loading the configured
+// files. If the files are watched for changes, Close should be called when the
+// manager is no longer used.
+func NewCertManager(opts CertManagerOptions) (*CertManager, error) {
+	if len(opts.Certificates) == 0 {
+		return nil, ErrNoCertificates
+	}
+
+	if opts.MinVersion == 0 {
+		opts.MinVersion = tls.VersionTLS12
+	}
+
+	if opts.ClientCAFile != "" && opts.ClientAuth == tls.NoClientCert {
+		opts.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	m := &CertManager{
+		opts:     opts,
+		modified: make(map[string]time.Time),
+		log:      new(logger.Nop),
+		done:     make(chan struct{}),
+	}
+
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+
+	if opts.WatchInterval > 0 {
+		m.wg.Add(1)
+		go m.watch()
+	}
+
+	return m, nil
+}
+
+// SetLogger sets the logger used to report reloads and reload failures.
+func (m *CertManager) SetLogger(log logger.Logger) {
+	m.Lock()
+	m.log = log
+	m.Unlock()
+}
+
+// Reload reads the certificate and CA files. If any file is invalid, an
+// error is returned and the existing certificates remain in use.
+func (m *CertManager) Reload() error {
+	modified := make(map[string]time.Time)
+	st := &certState{
+		hosts: make(map[string]*tls.Certificate),
+	}
+
+	for _, cf := range m.opts.Certificates {
+		cert, err := loadCertificate(cf, modified)
+		if err != nil {
+			return err
+		}
+
+		st.certs = append(st.certs, cert)
+		hosts := cf.Hosts
+		if len(hosts) == 0 {
+			hosts = cert.Leaf.DNSNames
+			if len(hosts) == 0 && cert.Leaf.Subject.CommonName != "" {
+				hosts = []string{cert.Leaf.Subject.CommonName}
+			}
+		}
+
+		for _, host := range hosts {
+			host = strings.ToLower(strings.TrimSuffix(host, "."))
+			if _, ok := st.hosts[host]; !ok {
+				st.hosts[host] = cert
+			}
+		}
+	}
+
+	var pool *x509.CertPool
+	if m.opts.ClientCAFile != "" {
+		b, err := readModified(m.opts.ClientCAFile, modified)
+		if err != nil {
+			return err
+		}
+
+		cas, err := parseCertificates(b)
+		if err != nil {
+			return fmt.Errorf("%s: %w", m.opts.ClientCAFile, err)
+		}
+
+		pool = x509.NewCertPool()
+		for _, ca := range cas {
+			pool.AddCert(ca)
+		}
+	}
+
+	st.config = &tls.Config{
+		MinVersion:     m.opts.MinVersion,
+		GetCertificate: st.getCertificate,
+		ClientAuth:     m.opts.ClientAuth,
+		ClientCAs:      pool,
+	}
+
+	m.Lock()
+	m.state = st
+	m.modified = modified
+	m.Unlock()
+
+	m.reloaded.call()
+
+	return nil
+}
+
+// OnReload registers a function which is called when the files are reloaded,
+// and returns a function which unregisters it.
+func (m *CertManager) OnReload(fn func()) func() {
+	return m.reloaded.add(fn)
+}
+
+// Close stops watching the files for changes.
+func (m *CertManager) Close() {
+	m.end.Do(func() {
+		close(m.done)
+	})
+	m.wg.Wait()
+}
+
+// TLSConfig returns a tls.Config which uses the currently loaded certificates
+// and client CAs for each new connection.
+func (m *CertManager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     m.opts.MinVersion,
+		GetCertificate: m.GetCertificate,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			return m.current().config, nil
+		},
+	}
+}
+
+// GetCertificate returns the certificate for the SNI hostname of a client, or
+// the default certificate if no certificate matches.
+func (m *CertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return m.current().getCertificate(hello)
+}
+
+// current returns the currently loaded certificates.
+func (m *CertManager) current() *certState {
+	m.RLock()
+	defer m.RUnlock()
+	return m.state
+}
+
+// watch reloads the files when they are modified, until the manager is closed.
+func (m *CertManager) watch() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.opts.WatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !m.changed() {
+				continue
+			}
+
+			m.RLock()
+			log := m.log
+			m.RUnlock()
+
+			if err := m.Reload(); err != nil {
+				log.Error("failed to reload certificates", "error", err)
+				continue
+			}
+
+			log.Info("certificates reloaded")
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// changed returns true if the modified time of any file has changed.
+func (m *CertManager) changed() bool {
+	m.RLock()
+	defer m.RUnlock()
+
+	for path, mod := range m.modified {
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue // keep the existing contents until the file returns.
+		}
+
+		if !fi.ModTime().Equal(mod) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getCertificate returns the certificate for the SNI hostname of a client.
+func (st *certState) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := st.hosts[name]; ok {
+		return cert, nil
+	}
+
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := st.hosts["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+
+	return st.certs[0], nil
+}
+
+// loadCertificate loads a certificate and private key pair.
+func loadCertificate(cf CertificateFile, modified map[string]time.Time) (*tls.Certificate, error) {
+	certPEM, err := readModified(cf.CertFile, modified)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := readModified(cf.KeyFile, modified)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cf.CertFile, err)
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cf.CertFile, err)
+	}
+
+	return &cert, nil
+}
+
+// parseCertificates parses all the PEM encoded certificates in a file.
+func parseCertificates(b []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, ErrNoClientCAs
+	}
+
+	return certs, nil
+}
+
+// readModified reads a file and records its modified time.
+func readModified(path string, modified map[string]time.Time) ([]byte, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	modified[path] = fi.ModTime()
+	return b, nil
+}
@@ -0,0 +1,370 @@
+package listeners
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testCA is a certificate authority which issues certificates for tests.
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	pem    []byte
+	serial int64
+}
+
+func newTestCA(t testing.TB, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCA{
+		cert:   cert,
+		key:    key,
+		pem:    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		serial: 1,
+	}
+}
+
+// issue returns a PEM encoded certificate and key signed by the CA.
+func (ca *testCA) issue(t testing.TB, cn string, client bool, hosts ...string) (certPEM, keyPEM []byte, cert *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	ca.serial++
+	usage := x509.ExtKeyUsageServerAuth
+	if client {
+		usage = x509.ExtKeyUsageClientAuth
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	cert, err = x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	kb, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}),
+		cert
+}
+
+// crl returns a DER encoded CRL revoking the given certificates.
+func (ca *testCA) crl(t testing.TB, revoked ...*x509.Certificate) []byte {
+	var entries []pkix.RevokedCertificate
+	for _, cert := range revoked {
+		entries = append(entries, pkix.RevokedCertificate{
+			SerialNumber:   cert.SerialNumber,
+			RevocationTime: time.Now(),
+		})
+	}
+
+	ca.serial++
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:              big.NewInt(ca.serial),
+		ThisUpdate:          time.Now().Add(-time.Minute),
+		NextUpdate:          time.Now().Add(time.Hour),
+		RevokedCertificates: entries,
+	}, ca.cert, ca.key)
+	require.NoError(t, err)
+
+	return der
+}
+
+func writeCertFile(t testing.TB, dir, name string, b []byte) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, b, 0600))
+	return path
+}
+
+// testCertFiles writes a server certificate for hosts and returns its files.
+func testCertFiles(t testing.TB, ca *testCA, dir, name string, hosts ...string) CertificateFile {
+	certPEM, keyPEM, _ := ca.issue(t, name, false, hosts...)
+	return CertificateFile{
+		CertFile: writeCertFile(t, dir, name+".crt", certPEM),
+		KeyFile:  writeCertFile(t, dir, name+".key", keyPEM),
+	}
+}
+
+// handshake performs a tls handshake between a client and a server config,
+// returning the server handshake error.
+func handshake(t *testing.T, server, client *tls.Config) (*tls.Conn, error) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	cl := tls.Client(c2, client)
+	go func() {
+		cl.Handshake()
+		cl.Read(make([]byte, 1)) // complete the handshake in tls 1.3.
+	}()
+
+	srv := tls.Server(c1, server)
+	return srv, srv.Handshake()
+}
+
+func TestNewCertManagerErrors(t *testing.T) {
+	_, err := NewCertManager(CertManagerOptions{})
+	require.ErrorIs(t, err, ErrNoCertificates)
+
+	dir := t.TempDir()
+	_, err = NewCertManager(CertManagerOptions{
+		Certificates: []CertificateFile{{CertFile: filepath.Join(dir, "missing"), KeyFile: filepath.Join(dir, "missing")}},
+	})
+	require.Error(t, err)
+
+	ca := newTestCA(t, "ca")
+	cf := testCertFiles(t, ca, dir, "server", "mochi.local")
+
+	_, err = NewCertManager(CertManagerOptions{
+		Certificates: []CertificateFile{{CertFile: cf.CertFile, KeyFile: cf.CertFile}},
+	})
+	require.Error(t, err)
+
+	_, err = NewCertManager(CertManagerOptions{
+		Certificates: []CertificateFile{cf},
+		ClientCAFile: writeCertFile(t, dir, "empty.pem", []byte("none")),
+	})
+	require.ErrorIs(t, err, ErrNoClientCAs)
+}
+
+func TestCertManagerGetCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "ca")
+	def := testCertFiles(t, ca, dir, "default", "default.mochi.local")
+	a := testCertFiles(t, ca, dir, "a", "a.mochi.local")
+	b := testCertFiles(t, ca, dir, "b", "*.b.mochi.local")
+	c := testCertFiles(t, ca, dir, "c", "ignored.mochi.local")
+	c.Hosts = []string{"C.mochi.local"}
+
+	m, err := NewCertManager(CertManagerOptions{
+		Certificates: []CertificateFile{def, a, b, c},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint16(tls.VersionTLS12), m.opts.MinVersion)
+
+	tt := []struct {
+		host string
+		want string
+	}{
+		{"a.mochi.local", "a"},
+		{"A.Mochi.Local.", "a"},
+		{"x.b.mochi.local", "b"},
+		{"b.mochi.local", "default"},
+		{"c.mochi.local", "c"},
+		{"ignored.mochi.local", "default"},
+		{"", "default"},
+	}
+
+	for _, tx := range tt {
+		cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: tx.host})
+		require.NoError(t, err)
+		require.Equal(t, tx.want, cert.Leaf.Subject.CommonName, tx.host)
+	}
+}
+
+func TestCertManagerHandshake(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "ca")
+	m, err := NewCertManager(CertManagerOptions{
+		Certificates: []CertificateFile{testCertFiles(t, ca, dir, "server", "mochi.local")},
+	})
+	require.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	srv, err := handshake(t, m.TLSConfig(), &tls.Config{RootCAs: roots, ServerName: "mochi.local"})
+	require.NoError(t, err)
+	require.Empty(t, srv.ConnectionState().PeerCertificates)
+}
+
+func TestCertManagerClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "ca")
+	certPEM, keyPEM, _ := ca.issue(t, "client", true)
+
+	m, err := NewCertManager(CertManagerOptions{
+		Certificates: []CertificateFile{testCertFiles(t, ca, dir, "server", "mochi.local")},
+		ClientCAFile: writeCertFile(t, dir, "ca.pem", ca.pem),
+	})
+	require.NoError(t, err)
+	require.Equal(t, tls.RequireAndVerifyClientCert, m.opts.ClientAuth)
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := &tls.Config{RootCAs: roots, ServerName: "mochi.local", Certificates: []tls.Certificate{pair}}
+
+	srv, err := handshake(t, m.TLSConfig(), client)
+	require.NoError(t, err)
+	require.Equal(t, "client", srv.ConnectionState().PeerCertificates[0].Subject.CommonName)
+
+	// clients without a certificate are refused.
+	_, err = handshake(t, m.TLSConfig(), &tls.Config{RootCAs: roots, ServerName: "mochi.local"})
+	require.Error(t, err)
+}
+
+func TestCertManagerOnReload(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewCertManager(CertManagerOptions{
+		Certificates: []CertificateFile{testCertFiles(t, newTestCA(t, "ca"), dir, "server", "mochi.local")},
+	})
+	require.NoError(t, err)
+
+	reloads := 0
+	unregister := m.OnReload(func() {
+		reloads++
+	})
+
+	others := 0
+	m.OnReload(func() {
+		others++
+	})
+
+	require.NoError(t, m.Reload())
+	require.Equal(t, 1, reloads)
+	require.Equal(t, 1, others)
+
+	// unregistered functions are no longer called.
+	unregister()
+	unregister()
+	require.NoError(t, m.Reload())
+	require.Equal(t, 1, reloads)
+	require.Equal(t, 2, others)
+}
+
+func TestCertManagerReloadKeepsState(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "ca")
+	cf := testCertFiles(t, ca, dir, "server", "mochi.local")
+	m, err := NewCertManager(CertManagerOptions{Certificates: []CertificateFile{cf}})
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(cf.CertFile, []byte("invalid"), 0600))
+	require.Error(t, m.Reload())
+
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	require.Equal(t, "server", cert.Leaf.Subject.CommonName)
+}
+
+func TestCertManagerWatch(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "ca")
+	cf := testCertFiles(t, ca, dir, "server", "mochi.local")
+	m, err := NewCertManager(CertManagerOptions{
+		Certificates:  []CertificateFile{cf},
+		WatchInterval: time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer m.Close()
+
+	certPEM, keyPEM, next := ca.issue(t, "rotated", false, "mochi.local")
+	require.NoError(t, ioutil.WriteFile(cf.KeyFile, keyPEM, 0600))
+	require.NoError(t, ioutil.WriteFile(cf.CertFile, certPEM, 0600))
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(cf.CertFile, future, future))
+
+	require.Eventually(t, func() bool {
+		cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "mochi.local"})
+		return err == nil && cert.Leaf.SerialNumber.Cmp(next.SerialNumber) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestCertManagerChanged(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "ca")
+	cf := testCertFiles(t, ca, dir, "server", "mochi.local")
+	m, err := NewCertManager(CertManagerOptions{Certificates: []CertificateFile{cf}})
+	require.NoError(t, err)
+	require.False(t, m.changed())
+
+	require.NoError(t, os.Remove(cf.KeyFile))
+	require.False(t, m.changed())
+
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(cf.CertFile, past, past))
+	require.True(t, m.changed())
+}
+
+func TestConfigTLSConfig(t *testing.T) {
+	tc, err := (&Config{}).tlsConfig()
+	require.NoError(t, err)
+	require.Nil(t, tc)
+
+	want := new(tls.Config)
+	tc, err = (&Config{TLSConfig: want}).tlsConfig()
+	require.NoError(t, err)
+	require.Equal(t, want, tc)
+
+	tc, err = (&Config{TLS: &TLS{Certificate: testCertificate, PrivateKey: testPrivateKey}}).tlsConfig()
+	require.NoError(t, err)
+	require.Len(t, tc.Certificates, 1)
+
+	_, err = (&Config{TLS: &TLS{Certificate: testCertificate, PrivateKey: []byte("invalid")}}).tlsConfig()
+	require.Error(t, err)
+
+	dir := t.TempDir()
+	m, err := NewCertManager(CertManagerOptions{
+		Certificates: []CertificateFile{testCertFiles(t, newTestCA(t, "ca"), dir, "server", "mochi.local")},
+	})
+	require.NoError(t, err)
+
+	tc, err = (&Config{CertManager: m, TLSConfig: want}).tlsConfig()
+	require.NoError(t, err)
+	require.NotNil(t, tc.GetConfigForClient)
+}
+
+func BenchmarkCertManagerGetCertificate(b *testing.B) {
+	dir := b.TempDir()
+	ca := newTestCA(b, "ca")
+	m, _ := NewCertManager(CertManagerOptions{
+		Certificates: []CertificateFile{testCertFiles(b, ca, dir, "server", "*.mochi.local")},
+	})
+
+	hello := &tls.ClientHelloInfo{ServerName: "a.mochi.local"}
+	for n := 0; n < b.N; n++ {
+		m.GetCertificate(hello)
+	}
+}
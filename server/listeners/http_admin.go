@@ -0,0 +1,201 @@
+package listeners
+
+import (
+	"context"
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/logger"
+	"github.com/mochi-co/mqtt/server/system"
+)
+
+// HTTPAdmin is a listener for serving the broker admin REST api. Requests must
+// present either the bearer token set with SetToken, or basic auth credentials
+// which are accepted by the Authenticate method of the listener auth controller.
+type HTTPAdmin struct {
+	sync.RWMutex
+	id      string        // the internal id of the listener.
+	address string        // the network address to bind to.
+	handler http.Handler  // the admin api handler, usually from server.AdminHandler.
+	token   string        // a bearer token which grants access to the api.
+	config  *Config       // configuration values for the listener.
+	listen  *http.Server  // the http server.
+	ln      net.Listener  // the network listener the http server is bound to.
+	err     error         // the error which stopped the listener serving, if any.
+	log     logger.Logger // a logger for listener events.
+	end     uint32        // ensure the close methods are only called once.
+}
+
+// adminListenerKey is the request context key of the id of the HTTPAdmin
+// listener which received a request.
+type adminListenerKey struct{}
+
+// AdminListenerID returns the id of the HTTPAdmin listener which received a
+// request, if the request was received by one.
+func AdminListenerID(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(adminListenerKey{}).(string)
+	return id, ok
+}
+
+// NewHTTPAdmin initialises and returns a new HTTP admin listener, listening on an
+// address and serving the admin api handler. All requests are denied until a
+// token or an auth controller is configured.
+func NewHTTPAdmin(id, address string, handler http.Handler) *HTTPAdmin {
+	return &HTTPAdmin{
+		id:      id,
+		address: address,
+		handler: handler,
+		config: &Config{
+			Auth: new(auth.Disallow),
+		},
+		log: new(logger.Nop),
+	}
+}
+
+// SetConfig sets the configuration values for the listener config.
+func (l *HTTPAdmin) SetConfig(config *Config) {
+	l.Lock()
+	if config != nil {
+		l.config = config
+
+		// If a config has been passed without an auth controller,
+		// it may be a mistake, so disallow all traffic.
+		if l.config.Auth == nil {
+			l.config.Auth = new(auth.Disallow)
+		}
+	}
+
+	l.Unlock()
+}
+
+// SetToken sets a bearer token which grants access to the admin api.
+// An empty token disables bearer token authentication.
+func (l *HTTPAdmin) SetToken(token string) {
+	l.Lock()
+	l.token = token
+	l.Unlock()
+}
+
+// SetLogger sets the logger used by the listener.
+func (l *HTTPAdmin) SetLogger(log logger.Logger) {
+	l.Lock()
+	l.log = log
+	l.Unlock()
+}
+
+// ID returns the id of the listener.
+func (l *HTTPAdmin) ID() string {
+	l.RLock()
+	id := l.id
+	l.RUnlock()
+	return id
+}
+
+// Listen starts listening on the listener's network address.
+func (l *HTTPAdmin) Listen(s *system.Info) error {
+	l.listen = &http.Server{
+		Addr:    l.address,
+		Handler: l.authenticate(l.handler),
+	}
+
+	tlsConfig, err := l.config.tlsConfig()
+	if err != nil {
+		return err
+	}
+	l.listen.TLSConfig = tlsConfig
+
+	return nil
+}
+
+// Serve starts listening for new connections and serving responses.
+func (l *HTTPAdmin) Serve(establish EstablishFunc) {
+	ln, err := net.Listen("tcp", l.address)
+	if err == nil {
+		l.Lock()
+		l.ln = ln
+		l.Unlock()
+		err = serveHTTP(l.listen, ln)
+	}
+
+	if err != nil {
+		l.log.Error("listener stopped serving", "listener", l.id, "error", err)
+		l.Lock()
+		l.err = err
+		l.Unlock()
+	}
+}
+
+// Addr returns the network address the listener is bound to, or nil if it is
+// not serving.
+func (l *HTTPAdmin) Addr() net.Addr {
+	l.RLock()
+	defer l.RUnlock()
+	if l.ln == nil {
+		return nil
+	}
+
+	return l.ln.Addr()
+}
+
+// ServeErr returns the error which stopped the listener serving, if any.
+func (l *HTTPAdmin) ServeErr() error {
+	l.RLock()
+	defer l.RUnlock()
+	return l.err
+}
+
+// Close closes the listener and any client connections.
+func (l *HTTPAdmin) Close(closeClients CloseFunc) {
+	l.Lock()
+	defer l.Unlock()
+
+	if atomic.CompareAndSwapUint32(&l.end, 0, 1) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		l.listen.Shutdown(ctx)
+	}
+
+	closeClients(l.id)
+}
+
+// authenticate wraps a handler, rejecting any requests which do not present
+// a valid bearer token or basic auth credentials. The id of the listener is
+// added to the context of authorized requests.
+func (l *HTTPAdmin) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if l.authorized(req) {
+			next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), adminListenerKey{}, l.ID())))
+			return
+		}
+
+		l.log.Warn("admin request unauthorized", "listener", l.id, "remote", req.RemoteAddr, "path", req.URL.Path)
+		w.Header().Set("WWW-Authenticate", `Basic realm="mochi"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+// authorized returns true if a request presents a valid bearer token or
+// basic auth credentials.
+func (l *HTTPAdmin) authorized(req *http.Request) bool {
+	l.RLock()
+	token := l.token
+	ac := l.config.Auth
+	l.RUnlock()
+
+	header := req.Header.Get("Authorization")
+	if token != "" && strings.HasPrefix(header, "Bearer ") {
+		return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), []byte(token)) == 1
+	}
+
+	if user, pass, ok := req.BasicAuth(); ok {
+		return ac.Authenticate([]byte(user), []byte(pass))
+	}
+
+	return false
+}
@@ -0,0 +1,230 @@
+package listeners
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/logger"
+	"github.com/mochi-co/mqtt/server/system"
+	"github.com/stretchr/testify/require"
+)
+
+// adminAuth is an auth controller which only accepts the admin user.
+type adminAuth struct{}
+
+func (a *adminAuth) Authenticate(user, password []byte) bool {
+	return string(user) == "admin" && string(password) == "secret"
+}
+
+func (a *adminAuth) ACL(user []byte, topic string, write bool) bool {
+	return false
+}
+
+var adminTestHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	io.WriteString(w, "ok")
+})
+
+func TestNewHTTPAdmin(t *testing.T) {
+	l := NewHTTPAdmin("t1", testPort, adminTestHandler)
+	require.Equal(t, "t1", l.id)
+	require.Equal(t, testPort, l.address)
+	require.NotNil(t, l.handler)
+	require.Equal(t, new(auth.Disallow), l.config.Auth)
+}
+
+func TestHTTPAdminSetConfig(t *testing.T) {
+	l := NewHTTPAdmin("t1", testPort, adminTestHandler)
+
+	l.SetConfig(&Config{
+		Auth: new(auth.Allow),
+	})
+	require.Equal(t, new(auth.Allow), l.config.Auth)
+
+	// Switch to disallow on bad config set.
+	l.SetConfig(new(Config))
+	require.Equal(t, new(auth.Disallow), l.config.Auth)
+}
+
+func TestHTTPAdminSetToken(t *testing.T) {
+	l := NewHTTPAdmin("t1", testPort, adminTestHandler)
+	l.SetToken("abc")
+	require.Equal(t, "abc", l.token)
+}
+
+func TestHTTPAdminSetLogger(t *testing.T) {
+	l := NewHTTPAdmin("t1", testPort, adminTestHandler)
+	require.Equal(t, new(logger.Nop), l.log)
+
+	log := new(logger.Mock)
+	l.SetLogger(log)
+	require.Equal(t, log, l.log)
+}
+
+func TestHTTPAdminID(t *testing.T) {
+	l := NewHTTPAdmin("t1", testPort, adminTestHandler)
+	require.Equal(t, "t1", l.ID())
+}
+
+func TestHTTPAdminListen(t *testing.T) {
+	l := NewHTTPAdmin("t1", testPort, adminTestHandler)
+	err := l.Listen(new(system.Info))
+	require.NoError(t, err)
+	require.Equal(t, testPort, l.listen.Addr)
+	require.Nil(t, l.listen.TLSConfig)
+}
+
+func TestHTTPAdminListenTLS(t *testing.T) {
+	l := NewHTTPAdmin("t1", testPort, adminTestHandler)
+	l.SetConfig(&Config{
+		Auth: new(auth.Allow),
+		TLS: &TLS{
+			Certificate: testCertificate,
+			PrivateKey:  testPrivateKey,
+		},
+	})
+	err := l.Listen(new(system.Info))
+	require.NoError(t, err)
+	require.NotNil(t, l.listen.TLSConfig)
+}
+
+func TestHTTPAdminListenTLSInvalid(t *testing.T) {
+	l := NewHTTPAdmin("t1", testPort, adminTestHandler)
+	l.SetConfig(&Config{
+		Auth: new(auth.Allow),
+		TLS: &TLS{
+			Certificate: []byte("abcde"),
+			PrivateKey:  testPrivateKey,
+		},
+	})
+	err := l.Listen(new(system.Info))
+	require.Error(t, err)
+}
+
+func TestHTTPAdminAuthenticate(t *testing.T) {
+	l := NewHTTPAdmin("t1", testPort, adminTestHandler)
+	log := new(logger.Mock)
+	l.SetLogger(log)
+	l.SetConfig(&Config{
+		Auth: new(adminAuth),
+	})
+	l.SetToken("abc")
+	h := l.authenticate(adminTestHandler)
+
+	tt := []struct {
+		desc   string
+		header string
+		user   string
+		pass   string
+		code   int
+	}{
+		{desc: "no credentials", code: http.StatusUnauthorized},
+		{desc: "valid token", header: "Bearer abc", code: http.StatusOK},
+		{desc: "invalid token", header: "Bearer abd", code: http.StatusUnauthorized},
+		{desc: "valid basic", user: "admin", pass: "secret", code: http.StatusOK},
+		{desc: "invalid basic", user: "admin", pass: "wrong", code: http.StatusUnauthorized},
+	}
+
+	for _, tx := range tt {
+		req := httptest.NewRequest(http.MethodGet, "/clients", nil)
+		if tx.header != "" {
+			req.Header.Set("Authorization", tx.header)
+		}
+		if tx.user != "" {
+			req.SetBasicAuth(tx.user, tx.pass)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		require.Equal(t, tx.code, w.Code, tx.desc)
+		if tx.code == http.StatusUnauthorized {
+			require.Equal(t, `Basic realm="mochi"`, w.Header().Get("WWW-Authenticate"), tx.desc)
+		}
+	}
+
+	_, ok := log.Find("admin request unauthorized")
+	require.True(t, ok)
+}
+
+func TestHTTPAdminAuthenticateListenerID(t *testing.T) {
+	l := NewHTTPAdmin("t1", testPort, adminTestHandler)
+	l.SetToken("abc")
+
+	var id string
+	var ok bool
+	h := l.authenticate(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id, ok = AdminListenerID(req.Context())
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/clients", nil)
+	req.Header.Set("Authorization", "Bearer abc")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	require.True(t, ok)
+	require.Equal(t, "t1", id)
+
+	_, ok = AdminListenerID(context.Background())
+	require.False(t, ok)
+}
+
+func TestHTTPAdminAuthenticateNoToken(t *testing.T) {
+	l := NewHTTPAdmin("t1", testPort, adminTestHandler)
+	h := l.authenticate(adminTestHandler)
+
+	req := httptest.NewRequest(http.MethodGet, "/clients", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestHTTPAdminServeAndClose(t *testing.T) {
+	l := NewHTTPAdmin("t1", testPort, adminTestHandler)
+	l.SetToken("abc")
+	err := l.Listen(new(system.Info))
+	require.NoError(t, err)
+
+	o := make(chan bool)
+	go func(o chan bool) {
+		l.Serve(MockEstablisher)
+		o <- true
+	}(o)
+	time.Sleep(time.Millisecond)
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost"+testPort+"/clients", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer abc")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, "ok", string(body))
+	require.NotNil(t, l.Addr())
+
+	var closed bool
+	l.Close(func(id string) {
+		closed = true
+	})
+	require.Equal(t, true, closed)
+	<-o
+	require.NoError(t, l.ServeErr())
+}
+
+func TestHTTPAdminServeErr(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	l := NewHTTPAdmin("t1", ln.Addr().String(), adminTestHandler)
+	err = l.Listen(new(system.Info))
+	require.NoError(t, err)
+
+	l.Serve(MockEstablisher) // the address is in use, so serving stops immediately.
+	require.Error(t, l.ServeErr())
+	require.Nil(t, l.Addr())
+}
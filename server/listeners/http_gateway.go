@@ -0,0 +1,177 @@
+package listeners
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/logger"
+	"github.com/mochi-co/mqtt/server/system"
+)
+
+// GatewayFunc returns an http.Handler which publishes and subscribes on behalf
+// of the http clients of a listener, using the listener auth controller.
+type GatewayFunc func(id string, ac auth.Controller) http.Handler
+
+// GatewayServer is an optional interface for listeners which serve the http
+// publish and subscribe gateway. When such a listener is added to the server,
+// the server provides a function returning the gateway handler.
+type GatewayServer interface {
+	SetGatewayHandler(fn GatewayFunc) // set the function returning the gateway handler.
+}
+
+// HTTPGateway is a listener which allows http clients to publish and subscribe
+// to topics, for clients which cannot connect using MQTT. Requests are
+// authenticated and checked against ACLs using the listener auth controller.
+type HTTPGateway struct {
+	sync.RWMutex
+	id      string        // the internal id of the listener.
+	address string        // the network address to bind to.
+	gateway GatewayFunc   // returns the gateway handler, set by the server.
+	config  *Config       // configuration values for the listener.
+	listen  *http.Server  // the http server.
+	ln      net.Listener  // the network listener the http server is bound to.
+	err     error         // the error which stopped the listener serving, if any.
+	log     logger.Logger // a logger for listener events.
+	end     uint32        // ensure the close methods are only called once.
+}
+
+// NewHTTPGateway initialises and returns a new HTTP gateway listener, listening
+// on an address.
+func NewHTTPGateway(id, address string) *HTTPGateway {
+	return &HTTPGateway{
+		id:      id,
+		address: address,
+		config: &Config{
+			Auth: new(auth.Allow),
+		},
+		log: new(logger.Nop),
+	}
+}
+
+// SetConfig sets the configuration values for the listener config.
+func (l *HTTPGateway) SetConfig(config *Config) {
+	l.Lock()
+	if config != nil {
+		l.config = config
+
+		// If a config has been passed without an auth controller,
+		// it may be a mistake, so disallow all traffic.
+		if l.config.Auth == nil {
+			l.config.Auth = new(auth.Disallow)
+		}
+	}
+
+	l.Unlock()
+}
+
+// SetGatewayHandler sets the function returning the gateway handler.
+func (l *HTTPGateway) SetGatewayHandler(fn GatewayFunc) {
+	l.Lock()
+	l.gateway = fn
+	l.Unlock()
+}
+
+// SetLogger sets the logger used by the listener.
+func (l *HTTPGateway) SetLogger(log logger.Logger) {
+	l.Lock()
+	l.log = log
+	l.Unlock()
+}
+
+// ID returns the id of the listener.
+func (l *HTTPGateway) ID() string {
+	l.RLock()
+	id := l.id
+	l.RUnlock()
+	return id
+}
+
+// Listen starts listening on the listener's network address.
+func (l *HTTPGateway) Listen(s *system.Info) error {
+	l.RLock()
+	gateway := l.gateway
+	l.RUnlock()
+
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+	})
+
+	if gateway != nil {
+		handler = gateway(l.id, l.config.Auth)
+	}
+
+	// streams are cancelled on shutdown, as they would otherwise never be idle.
+	ctx, cancel := context.WithCancel(context.Background())
+	l.listen = &http.Server{
+		Addr:    l.address,
+		Handler: handler,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+	l.listen.RegisterOnShutdown(cancel)
+
+	tlsConfig, err := l.config.tlsConfig()
+	if err != nil {
+		return err
+	}
+	l.listen.TLSConfig = tlsConfig
+
+	return nil
+}
+
+// Serve starts listening for new connections and serving responses.
+func (l *HTTPGateway) Serve(establish EstablishFunc) {
+	ln, err := net.Listen("tcp", l.address)
+	if err == nil {
+		l.Lock()
+		l.ln = ln
+		l.Unlock()
+		err = serveHTTP(l.listen, ln)
+	}
+
+	if err != nil {
+		l.log.Error("listener stopped serving", "listener", l.id, "error", err)
+		l.Lock()
+		l.err = err
+		l.Unlock()
+	}
+}
+
+// Addr returns the network address the listener is bound to, or nil if it is
+// not serving.
+func (l *HTTPGateway) Addr() net.Addr {
+	l.RLock()
+	defer l.RUnlock()
+	if l.ln == nil {
+		return nil
+	}
+
+	return l.ln.Addr()
+}
+
+// ServeErr returns the error which stopped the listener serving, if any.
+func (l *HTTPGateway) ServeErr() error {
+	l.RLock()
+	defer l.RUnlock()
+	return l.err
+}
+
+// Close closes the listener and any client connections.
+func (l *HTTPGateway) Close(closeClients CloseFunc) {
+	l.Lock()
+	defer l.Unlock()
+
+	if atomic.CompareAndSwapUint32(&l.end, 0, 1) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		l.listen.Shutdown(ctx)
+	}
+
+	closeClients(l.id)
+}
@@ -0,0 +1,167 @@
+package listeners
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/logger"
+	"github.com/mochi-co/mqtt/server/system"
+	"github.com/stretchr/testify/require"
+)
+
+// gatewayTestFunc returns a handler which writes the listener id, or streams
+// until the request is cancelled.
+func gatewayTestFunc(id string, ac auth.Controller) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/subscribe" {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-req.Context().Done()
+			return
+		}
+
+		io.WriteString(w, id)
+	})
+}
+
+func TestNewHTTPGateway(t *testing.T) {
+	l := NewHTTPGateway("t1", testPort)
+	require.Equal(t, "t1", l.id)
+	require.Equal(t, testPort, l.address)
+	require.Equal(t, new(auth.Allow), l.config.Auth)
+}
+
+func TestHTTPGatewaySetConfig(t *testing.T) {
+	l := NewHTTPGateway("t1", testPort)
+
+	l.SetConfig(&Config{
+		Auth: new(auth.Allow),
+	})
+	require.Equal(t, new(auth.Allow), l.config.Auth)
+
+	// Switch to disallow on bad config set.
+	l.SetConfig(new(Config))
+	require.Equal(t, new(auth.Disallow), l.config.Auth)
+}
+
+func TestHTTPGatewaySetGatewayHandler(t *testing.T) {
+	l := NewHTTPGateway("t1", testPort)
+	l.SetGatewayHandler(gatewayTestFunc)
+	require.NotNil(t, l.gateway)
+}
+
+func TestHTTPGatewaySetLogger(t *testing.T) {
+	l := NewHTTPGateway("t1", testPort)
+	log := new(logger.Mock)
+	l.SetLogger(log)
+	require.Equal(t, log, l.log)
+}
+
+func TestHTTPGatewayID(t *testing.T) {
+	l := NewHTTPGateway("t1", testPort)
+	require.Equal(t, "t1", l.ID())
+}
+
+func TestHTTPGatewayListen(t *testing.T) {
+	l := NewHTTPGateway("t1", testPort)
+	l.SetGatewayHandler(gatewayTestFunc)
+	require.NoError(t, l.Listen(new(system.Info)))
+	require.Equal(t, testPort, l.listen.Addr)
+	require.Nil(t, l.listen.TLSConfig)
+
+	w := httptest.NewRecorder()
+	l.listen.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/topics/a", nil))
+	require.Equal(t, "t1", w.Body.String())
+}
+
+func TestHTTPGatewayListenNoGateway(t *testing.T) {
+	l := NewHTTPGateway("t1", testPort)
+	require.NoError(t, l.Listen(new(system.Info)))
+
+	w := httptest.NewRecorder()
+	l.listen.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/topics/a", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestHTTPGatewayListenTLS(t *testing.T) {
+	l := NewHTTPGateway("t1", testPort)
+	l.SetConfig(&Config{
+		Auth: new(auth.Allow),
+		TLS: &TLS{
+			Certificate: testCertificate,
+			PrivateKey:  testPrivateKey,
+		},
+	})
+	require.NoError(t, l.Listen(new(system.Info)))
+	require.NotNil(t, l.listen.TLSConfig)
+}
+
+func TestHTTPGatewayListenTLSInvalid(t *testing.T) {
+	l := NewHTTPGateway("t1", testPort)
+	l.SetConfig(&Config{
+		Auth: new(auth.Allow),
+		TLS: &TLS{
+			Certificate: []byte("abcde"),
+			PrivateKey:  testPrivateKey,
+		},
+	})
+	require.Error(t, l.Listen(new(system.Info)))
+}
+
+func TestHTTPGatewayServeErr(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	l := NewHTTPGateway("t1", ln.Addr().String())
+	err = l.Listen(new(system.Info))
+	require.NoError(t, err)
+
+	l.Serve(MockEstablisher) // the address is in use, so serving stops immediately.
+	require.Error(t, l.ServeErr())
+	require.Nil(t, l.Addr())
+}
+
+func TestHTTPGatewayServeAndClose(t *testing.T) {
+	l := NewHTTPGateway("t1", testPort)
+	l.SetGatewayHandler(gatewayTestFunc)
+	require.NoError(t, l.Listen(new(system.Info)))
+
+	o := make(chan bool)
+	go func(o chan bool) {
+		l.Serve(MockEstablisher)
+		o <- true
+	}(o)
+	time.Sleep(time.Millisecond)
+
+	resp, err := http.Get("http://localhost" + testPort + "/topics/a")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, "t1", string(body))
+
+	// streams are ended when the listener is closed.
+	resp, err = http.Get("http://localhost" + testPort + "/subscribe")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	start := time.Now()
+	var closed bool
+	l.Close(func(id string) {
+		closed = true
+	})
+	require.Equal(t, true, closed)
+	require.Less(t, time.Since(start), time.Second)
+	<-o
+	require.NoError(t, l.ServeErr())
+
+	_, err = bufio.NewReader(resp.Body).ReadByte()
+	require.Error(t, err)
+}
@@ -2,27 +2,34 @@ package listeners
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"io"
+	"net"
 	"net/http"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/logger"
+	"github.com/mochi-co/mqtt/server/metrics"
 	"github.com/mochi-co/mqtt/server/system"
 )
 
-// HTTPStats is a listener for presenting the server $SYS stats on a JSON http endpoint.
+// HTTPStats is a listener for presenting the server $SYS stats on a JSON http endpoint,
+// and the broker metrics in the Prometheus text exposition format at /metrics.
 type HTTPStats struct {
 	sync.RWMutex
-	id      string       // the internal id of the listener.
-	address string       // the network address to bind to.
-	config  *Config      // configuration values for the listener.
-	system  *system.Info // pointers to the server data.
-	listen  *http.Server // the http server.
-	end     uint32       // ensure the close methods are only called once.}
+	id      string        // the internal id of the listener.
+	address string        // the network address to bind to.
+	config  *Config       // configuration values for the listener.
+	system  *system.Info  // pointers to the server data.
+	listen  *http.Server  // the http server.
+	ln      net.Listener  // the network listener the http server is bound to.
+	err     error         // the error which stopped the listener serving, if any.
+	metrics http.Handler  // the handler serving the broker metrics, if provided by the server.
+	log     logger.Logger // a logger for listener events.
+	end     uint32        // ensure the close methods are only called once.
 }
 
 // NewHTTPStats initialises and returns a new HTTP listener, listening on an address.
@@ -33,6 +40,7 @@ func NewHTTPStats(id, address string) *HTTPStats {
 		config: &Config{
 			Auth: new(auth.Allow),
 		},
+		log: new(logger.Nop),
 	}
 }
 
@@ -52,6 +60,21 @@ func (l *HTTPStats) SetConfig(config *Config) {
 	l.Unlock()
 }
 
+// SetLogger sets the logger used by the listener.
+func (l *HTTPStats) SetLogger(log logger.Logger) {
+	l.Lock()
+	l.log = log
+	l.Unlock()
+}
+
+// SetMetricsHandler sets the handler used to serve the /metrics endpoint. If no
+// handler is set, only the $SYS stats are served as metrics.
+func (l *HTTPStats) SetMetricsHandler(h http.Handler) {
+	l.Lock()
+	l.metrics = h
+	l.Unlock()
+}
+
 // ID returns the id of the listener.
 func (l *HTTPStats) ID() string {
 	l.RLock()
@@ -65,37 +88,56 @@ func (l *HTTPStats) Listen(s *system.Info) error {
 	l.system = s
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", l.jsonHandler)
+	mux.HandleFunc("/metrics", l.metricsHandler)
 	l.listen = &http.Server{
 		Addr:    l.address,
 		Handler: mux,
 	}
 
-	// The following logic is deprecated in favour of passing through the tls.Config
-	// value directly, however it remains in order to provide backwards compatibility.
-	// It will be removed someday, so use the preferred method (l.config.TLSConfig).
-	if l.config.TLS != nil && len(l.config.TLS.Certificate) > 0 && len(l.config.TLS.PrivateKey) > 0 {
-		cert, err := tls.X509KeyPair(l.config.TLS.Certificate, l.config.TLS.PrivateKey)
-		if err != nil {
-			return err
-		}
-
-		l.listen.TLSConfig = &tls.Config{
-			Certificates: []tls.Certificate{cert},
-		}
-	} else {
-		l.listen.TLSConfig = l.config.TLSConfig
+	tlsConfig, err := l.config.tlsConfig()
+	if err != nil {
+		return err
 	}
+	l.listen.TLSConfig = tlsConfig
 
 	return nil
 }
 
 // Serve starts listening for new connections and serving responses.
 func (l *HTTPStats) Serve(establish EstablishFunc) {
-	if l.listen.TLSConfig != nil {
-		l.listen.ListenAndServeTLS("", "")
-	} else {
-		l.listen.ListenAndServe()
+	ln, err := net.Listen("tcp", l.address)
+	if err == nil {
+		l.Lock()
+		l.ln = ln
+		l.Unlock()
+		err = serveHTTP(l.listen, ln)
+	}
+
+	if err != nil {
+		l.log.Error("listener stopped serving", "listener", l.id, "error", err)
+		l.Lock()
+		l.err = err
+		l.Unlock()
+	}
+}
+
+// Addr returns the network address the listener is bound to, or nil if it is
+// not serving.
+func (l *HTTPStats) Addr() net.Addr {
+	l.RLock()
+	defer l.RUnlock()
+	if l.ln == nil {
+		return nil
 	}
+
+	return l.ln.Addr()
+}
+
+// ServeErr returns the error which stopped the listener serving, if any.
+func (l *HTTPStats) ServeErr() error {
+	l.RLock()
+	defer l.RUnlock()
+	return l.err
 }
 
 // Close closes the listener and any client connections.
@@ -116,9 +158,30 @@ func (l *HTTPStats) Close(closeClients CloseFunc) {
 func (l *HTTPStats) jsonHandler(w http.ResponseWriter, req *http.Request) {
 	info, err := json.MarshalIndent(l.system, "", "\t")
 	if err != nil {
+		l.log.Warn("failed to encode system info", "listener", l.id, "error", err)
 		io.WriteString(w, err.Error())
 		return
 	}
 
 	w.Write(info)
 }
+
+// metricsHandler is an HTTP handler which outputs the broker metrics in the
+// Prometheus text exposition format.
+func (l *HTTPStats) metricsHandler(w http.ResponseWriter, req *http.Request) {
+	l.RLock()
+	h := l.metrics
+	l.RUnlock()
+
+	if h != nil {
+		h.ServeHTTP(w, req)
+		return
+	}
+
+	w.Header().Set("Content-Type", metrics.ContentType)
+	mw := metrics.NewWriter(w)
+	metrics.WriteInfo(mw, l.system)
+	if err := mw.Flush(); err != nil {
+		l.log.Warn("failed to write metrics", "listener", l.id, "error", err)
+	}
+}
@@ -3,12 +3,14 @@ package listeners
 import (
 	"encoding/json"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/logger"
 	"github.com/mochi-co/mqtt/server/system"
 	"github.com/stretchr/testify/require"
 )
@@ -49,6 +51,15 @@ func BenchmarkHTTPStatsSetConfig(b *testing.B) {
 	}
 }
 
+func TestHTTPStatsSetLogger(t *testing.T) {
+	l := NewHTTPStats("t1", testPort)
+	require.Equal(t, new(logger.Nop), l.log)
+
+	log := new(logger.Mock)
+	l.SetLogger(log)
+	require.Equal(t, log, l.log)
+}
+
 func TestHTTPStatsID(t *testing.T) {
 	l := NewHTTPStats("t1", testPort)
 	require.Equal(t, "t1", l.ID())
@@ -152,6 +163,49 @@ func TestHTTPStatsServeAndClose(t *testing.T) {
 	<-o
 }
 
+func TestHTTPStatsAddr(t *testing.T) {
+	l := NewHTTPStats("t1", "127.0.0.1:0")
+	require.Nil(t, l.Addr())
+	err := l.Listen(new(system.Info))
+	require.NoError(t, err)
+
+	o := make(chan bool)
+	go func() {
+		l.Serve(MockEstablisher)
+		o <- true
+	}()
+
+	require.Eventually(t, func() bool {
+		return l.Addr() != nil
+	}, time.Second, time.Millisecond)
+
+	resp, err := http.Get("http://" + l.Addr().String())
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	l.Close(MockCloser)
+	<-o
+	require.NoError(t, l.ServeErr())
+}
+
+func TestHTTPStatsServeErr(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	l := NewHTTPStats("t1", ln.Addr().String())
+	log := new(logger.Mock)
+	l.SetLogger(log)
+	err = l.Listen(new(system.Info))
+	require.NoError(t, err)
+
+	l.Serve(MockEstablisher) // the address is in use, so serving stops immediately.
+	require.Error(t, l.ServeErr())
+	require.Nil(t, l.Addr())
+	_, ok := log.Find("listener stopped serving")
+	require.True(t, ok)
+}
+
 func TestHTTPStatsServeTLSAndClose(t *testing.T) {
 	l := NewHTTPStats("t1", testPort)
 	l.SetConfig(&Config{
@@ -196,3 +250,41 @@ func TestHTTPStatsJSONHandler(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, "test", v.Version)
 }
+
+func TestHTTPStatsSetMetricsHandler(t *testing.T) {
+	l := NewHTTPStats("t1", testPort)
+	var _ MetricsServer = l
+	require.Nil(t, l.metrics)
+
+	l.SetMetricsHandler(http.NotFoundHandler())
+	require.NotNil(t, l.metrics)
+}
+
+func TestHTTPStatsMetricsHandler(t *testing.T) {
+	l := NewHTTPStats("t1", testPort)
+	err := l.Listen(&system.Info{
+		Version:          "test",
+		ClientsConnected: 3,
+	})
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	l.metricsHandler(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	require.Contains(t, w.Body.String(), `mochi_info{version="test"} 1`)
+	require.Contains(t, w.Body.String(), "mochi_clients_connected 3\n")
+}
+
+func TestHTTPStatsMetricsHandlerProvided(t *testing.T) {
+	l := NewHTTPStats("t1", testPort)
+	err := l.Listen(new(system.Info))
+	require.NoError(t, err)
+
+	l.SetMetricsHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("provided"))
+	}))
+
+	w := httptest.NewRecorder()
+	l.metricsHandler(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, "provided", w.Body.String())
+}
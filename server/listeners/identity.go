@@ -0,0 +1,115 @@
+package listeners
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+)
+
+// IdentitySource is a value of a client certificate which may be used as the
+// identity of a client.
+type IdentitySource string
+
+const (
+	IdentityNone        IdentitySource = ""            // the certificate is not used.
+	IdentityCommonName  IdentitySource = "cn"          // the subject common name.
+	IdentitySANDNS      IdentitySource = "san-dns"     // the first DNS subject alternative name.
+	IdentitySANURI      IdentitySource = "san-uri"     // the first URI subject alternative name.
+	IdentitySANEmail    IdentitySource = "san-email"   // the first email subject alternative name.
+	IdentityFingerprint IdentitySource = "fingerprint" // the hex sha256 fingerprint of the certificate.
+)
+
+var (
+	// ErrNoPeerCertificate indicates that an identity was required but the client
+	// did not present a certificate.
+	ErrNoPeerCertificate = errors.New("no client certificate")
+
+	// ErrNoCertificateIdentity indicates that the client certificate does not
+	// contain the value used as the client identity.
+	ErrNoCertificateIdentity = errors.New("client certificate has no identity value")
+
+	// ErrInvalidIdentitySource indicates that an identity source is not known.
+	ErrInvalidIdentitySource = errors.New("invalid identity source")
+)
+
+// Identity configures how the identity of clients is derived from the verified
+// certificates they present to a TLS listener. The TLS config of the listener
+// should require and verify client certificates.
+type Identity struct {
+	// Username replaces the username of a client with a value from its
+	// certificate. The CONNECT username is ignored, but a password is still
+	// passed to the auth controller.
+	Username IdentitySource
+
+	// ClientID requires the client id of a client to match a value from its
+	// certificate. Clients connecting with an empty client id are assigned the
+	// value, and clients connecting with a different client id are refused.
+	ClientID IdentitySource
+}
+
+// IdentityMapper is an optional interface for listeners which derive the
+// identity of clients from their certificates.
+type IdentityMapper interface {
+	Identity() *Identity // return the identity mapping of the listener, or nil.
+}
+
+// Map returns the username and client id of a client with the given peer
+// certificates. A value is empty if its source is IdentityNone.
+func (id *Identity) Map(certs []*x509.Certificate) (username, clientID string, err error) {
+	if id == nil || (id.Username == IdentityNone && id.ClientID == IdentityNone) {
+		return "", "", nil
+	}
+
+	if len(certs) == 0 {
+		return "", "", ErrNoPeerCertificate
+	}
+
+	if id.Username != IdentityNone {
+		username, err = CertificateIdentity(certs[0], id.Username)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	if id.ClientID != IdentityNone {
+		clientID, err = CertificateIdentity(certs[0], id.ClientID)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	return username, clientID, nil
+}
+
+// CertificateIdentity returns the value of a certificate for an identity source.
+func CertificateIdentity(cert *x509.Certificate, source IdentitySource) (string, error) {
+	var v string
+	switch source {
+	case IdentityCommonName:
+		v = cert.Subject.CommonName
+	case IdentitySANDNS:
+		if len(cert.DNSNames) > 0 {
+			v = cert.DNSNames[0]
+		}
+	case IdentitySANURI:
+		if len(cert.URIs) > 0 {
+			v = cert.URIs[0].String()
+		}
+	case IdentitySANEmail:
+		if len(cert.EmailAddresses) > 0 {
+			v = cert.EmailAddresses[0]
+		}
+	case IdentityFingerprint:
+		sum := sha256.Sum256(cert.Raw)
+		v = hex.EncodeToString(sum[:])
+	default:
+		return "", ErrInvalidIdentitySource
+	}
+
+	if v == "" {
+		return "", ErrNoCertificateIdentity
+	}
+
+	return v, nil
+}
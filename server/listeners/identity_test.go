@@ -0,0 +1,102 @@
+package listeners
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testIdentityCert() *x509.Certificate {
+	return &x509.Certificate{
+		Raw:            []byte("certificate"),
+		Subject:        pkix.Name{CommonName: "mochi"},
+		DNSNames:       []string{"device1.mochi.local", "device2.mochi.local"},
+		URIs:           []*url.URL{{Scheme: "spiffe", Host: "mochi", Path: "/device1"}},
+		EmailAddresses: []string{"device1@mochi.local"},
+	}
+}
+
+func TestCertificateIdentity(t *testing.T) {
+	cert := testIdentityCert()
+	sum := sha256.Sum256(cert.Raw)
+
+	tt := []struct {
+		source IdentitySource
+		want   string
+	}{
+		{IdentityCommonName, "mochi"},
+		{IdentitySANDNS, "device1.mochi.local"},
+		{IdentitySANURI, "spiffe://mochi/device1"},
+		{IdentitySANEmail, "device1@mochi.local"},
+		{IdentityFingerprint, hex.EncodeToString(sum[:])},
+	}
+
+	for _, tx := range tt {
+		v, err := CertificateIdentity(cert, tx.source)
+		require.NoError(t, err, tx.source)
+		require.Equal(t, tx.want, v, tx.source)
+	}
+}
+
+func TestCertificateIdentityErrors(t *testing.T) {
+	_, err := CertificateIdentity(new(x509.Certificate), IdentityCommonName)
+	require.ErrorIs(t, err, ErrNoCertificateIdentity)
+
+	_, err = CertificateIdentity(new(x509.Certificate), IdentitySANURI)
+	require.ErrorIs(t, err, ErrNoCertificateIdentity)
+
+	_, err = CertificateIdentity(testIdentityCert(), "serial")
+	require.ErrorIs(t, err, ErrInvalidIdentitySource)
+}
+
+func TestIdentityMap(t *testing.T) {
+	certs := []*x509.Certificate{testIdentityCert()}
+
+	username, clientID, err := (&Identity{
+		Username: IdentityCommonName,
+		ClientID: IdentitySANDNS,
+	}).Map(certs)
+	require.NoError(t, err)
+	require.Equal(t, "mochi", username)
+	require.Equal(t, "device1.mochi.local", clientID)
+
+	username, clientID, err = (&Identity{ClientID: IdentityCommonName}).Map(certs)
+	require.NoError(t, err)
+	require.Equal(t, "", username)
+	require.Equal(t, "mochi", clientID)
+}
+
+func TestIdentityMapNone(t *testing.T) {
+	var id *Identity
+	username, clientID, err := id.Map(nil)
+	require.NoError(t, err)
+	require.Empty(t, username)
+	require.Empty(t, clientID)
+
+	_, _, err = new(Identity).Map(nil)
+	require.NoError(t, err)
+}
+
+func TestIdentityMapErrors(t *testing.T) {
+	_, _, err := (&Identity{Username: IdentityCommonName}).Map(nil)
+	require.ErrorIs(t, err, ErrNoPeerCertificate)
+
+	_, _, err = (&Identity{Username: IdentitySANEmail}).Map([]*x509.Certificate{new(x509.Certificate)})
+	require.ErrorIs(t, err, ErrNoCertificateIdentity)
+
+	_, _, err = (&Identity{ClientID: IdentitySANDNS}).Map([]*x509.Certificate{new(x509.Certificate)})
+	require.ErrorIs(t, err, ErrNoCertificateIdentity)
+}
+
+func BenchmarkIdentityMap(b *testing.B) {
+	id := &Identity{Username: IdentityCommonName, ClientID: IdentitySANDNS}
+	certs := []*x509.Certificate{testIdentityCert()}
+	for n := 0; n < b.N; n++ {
+		id.Map(certs)
+	}
+}
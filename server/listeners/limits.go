@@ -0,0 +1,161 @@
+package listeners
+
+import (
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mochi-co/mqtt/server/system"
+)
+
+// Limits restricts the connections accepted by a listener, to protect the
+// server from reconnect storms and clients which open many connections.
+// Connections over a limit are closed before any packets are read. Limits are
+// applied by the TCP, unix socket and websocket listeners.
+type Limits struct {
+	// MaxConnections is the maximum number of concurrent connections to the
+	// listener. If 0, the number of connections is not limited.
+	MaxConnections int
+
+	// MaxConnectionsPerIP is the maximum number of concurrent connections to the
+	// listener from a single source ip address. Connections through a trusted
+	// proxy are counted against the address of the client. If 0, the number of
+	// connections from an address is not limited.
+	MaxConnectionsPerIP int
+
+	// AcceptRate is the sustained number of connections accepted per second.
+	// If 0, the rate of connections is not limited.
+	AcceptRate float64
+
+	// AcceptBurst is the number of connections which may be accepted at once
+	// before AcceptRate applies. The default is AcceptRate, and at least 1.
+	AcceptBurst int
+}
+
+// connLimiter applies the connection limits of a listener. A nil connLimiter
+// admits all connections.
+type connLimiter struct {
+	sync.Mutex
+	opts   Limits           // the limits of the listener.
+	system *system.Info     // the server info holding the rejected counters, if any.
+	conns  int              // the number of connections currently admitted.
+	ips    map[string]int   // the number of connections currently admitted, by ip.
+	tokens float64          // the number of connections which may be accepted now.
+	last   time.Time        // the time the tokens were last refilled.
+	now    func() time.Time // returns the current time.
+}
+
+// newConnLimiter returns a connLimiter for a listener, or nil if the listener
+// has no limits.
+func newConnLimiter(opts *Limits, s *system.Info) *connLimiter {
+	if opts == nil || (opts.MaxConnections <= 0 && opts.MaxConnectionsPerIP <= 0 && opts.AcceptRate <= 0) {
+		return nil
+	}
+
+	l := &connLimiter{
+		opts:   *opts,
+		system: s,
+		ips:    map[string]int{},
+		now:    time.Now,
+	}
+
+	if l.opts.AcceptBurst < 1 {
+		l.opts.AcceptBurst = int(math.Max(1, math.Ceil(l.opts.AcceptRate)))
+	}
+
+	l.tokens = float64(l.opts.AcceptBurst)
+	l.last = l.now()
+
+	return l
+}
+
+// allow returns true if a newly accepted connection is within the accept rate.
+func (l *connLimiter) allow() bool {
+	if l == nil || l.opts.AcceptRate <= 0 {
+		return true
+	}
+
+	l.Lock()
+	now := l.now()
+	l.tokens = math.Min(float64(l.opts.AcceptBurst), l.tokens+now.Sub(l.last).Seconds()*l.opts.AcceptRate)
+	l.last = now
+	ok := l.tokens >= 1
+	if ok {
+		l.tokens--
+	}
+	l.Unlock()
+
+	if !ok {
+		l.count(func(s *system.Info) *int64 { return &s.ConnectionsRateLimited })
+	}
+
+	return ok
+}
+
+// acquire admits a connection from a remote address if it is within the
+// concurrent connection limits. If admitted, release must be called once the
+// connection is closed.
+func (l *connLimiter) acquire(remote string) (release func(), ok bool) {
+	if l == nil || (l.opts.MaxConnections <= 0 && l.opts.MaxConnectionsPerIP <= 0) {
+		return func() {}, true
+	}
+
+	ip := remoteIP(remote)
+
+	l.Lock()
+	if l.opts.MaxConnections > 0 && l.conns >= l.opts.MaxConnections {
+		l.Unlock()
+		l.count(func(s *system.Info) *int64 { return &s.ConnectionsRejected })
+		return nil, false
+	}
+
+	if l.opts.MaxConnectionsPerIP > 0 && ip != "" && l.ips[ip] >= l.opts.MaxConnectionsPerIP {
+		l.Unlock()
+		l.count(func(s *system.Info) *int64 { return &s.ConnectionsIPLimited })
+		return nil, false
+	}
+
+	l.conns++
+	if ip != "" {
+		l.ips[ip]++
+	}
+	l.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.Lock()
+			l.conns--
+			if ip != "" {
+				if l.ips[ip]--; l.ips[ip] <= 0 {
+					delete(l.ips, ip)
+				}
+			}
+			l.Unlock()
+		})
+	}, true
+}
+
+// count increments a rejected connections counter of the server info.
+func (l *connLimiter) count(counter func(s *system.Info) *int64) {
+	if l.system != nil {
+		atomic.AddInt64(counter(l.system), 1)
+	}
+}
+
+// remoteIP returns the ip address of a remote address, or an empty string if
+// the address is not an ip address, such as for unix socket connections.
+func remoteIP(remote string) string {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+
+	return ""
+}
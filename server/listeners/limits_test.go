@@ -0,0 +1,137 @@
+package listeners
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mochi-co/mqtt/server/system"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewConnLimiter(t *testing.T) {
+	require.Nil(t, newConnLimiter(nil, nil))
+	require.Nil(t, newConnLimiter(&Limits{AcceptBurst: 5}, nil))
+
+	l := newConnLimiter(&Limits{MaxConnections: 1}, nil)
+	require.NotNil(t, l)
+	require.Equal(t, 1, l.opts.AcceptBurst)
+
+	l = newConnLimiter(&Limits{AcceptRate: 2.5}, nil)
+	require.Equal(t, 3, l.opts.AcceptBurst)
+	require.Equal(t, float64(3), l.tokens)
+
+	l = newConnLimiter(&Limits{AcceptRate: 1, AcceptBurst: 10}, nil)
+	require.Equal(t, 10, l.opts.AcceptBurst)
+}
+
+func TestConnLimiterNil(t *testing.T) {
+	var l *connLimiter
+	require.True(t, l.allow())
+	release, ok := l.acquire("127.0.0.1:1")
+	require.True(t, ok)
+	release()
+}
+
+func TestConnLimiterAllow(t *testing.T) {
+	info := new(system.Info)
+	l := newConnLimiter(&Limits{AcceptRate: 2, AcceptBurst: 2}, info)
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+	l.last = now
+
+	require.True(t, l.allow())
+	require.True(t, l.allow())
+	require.False(t, l.allow())
+	require.Equal(t, int64(1), info.ConnectionsRateLimited)
+
+	now = now.Add(500 * time.Millisecond) // one token at 2 per second.
+	require.True(t, l.allow())
+	require.False(t, l.allow())
+
+	now = now.Add(time.Hour) // tokens are capped at the burst.
+	require.True(t, l.allow())
+	require.True(t, l.allow())
+	require.False(t, l.allow())
+	require.Equal(t, int64(3), info.ConnectionsRateLimited)
+}
+
+func TestConnLimiterAllowNoRate(t *testing.T) {
+	l := newConnLimiter(&Limits{MaxConnections: 1}, nil)
+	for i := 0; i < 10; i++ {
+		require.True(t, l.allow())
+	}
+}
+
+func TestConnLimiterAcquire(t *testing.T) {
+	info := new(system.Info)
+	l := newConnLimiter(&Limits{MaxConnections: 2}, info)
+
+	r1, ok := l.acquire("127.0.0.1:1")
+	require.True(t, ok)
+	_, ok = l.acquire("127.0.0.2:1")
+	require.True(t, ok)
+
+	_, ok = l.acquire("127.0.0.3:1")
+	require.False(t, ok)
+	require.Equal(t, int64(1), info.ConnectionsRejected)
+
+	r1()
+	r1() // release is only counted once.
+	_, ok = l.acquire("127.0.0.3:1")
+	require.True(t, ok)
+	_, ok = l.acquire("127.0.0.4:1")
+	require.False(t, ok)
+	require.Equal(t, int64(2), info.ConnectionsRejected)
+}
+
+func TestConnLimiterAcquirePerIP(t *testing.T) {
+	info := new(system.Info)
+	l := newConnLimiter(&Limits{MaxConnectionsPerIP: 1}, info)
+
+	r1, ok := l.acquire("127.0.0.1:1")
+	require.True(t, ok)
+	_, ok = l.acquire("127.0.0.1:2")
+	require.False(t, ok)
+	require.Equal(t, int64(1), info.ConnectionsIPLimited)
+
+	_, ok = l.acquire("[::1]:1")
+	require.True(t, ok)
+
+	// connections without an ip address are not limited by address.
+	_, ok = l.acquire("")
+	require.True(t, ok)
+	_, ok = l.acquire("")
+	require.True(t, ok)
+
+	r1()
+	require.NotContains(t, l.ips, "127.0.0.1")
+	_, ok = l.acquire("127.0.0.1:2")
+	require.True(t, ok)
+}
+
+func TestRemoteIP(t *testing.T) {
+	tt := []struct {
+		remote string
+		want   string
+	}{
+		{"127.0.0.1:1883", "127.0.0.1"},
+		{"[::1]:1883", "::1"},
+		{"10.0.0.1", "10.0.0.1"},
+		{"mem-1", ""},
+		{"@", ""},
+		{"", ""},
+	}
+
+	for _, tx := range tt {
+		require.Equal(t, tx.want, remoteIP(tx.remote), tx.remote)
+	}
+}
+
+func BenchmarkConnLimiterAcquire(b *testing.B) {
+	l := newConnLimiter(&Limits{MaxConnections: 10, MaxConnectionsPerIP: 10, AcceptRate: 1e9}, nil)
+	for n := 0; n < b.N; n++ {
+		l.allow()
+		release, _ := l.acquire("127.0.0.1:1883")
+		release()
+	}
+}
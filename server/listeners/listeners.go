@@ -2,13 +2,23 @@ package listeners
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"net"
+	"net/http"
+	"sort"
 	"sync"
 
 	"github.com/mochi-co/mqtt/server/listeners/auth"
 	"github.com/mochi-co/mqtt/server/system"
 )
 
+var (
+	// ErrListenerNotFound indicates that a listener id was not in the
+	// listeners map.
+	ErrListenerNotFound = errors.New("listener not found")
+)
+
 // Config contains configuration values for a listener.
 type Config struct {
 	// Auth controller containing auth and ACL logic for
@@ -24,6 +34,28 @@ type Config struct {
 	// TLSConfig is a tls.Config configuration to be used with the listener.
 	// See examples folder for basic and mutual-tls use.
 	TLSConfig *tls.Config
+
+	// Identity derives the username or client id of clients from the verified
+	// certificates they present. It requires a TLSConfig which verifies client
+	// certificates.
+	Identity *Identity
+
+	// CertManager provides certificates which are reloaded from files without
+	// restarting the listener. If set, it is used instead of TLS and TLSConfig.
+	CertManager *CertManager
+
+	// Revocation refuses revoked client certificates, including those of a
+	// CertManager. Clients which are connected when their certificate is
+	// revoked are disconnected.
+	Revocation *Revocation
+
+	// Proxy reads the original addresses of clients which connect through
+	// trusted proxies or load balancers.
+	Proxy *Proxy
+
+	// Limits restricts the number and rate of connections accepted by the
+	// listener.
+	Limits *Limits
 }
 
 // TLS contains the TLS certificates and settings for the listener connection.
@@ -35,6 +67,60 @@ type TLS struct {
 	PrivateKey  []byte // the body of a private key.
 }
 
+// tlsConfig returns the tls config of a listener, or nil if the listener does
+// not use tls.
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	tc, err := c.baseTLSConfig()
+	if err != nil || tc == nil || c.Revocation == nil {
+		return tc, err
+	}
+
+	return c.Revocation.Wrap(tc), nil
+}
+
+// proxyPolicy returns the proxy policy of a listener, or nil if the listener
+// does not accept client addresses from proxies.
+func (c *Config) proxyPolicy() (*proxyPolicy, error) {
+	if c.Proxy == nil {
+		return nil, nil
+	}
+
+	return newProxyPolicy(*c.Proxy)
+}
+
+// revokers returns the certificate revocation checkers of a listener.
+func (c *Config) revokers() []Revoker {
+	if c.Revocation == nil {
+		return nil
+	}
+
+	return []Revoker{c.Revocation}
+}
+
+// baseTLSConfig returns the tls config of a listener before revocation checks
+// are added.
+func (c *Config) baseTLSConfig() (*tls.Config, error) {
+	if c.CertManager != nil {
+		return c.CertManager.TLSConfig(), nil
+	}
+
+	// The following logic is deprecated in favour of passing through the tls.Config
+	// value directly, however it remains in order to provide backwards compatibility.
+	// It will be removed someday, so use the preferred method (c.TLSConfig).
+	if c.TLS != nil && len(c.TLS.Certificate) > 0 && len(c.TLS.PrivateKey) > 0 {
+		cert, err := tls.X509KeyPair(c.TLS.Certificate, c.TLS.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}, nil
+	}
+
+	return c.TLSConfig, nil
+}
+
 // EstablishFunc is a callback function for establishing new clients.
 type EstablishFunc func(id string, c net.Conn, ac auth.Controller) error
 
@@ -51,11 +137,86 @@ type Listener interface {
 	Close(CloseFunc)             // stop and close the listener.
 }
 
+// Revoker is an interface for certificate revocation checkers which reload
+// their revocation lists.
+type Revoker interface {
+	Revoked(cert *x509.Certificate) bool // return true if a certificate is revoked.
+	OnReload(fn func()) func()           // call a function when the revocation lists are reloaded, until unregistered.
+}
+
+// RevocationChecker is an optional interface for listeners which refuse revoked
+// client certificates. When such a listener is added to the server, clients
+// connected to it are disconnected if a reload revokes their certificate.
+type RevocationChecker interface {
+	Revokers() []Revoker // return the revocation checkers of the listener.
+}
+
+// MetricsServer is an optional interface for listeners which serve the broker
+// metrics. When such a listener is added to the server, the server provides
+// a handler which writes all broker metrics.
+type MetricsServer interface {
+	SetMetricsHandler(h http.Handler) // set the handler serving the metrics endpoint.
+}
+
+// Addresser is an optional interface for listeners which report the network
+// address they are bound to, such as when the configured port is 0.
+type Addresser interface {
+	Addr() net.Addr // return the bound address, or nil if not bound.
+}
+
+// ServeErrorer is an optional interface for listeners which report the error
+// which stopped them serving, if any.
+type ServeErrorer interface {
+	ServeErr() error // return the error which stopped the listener serving.
+}
+
+// The lifecycle states of a listener.
+const (
+	StateAdded     = "added"     // the listener has been added but has not listened.
+	StateListening = "listening" // the listener has opened its address but is not serving.
+	StateServing   = "serving"   // the listener is serving connections.
+	StateStopped   = "stopped"   // the listener stopped serving without being closed.
+	StateClosed    = "closed"    // the listener has been closed.
+	StateFailed    = "failed"    // the listener failed to listen or stopped serving with an error.
+)
+
+// State is a point-in-time snapshot of the lifecycle of a listener.
+type State struct {
+	Status  string // the lifecycle state of the listener.
+	Address string // the address the listener is bound to, if known.
+	Err     error  // the error which failed the listener, if any.
+}
+
+// listenerState tracks the lifecycle of a listener in the listeners map.
+type listenerState struct {
+	status string        // the lifecycle state of the listener.
+	err    error         // the error which failed the listener, if any.
+	done   chan struct{} // closed when the listener stops serving, if served.
+}
+
+// serveHTTP serves an http server on a bound network listener until the server
+// is shut down, returning any error other than http.ErrServerClosed.
+func serveHTTP(srv *http.Server, ln net.Listener) error {
+	var err error
+	if srv.TLSConfig != nil {
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
 // Listeners contains the network listeners for the broker.
 type Listeners struct {
-	wg       sync.WaitGroup      // a waitgroup that waits for all listeners to finish.
-	internal map[string]Listener // a map of active listeners.
-	system   *system.Info        // pointers to system info.
+	wg       sync.WaitGroup            // a waitgroup that waits for all listeners to finish.
+	internal map[string]Listener       // a map of active listeners.
+	states   map[string]*listenerState // the lifecycle state of each listener.
+	system   *system.Info              // pointers to system info.
 	sync.RWMutex
 }
 
@@ -63,6 +224,7 @@ type Listeners struct {
 func New(s *system.Info) *Listeners {
 	return &Listeners{
 		internal: map[string]Listener{},
+		states:   map[string]*listenerState{},
 		system:   s,
 	}
 }
@@ -71,9 +233,55 @@ func New(s *system.Info) *Listeners {
 func (l *Listeners) Add(val Listener) {
 	l.Lock()
 	l.internal[val.ID()] = val
+	l.states[val.ID()] = &listenerState{status: StateAdded}
 	l.Unlock()
 }
 
+// Listen opens the network address of a listener from the internal map.
+func (l *Listeners) Listen(id string) error {
+	l.RLock()
+	listener, ok := l.internal[id]
+	l.RUnlock()
+	if !ok {
+		return ErrListenerNotFound
+	}
+
+	err := listener.Listen(l.system)
+
+	l.Lock()
+	if st, ok := l.states[id]; ok {
+		st.status, st.err = StateListening, err
+		if err != nil {
+			st.status = StateFailed
+		}
+	}
+	l.Unlock()
+
+	return err
+}
+
+// State returns a snapshot of the lifecycle state of a listener, if it exists.
+func (l *Listeners) State(id string) (State, bool) {
+	l.RLock()
+	listener, ok := l.internal[id]
+	var state State
+	if st, has := l.states[id]; has {
+		state.Status, state.Err = st.status, st.err
+	}
+	l.RUnlock()
+	if !ok {
+		return state, false
+	}
+
+	if a, ok := listener.(Addresser); ok {
+		if addr := a.Addr(); addr != nil {
+			state.Address = addr.String()
+		}
+	}
+
+	return state, true
+}
+
 // Get returns the value of a listener if it exists.
 func (l *Listeners) Get(id string) (Listener, bool) {
 	l.RLock()
@@ -90,23 +298,60 @@ func (l *Listeners) Len() int {
 	return val
 }
 
+// IDs returns the ids of all listeners in the internal map, sorted.
+func (l *Listeners) IDs() []string {
+	l.RLock()
+	ids := make([]string, 0, len(l.internal))
+	for id := range l.internal {
+		ids = append(ids, id)
+	}
+	l.RUnlock()
+
+	sort.Strings(ids)
+	return ids
+}
+
 // Delete removes a listener from the internal map.
 func (l *Listeners) Delete(id string) {
 	l.Lock()
 	delete(l.internal, id)
+	delete(l.states, id)
 	l.Unlock()
 }
 
-// Serve starts a listener serving from the internal map.
+// Serve starts a listener serving from the internal map. Listeners which are
+// already serving, or which have failed or been closed, are not served again.
 func (l *Listeners) Serve(id string, establisher EstablishFunc) {
-	l.RLock()
-	listener := l.internal[id]
-	l.RUnlock()
+	l.Lock()
+	listener, ok := l.internal[id]
+	st := l.states[id]
+	if !ok || (st.status != StateAdded && st.status != StateListening) {
+		l.Unlock()
+		return
+	}
+	st.status = StateServing
+	st.done = make(chan struct{})
+	l.wg.Add(1)
+	l.Unlock()
 
 	go func(e EstablishFunc) {
 		defer l.wg.Done()
-		l.wg.Add(1)
 		listener.Serve(e)
+
+		var err error
+		if se, ok := listener.(ServeErrorer); ok {
+			err = se.ServeErr()
+		}
+
+		l.Lock()
+		if st.status != StateClosed {
+			st.status, st.err = StateStopped, err
+			if err != nil {
+				st.status = StateFailed
+			}
+		}
+		close(st.done)
+		l.Unlock()
 	}(establisher)
 }
 
@@ -128,10 +373,39 @@ func (l *Listeners) ServeAll(establisher EstablishFunc) {
 
 // Close stops a listener from the internal map.
 func (l *Listeners) Close(id string, closer CloseFunc) {
+	l.Lock()
+	listener, ok := l.internal[id]
+	if ok {
+		l.states[id].status = StateClosed
+	}
+	l.Unlock()
+
+	if ok {
+		listener.Close(closer)
+	}
+}
+
+// Remove stops a listener, waits for it to finish serving, and removes it
+// from the internal map.
+func (l *Listeners) Remove(id string, closer CloseFunc) error {
+	l.RLock()
+	st, ok := l.states[id]
+	l.RUnlock()
+	if !ok {
+		return ErrListenerNotFound
+	}
+
+	l.Close(id, closer)
+
 	l.RLock()
-	listener := l.internal[id]
+	done := st.done
 	l.RUnlock()
-	listener.Close(closer)
+	if done != nil {
+		<-done
+	}
+
+	l.Delete(id)
+	return nil
 }
 
 // CloseAll iterates and closes all registered listeners.
@@ -117,6 +117,13 @@ func BenchmarkLenListener(b *testing.B) {
 	}
 }
 
+func TestIDsListener(t *testing.T) {
+	l := New(nil)
+	l.Add(NewMockListener("t2", ":1882"))
+	l.Add(NewMockListener("t1", ":1882"))
+	require.Equal(t, []string{"t1", "t2"}, l.IDs())
+}
+
 func TestDeleteListener(t *testing.T) {
 	l := New(nil)
 	l.Add(NewMockListener("t1", ":1882"))
@@ -136,6 +143,88 @@ func BenchmarkDeleteListener(b *testing.B) {
 	}
 }
 
+func TestListenListener(t *testing.T) {
+	l := New(nil)
+	l.Add(NewMockListener("t1", ":1882"))
+	state, ok := l.State("t1")
+	require.True(t, ok)
+	require.Equal(t, State{Status: StateAdded}, state)
+
+	require.NoError(t, l.Listen("t1"))
+	require.True(t, l.internal["t1"].(*MockListener).IsListening())
+	state, _ = l.State("t1")
+	require.Equal(t, State{Status: StateListening}, state)
+
+	require.ErrorIs(t, l.Listen("t2"), ErrListenerNotFound)
+	_, ok = l.State("t2")
+	require.False(t, ok)
+}
+
+func TestListenListenerFailed(t *testing.T) {
+	l := New(nil)
+	m := NewMockListener("t1", ":1882")
+	m.ErrListen = true
+	l.Add(m)
+
+	err := l.Listen("t1")
+	require.Error(t, err)
+	state, _ := l.State("t1")
+	require.Equal(t, State{Status: StateFailed, Err: err}, state)
+
+	l.Serve("t1", MockEstablisher) // failed listeners are not served.
+	time.Sleep(time.Millisecond)
+	require.False(t, m.IsServing())
+}
+
+func TestListenerStateLifecycle(t *testing.T) {
+	l := New(nil)
+	tcp := NewTCP("t1", "127.0.0.1:0")
+	l.Add(tcp)
+	require.NoError(t, l.Listen("t1"))
+
+	state, _ := l.State("t1")
+	require.Equal(t, StateListening, state.Status)
+	require.Equal(t, tcp.Addr().String(), state.Address)
+
+	l.Serve("t1", MockEstablisher)
+	state, _ = l.State("t1")
+	require.Equal(t, StateServing, state.Status)
+
+	l.Close("t1", MockCloser)
+	l.wg.Wait()
+	state, _ = l.State("t1")
+	require.Equal(t, StateClosed, state.Status)
+	require.NoError(t, state.Err)
+}
+
+func TestListenerStateServeErr(t *testing.T) {
+	l := New(nil)
+	tcp := NewTCP("t1", "127.0.0.1:0")
+	l.Add(tcp)
+	require.NoError(t, l.Listen("t1"))
+	l.Serve("t1", MockEstablisher)
+
+	tcp.listen.Close() // close the underlying listener without closing the listener.
+	l.wg.Wait()
+
+	state, _ := l.State("t1")
+	require.Equal(t, StateFailed, state.Status)
+	require.Error(t, state.Err)
+	tcp.Close(MockCloser)
+}
+
+func TestListenerStateStopped(t *testing.T) {
+	l := New(nil)
+	l.Add(NewMemory("t1"))
+	l.Serve("t1", MockEstablisher)
+
+	l.internal["t1"].(*Memory).Close(MockCloser) // stop without closing through the listeners.
+	l.wg.Wait()
+
+	state, _ := l.State("t1")
+	require.Equal(t, State{Status: StateStopped, Address: "t1"}, state)
+}
+
 func TestServeListener(t *testing.T) {
 	l := New(nil)
 	l.Add(NewMockListener("t1", ":1882"))
@@ -186,6 +275,50 @@ func BenchmarkServeAllListeners(b *testing.B) {
 	}
 }
 
+func TestServeListenerOnce(t *testing.T) {
+	l := New(nil)
+	m := NewMockListener("t1", ":1882")
+	l.Add(m)
+	l.Serve("t1", MockEstablisher)
+	l.Serve("t1", MockEstablisher) // already serving.
+	l.Serve("t2", MockEstablisher) // missing listeners are ignored.
+
+	l.Close("t1", MockCloser)
+	l.wg.Wait()
+}
+
+func TestRemoveListener(t *testing.T) {
+	l := New(nil)
+	l.Add(NewMockListener("t1", ":1882"))
+	l.Serve("t1", MockEstablisher)
+
+	var closed string
+	err := l.Remove("t1", func(id string) {
+		closed = id
+	})
+	require.NoError(t, err)
+	require.Equal(t, "t1", closed)
+	require.Equal(t, 0, l.Len())
+	_, ok := l.State("t1")
+	require.False(t, ok)
+
+	require.ErrorIs(t, l.Remove("t1", MockCloser), ErrListenerNotFound)
+}
+
+func TestRemoveListenerNotServed(t *testing.T) {
+	l := New(nil)
+	l.Add(NewMockListener("t1", ":1882"))
+	require.NoError(t, l.Remove("t1", MockCloser))
+	require.Equal(t, 0, l.Len())
+}
+
+func TestCloseListenerMissing(t *testing.T) {
+	l := New(nil)
+	l.Close("t1", func(id string) {
+		require.Fail(t, "missing listener closed")
+	})
+}
+
 func TestCloseListener(t *testing.T) {
 	l := New(nil)
 	mocked := NewMockListener("t1", ":1882")
@@ -0,0 +1,427 @@
+package listeners
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/logger"
+	"github.com/mochi-co/mqtt/server/system"
+)
+
+const (
+	// memBufferSize is the number of bytes buffered in each direction of an
+	// in-memory connection before writes wait for the other end to read.
+	memBufferSize = 64 * 1024
+)
+
+var (
+	// ErrListenerClosed indicates that a connection was dialed to a listener
+	// which has been closed.
+	ErrListenerClosed = errors.New("listener closed")
+)
+
+// Memory is a listener for establishing client connections in memory, without
+// opening a network address. Clients in the same process, such as tests, connect
+// to the server using Dial.
+type Memory struct {
+	sync.RWMutex
+	id     string        // the internal id of the listener.
+	config *Config       // configuration values for the listener.
+	log    logger.Logger // a logger for listener events.
+	conns  chan net.Conn // dialed connections waiting to be established.
+	dialed uint64        // the number of connections dialed, used to name clients.
+	done   chan struct{} // closed when the listener is closed.
+	end    sync.Once     // ensures the listener is only closed once.
+}
+
+// NewMemory initialises and returns a new in-memory listener.
+func NewMemory(id string) *Memory {
+	return &Memory{
+		id: id,
+		config: &Config{ // default configuration.
+			Auth: new(auth.Allow),
+		},
+		log:   new(logger.Nop),
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// SetConfig sets the configuration values for the listener config.
+func (l *Memory) SetConfig(config *Config) {
+	l.Lock()
+	if config != nil {
+		l.config = config
+
+		// If a config has been passed without an auth controller,
+		// it may be a mistake, so disallow all traffic.
+		if l.config.Auth == nil {
+			l.config.Auth = new(auth.Disallow)
+		}
+	}
+
+	l.Unlock()
+}
+
+// SetLogger sets the logger used by the listener.
+func (l *Memory) SetLogger(log logger.Logger) {
+	l.Lock()
+	l.log = log
+	l.Unlock()
+}
+
+// ID returns the id of the listener.
+func (l *Memory) ID() string {
+	l.RLock()
+	id := l.id
+	l.RUnlock()
+	return id
+}
+
+// Listen prepares the listener. No network address is opened.
+func (l *Memory) Listen(s *system.Info) error {
+	return nil
+}
+
+// Serve establishes dialed connections with the connection establishment
+// callback until the listener is closed.
+func (l *Memory) Serve(establish EstablishFunc) {
+	for {
+		select {
+		case conn := <-l.conns:
+			l.RLock()
+			ac := l.config.Auth
+			l.log.Debug("connection accepted", "listener", l.id, "remote", conn.RemoteAddr().String())
+			l.RUnlock()
+
+			go func() {
+				_ = establish(l.id, conn, ac)
+			}()
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// Dial connects a new client to the listener and returns the client end of the
+// connection. It waits until the listener is served.
+func (l *Memory) Dial() (net.Conn, error) {
+	return l.DialContext(context.Background())
+}
+
+// DialContext connects a new client to the listener, waiting until the
+// listener is served or the context is done.
+func (l *Memory) DialContext(ctx context.Context) (net.Conn, error) {
+	n := atomic.AddUint64(&l.dialed, 1)
+	client, server := memPipe(memAddr(l.id+"-"+strconv.FormatUint(n, 10)), memAddr(l.id))
+
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Addr returns the in-memory address of the listener, which is its id.
+func (l *Memory) Addr() net.Addr {
+	return memAddr(l.ID())
+}
+
+// Close stops accepting connections and closes any client connections.
+func (l *Memory) Close(closeClients CloseFunc) {
+	l.end.Do(func() {
+		close(l.done)
+	})
+
+	closeClients(l.ID())
+}
+
+// memAddr is the address of one end of an in-memory connection.
+type memAddr string
+
+// Network returns the name of the network.
+func (a memAddr) Network() string {
+	return "memory"
+}
+
+// String returns the address.
+func (a memAddr) String() string {
+	return string(a)
+}
+
+// memPipe returns the two ends of a buffered in-memory connection. Unlike
+// net.Pipe, writes only wait for the other end to read once memBufferSize
+// bytes are buffered.
+func memPipe(client, server memAddr) (net.Conn, net.Conn) {
+	a, b := newMemBuffer(memBufferSize), newMemBuffer(memBufferSize)
+	return newMemConn(a, b, client, server), newMemConn(b, a, server, client)
+}
+
+// memBuffer holds the bytes written in one direction of an in-memory connection.
+type memBuffer struct {
+	sync.Mutex
+	buf    bytes.Buffer  // bytes written but not yet read.
+	size   int           // the maximum number of bytes buffered.
+	closed bool          // true once either end has closed the connection.
+	signal chan struct{} // wakes a waiting reader after a write or close.
+	space  chan struct{} // wakes a waiting writer after a read or close.
+}
+
+// newMemBuffer returns a new memBuffer which holds up to size bytes.
+func newMemBuffer(size int) *memBuffer {
+	return &memBuffer{
+		size:   size,
+		signal: make(chan struct{}, 1),
+		space:  make(chan struct{}, 1),
+	}
+}
+
+// write appends as many bytes to the buffer as it has space for, returning the
+// number of bytes written.
+func (b *memBuffer) write(p []byte) (int, error) {
+	b.Lock()
+	if b.closed {
+		b.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+
+	n := b.size - b.buf.Len()
+	if n > len(p) {
+		n = len(p)
+	}
+
+	if n > 0 {
+		b.buf.Write(p[:n])
+	}
+	b.Unlock()
+
+	if n > 0 {
+		wake(b.signal)
+	}
+	return n, nil
+}
+
+// close marks the buffer as closed. Buffered bytes may still be read.
+func (b *memBuffer) close() {
+	b.Lock()
+	b.closed = true
+	b.Unlock()
+	wake(b.signal)
+	wake(b.space)
+}
+
+// wake wakes a reader or writer waiting on a signal channel, if any.
+func wake(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// memConn is one end of an in-memory connection, which satisfies the net.Conn
+// interface.
+type memConn struct {
+	r             *memBuffer    // the buffer read from.
+	w             *memBuffer    // the buffer written to.
+	local         memAddr       // the address of this end.
+	remote        memAddr       // the address of the other end.
+	readDeadline  *memDeadline  // the read deadline.
+	writeDeadline *memDeadline  // the write deadline.
+	done          chan struct{} // closed when this end is closed.
+	end           sync.Once     // ensures the connection is only closed once.
+}
+
+// newMemConn returns a new memConn.
+func newMemConn(r, w *memBuffer, local, remote memAddr) *memConn {
+	return &memConn{
+		r:             r,
+		w:             w,
+		local:         local,
+		remote:        remote,
+		readDeadline:  newMemDeadline(),
+		writeDeadline: newMemDeadline(),
+		done:          make(chan struct{}),
+	}
+}
+
+// Read reads bytes written by the other end, waiting until bytes are
+// available, the other end is closed, or the read deadline passes.
+func (c *memConn) Read(p []byte) (int, error) {
+	for {
+		select {
+		case <-c.done:
+			return 0, io.ErrClosedPipe
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		default:
+		}
+
+		c.r.Lock()
+		if c.r.buf.Len() > 0 || len(p) == 0 {
+			n, _ := c.r.buf.Read(p)
+			c.r.Unlock()
+			wake(c.r.space)
+			return n, nil
+		}
+
+		if c.r.closed {
+			c.r.Unlock()
+			return 0, io.EOF
+		}
+		c.r.Unlock()
+
+		select {
+		case <-c.r.signal:
+		case <-c.readDeadline.wait():
+		case <-c.done:
+		}
+	}
+}
+
+// Write writes bytes to be read by the other end, waiting while the buffer is
+// full until the other end reads, either end is closed, or the write deadline
+// passes.
+func (c *memConn) Write(p []byte) (int, error) {
+	var n int
+	for {
+		select {
+		case <-c.done:
+			return n, io.ErrClosedPipe
+		case <-c.writeDeadline.wait():
+			return n, os.ErrDeadlineExceeded
+		default:
+		}
+
+		m, err := c.w.write(p[n:])
+		n += m
+		if err != nil || n == len(p) {
+			return n, err
+		}
+
+		if m > 0 {
+			continue
+		}
+
+		select {
+		case <-c.w.space:
+		case <-c.writeDeadline.wait():
+		case <-c.done:
+		}
+	}
+}
+
+// Close closes the connection. The other end may read any bytes already
+// written before receiving io.EOF.
+func (c *memConn) Close() error {
+	c.end.Do(func() {
+		close(c.done)
+		c.w.close()
+		c.r.close()
+	})
+
+	return nil
+}
+
+// LocalAddr returns the address of this end of the connection.
+func (c *memConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the address of the other end of the connection.
+func (c *memConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline sets the read and write deadlines.
+func (c *memConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline sets the read deadline.
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline.
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// memDeadline is a deadline of an in-memory connection, which closes a
+// channel when it passes.
+type memDeadline struct {
+	sync.Mutex
+	timer  *time.Timer   // closes cancel when the deadline passes.
+	cancel chan struct{} // closed once the deadline has passed.
+}
+
+// newMemDeadline returns a new memDeadline with no deadline set.
+func newMemDeadline() *memDeadline {
+	return &memDeadline{
+		cancel: make(chan struct{}),
+	}
+}
+
+// set sets the deadline. A zero time clears the deadline.
+func (d *memDeadline) set(t time.Time) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer to close the channel.
+	}
+	d.timer = nil
+
+	var expired bool
+	select {
+	case <-d.cancel:
+		expired = true
+	default:
+	}
+
+	if t.IsZero() {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+
+	if !expired {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel which is closed when the deadline passes.
+func (d *memDeadline) wait() chan struct{} {
+	d.Lock()
+	defer d.Unlock()
+	return d.cancel
+}
@@ -0,0 +1,265 @@
+package listeners
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewMemory(t *testing.T) {
+	l := NewMemory("m1")
+	require.Equal(t, "m1", l.id)
+	require.Equal(t, new(auth.Allow), l.config.Auth)
+	require.NoError(t, l.Listen(nil))
+}
+
+func TestMemorySetConfig(t *testing.T) {
+	l := NewMemory("m1")
+
+	l.SetConfig(&Config{
+		Auth: new(auth.Allow),
+	})
+	require.Equal(t, new(auth.Allow), l.config.Auth)
+
+	// Switch to disallow on bad config set.
+	l.SetConfig(new(Config))
+	require.Equal(t, new(auth.Disallow), l.config.Auth)
+}
+
+func TestMemorySetLogger(t *testing.T) {
+	l := NewMemory("m1")
+	log := new(logger.Mock)
+	l.SetLogger(log)
+	require.Equal(t, log, l.log)
+}
+
+func TestMemoryID(t *testing.T) {
+	l := NewMemory("m1")
+	require.Equal(t, "m1", l.ID())
+}
+
+func TestMemoryAddr(t *testing.T) {
+	l := NewMemory("mem")
+	require.Equal(t, "memory", l.Addr().Network())
+	require.Equal(t, "mem", l.Addr().String())
+}
+
+func TestMemoryServeDial(t *testing.T) {
+	l := NewMemory("m1")
+	l.SetConfig(&Config{Auth: new(auth.Disallow)})
+
+	type established struct {
+		id   string
+		conn net.Conn
+		ac   auth.Controller
+	}
+
+	e := make(chan established)
+	o := make(chan bool)
+	go func() {
+		l.Serve(func(id string, c net.Conn, ac auth.Controller) error {
+			e <- established{id, c, ac}
+			return nil
+		})
+		o <- true
+	}()
+
+	client, err := l.Dial()
+	require.NoError(t, err)
+	defer client.Close()
+
+	got := <-e
+	require.Equal(t, "m1", got.id)
+	require.Equal(t, new(auth.Disallow), got.ac)
+	require.Equal(t, "m1-1", client.LocalAddr().String())
+	require.Equal(t, "m1", client.RemoteAddr().String())
+	require.Equal(t, "m1-1", got.conn.RemoteAddr().String())
+	require.Equal(t, "memory", got.conn.RemoteAddr().Network())
+
+	// writes do not wait for the other end to read.
+	_, err = client.Write([]byte{0x10, 0x00})
+	require.NoError(t, err)
+	_, err = client.Write([]byte{0xc0, 0x00})
+	require.NoError(t, err)
+
+	b := make([]byte, 4)
+	_, err = io.ReadFull(got.conn, b)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x10, 0x00, 0xc0, 0x00}, b)
+
+	var closed bool
+	l.Close(func(id string) {
+		closed = true
+	})
+	require.True(t, closed)
+	<-o
+
+	_, err = l.Dial()
+	require.ErrorIs(t, err, ErrListenerClosed)
+
+	// closing again only closes clients.
+	l.Close(MockCloser)
+}
+
+func TestMemoryDialContext(t *testing.T) {
+	l := NewMemory("m1")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+
+	_, err := l.DialContext(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestMemConnClose(t *testing.T) {
+	client, server := memPipe("client", "server")
+
+	_, err := client.Write([]byte{1, 2})
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+	require.NoError(t, client.Close())
+
+	// buffered bytes are read before eof.
+	b, err := io.ReadAll(server)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2}, b)
+
+	_, err = server.Write([]byte{3})
+	require.ErrorIs(t, err, io.ErrClosedPipe)
+
+	_, err = client.Write([]byte{3})
+	require.ErrorIs(t, err, io.ErrClosedPipe)
+
+	_, err = client.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.ErrClosedPipe)
+}
+
+func TestMemConnCloseWhileReading(t *testing.T) {
+	client, server := memPipe("client", "server")
+
+	o := make(chan error)
+	go func() {
+		_, err := server.Read(make([]byte, 1))
+		o <- err
+	}()
+
+	time.Sleep(time.Millisecond)
+	server.Close()
+	require.ErrorIs(t, <-o, io.ErrClosedPipe)
+	client.Close()
+}
+
+func TestMemConnReadEmpty(t *testing.T) {
+	client, _ := memPipe("client", "server")
+	n, err := client.Read(nil)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+}
+
+func TestMemConnReadDeadline(t *testing.T) {
+	client, server := memPipe("client", "server")
+
+	require.NoError(t, server.SetReadDeadline(time.Now().Add(time.Millisecond)))
+	_, err := server.Read(make([]byte, 1))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// expired deadlines fail immediately.
+	_, err = server.Read(make([]byte, 1))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// clearing the deadline allows reads again.
+	require.NoError(t, server.SetReadDeadline(time.Time{}))
+	_, err = client.Write([]byte{1})
+	require.NoError(t, err)
+	b := make([]byte, 1)
+	_, err = server.Read(b)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, b)
+
+	// extending a deadline before it passes.
+	require.NoError(t, server.SetReadDeadline(time.Now().Add(time.Millisecond)))
+	require.NoError(t, server.SetReadDeadline(time.Now().Add(time.Hour)))
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		client.Write([]byte{2})
+	}()
+	_, err = server.Read(b)
+	require.NoError(t, err)
+	require.Equal(t, []byte{2}, b)
+}
+
+func TestMemConnWriteDeadline(t *testing.T) {
+	client, _ := memPipe("client", "server")
+
+	require.NoError(t, client.SetDeadline(time.Now().Add(-time.Second)))
+	_, err := client.Write([]byte{1})
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	require.NoError(t, client.SetWriteDeadline(time.Time{}))
+	_, err = client.Write([]byte{1})
+	require.NoError(t, err)
+}
+
+func TestMemConnWriteFull(t *testing.T) {
+	client, server := memPipe("client", "server")
+	client.(*memConn).w.size = 4
+
+	// writes wait for the other end to read once the buffer is full.
+	written := make(chan int)
+	go func() {
+		n, _ := client.Write([]byte{1, 2, 3, 4, 5, 6})
+		written <- n
+	}()
+
+	select {
+	case <-written:
+		t.Fatal("write did not wait for a full buffer")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	p := make([]byte, 6)
+	_, err := io.ReadFull(server, p)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3, 4, 5, 6}, p)
+	require.Equal(t, 6, <-written)
+}
+
+func TestMemConnWriteFullDeadline(t *testing.T) {
+	client, _ := memPipe("client", "server")
+	client.(*memConn).w.size = 4
+
+	require.NoError(t, client.SetWriteDeadline(time.Now().Add(10*time.Millisecond)))
+	n, err := client.Write([]byte{1, 2, 3, 4, 5, 6})
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	require.Equal(t, 4, n)
+}
+
+func TestMemConnWriteFullClose(t *testing.T) {
+	client, server := memPipe("client", "server")
+	client.(*memConn).w.size = 4
+
+	o := make(chan error)
+	go func() {
+		_, err := client.Write([]byte{1, 2, 3, 4, 5, 6})
+		o <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	server.Close()
+	require.ErrorIs(t, <-o, io.ErrClosedPipe)
+}
+
+func BenchmarkMemConnWriteRead(b *testing.B) {
+	client, server := memPipe("client", "server")
+	p := make([]byte, 64)
+	for n := 0; n < b.N; n++ {
+		client.Write(p)
+		io.ReadFull(server, p)
+	}
+}
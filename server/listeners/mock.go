@@ -7,6 +7,7 @@ import (
 	"sync"
 
 	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/logger"
 	"github.com/mochi-co/mqtt/server/system"
 )
 
@@ -18,16 +19,19 @@ func MockEstablisher(id string, c net.Conn, ac auth.Controller) error {
 	return nil
 }
 
-// MockListener is a mock listener for establishing client connections.
+// MockListener is a mock listener for establishing client connections. It does
+// not establish connections, so tests which connect clients to a server should
+// use a Memory listener instead.
 type MockListener struct {
 	sync.RWMutex
-	id        string    // the id of the listener.
-	address   string    // the network address the listener binds to.
-	Config    *Config   // configuration for the listener.
-	done      chan bool // indicate the listener is done.
-	Serving   bool      // indicate the listener is serving.
-	Listening bool      // indiciate the listener is listening.
-	ErrListen bool      // throw an error on listen.
+	id        string        // the id of the listener.
+	address   string        // the network address the listener binds to.
+	Config    *Config       // configuration for the listener.
+	Log       logger.Logger // the logger passed by the server.
+	done      chan bool     // indicate the listener is done.
+	Serving   bool          // indicate the listener is serving.
+	Listening bool          // indiciate the listener is listening.
+	ErrListen bool          // throw an error on listen.
 }
 
 // NewMockListener returns a new instance of MockListener
@@ -68,6 +72,13 @@ func (l *MockListener) SetConfig(config *Config) {
 	l.Unlock()
 }
 
+// SetLogger sets the logger of the mock listener.
+func (l *MockListener) SetLogger(log logger.Logger) {
+	l.Lock()
+	l.Log = log
+	l.Unlock()
+}
+
 // ID returns the id of the mock listener.
 func (l *MockListener) ID() string {
 	l.RLock()
@@ -8,6 +8,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/logger"
 )
 
 func TestMockEstablisher(t *testing.T) {
@@ -87,3 +88,10 @@ func TestNewMockListenerIsServing(t *testing.T) {
 	mocked := NewMockListener("t1", ":1882")
 	require.Equal(t, false, mocked.IsServing())
 }
+
+func TestMockListenerSetLogger(t *testing.T) {
+	mocked := NewMockListener("t1", testPort)
+	log := new(logger.Mock)
+	mocked.SetLogger(log)
+	require.Equal(t, log, mocked.Log)
+}
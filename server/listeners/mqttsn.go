@@ -0,0 +1,1152 @@
+package listeners
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/xid"
+
+	"github.com/mochi-co/mqtt/server/internal/packets"
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/logger"
+	"github.com/mochi-co/mqtt/server/system"
+)
+
+const (
+	defaultMQTTSNSleepBuffer = 100              // the default number of messages buffered for a sleeping client.
+	defaultMQTTSNSupervise   = time.Second      // how often the keepalives and sleep durations of clients are checked.
+	mqttsnMaxDatagram        = 65535            // the largest datagram which can be received.
+	mqttsnConnectTimeout     = 30 * time.Second // the time a client has to finish will negotiation.
+	mqttsnWriteTimeout       = 5 * time.Second  // the time the server has to read a packet from the gateway.
+)
+
+var (
+	// ErrInvalidMQTTPacket indicates that the server sent an MQTT packet which
+	// the gateway could not decode.
+	ErrInvalidMQTTPacket = errors.New("invalid mqtt packet")
+)
+
+// PublishFunc publishes a message on behalf of a client which is not connected
+// to the server, returning false if the message was rejected.
+type PublishFunc func(cl auth.Client, topic string, payload []byte, retain bool) bool
+
+// Publisher is an interface for listeners which publish messages on behalf of
+// clients which are not connected, such as MQTT-SN qos -1 publishes. The server
+// sets the publish function when the listener is added.
+type Publisher interface {
+	SetPublisher(fn PublishFunc)
+}
+
+// MQTTSNOptions contains the settings of an MQTT-SN gateway listener.
+type MQTTSNOptions struct {
+	GatewayID                 byte              // the gateway id sent to clients searching for a gateway.
+	PredefinedTopics          map[uint16]string // topic names which clients may use by id without registering them.
+	SleepBuffer               int               // the number of messages buffered for each sleeping client, 100 if 0.
+	AllowAnonymousQosMinusOne bool              // accept qos -1 publishes from unconnected clients, authenticated anonymously by remote address.
+}
+
+// MQTTSN is a listener which acts as an MQTT-SN v1.2 gateway over UDP. Each
+// MQTT-SN client is connected to the server as an MQTT client with a session of
+// its own, so clients are authenticated by the auth controller of the listener
+// using their client id and remote address, and are subject to its ACLs.
+type MQTTSN struct {
+	sync.RWMutex
+	id        string               // the internal id of the listener.
+	address   string               // the network address to bind to.
+	opts      MQTTSNOptions        // the gateway options.
+	topics    map[string]uint16    // the predefined topic ids, by topic name.
+	conn      net.PacketConn       // the udp socket of the gateway.
+	config    *Config              // configuration values for the listener.
+	log       logger.Logger        // a logger for listener events.
+	err       error                // the error which stopped the listener serving, if any.
+	establish EstablishFunc        // the connection establishment callback.
+	publish   PublishFunc          // publishes qos -1 messages.
+	clients   map[string]*snClient // the clients of the gateway, by remote address.
+	supervise time.Duration        // how often the keepalives and sleep durations of clients are checked.
+	done      chan struct{}        // closed when the listener is closed.
+	end       uint32               // ensure the close methods are only called once.
+}
+
+// NewMQTTSN initialises and returns a new MQTT-SN gateway listener, listening
+// on a udp address.
+func NewMQTTSN(id, address string) *MQTTSN {
+	return &MQTTSN{
+		id:      id,
+		address: address,
+		topics:  map[string]uint16{},
+		config: &Config{ // default configuration.
+			Auth: new(auth.Allow),
+		},
+		opts: MQTTSNOptions{
+			SleepBuffer: defaultMQTTSNSleepBuffer,
+		},
+		log:       new(logger.Nop),
+		clients:   map[string]*snClient{},
+		supervise: defaultMQTTSNSupervise,
+		done:      make(chan struct{}),
+	}
+}
+
+// SetOptions sets the gateway options of the listener.
+func (l *MQTTSN) SetOptions(opts MQTTSNOptions) {
+	l.Lock()
+	defer l.Unlock()
+
+	if opts.SleepBuffer <= 0 {
+		opts.SleepBuffer = defaultMQTTSNSleepBuffer
+	}
+
+	l.opts = opts
+	l.topics = make(map[string]uint16, len(opts.PredefinedTopics))
+	for id, topic := range opts.PredefinedTopics {
+		l.topics[topic] = id
+	}
+}
+
+// SetConfig sets the configuration values for the listener config. The tls
+// settings are not used.
+func (l *MQTTSN) SetConfig(config *Config) {
+	l.Lock()
+	if config != nil {
+		l.config = config
+
+		// If a config has been passed without an auth controller,
+		// it may be a mistake, so disallow all traffic.
+		if l.config.Auth == nil {
+			l.config.Auth = new(auth.Disallow)
+		}
+	}
+
+	l.Unlock()
+}
+
+// SetPublisher sets the function used to publish qos -1 messages.
+func (l *MQTTSN) SetPublisher(fn PublishFunc) {
+	l.Lock()
+	l.publish = fn
+	l.Unlock()
+}
+
+// SetLogger sets the logger used by the listener.
+func (l *MQTTSN) SetLogger(log logger.Logger) {
+	l.Lock()
+	l.log = log
+	l.Unlock()
+}
+
+// ID returns the id of the listener.
+func (l *MQTTSN) ID() string {
+	l.RLock()
+	id := l.id
+	l.RUnlock()
+	return id
+}
+
+// Listen starts listening on the listener's udp address.
+func (l *MQTTSN) Listen(s *system.Info) error {
+	conn, err := net.ListenPacket("udp", l.address)
+	if err != nil {
+		return err
+	}
+
+	l.Lock()
+	l.conn = conn
+	l.Unlock()
+
+	return nil
+}
+
+// Serve reads MQTT-SN messages from clients, and calls the establish connection
+// callback for each client which connects.
+func (l *MQTTSN) Serve(establish EstablishFunc) {
+	l.Lock()
+	l.establish = establish
+	l.Unlock()
+
+	go l.supervisor()
+
+	buf := make([]byte, mqttsnMaxDatagram)
+	for {
+		if atomic.LoadUint32(&l.end) == 1 {
+			return
+		}
+
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if atomic.LoadUint32(&l.end) == 0 {
+				l.log.Error("listener stopped reading datagrams", "listener", l.id, "error", err)
+				l.Lock()
+				l.err = err
+				l.Unlock()
+			}
+			return
+		}
+
+		pk, err := decodeSNPacket(buf[:n])
+		if err != nil {
+			l.log.Debug("mqtt-sn packet rejected", "listener", l.id, "remote", addr.String(), "error", err)
+			continue
+		}
+
+		l.handle(addr, pk)
+	}
+}
+
+// Addr returns the network address the listener is bound to, or nil if it is
+// not listening.
+func (l *MQTTSN) Addr() net.Addr {
+	l.RLock()
+	defer l.RUnlock()
+	if l.conn == nil {
+		return nil
+	}
+
+	return l.conn.LocalAddr()
+}
+
+// ServeErr returns the error which stopped the listener serving, if any.
+func (l *MQTTSN) ServeErr() error {
+	l.RLock()
+	defer l.RUnlock()
+	return l.err
+}
+
+// Close closes the listener and any client connections.
+func (l *MQTTSN) Close(closeClients CloseFunc) {
+	l.Lock()
+	var clients []*snClient
+	if atomic.CompareAndSwapUint32(&l.end, 0, 1) {
+		close(l.done)
+		closeClients(l.id)
+		for _, c := range l.clients {
+			clients = append(clients, c)
+		}
+	}
+
+	if l.conn != nil {
+		_ = l.conn.Close()
+	}
+	l.Unlock()
+
+	// The clients cannot be reached once the socket is closed, so their
+	// connections are closed even if the server kept them open.
+	for _, c := range clients {
+		c.close()
+	}
+}
+
+// handle processes a message received from a client.
+func (l *MQTTSN) handle(addr net.Addr, pk snPacket) {
+	switch pk.Type {
+	case snSearchGW:
+		l.RLock()
+		gwid := l.opts.GatewayID
+		l.RUnlock()
+		l.send(addr, snPacket{Type: snGWInfo, GatewayID: gwid})
+		return
+	case snConnect:
+		l.connect(addr, pk)
+		return
+	case snPingreq:
+		if pk.ClientID != "" {
+			l.wake(addr, pk.ClientID)
+			return
+		}
+	case snPublish:
+		if pk.qos() == snQosMinusOne {
+			l.publishMinusOne(addr, pk)
+			return
+		}
+	}
+
+	l.RLock()
+	c, ok := l.clients[addr.String()]
+	l.RUnlock()
+	if !ok {
+		l.log.Debug("mqtt-sn packet from unknown client", "listener", l.id, "remote", addr.String(), "type", pk.Type)
+		return
+	}
+
+	c.handle(pk)
+}
+
+// send sends a message to a client.
+func (l *MQTTSN) send(addr net.Addr, pk snPacket) {
+	_, _ = l.conn.WriteTo(pk.encode(), addr)
+}
+
+// connect connects a client to the server, first requesting its will if the
+// will flag is set. A sleeping client which connects again without a clean
+// session resumes its existing session.
+func (l *MQTTSN) connect(addr net.Addr, pk snPacket) {
+	l.RLock()
+	old, ok := l.clients[addr.String()]
+	l.RUnlock()
+
+	if ok {
+		if old.resume(pk) {
+			return
+		}
+		old.disconnect()
+	}
+
+	c := newSNClient(l, addr, pk)
+	c.Lock()
+	defer c.Unlock()
+
+	l.Lock()
+	l.clients[addr.String()] = c
+	l.Unlock()
+
+	if pk.Flags&snFlagWill > 0 {
+		c.state = snStateWillTopic
+		c.send(snPacket{Type: snWillTopicReq})
+		return
+	}
+
+	c.dial()
+}
+
+// wake delivers the messages buffered for a sleeping client. A client may only
+// wake from the address it connected from, and must connect again if its
+// address has changed.
+func (l *MQTTSN) wake(addr net.Addr, id string) {
+	l.RLock()
+	c := l.clients[addr.String()]
+	l.RUnlock()
+
+	if c == nil || c.id != id {
+		l.log.Debug("mqtt-sn wake from unknown client", "listener", l.id, "remote", addr.String(), "client_id", id)
+		return
+	}
+
+	c.wake()
+}
+
+// publishMinusOne publishes a qos -1 message, which is sent by clients without
+// connecting, using a predefined topic id or short topic name. A message from
+// the address of a connected client is published as that client, and any other
+// message is only accepted if AllowAnonymousQosMinusOne is set and the auth
+// controller of the listener authenticates it as an anonymous client.
+func (l *MQTTSN) publishMinusOne(addr net.Addr, pk snPacket) {
+	l.RLock()
+	publish := l.publish
+	ac := auth.Adapt(l.config.Auth)
+	anonymous := l.opts.AllowAnonymousQosMinusOne
+	topic, ok := l.predefined(pk)
+	c := l.clients[addr.String()]
+	l.RUnlock()
+
+	if !ok || publish == nil {
+		l.log.Debug("mqtt-sn qos -1 publish dropped", "listener", l.id, "remote", addr.String(), "topic_id", pk.TopicID)
+		return
+	}
+
+	cl := auth.Client{
+		Remote:   addr.String(),
+		Listener: l.id,
+	}
+
+	if c != nil && c.connected() {
+		cl.ID = c.id
+	} else {
+		if !anonymous {
+			l.log.Debug("mqtt-sn qos -1 publish from unconnected client", "listener", l.id, "remote", addr.String())
+			return
+		}
+
+		cl.ConnID = xid.New().String()
+		if !ac.AuthenticateClient(cl, nil) {
+			l.log.Debug("mqtt-sn qos -1 publish not authenticated", "listener", l.id, "remote", addr.String())
+			return
+		}
+
+		if d, ok := ac.(auth.Disconnector); ok {
+			defer d.ClientDisconnected(cl)
+		}
+	}
+
+	retain := pk.Flags&snFlagRetain > 0
+	if !ac.ClientACL(cl, auth.Access{Topic: topic, Write: true, Retain: retain}) {
+		l.log.Debug("mqtt-sn qos -1 publish denied", "listener", l.id, "remote", addr.String(), "topic", topic)
+		return
+	}
+
+	publish(cl, topic, pk.Data, retain)
+}
+
+// predefined returns the topic name of a predefined topic id or short topic
+// name. It must be called while holding a lock.
+func (l *MQTTSN) predefined(pk snPacket) (string, bool) {
+	switch pk.topicIDType() {
+	case snTopicPredefined:
+		topic, ok := l.opts.PredefinedTopics[pk.TopicID]
+		return topic, ok
+	case snTopicShort:
+		return string([]byte{byte(pk.TopicID >> 8), byte(pk.TopicID)}), true
+	}
+
+	return "", false
+}
+
+// supervise disconnects clients which have not been heard from within one and a
+// half times their keepalive or sleep duration, until the listener is closed.
+func (l *MQTTSN) supervisor() {
+	tick := time.NewTicker(l.supervise)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case now := <-tick.C:
+			l.RLock()
+			clients := make([]*snClient, 0, len(l.clients))
+			for _, c := range l.clients {
+				clients = append(clients, c)
+			}
+			l.RUnlock()
+
+			for _, c := range clients {
+				if c.expired(now) {
+					l.log.Info("mqtt-sn client lost", "listener", l.id, "client_id", c.id)
+					l.remove(c)
+					c.close()
+				}
+			}
+		}
+	}
+}
+
+// remove removes a client from the gateway if it is still the client of its
+// remote address.
+func (l *MQTTSN) remove(c *snClient) {
+	l.Lock()
+	defer l.Unlock()
+
+	for key, cl := range l.clients {
+		if cl == c {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// The states of an MQTT-SN client.
+const (
+	snStateWillTopic  byte = iota // waiting for the will topic.
+	snStateWillMsg                // waiting for the will message.
+	snStateConnecting             // waiting for the server to accept the connection.
+	snStateActive                 // connected.
+	snStateAsleep                 // sleeping, with messages buffered.
+	snStateAwake                  // receiving buffered messages.
+	snStateClosed                 // disconnected.
+)
+
+// snClient is an MQTT-SN client of a gateway, which is translated to an MQTT
+// connection to the server. The client lock may be held while taking the
+// listener lock, but not the reverse.
+type snClient struct {
+	sync.Mutex
+	l           *MQTTSN                    // the gateway of the client.
+	addr        net.Addr                   // the remote address of the client.
+	id          string                     // the client id.
+	state       byte                       // the state of the client.
+	conn        net.Conn                   // the gateway end of the mqtt connection to the server.
+	connect     packets.Packet             // the mqtt connect packet of the client.
+	keepalive   time.Duration              // the keepalive of the client.
+	sleep       time.Duration              // the sleep duration of a sleeping client.
+	seen        time.Time                  // the time the client was last heard from.
+	topics      map[uint16]string          // the registered topic names, by topic id.
+	ids         map[string]uint16          // the registered topic ids, by topic name.
+	nextTopic   uint16                     // the last topic id registered.
+	nextMsg     uint16                     // the last message id used for a register.
+	pubacks     map[uint16]uint16          // the topic ids of qos 1 publishes awaiting a puback, by message id.
+	subacks     map[uint16]uint16          // the topic ids of subscriptions awaiting a suback, by message id.
+	registering map[uint16]*snRegistration // registers awaiting a regack, by message id.
+	buffered    []packets.Packet           // messages received while sleeping.
+}
+
+// snRegistration is a topic registered with a client by the gateway, and the
+// publishes waiting for the client to acknowledge it.
+type snRegistration struct {
+	id      uint16     // the topic id.
+	waiting []snPacket // the publishes to send once acknowledged.
+}
+
+// newSNClient returns a new snClient for a connect message.
+func newSNClient(l *MQTTSN, addr net.Addr, pk snPacket) *snClient {
+	return &snClient{
+		l:     l,
+		addr:  addr,
+		id:    pk.ClientID,
+		state: snStateConnecting,
+		connect: packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type: packets.Connect,
+			},
+			ProtocolName:     []byte("MQTT"),
+			ProtocolVersion:  4,
+			CleanSession:     pk.Flags&snFlagCleanSession > 0,
+			ClientIdentifier: pk.ClientID,
+		},
+		keepalive:   time.Duration(pk.Duration) * time.Second,
+		seen:        time.Now(),
+		topics:      map[uint16]string{},
+		ids:         map[string]uint16{},
+		pubacks:     map[uint16]uint16{},
+		subacks:     map[uint16]uint16{},
+		registering: map[uint16]*snRegistration{},
+	}
+}
+
+// dial connects the client to the server. Keepalives are supervised by the
+// gateway, so the mqtt connection has no keepalive.
+func (c *snClient) dial() {
+	client, server := memPipe(memAddr(c.addr.String()), memAddr(c.l.id))
+	c.conn = client
+	c.state = snStateConnecting
+
+	c.l.RLock()
+	ac := c.l.config.Auth
+	establish := c.l.establish
+	c.l.RUnlock()
+
+	go func() {
+		_ = establish(c.l.id, server, ac)
+	}()
+
+	c.write(c.connect)
+	go c.read(client)
+}
+
+// resume returns a sleeping client to the active state if it connects again
+// without a clean session or will, and returns true if it was resumed.
+func (c *snClient) resume(pk snPacket) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if (c.state != snStateAsleep && c.state != snStateAwake) ||
+		pk.ClientID != c.id || pk.Flags&(snFlagCleanSession|snFlagWill) > 0 {
+		return false
+	}
+
+	c.state = snStateActive
+	c.keepalive = time.Duration(pk.Duration) * time.Second
+	c.seen = time.Now()
+	c.send(snPacket{Type: snConnack, ReturnCode: snAccepted})
+	c.flush()
+
+	return true
+}
+
+// disconnect disconnects the mqtt connection of a client which has connected
+// again, without publishing its will.
+func (c *snClient) disconnect() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.state = snStateClosed
+	if c.conn != nil {
+		c.write(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Disconnect}})
+		_ = c.conn.Close()
+	}
+}
+
+// connected returns true if the client has been accepted by the server.
+func (c *snClient) connected() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.state == snStateActive || c.state == snStateAsleep || c.state == snStateAwake
+}
+
+// wake delivers the messages buffered for a sleeping client. The client returns
+// to sleep once it has received them.
+func (c *snClient) wake() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.seen = time.Now()
+
+	if c.state != snStateAsleep {
+		if c.state == snStateActive {
+			c.send(snPacket{Type: snPingresp})
+		}
+		return
+	}
+
+	c.state = snStateAwake
+	c.flush()
+	c.slept()
+}
+
+// slept returns an awake client to sleep once all buffered messages have been
+// sent to it. It must be called while holding the client lock.
+func (c *snClient) slept() {
+	if c.state == snStateAwake && len(c.registering) == 0 {
+		c.state = snStateAsleep
+		c.send(snPacket{Type: snPingresp})
+	}
+}
+
+// flush sends any buffered messages to the client. It must be called while
+// holding the client lock.
+func (c *snClient) flush() {
+	for _, pk := range c.buffered {
+		c.deliver(pk)
+	}
+	c.buffered = nil
+}
+
+// expired returns true if the client has not been heard from within one and a
+// half times its keepalive or sleep duration.
+func (c *snClient) expired(now time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	var timeout time.Duration
+	switch c.state {
+	case snStateWillTopic, snStateWillMsg:
+		timeout = mqttsnConnectTimeout
+	case snStateAsleep:
+		timeout = c.sleep + c.sleep/2
+	default:
+		timeout = c.keepalive + c.keepalive/2
+	}
+
+	return timeout > 0 && now.Sub(c.seen) > timeout
+}
+
+// close closes the mqtt connection of a lost client without disconnecting, so
+// the server publishes its will.
+func (c *snClient) close() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.state = snStateClosed
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
+}
+
+// send sends a message to the client. It must be called while holding the
+// client lock.
+func (c *snClient) send(pk snPacket) {
+	c.l.send(c.addr, pk)
+}
+
+// write writes an mqtt packet to the server. It must be called while holding the
+// client lock.
+func (c *snClient) write(pk packets.Packet) {
+	if c.conn == nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	var err error
+	switch pk.FixedHeader.Type {
+	case packets.Connect:
+		err = pk.ConnectEncode(&buf)
+	case packets.Publish:
+		err = pk.PublishEncode(&buf)
+	case packets.Puback:
+		err = pk.PubackEncode(&buf)
+	case packets.Pubrec:
+		err = pk.PubrecEncode(&buf)
+	case packets.Pubrel:
+		err = pk.PubrelEncode(&buf)
+	case packets.Pubcomp:
+		err = pk.PubcompEncode(&buf)
+	case packets.Subscribe:
+		err = pk.SubscribeEncode(&buf)
+	case packets.Unsubscribe:
+		err = pk.UnsubscribeEncode(&buf)
+	case packets.Disconnect:
+		err = pk.DisconnectEncode(&buf)
+	}
+
+	if err != nil {
+		return
+	}
+
+	// The server reads the connection continuously, so a full connection means
+	// the client is stuck. Close it rather than stall the gateway.
+	_ = c.conn.SetWriteDeadline(time.Now().Add(mqttsnWriteTimeout))
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		_ = c.conn.Close()
+	}
+}
+
+// handle translates a message from the client into mqtt packets for the server.
+func (c *snClient) handle(pk snPacket) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.seen = time.Now()
+
+	switch pk.Type {
+	case snWillTopic:
+		if c.state != snStateWillTopic {
+			return
+		}
+
+		if pk.TopicName == "" {
+			c.dial()
+			return
+		}
+
+		c.connect.WillFlag = true
+		c.connect.WillTopic = pk.TopicName
+		c.connect.WillQos = pk.qos()
+		c.connect.WillRetain = pk.Flags&snFlagRetain > 0
+		c.state = snStateWillMsg
+		c.send(snPacket{Type: snWillMsgReq})
+	case snWillMsg:
+		if c.state != snStateWillMsg {
+			return
+		}
+
+		c.connect.WillMessage = pk.Data
+		c.dial()
+	case snRegister:
+		c.handleRegister(pk)
+	case snRegack:
+		c.handleRegack(pk)
+	case snPublish:
+		c.handlePublish(pk)
+	case snPuback:
+		if pk.ReturnCode == snRejectedTopicID {
+			c.unregister(pk.TopicID)
+		}
+		c.write(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Puback}, PacketID: pk.MsgID})
+	case snPubrec:
+		c.write(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pubrec}, PacketID: pk.MsgID})
+	case snPubrel:
+		c.write(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pubrel, Qos: 1}, PacketID: pk.MsgID})
+	case snPubcomp:
+		c.write(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pubcomp}, PacketID: pk.MsgID})
+	case snSubscribe:
+		c.handleSubscribe(pk)
+	case snUnsubscribe:
+		c.handleUnsubscribe(pk)
+	case snPingreq:
+		if c.state == snStateActive {
+			c.send(snPacket{Type: snPingresp})
+		}
+	case snDisconnect:
+		c.handleDisconnect(pk)
+	case snWillTopicUpd: // the will of an mqtt session cannot be changed.
+		c.send(snPacket{Type: snWillTopicResp, ReturnCode: snRejectedNotSupported})
+	case snWillMsgUpd:
+		c.send(snPacket{Type: snWillMsgResp, ReturnCode: snRejectedNotSupported})
+	}
+}
+
+// handleRegister registers a topic name requested by the client.
+func (c *snClient) handleRegister(pk snPacket) {
+	if c.state != snStateActive {
+		return
+	}
+
+	if pk.TopicName == "" || strings.ContainsAny(pk.TopicName, "+#") {
+		c.send(snPacket{Type: snRegack, MsgID: pk.MsgID, ReturnCode: snRejectedNotSupported})
+		return
+	}
+
+	c.send(snPacket{Type: snRegack, TopicID: c.register(pk.TopicName), MsgID: pk.MsgID, ReturnCode: snAccepted})
+}
+
+// handleRegack sends the publishes which were waiting for a topic to be
+// registered by the client.
+func (c *snClient) handleRegack(pk snPacket) {
+	reg, ok := c.registering[pk.MsgID]
+	if !ok {
+		return
+	}
+
+	delete(c.registering, pk.MsgID)
+	if pk.ReturnCode != snAccepted {
+		c.unregister(reg.id)
+	} else {
+		for _, w := range reg.waiting {
+			c.send(w)
+		}
+	}
+
+	c.slept()
+}
+
+// handlePublish publishes a message from the client to the server.
+func (c *snClient) handlePublish(pk snPacket) {
+	if c.state != snStateActive {
+		return
+	}
+
+	var topic string
+	var ok bool
+	if pk.topicIDType() == snTopicNormal {
+		topic, ok = c.topics[pk.TopicID]
+	} else {
+		c.l.RLock()
+		topic, ok = c.l.predefined(pk)
+		c.l.RUnlock()
+	}
+
+	if !ok {
+		c.send(snPacket{Type: snPuback, TopicID: pk.TopicID, MsgID: pk.MsgID, ReturnCode: snRejectedTopicID})
+		return
+	}
+
+	qos := pk.qos()
+	if qos == 1 {
+		c.pubacks[pk.MsgID] = pk.TopicID
+	}
+
+	c.write(packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    qos,
+			Dup:    pk.Flags&snFlagDup > 0,
+			Retain: pk.Flags&snFlagRetain > 0,
+		},
+		TopicName: topic,
+		PacketID:  pk.MsgID,
+		Payload:   pk.Data,
+	})
+}
+
+// handleSubscribe subscribes the client to a topic filter. The suback of a
+// topic name without wildcards contains the topic id registered for it.
+func (c *snClient) handleSubscribe(pk snPacket) {
+	if c.state != snStateActive {
+		return
+	}
+
+	filter, id, ok := c.filter(pk)
+	if !ok {
+		c.send(snPacket{Type: snSuback, TopicID: pk.TopicID, MsgID: pk.MsgID, ReturnCode: snRejectedTopicID})
+		return
+	}
+
+	if pk.qos() > 2 {
+		c.send(snPacket{Type: snSuback, TopicID: pk.TopicID, MsgID: pk.MsgID, ReturnCode: snRejectedNotSupported})
+		return
+	}
+
+	if pk.topicIDType() == snTopicNormal && !strings.ContainsAny(filter, "+#") {
+		id = c.register(filter)
+	}
+
+	c.subacks[pk.MsgID] = id
+	c.write(packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Subscribe,
+			Qos:  1,
+		},
+		PacketID: pk.MsgID,
+		Topics:   []string{filter},
+		Qoss:     []byte{pk.qos()},
+	})
+}
+
+// handleUnsubscribe unsubscribes the client from a topic filter.
+func (c *snClient) handleUnsubscribe(pk snPacket) {
+	if c.state != snStateActive {
+		return
+	}
+
+	filter, _, ok := c.filter(pk)
+	if !ok {
+		c.send(snPacket{Type: snUnsuback, MsgID: pk.MsgID})
+		return
+	}
+
+	c.write(packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Unsubscribe,
+			Qos:  1,
+		},
+		PacketID: pk.MsgID,
+		Topics:   []string{filter},
+	})
+}
+
+// filter returns the topic filter of a subscribe or unsubscribe message, and the
+// topic id of a predefined topic.
+func (c *snClient) filter(pk snPacket) (string, uint16, bool) {
+	if pk.topicIDType() == snTopicNormal {
+		return pk.TopicName, 0, pk.TopicName != ""
+	}
+
+	c.l.RLock()
+	topic, ok := c.l.predefined(pk)
+	c.l.RUnlock()
+
+	if pk.topicIDType() == snTopicPredefined {
+		return topic, pk.TopicID, ok
+	}
+
+	return topic, 0, ok
+}
+
+// handleDisconnect disconnects the client, or puts it to sleep if a sleep
+// duration is given.
+func (c *snClient) handleDisconnect(pk snPacket) {
+	if pk.Duration > 0 && (c.state == snStateActive || c.state == snStateAwake) {
+		c.state = snStateAsleep
+		c.sleep = time.Duration(pk.Duration) * time.Second
+		c.send(snPacket{Type: snDisconnect})
+		return
+	}
+
+	c.state = snStateClosed
+	c.send(snPacket{Type: snDisconnect})
+	c.write(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Disconnect}})
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
+
+	go c.l.remove(c)
+}
+
+// register returns the topic id of a topic name, registering a new id if the
+// topic has not been registered. It must be called while holding the client lock.
+func (c *snClient) register(topic string) uint16 {
+	if id, ok := c.ids[topic]; ok {
+		return id
+	}
+
+	c.nextTopic++
+	if c.nextTopic == 0 || c.nextTopic == 0xFFFF {
+		c.nextTopic = 1
+	}
+
+	if old, ok := c.topics[c.nextTopic]; ok {
+		delete(c.ids, old)
+	}
+
+	c.topics[c.nextTopic] = topic
+	c.ids[topic] = c.nextTopic
+	return c.nextTopic
+}
+
+// unregister removes a registered topic id. It must be called while holding the
+// client lock.
+func (c *snClient) unregister(id uint16) {
+	if topic, ok := c.topics[id]; ok {
+		delete(c.ids, topic)
+		delete(c.topics, id)
+	}
+}
+
+// read reads mqtt packets sent by the server to the client, until the
+// connection is closed.
+func (c *snClient) read(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		pk, err := readMQTTPacket(r)
+		if err != nil {
+			break
+		}
+
+		if !c.receive(pk) {
+			break
+		}
+	}
+
+	_ = conn.Close()
+
+	c.Lock()
+	if c.state != snStateClosed { // the server closed the connection.
+		c.state = snStateClosed
+		c.send(snPacket{Type: snDisconnect})
+	}
+	c.Unlock()
+
+	c.l.remove(c)
+}
+
+// receive translates an mqtt packet from the server into messages for the
+// client. It returns false if the connection was refused.
+func (c *snClient) receive(pk packets.Packet) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	switch pk.FixedHeader.Type {
+	case packets.Connack:
+		if pk.ReturnCode != packets.Accepted {
+			c.l.log.Debug("mqtt-sn connection refused", "listener", c.l.id, "remote", c.addr.String(), "client_id", c.id, "code", pk.ReturnCode)
+			c.state = snStateClosed
+			rc := snRejectedNotSupported
+			if pk.ReturnCode == packets.CodeConnectServerUnavailable {
+				rc = snRejectedCongestion
+			}
+			c.send(snPacket{Type: snConnack, ReturnCode: rc})
+			return false
+		}
+
+		c.state = snStateActive
+		c.send(snPacket{Type: snConnack, ReturnCode: snAccepted})
+	case packets.Publish:
+		if c.state != snStateAsleep {
+			c.deliver(pk)
+			return true
+		}
+
+		c.l.RLock()
+		limit := c.l.opts.SleepBuffer
+		c.l.RUnlock()
+		if len(c.buffered) >= limit {
+			c.l.log.Warn("mqtt-sn sleep buffer full, message dropped", "listener", c.l.id, "client_id", c.id, "topic", pk.TopicName)
+			return true
+		}
+		c.buffered = append(c.buffered, pk)
+	case packets.Puback:
+		c.send(snPacket{Type: snPuback, TopicID: c.pubacks[pk.PacketID], MsgID: pk.PacketID, ReturnCode: snAccepted})
+		delete(c.pubacks, pk.PacketID)
+	case packets.Pubrec:
+		c.send(snPacket{Type: snPubrec, MsgID: pk.PacketID})
+	case packets.Pubrel:
+		c.send(snPacket{Type: snPubrel, MsgID: pk.PacketID})
+	case packets.Pubcomp:
+		c.send(snPacket{Type: snPubcomp, MsgID: pk.PacketID})
+	case packets.Suback:
+		sk := snPacket{Type: snSuback, TopicID: c.subacks[pk.PacketID], MsgID: pk.PacketID, ReturnCode: snAccepted}
+		if len(pk.ReturnCodes) == 0 || pk.ReturnCodes[0] > 2 {
+			sk.ReturnCode = snRejectedNotSupported
+		} else {
+			sk.Flags = pk.ReturnCodes[0] << 5
+		}
+		delete(c.subacks, pk.PacketID)
+		c.send(sk)
+	case packets.Unsuback:
+		c.send(snPacket{Type: snUnsuback, MsgID: pk.PacketID})
+	}
+
+	return true
+}
+
+// deliver sends a message from the server to the client. If the topic has no
+// topic id, it is registered with the client and the message is sent once the
+// client acknowledges the registration. It must be called while holding the
+// client lock.
+func (c *snClient) deliver(pk packets.Packet) {
+	sk := snPacket{
+		Type:  snPublish,
+		Flags: pk.FixedHeader.Qos << 5,
+		MsgID: pk.PacketID,
+		Data:  pk.Payload,
+	}
+
+	if pk.FixedHeader.Dup {
+		sk.Flags |= snFlagDup
+	}
+
+	if pk.FixedHeader.Retain {
+		sk.Flags |= snFlagRetain
+	}
+
+	c.l.RLock()
+	id, predefined := c.l.topics[pk.TopicName]
+	c.l.RUnlock()
+
+	switch {
+	case predefined:
+		sk.Flags |= snTopicPredefined
+		sk.TopicID = id
+	case len(pk.TopicName) == 2:
+		sk.Flags |= snTopicShort
+		sk.TopicID = uint16(pk.TopicName[0])<<8 | uint16(pk.TopicName[1])
+	default:
+		id, ok := c.ids[pk.TopicName]
+		if !ok {
+			sk.TopicID = c.register(pk.TopicName)
+			c.nextMsg++
+			if c.nextMsg == 0 {
+				c.nextMsg = 1
+			}
+
+			c.registering[c.nextMsg] = &snRegistration{id: sk.TopicID, waiting: []snPacket{sk}}
+			c.send(snPacket{Type: snRegister, TopicID: sk.TopicID, MsgID: c.nextMsg, TopicName: pk.TopicName})
+			return
+		}
+
+		sk.TopicID = id
+		for _, reg := range c.registering {
+			if reg.id == id { // still waiting for the client to acknowledge the topic.
+				reg.waiting = append(reg.waiting, sk)
+				return
+			}
+		}
+	}
+
+	c.send(sk)
+}
+
+// readMQTTPacket reads an mqtt packet sent by the server.
+func readMQTTPacket(r *bufio.Reader) (pk packets.Packet, err error) {
+	hb, err := r.ReadByte()
+	if err != nil {
+		return pk, err
+	}
+
+	err = pk.FixedHeader.Decode(hb)
+	if err != nil {
+		return pk, err
+	}
+
+	var remaining, multiplier int = 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return pk, packets.ErrOversizedLengthIndicator
+		}
+
+		b, err := r.ReadByte()
+		if err != nil {
+			return pk, err
+		}
+
+		remaining += int(b&127) * multiplier
+		multiplier *= 128
+		if b < 128 {
+			break
+		}
+	}
+
+	pk.FixedHeader.Remaining = remaining
+	buf := make([]byte, remaining)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return pk, err
+	}
+
+	switch pk.FixedHeader.Type {
+	case packets.Connack:
+		err = pk.ConnackDecode(buf)
+	case packets.Publish:
+		err = pk.PublishDecode(buf)
+	case packets.Puback:
+		err = pk.PubackDecode(buf)
+	case packets.Pubrec:
+		err = pk.PubrecDecode(buf)
+	case packets.Pubrel:
+		err = pk.PubrelDecode(buf)
+	case packets.Pubcomp:
+		err = pk.PubcompDecode(buf)
+	case packets.Suback:
+		err = pk.SubackDecode(buf)
+	case packets.Unsuback:
+		err = pk.UnsubackDecode(buf)
+	case packets.Pingresp:
+	default:
+		err = ErrInvalidMQTTPacket
+	}
+
+	return pk, err
+}
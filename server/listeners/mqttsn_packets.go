@@ -0,0 +1,311 @@
+package listeners
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// The MQTT-SN v1.2 message types.
+const (
+	snAdvertise     byte = 0x00
+	snSearchGW      byte = 0x01
+	snGWInfo        byte = 0x02
+	snConnect       byte = 0x04
+	snConnack       byte = 0x05
+	snWillTopicReq  byte = 0x06
+	snWillTopic     byte = 0x07
+	snWillMsgReq    byte = 0x08
+	snWillMsg       byte = 0x09
+	snRegister      byte = 0x0A
+	snRegack        byte = 0x0B
+	snPublish       byte = 0x0C
+	snPuback        byte = 0x0D
+	snPubcomp       byte = 0x0E
+	snPubrec        byte = 0x0F
+	snPubrel        byte = 0x10
+	snSubscribe     byte = 0x12
+	snSuback        byte = 0x13
+	snUnsubscribe   byte = 0x14
+	snUnsuback      byte = 0x15
+	snPingreq       byte = 0x16
+	snPingresp      byte = 0x17
+	snDisconnect    byte = 0x18
+	snWillTopicUpd  byte = 0x1A
+	snWillTopicResp byte = 0x1B
+	snWillMsgUpd    byte = 0x1C
+	snWillMsgResp   byte = 0x1D
+)
+
+// The MQTT-SN return codes.
+const (
+	snAccepted             byte = 0x00
+	snRejectedCongestion   byte = 0x01
+	snRejectedTopicID      byte = 0x02
+	snRejectedNotSupported byte = 0x03
+)
+
+// The bits of the MQTT-SN flags field.
+const (
+	snFlagDup          byte = 0x80
+	snFlagQos          byte = 0x60
+	snFlagRetain       byte = 0x10
+	snFlagWill         byte = 0x08
+	snFlagCleanSession byte = 0x04
+	snFlagTopicIDType  byte = 0x03
+)
+
+// The MQTT-SN topic id types.
+const (
+	snTopicNormal     byte = 0x00 // a topic id registered by the client or gateway, or a topic name in a subscribe.
+	snTopicPredefined byte = 0x01 // a topic id known in advance by the client and gateway.
+	snTopicShort      byte = 0x02 // a two character topic name sent in place of a topic id.
+)
+
+const (
+	snProtocolID  byte = 0x01 // the protocol id of an MQTT-SN v1.2 connect.
+	snQosMinusOne byte = 0x03 // the qos of a publish by a client which is not connected.
+)
+
+var (
+	// ErrInvalidMQTTSNPacket indicates that a datagram was not a valid MQTT-SN
+	// v1.2 message.
+	ErrInvalidMQTTSNPacket = errors.New("invalid mqtt-sn packet")
+)
+
+// snPacket is an MQTT-SN message. Like packets.Packet, a single type covers all
+// message types, and only the fields of a message type are used.
+type snPacket struct {
+	Type       byte   // the message type.
+	Flags      byte   // the flags of a connect, willtopic, publish, subscribe, suback or unsubscribe.
+	Duration   uint16 // the keepalive of a connect, the sleep duration of a disconnect, or the advertise interval.
+	ClientID   string // the client id of a connect or pingreq.
+	TopicID    uint16 // the topic id of a register, regack, publish, puback, suback, or (un)subscribe.
+	MsgID      uint16 // the message id.
+	TopicName  string // the topic name of a register, willtopic or (un)subscribe.
+	Data       []byte // the payload of a publish, willmsg or willmsgupd, or the address of a gwinfo.
+	ReturnCode byte   // the return code of an acknowledgement.
+	GatewayID  byte   // the gateway id of a gwinfo or advertise.
+	Radius     byte   // the broadcast radius of a searchgw.
+}
+
+// qos returns the qos of the packet flags, where snQosMinusOne is qos -1.
+func (pk *snPacket) qos() byte {
+	return (pk.Flags & snFlagQos) >> 5
+}
+
+// topicIDType returns the topic id type of the packet flags.
+func (pk *snPacket) topicIDType() byte {
+	return pk.Flags & snFlagTopicIDType
+}
+
+// decodeSNPacket decodes an MQTT-SN message from a datagram. The returned
+// packet does not share memory with the datagram.
+func decodeSNPacket(b []byte) (pk snPacket, err error) {
+	if len(b) < 2 {
+		return pk, ErrInvalidMQTTSNPacket
+	}
+
+	length, n := int(b[0]), 1
+	if b[0] == 0x01 { // a three byte length field.
+		if len(b) < 4 {
+			return pk, ErrInvalidMQTTSNPacket
+		}
+		length, n = int(binary.BigEndian.Uint16(b[1:3])), 3
+	}
+
+	if length <= n || length > len(b) {
+		return pk, ErrInvalidMQTTSNPacket
+	}
+
+	pk.Type = b[n]
+	body := b[n+1 : length]
+
+	switch pk.Type {
+	case snAdvertise:
+		if len(body) != 3 {
+			return pk, ErrInvalidMQTTSNPacket
+		}
+		pk.GatewayID = body[0]
+		pk.Duration = binary.BigEndian.Uint16(body[1:])
+	case snSearchGW:
+		if len(body) != 1 {
+			return pk, ErrInvalidMQTTSNPacket
+		}
+		pk.Radius = body[0]
+	case snGWInfo:
+		if len(body) < 1 {
+			return pk, ErrInvalidMQTTSNPacket
+		}
+		pk.GatewayID = body[0]
+		pk.Data = copyBytes(body[1:])
+	case snConnect:
+		if len(body) < 4 || body[1] != snProtocolID {
+			return pk, ErrInvalidMQTTSNPacket
+		}
+		pk.Flags = body[0]
+		pk.Duration = binary.BigEndian.Uint16(body[2:])
+		pk.ClientID = string(body[4:])
+	case snConnack, snWillTopicResp, snWillMsgResp:
+		if len(body) != 1 {
+			return pk, ErrInvalidMQTTSNPacket
+		}
+		pk.ReturnCode = body[0]
+	case snWillTopicReq, snWillMsgReq, snPingresp:
+		if len(body) != 0 {
+			return pk, ErrInvalidMQTTSNPacket
+		}
+	case snWillTopic, snWillTopicUpd:
+		if len(body) > 0 { // an empty willtopic removes the will.
+			pk.Flags = body[0]
+			pk.TopicName = string(body[1:])
+		}
+	case snWillMsg, snWillMsgUpd:
+		pk.Data = copyBytes(body)
+	case snRegister:
+		if len(body) < 4 {
+			return pk, ErrInvalidMQTTSNPacket
+		}
+		pk.TopicID = binary.BigEndian.Uint16(body)
+		pk.MsgID = binary.BigEndian.Uint16(body[2:])
+		pk.TopicName = string(body[4:])
+	case snRegack, snPuback:
+		if len(body) != 5 {
+			return pk, ErrInvalidMQTTSNPacket
+		}
+		pk.TopicID = binary.BigEndian.Uint16(body)
+		pk.MsgID = binary.BigEndian.Uint16(body[2:])
+		pk.ReturnCode = body[4]
+	case snPublish:
+		if len(body) < 5 {
+			return pk, ErrInvalidMQTTSNPacket
+		}
+		pk.Flags = body[0]
+		pk.TopicID = binary.BigEndian.Uint16(body[1:])
+		pk.MsgID = binary.BigEndian.Uint16(body[3:])
+		pk.Data = copyBytes(body[5:])
+	case snPubrec, snPubrel, snPubcomp, snUnsuback:
+		if len(body) != 2 {
+			return pk, ErrInvalidMQTTSNPacket
+		}
+		pk.MsgID = binary.BigEndian.Uint16(body)
+	case snSubscribe, snUnsubscribe:
+		if len(body) < 3 {
+			return pk, ErrInvalidMQTTSNPacket
+		}
+		pk.Flags = body[0]
+		pk.MsgID = binary.BigEndian.Uint16(body[1:])
+		switch pk.topicIDType() {
+		case snTopicNormal:
+			pk.TopicName = string(body[3:])
+		case snTopicPredefined, snTopicShort:
+			if len(body) != 5 {
+				return pk, ErrInvalidMQTTSNPacket
+			}
+			pk.TopicID = binary.BigEndian.Uint16(body[3:])
+		default:
+			return pk, ErrInvalidMQTTSNPacket
+		}
+	case snSuback:
+		if len(body) != 6 {
+			return pk, ErrInvalidMQTTSNPacket
+		}
+		pk.Flags = body[0]
+		pk.TopicID = binary.BigEndian.Uint16(body[1:])
+		pk.MsgID = binary.BigEndian.Uint16(body[3:])
+		pk.ReturnCode = body[5]
+	case snPingreq:
+		pk.ClientID = string(body)
+	case snDisconnect:
+		switch len(body) {
+		case 0:
+		case 2:
+			pk.Duration = binary.BigEndian.Uint16(body)
+		default:
+			return pk, ErrInvalidMQTTSNPacket
+		}
+	default:
+		return pk, ErrInvalidMQTTSNPacket
+	}
+
+	return pk, nil
+}
+
+// encode encodes the packet as an MQTT-SN message.
+func (pk *snPacket) encode() []byte {
+	var body []byte
+	switch pk.Type {
+	case snAdvertise:
+		body = append(body, pk.GatewayID)
+		body = appendUint16(body, pk.Duration)
+	case snSearchGW:
+		body = append(body, pk.Radius)
+	case snGWInfo:
+		body = append(body, pk.GatewayID)
+		body = append(body, pk.Data...)
+	case snConnect:
+		body = append(body, pk.Flags, snProtocolID)
+		body = appendUint16(body, pk.Duration)
+		body = append(body, pk.ClientID...)
+	case snConnack, snWillTopicResp, snWillMsgResp:
+		body = append(body, pk.ReturnCode)
+	case snWillTopic, snWillTopicUpd:
+		if pk.TopicName != "" {
+			body = append(body, pk.Flags)
+			body = append(body, pk.TopicName...)
+		}
+	case snWillMsg, snWillMsgUpd:
+		body = append(body, pk.Data...)
+	case snRegister:
+		body = appendUint16(body, pk.TopicID)
+		body = appendUint16(body, pk.MsgID)
+		body = append(body, pk.TopicName...)
+	case snRegack, snPuback:
+		body = appendUint16(body, pk.TopicID)
+		body = appendUint16(body, pk.MsgID)
+		body = append(body, pk.ReturnCode)
+	case snPublish:
+		body = append(body, pk.Flags)
+		body = appendUint16(body, pk.TopicID)
+		body = appendUint16(body, pk.MsgID)
+		body = append(body, pk.Data...)
+	case snPubrec, snPubrel, snPubcomp, snUnsuback:
+		body = appendUint16(body, pk.MsgID)
+	case snSubscribe, snUnsubscribe:
+		body = append(body, pk.Flags)
+		body = appendUint16(body, pk.MsgID)
+		if pk.topicIDType() == snTopicNormal {
+			body = append(body, pk.TopicName...)
+		} else {
+			body = appendUint16(body, pk.TopicID)
+		}
+	case snSuback:
+		body = append(body, pk.Flags)
+		body = appendUint16(body, pk.TopicID)
+		body = appendUint16(body, pk.MsgID)
+		body = append(body, pk.ReturnCode)
+	case snPingreq:
+		body = append(body, pk.ClientID...)
+	case snDisconnect:
+		if pk.Duration > 0 {
+			body = appendUint16(body, pk.Duration)
+		}
+	}
+
+	length := len(body) + 2
+	if length < 256 {
+		return append([]byte{byte(length), pk.Type}, body...)
+	}
+
+	length += 2
+	return append([]byte{0x01, byte(length >> 8), byte(length), pk.Type}, body...)
+}
+
+// appendUint16 appends a big endian uint16 to a byte slice.
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// copyBytes returns a copy of a byte slice.
+func copyBytes(b []byte) []byte {
+	return append([]byte{}, b...)
+}
@@ -0,0 +1,247 @@
+package listeners
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSNPacketEncodeDecode(t *testing.T) {
+	tt := []struct {
+		desc    string
+		pk      snPacket
+		encoded []byte
+	}{
+		{
+			desc:    "advertise",
+			pk:      snPacket{Type: snAdvertise, GatewayID: 7, Duration: 900},
+			encoded: []byte{5, snAdvertise, 7, 0x03, 0x84},
+		},
+		{
+			desc:    "searchgw",
+			pk:      snPacket{Type: snSearchGW, Radius: 1},
+			encoded: []byte{3, snSearchGW, 1},
+		},
+		{
+			desc:    "gwinfo",
+			pk:      snPacket{Type: snGWInfo, GatewayID: 7, Data: []byte{}},
+			encoded: []byte{3, snGWInfo, 7},
+		},
+		{
+			desc:    "connect",
+			pk:      snPacket{Type: snConnect, Flags: snFlagWill | snFlagCleanSession, Duration: 30, ClientID: "sensor"},
+			encoded: []byte{12, snConnect, 0x0C, snProtocolID, 0, 30, 's', 'e', 'n', 's', 'o', 'r'},
+		},
+		{
+			desc:    "connack",
+			pk:      snPacket{Type: snConnack, ReturnCode: snRejectedCongestion},
+			encoded: []byte{3, snConnack, 0x01},
+		},
+		{
+			desc:    "willtopicreq",
+			pk:      snPacket{Type: snWillTopicReq},
+			encoded: []byte{2, snWillTopicReq},
+		},
+		{
+			desc:    "willtopic",
+			pk:      snPacket{Type: snWillTopic, Flags: 0x20 | snFlagRetain, TopicName: "a/b"},
+			encoded: []byte{6, snWillTopic, 0x30, 'a', '/', 'b'},
+		},
+		{
+			desc:    "willtopic empty",
+			pk:      snPacket{Type: snWillTopic},
+			encoded: []byte{2, snWillTopic},
+		},
+		{
+			desc:    "willmsg",
+			pk:      snPacket{Type: snWillMsg, Data: []byte("gone")},
+			encoded: []byte{6, snWillMsg, 'g', 'o', 'n', 'e'},
+		},
+		{
+			desc:    "register",
+			pk:      snPacket{Type: snRegister, TopicID: 1, MsgID: 2, TopicName: "a/b"},
+			encoded: []byte{9, snRegister, 0, 1, 0, 2, 'a', '/', 'b'},
+		},
+		{
+			desc:    "regack",
+			pk:      snPacket{Type: snRegack, TopicID: 1, MsgID: 2, ReturnCode: snAccepted},
+			encoded: []byte{7, snRegack, 0, 1, 0, 2, 0},
+		},
+		{
+			desc:    "publish",
+			pk:      snPacket{Type: snPublish, Flags: 0x20 | snTopicPredefined, TopicID: 1, MsgID: 2, Data: []byte("hi")},
+			encoded: []byte{9, snPublish, 0x21, 0, 1, 0, 2, 'h', 'i'},
+		},
+		{
+			desc:    "puback",
+			pk:      snPacket{Type: snPuback, TopicID: 1, MsgID: 2, ReturnCode: snRejectedTopicID},
+			encoded: []byte{7, snPuback, 0, 1, 0, 2, 0x02},
+		},
+		{
+			desc:    "pubrec",
+			pk:      snPacket{Type: snPubrec, MsgID: 2},
+			encoded: []byte{4, snPubrec, 0, 2},
+		},
+		{
+			desc:    "pubrel",
+			pk:      snPacket{Type: snPubrel, MsgID: 2},
+			encoded: []byte{4, snPubrel, 0, 2},
+		},
+		{
+			desc:    "pubcomp",
+			pk:      snPacket{Type: snPubcomp, MsgID: 2},
+			encoded: []byte{4, snPubcomp, 0, 2},
+		},
+		{
+			desc:    "subscribe name",
+			pk:      snPacket{Type: snSubscribe, Flags: 0x20, MsgID: 2, TopicName: "a/#"},
+			encoded: []byte{8, snSubscribe, 0x20, 0, 2, 'a', '/', '#'},
+		},
+		{
+			desc:    "subscribe predefined",
+			pk:      snPacket{Type: snSubscribe, Flags: snTopicPredefined, MsgID: 2, TopicID: 1},
+			encoded: []byte{7, snSubscribe, 0x01, 0, 2, 0, 1},
+		},
+		{
+			desc:    "suback",
+			pk:      snPacket{Type: snSuback, Flags: 0x20, TopicID: 1, MsgID: 2, ReturnCode: snAccepted},
+			encoded: []byte{8, snSuback, 0x20, 0, 1, 0, 2, 0},
+		},
+		{
+			desc:    "unsubscribe short",
+			pk:      snPacket{Type: snUnsubscribe, Flags: snTopicShort, MsgID: 2, TopicID: 0x6162},
+			encoded: []byte{7, snUnsubscribe, 0x02, 0, 2, 'a', 'b'},
+		},
+		{
+			desc:    "unsuback",
+			pk:      snPacket{Type: snUnsuback, MsgID: 2},
+			encoded: []byte{4, snUnsuback, 0, 2},
+		},
+		{
+			desc:    "pingreq",
+			pk:      snPacket{Type: snPingreq, ClientID: "sensor"},
+			encoded: []byte{8, snPingreq, 's', 'e', 'n', 's', 'o', 'r'},
+		},
+		{
+			desc:    "pingresp",
+			pk:      snPacket{Type: snPingresp},
+			encoded: []byte{2, snPingresp},
+		},
+		{
+			desc:    "disconnect",
+			pk:      snPacket{Type: snDisconnect},
+			encoded: []byte{2, snDisconnect},
+		},
+		{
+			desc:    "disconnect sleep",
+			pk:      snPacket{Type: snDisconnect, Duration: 60},
+			encoded: []byte{4, snDisconnect, 0, 60},
+		},
+		{
+			desc:    "willtopicresp",
+			pk:      snPacket{Type: snWillTopicResp, ReturnCode: snRejectedNotSupported},
+			encoded: []byte{3, snWillTopicResp, 0x03},
+		},
+		{
+			desc:    "willmsgupd",
+			pk:      snPacket{Type: snWillMsgUpd, Data: []byte("x")},
+			encoded: []byte{3, snWillMsgUpd, 'x'},
+		},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			require.Equal(t, tx.encoded, tx.pk.encode())
+
+			pk, err := decodeSNPacket(tx.encoded)
+			require.NoError(t, err)
+			require.Equal(t, tx.pk, pk)
+		})
+	}
+}
+
+func TestSNPacketLongLength(t *testing.T) {
+	pk := snPacket{Type: snPublish, TopicID: 1, Data: []byte(strings.Repeat("a", 300))}
+	b := pk.encode()
+	require.Equal(t, []byte{0x01, 0x01, 0x35, snPublish}, b[:4])
+	require.Len(t, b, 309)
+
+	decoded, err := decodeSNPacket(b)
+	require.NoError(t, err)
+	require.Equal(t, pk, decoded)
+}
+
+func TestDecodeSNPacketCopies(t *testing.T) {
+	b := []byte{9, snPublish, 0x00, 0, 1, 0, 2, 'h', 'i'}
+	pk, err := decodeSNPacket(b)
+	require.NoError(t, err)
+
+	b[7] = 'x'
+	require.Equal(t, []byte("hi"), pk.Data)
+}
+
+func TestDecodeSNPacketTrailing(t *testing.T) {
+	pk, err := decodeSNPacket([]byte{2, snPingresp, 0xFF, 0xFF})
+	require.NoError(t, err)
+	require.Equal(t, snPingresp, pk.Type)
+}
+
+func TestDecodeSNPacketInvalid(t *testing.T) {
+	tt := [][]byte{
+		{},
+		{2},
+		{0x01, 0},
+		{0x01, 0, 2, snPingresp},
+		{1, snPingresp},
+		{3, snPingresp},
+		{3, 0xFE, 0},                        // encapsulated messages are not supported.
+		{6, snConnect, 0, 0x02, 0, 1},       // unknown protocol id.
+		{5, snConnect, 0, 0x01, 0},          // short connect.
+		{3, snConnack},                      // missing return code.
+		{3, snPingresp, 0},                  // unexpected body.
+		{4, snSearchGW, 1, 2},               // long searchgw.
+		{2, snGWInfo},                       // missing gateway id.
+		{4, snAdvertise, 1, 2},              // short advertise.
+		{5, snRegister, 0, 1, 0},            // short register.
+		{6, snRegack, 0, 1, 0, 2},           // short regack.
+		{6, snPublish, 0, 0, 1, 0},          // short publish.
+		{3, snPubrel, 0},                    // short pubrel.
+		{4, snSubscribe, 0, 0},              // short subscribe.
+		{6, snSubscribe, 0x01, 0, 2, 0},     // short predefined topic id.
+		{7, snSubscribe, 0x03, 0, 2, 0, 1},  // reserved topic id type.
+		{7, snSuback, 0, 0, 1, 0, 2},        // short suback.
+		{3, snDisconnect, 0},                // short duration.
+		{3, snWillMsgReq, 0},                // unexpected body.
+		{8, snUnsubscribe, 0x02, 0, 2, 'a'}, // length beyond datagram.
+	}
+
+	for _, b := range tt {
+		_, err := decodeSNPacket(b)
+		require.ErrorIs(t, err, ErrInvalidMQTTSNPacket, "%v", b)
+	}
+}
+
+func TestSNPacketFlags(t *testing.T) {
+	pk := snPacket{Flags: 0x60 | snFlagRetain | snTopicShort}
+	require.Equal(t, snQosMinusOne, pk.qos())
+	require.Equal(t, snTopicShort, pk.topicIDType())
+
+	pk = snPacket{Flags: 0x40 | snTopicPredefined}
+	require.Equal(t, byte(2), pk.qos())
+	require.Equal(t, snTopicPredefined, pk.topicIDType())
+}
+
+func BenchmarkDecodeSNPacket(b *testing.B) {
+	pk := []byte{9, snPublish, 0x21, 0, 1, 0, 2, 'h', 'i'}
+	for n := 0; n < b.N; n++ {
+		_, _ = decodeSNPacket(pk)
+	}
+}
+
+func BenchmarkSNPacketEncode(b *testing.B) {
+	pk := snPacket{Type: snPublish, Flags: 0x21, TopicID: 1, MsgID: 2, Data: []byte("hi")}
+	for n := 0; n < b.N; n++ {
+		_ = pk.encode()
+	}
+}
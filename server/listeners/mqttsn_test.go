@@ -0,0 +1,1021 @@
+package listeners
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-co/mqtt/server/internal/packets"
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/logger"
+)
+
+// snTestServer acts as the server for the clients of an MQTT-SN listener,
+// answering connects with a return code and recording the packets received.
+type snTestServer struct {
+	code    byte
+	packets chan packets.Packet
+	conns   chan net.Conn
+}
+
+func newSNTestServer(code byte) *snTestServer {
+	return &snTestServer{
+		code:    code,
+		packets: make(chan packets.Packet, 16),
+		conns:   make(chan net.Conn, 4),
+	}
+}
+
+func (s *snTestServer) establish(id string, c net.Conn, ac auth.Controller) error {
+	r := bufio.NewReader(c)
+	for {
+		pk, err := readTestPacket(r)
+		if err != nil {
+			return err
+		}
+
+		s.packets <- pk
+		if pk.FixedHeader.Type == packets.Connect {
+			writeTestPacket(c, packets.Packet{
+				FixedHeader: packets.FixedHeader{Type: packets.Connack},
+				ReturnCode:  s.code,
+			})
+			s.conns <- c
+		}
+	}
+}
+
+func (s *snTestServer) next(t *testing.T) packets.Packet {
+	select {
+	case pk := <-s.packets:
+		return pk
+	case <-time.After(time.Second):
+		require.Fail(t, "no packet received by server")
+	}
+	return packets.Packet{}
+}
+
+// readTestPacket reads a packet sent by an MQTT-SN client to the server.
+func readTestPacket(r *bufio.Reader) (pk packets.Packet, err error) {
+	hb, err := r.ReadByte()
+	if err != nil {
+		return pk, err
+	}
+
+	err = pk.FixedHeader.Decode(hb)
+	if err != nil {
+		return pk, err
+	}
+
+	var remaining, multiplier int = 0, 1
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return pk, err
+		}
+		remaining += int(b&127) * multiplier
+		multiplier *= 128
+		if b < 128 {
+			break
+		}
+	}
+
+	buf := make([]byte, remaining)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return pk, err
+	}
+
+	switch pk.FixedHeader.Type {
+	case packets.Connect:
+		err = pk.ConnectDecode(buf)
+	case packets.Publish:
+		err = pk.PublishDecode(buf)
+	case packets.Puback:
+		err = pk.PubackDecode(buf)
+	case packets.Pubrec:
+		err = pk.PubrecDecode(buf)
+	case packets.Pubrel:
+		err = pk.PubrelDecode(buf)
+	case packets.Pubcomp:
+		err = pk.PubcompDecode(buf)
+	case packets.Subscribe:
+		err = pk.SubscribeDecode(buf)
+	case packets.Unsubscribe:
+		err = pk.UnsubscribeDecode(buf)
+	}
+
+	return pk, err
+}
+
+// writeTestPacket writes a packet from the server to an MQTT-SN client.
+func writeTestPacket(c net.Conn, pk packets.Packet) {
+	var buf bytes.Buffer
+	switch pk.FixedHeader.Type {
+	case packets.Connack:
+		_ = pk.ConnackEncode(&buf)
+	case packets.Publish:
+		_ = pk.PublishEncode(&buf)
+	case packets.Puback:
+		_ = pk.PubackEncode(&buf)
+	case packets.Pubrec:
+		_ = pk.PubrecEncode(&buf)
+	case packets.Pubrel:
+		_ = pk.PubrelEncode(&buf)
+	case packets.Pubcomp:
+		_ = pk.PubcompEncode(&buf)
+	case packets.Suback:
+		_ = pk.SubackEncode(&buf)
+	case packets.Unsuback:
+		_ = pk.UnsubackEncode(&buf)
+	}
+	_, _ = c.Write(buf.Bytes())
+}
+
+// newTestMQTTSN returns a served MQTT-SN listener.
+func newTestMQTTSN(t *testing.T, establish EstablishFunc, opts MQTTSNOptions) *MQTTSN {
+	l := NewMQTTSN("sn1", "127.0.0.1:0")
+	l.SetOptions(opts)
+	require.NoError(t, l.Listen(nil))
+	go l.Serve(establish)
+	t.Cleanup(func() {
+		l.Close(MockCloser)
+	})
+	return l
+}
+
+// dialSN returns a udp client of an MQTT-SN listener.
+func dialSN(t *testing.T, l *MQTTSN) net.Conn {
+	conn, err := net.Dial("udp", l.conn.LocalAddr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return conn
+}
+
+func snWrite(t *testing.T, conn net.Conn, pk snPacket) {
+	_, err := conn.Write(pk.encode())
+	require.NoError(t, err)
+}
+
+func snRead(t *testing.T, conn net.Conn) snPacket {
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	pk, err := decodeSNPacket(buf[:n])
+	require.NoError(t, err)
+	return pk
+}
+
+// connectSN connects a client to a listener and returns the server end of its
+// mqtt connection.
+func connectSN(t *testing.T, conn net.Conn, s *snTestServer, id string) net.Conn {
+	snWrite(t, conn, snPacket{Type: snConnect, Flags: snFlagCleanSession, Duration: 30, ClientID: id})
+	require.Equal(t, packets.Connect, s.next(t).FixedHeader.Type)
+	require.Equal(t, snPacket{Type: snConnack, ReturnCode: snAccepted}, snRead(t, conn))
+	return <-s.conns
+}
+
+func TestNewMQTTSN(t *testing.T) {
+	l := NewMQTTSN("sn1", ":1884")
+	require.Equal(t, "sn1", l.id)
+	require.Equal(t, ":1884", l.address)
+	require.Equal(t, new(auth.Allow), l.config.Auth)
+	require.Equal(t, defaultMQTTSNSleepBuffer, l.opts.SleepBuffer)
+}
+
+func TestMQTTSNSetOptions(t *testing.T) {
+	l := NewMQTTSN("sn1", ":1884")
+	l.SetOptions(MQTTSNOptions{
+		GatewayID: 3,
+		PredefinedTopics: map[uint16]string{
+			1: "sensors/temperature",
+		},
+	})
+	require.Equal(t, byte(3), l.opts.GatewayID)
+	require.Equal(t, defaultMQTTSNSleepBuffer, l.opts.SleepBuffer)
+	require.Equal(t, map[string]uint16{"sensors/temperature": 1}, l.topics)
+
+	l.SetOptions(MQTTSNOptions{SleepBuffer: 5})
+	require.Equal(t, 5, l.opts.SleepBuffer)
+	require.Empty(t, l.topics)
+}
+
+func TestMQTTSNSetConfig(t *testing.T) {
+	l := NewMQTTSN("sn1", ":1884")
+
+	l.SetConfig(&Config{
+		Auth: new(auth.Allow),
+	})
+	require.Equal(t, new(auth.Allow), l.config.Auth)
+
+	// Switch to disallow on bad config set.
+	l.SetConfig(new(Config))
+	require.Equal(t, new(auth.Disallow), l.config.Auth)
+}
+
+func TestMQTTSNSetLogger(t *testing.T) {
+	l := NewMQTTSN("sn1", ":1884")
+	log := new(logger.Mock)
+	l.SetLogger(log)
+	require.Equal(t, log, l.log)
+}
+
+func TestMQTTSNSetPublisher(t *testing.T) {
+	l := NewMQTTSN("sn1", ":1884")
+	l.SetPublisher(func(cl auth.Client, topic string, payload []byte, retain bool) bool {
+		return true
+	})
+	require.NotNil(t, l.publish)
+}
+
+func TestMQTTSNID(t *testing.T) {
+	l := NewMQTTSN("sn1", ":1884")
+	require.Equal(t, "sn1", l.ID())
+}
+
+func TestMQTTSNListenInvalid(t *testing.T) {
+	l := NewMQTTSN("sn1", "127.0.0.1:x")
+	require.Error(t, l.Listen(nil))
+}
+
+func TestMQTTSNServeClose(t *testing.T) {
+	l := NewMQTTSN("sn1", "127.0.0.1:0")
+	require.NoError(t, l.Listen(nil))
+
+	o := make(chan bool)
+	go func() {
+		l.Serve(MockEstablisher)
+		o <- true
+	}()
+
+	time.Sleep(time.Millisecond)
+	var closed bool
+	l.Close(func(id string) {
+		closed = true
+	})
+	require.True(t, closed)
+	<-o
+
+	// ensure close is only called once.
+	closed = false
+	l.Close(func(id string) {
+		closed = true
+	})
+	require.False(t, closed)
+}
+
+func TestMQTTSNAddr(t *testing.T) {
+	l := NewMQTTSN("sn1", "127.0.0.1:0")
+	require.Nil(t, l.Addr())
+	require.NoError(t, l.Listen(nil))
+
+	addr, ok := l.Addr().(*net.UDPAddr)
+	require.True(t, ok)
+	require.NotZero(t, addr.Port)
+
+	o := make(chan bool)
+	go func() {
+		l.Serve(MockEstablisher)
+		o <- true
+	}()
+
+	time.Sleep(time.Millisecond)
+	l.conn.Close() // close the socket without closing the listener.
+	<-o
+	require.Error(t, l.ServeErr())
+	l.Close(MockCloser)
+}
+
+func TestMQTTSNCloseClients(t *testing.T) {
+	s := newSNTestServer(packets.Accepted)
+	l := newTestMQTTSN(t, s.establish, MQTTSNOptions{})
+	sc := connectSN(t, dialSN(t, l), s, "sensor")
+
+	// the connection is closed even if the server does not close the client.
+	l.Close(MockCloser)
+	require.NoError(t, sc.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err := sc.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestMQTTSNSearchGW(t *testing.T) {
+	l := newTestMQTTSN(t, MockEstablisher, MQTTSNOptions{GatewayID: 9})
+	conn := dialSN(t, l)
+
+	snWrite(t, conn, snPacket{Type: snSearchGW, Radius: 1})
+	require.Equal(t, snPacket{Type: snGWInfo, GatewayID: 9, Data: []byte{}}, snRead(t, conn))
+}
+
+func TestMQTTSNInvalidPacket(t *testing.T) {
+	log := new(logger.Mock)
+	l := newTestMQTTSN(t, MockEstablisher, MQTTSNOptions{})
+	l.SetLogger(log)
+	conn := dialSN(t, l)
+
+	_, err := conn.Write([]byte{3, 0xFE, 0})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		_, ok := log.Find("mqtt-sn packet rejected")
+		return ok
+	}, time.Second, time.Millisecond)
+}
+
+func TestMQTTSNConnect(t *testing.T) {
+	s := newSNTestServer(packets.Accepted)
+	l := newTestMQTTSN(t, s.establish, MQTTSNOptions{})
+	conn := dialSN(t, l)
+
+	snWrite(t, conn, snPacket{Type: snConnect, Flags: snFlagCleanSession, Duration: 30, ClientID: "sensor"})
+
+	pk := s.next(t)
+	require.Equal(t, packets.Connect, pk.FixedHeader.Type)
+	require.Equal(t, "sensor", pk.ClientIdentifier)
+	require.Equal(t, byte(4), pk.ProtocolVersion)
+	require.True(t, pk.CleanSession)
+	require.False(t, pk.WillFlag)
+	require.Equal(t, uint16(0), pk.Keepalive)
+
+	require.Equal(t, snPacket{Type: snConnack, ReturnCode: snAccepted}, snRead(t, conn))
+	sc := <-s.conns
+	require.Equal(t, conn.LocalAddr().String(), sc.RemoteAddr().String())
+
+	l.RLock()
+	c := l.clients[conn.LocalAddr().String()]
+	l.RUnlock()
+	c.Lock()
+	require.Equal(t, snStateActive, c.state)
+	require.Equal(t, 30*time.Second, c.keepalive)
+	c.Unlock()
+}
+
+func TestMQTTSNConnectWill(t *testing.T) {
+	s := newSNTestServer(packets.Accepted)
+	l := newTestMQTTSN(t, s.establish, MQTTSNOptions{})
+	conn := dialSN(t, l)
+
+	snWrite(t, conn, snPacket{Type: snConnect, Flags: snFlagWill, Duration: 30, ClientID: "sensor"})
+	require.Equal(t, snPacket{Type: snWillTopicReq}, snRead(t, conn))
+
+	snWrite(t, conn, snPacket{Type: snWillTopic, Flags: 0x20 | snFlagRetain, TopicName: "sensors/gone"})
+	require.Equal(t, snPacket{Type: snWillMsgReq}, snRead(t, conn))
+
+	snWrite(t, conn, snPacket{Type: snWillMsg, Data: []byte("offline")})
+	pk := s.next(t)
+	require.Equal(t, packets.Connect, pk.FixedHeader.Type)
+	require.False(t, pk.CleanSession)
+	require.True(t, pk.WillFlag)
+	require.Equal(t, "sensors/gone", pk.WillTopic)
+	require.Equal(t, []byte("offline"), pk.WillMessage)
+	require.Equal(t, byte(1), pk.WillQos)
+	require.True(t, pk.WillRetain)
+
+	require.Equal(t, snPacket{Type: snConnack, ReturnCode: snAccepted}, snRead(t, conn))
+}
+
+func TestMQTTSNConnectEmptyWill(t *testing.T) {
+	s := newSNTestServer(packets.Accepted)
+	l := newTestMQTTSN(t, s.establish, MQTTSNOptions{})
+	conn := dialSN(t, l)
+
+	snWrite(t, conn, snPacket{Type: snConnect, Flags: snFlagWill, Duration: 30, ClientID: "sensor"})
+	require.Equal(t, snPacket{Type: snWillTopicReq}, snRead(t, conn))
+
+	snWrite(t, conn, snPacket{Type: snWillTopic})
+	pk := s.next(t)
+	require.False(t, pk.WillFlag)
+	require.Equal(t, snPacket{Type: snConnack, ReturnCode: snAccepted}, snRead(t, conn))
+}
+
+func TestMQTTSNConnectRefused(t *testing.T) {
+	tt := []struct {
+		code byte
+		rc   byte
+	}{
+		{code: packets.CodeConnectNotAuthorised, rc: snRejectedNotSupported},
+		{code: packets.CodeConnectServerUnavailable, rc: snRejectedCongestion},
+	}
+
+	for _, tx := range tt {
+		s := newSNTestServer(tx.code)
+		l := newTestMQTTSN(t, s.establish, MQTTSNOptions{})
+		conn := dialSN(t, l)
+
+		snWrite(t, conn, snPacket{Type: snConnect, Duration: 30, ClientID: "sensor"})
+		require.Equal(t, snPacket{Type: snConnack, ReturnCode: tx.rc}, snRead(t, conn))
+		require.Eventually(t, func() bool {
+			l.RLock()
+			defer l.RUnlock()
+			return len(l.clients) == 0
+		}, time.Second, time.Millisecond)
+	}
+}
+
+func TestMQTTSNRegisterPublish(t *testing.T) {
+	s := newSNTestServer(packets.Accepted)
+	l := newTestMQTTSN(t, s.establish, MQTTSNOptions{
+		PredefinedTopics: map[uint16]string{
+			7: "sensors/temperature",
+		},
+	})
+	conn := dialSN(t, l)
+	sc := connectSN(t, conn, s, "sensor")
+
+	snWrite(t, conn, snPacket{Type: snRegister, MsgID: 1, TopicName: "a/b"})
+	require.Equal(t, snPacket{Type: snRegack, TopicID: 1, MsgID: 1, ReturnCode: snAccepted}, snRead(t, conn))
+
+	snWrite(t, conn, snPacket{Type: snRegister, MsgID: 2, TopicName: "a/b"})
+	require.Equal(t, snPacket{Type: snRegack, TopicID: 1, MsgID: 2, ReturnCode: snAccepted}, snRead(t, conn))
+
+	snWrite(t, conn, snPacket{Type: snRegister, MsgID: 3, TopicName: "a/+"})
+	require.Equal(t, snPacket{Type: snRegack, MsgID: 3, ReturnCode: snRejectedNotSupported}, snRead(t, conn))
+
+	snWrite(t, conn, snPacket{Type: snPublish, Flags: 0x20 | snFlagRetain, TopicID: 1, MsgID: 5, Data: []byte("hello")})
+	pk := s.next(t)
+	require.Equal(t, packets.Publish, pk.FixedHeader.Type)
+	require.Equal(t, byte(1), pk.FixedHeader.Qos)
+	require.True(t, pk.FixedHeader.Retain)
+	require.Equal(t, "a/b", pk.TopicName)
+	require.Equal(t, uint16(5), pk.PacketID)
+	require.Equal(t, []byte("hello"), pk.Payload)
+
+	writeTestPacket(sc, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Puback}, PacketID: 5})
+	require.Equal(t, snPacket{Type: snPuback, TopicID: 1, MsgID: 5, ReturnCode: snAccepted}, snRead(t, conn))
+
+	snWrite(t, conn, snPacket{Type: snPublish, Flags: snTopicPredefined, TopicID: 7, Data: []byte("21.5")})
+	pk = s.next(t)
+	require.Equal(t, "sensors/temperature", pk.TopicName)
+	require.Equal(t, byte(0), pk.FixedHeader.Qos)
+
+	snWrite(t, conn, snPacket{Type: snPublish, Flags: snTopicShort, TopicID: 0x6162, Data: []byte("x")})
+	require.Equal(t, "ab", s.next(t).TopicName)
+
+	snWrite(t, conn, snPacket{Type: snPublish, Flags: 0x20, TopicID: 9, MsgID: 6})
+	require.Equal(t, snPacket{Type: snPuback, TopicID: 9, MsgID: 6, ReturnCode: snRejectedTopicID}, snRead(t, conn))
+
+	snWrite(t, conn, snPacket{Type: snPublish, Flags: snTopicPredefined, TopicID: 8, MsgID: 7})
+	require.Equal(t, snPacket{Type: snPuback, TopicID: 8, MsgID: 7, ReturnCode: snRejectedTopicID}, snRead(t, conn))
+}
+
+func TestMQTTSNPublishQos2(t *testing.T) {
+	s := newSNTestServer(packets.Accepted)
+	l := newTestMQTTSN(t, s.establish, MQTTSNOptions{})
+	conn := dialSN(t, l)
+	sc := connectSN(t, conn, s, "sensor")
+
+	snWrite(t, conn, snPacket{Type: snPublish, Flags: 0x40 | snTopicShort, TopicID: 0x6162, MsgID: 3, Data: []byte("x")})
+	pk := s.next(t)
+	require.Equal(t, byte(2), pk.FixedHeader.Qos)
+	require.Equal(t, uint16(3), pk.PacketID)
+
+	writeTestPacket(sc, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pubrec}, PacketID: 3})
+	require.Equal(t, snPacket{Type: snPubrec, MsgID: 3}, snRead(t, conn))
+
+	snWrite(t, conn, snPacket{Type: snPubrel, MsgID: 3})
+	pk = s.next(t)
+	require.Equal(t, packets.Pubrel, pk.FixedHeader.Type)
+	require.Equal(t, uint16(3), pk.PacketID)
+
+	writeTestPacket(sc, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pubcomp}, PacketID: 3})
+	require.Equal(t, snPacket{Type: snPubcomp, MsgID: 3}, snRead(t, conn))
+}
+
+func TestMQTTSNSubscribe(t *testing.T) {
+	s := newSNTestServer(packets.Accepted)
+	l := newTestMQTTSN(t, s.establish, MQTTSNOptions{
+		PredefinedTopics: map[uint16]string{
+			7: "sensors/temperature",
+		},
+	})
+	conn := dialSN(t, l)
+	sc := connectSN(t, conn, s, "sensor")
+
+	snWrite(t, conn, snPacket{Type: snSubscribe, Flags: 0x20, MsgID: 1, TopicName: "a/b"})
+	pk := s.next(t)
+	require.Equal(t, packets.Subscribe, pk.FixedHeader.Type)
+	require.Equal(t, []string{"a/b"}, pk.Topics)
+	require.Equal(t, []byte{1}, pk.Qoss)
+
+	writeTestPacket(sc, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Suback}, PacketID: 1, ReturnCodes: []byte{1}})
+	require.Equal(t, snPacket{Type: snSuback, Flags: 0x20, TopicID: 1, MsgID: 1, ReturnCode: snAccepted}, snRead(t, conn))
+
+	snWrite(t, conn, snPacket{Type: snSubscribe, MsgID: 2, TopicName: "a/#"})
+	require.Equal(t, []string{"a/#"}, s.next(t).Topics)
+	writeTestPacket(sc, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Suback}, PacketID: 2, ReturnCodes: []byte{packets.ErrSubAckNetworkError}})
+	require.Equal(t, snPacket{Type: snSuback, MsgID: 2, ReturnCode: snRejectedNotSupported}, snRead(t, conn))
+
+	snWrite(t, conn, snPacket{Type: snSubscribe, Flags: snTopicPredefined, MsgID: 3, TopicID: 7})
+	require.Equal(t, []string{"sensors/temperature"}, s.next(t).Topics)
+	writeTestPacket(sc, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Suback}, PacketID: 3, ReturnCodes: []byte{0}})
+	require.Equal(t, snPacket{Type: snSuback, TopicID: 7, MsgID: 3, ReturnCode: snAccepted}, snRead(t, conn))
+
+	snWrite(t, conn, snPacket{Type: snSubscribe, Flags: snTopicPredefined, MsgID: 4, TopicID: 8})
+	require.Equal(t, snPacket{Type: snSuback, TopicID: 8, MsgID: 4, ReturnCode: snRejectedTopicID}, snRead(t, conn))
+
+	snWrite(t, conn, snPacket{Type: snSubscribe, Flags: 0x60, MsgID: 5, TopicName: "a/b"})
+	require.Equal(t, snPacket{Type: snSuback, MsgID: 5, ReturnCode: snRejectedNotSupported}, snRead(t, conn))
+
+	snWrite(t, conn, snPacket{Type: snUnsubscribe, Flags: snTopicShort, MsgID: 6, TopicID: 0x6162})
+	pk = s.next(t)
+	require.Equal(t, packets.Unsubscribe, pk.FixedHeader.Type)
+	require.Equal(t, []string{"ab"}, pk.Topics)
+	writeTestPacket(sc, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Unsuback}, PacketID: 6})
+	require.Equal(t, snPacket{Type: snUnsuback, MsgID: 6}, snRead(t, conn))
+
+	snWrite(t, conn, snPacket{Type: snUnsubscribe, Flags: snTopicPredefined, MsgID: 7, TopicID: 8})
+	require.Equal(t, snPacket{Type: snUnsuback, MsgID: 7}, snRead(t, conn))
+}
+
+func TestMQTTSNDeliver(t *testing.T) {
+	s := newSNTestServer(packets.Accepted)
+	l := newTestMQTTSN(t, s.establish, MQTTSNOptions{
+		PredefinedTopics: map[uint16]string{
+			7: "sensors/temperature",
+		},
+	})
+	conn := dialSN(t, l)
+	sc := connectSN(t, conn, s, "sensor")
+
+	publish := func(topic string, qos byte, id uint16) {
+		writeTestPacket(sc, packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: qos},
+			TopicName:   topic,
+			PacketID:    id,
+			Payload:     []byte(topic),
+		})
+	}
+
+	publish("c/d", 1, 10)
+	publish("c/d", 0, 0)
+	require.Equal(t, snPacket{Type: snRegister, TopicID: 1, MsgID: 1, TopicName: "c/d"}, snRead(t, conn))
+
+	snWrite(t, conn, snPacket{Type: snRegack, TopicID: 1, MsgID: 1, ReturnCode: snAccepted})
+	require.Equal(t, snPacket{Type: snPublish, Flags: 0x20, TopicID: 1, MsgID: 10, Data: []byte("c/d")}, snRead(t, conn))
+	require.Equal(t, snPacket{Type: snPublish, TopicID: 1, Data: []byte("c/d")}, snRead(t, conn))
+
+	snWrite(t, conn, snPacket{Type: snPuback, TopicID: 1, MsgID: 10, ReturnCode: snAccepted})
+	pk := s.next(t)
+	require.Equal(t, packets.Puback, pk.FixedHeader.Type)
+	require.Equal(t, uint16(10), pk.PacketID)
+
+	publish("c/d", 0, 0)
+	require.Equal(t, snPacket{Type: snPublish, TopicID: 1, Data: []byte("c/d")}, snRead(t, conn))
+
+	publish("sensors/temperature", 0, 0)
+	require.Equal(t, snPacket{Type: snPublish, Flags: snTopicPredefined, TopicID: 7, Data: []byte("sensors/temperature")}, snRead(t, conn))
+
+	publish("ab", 2, 11)
+	require.Equal(t, snPacket{Type: snPublish, Flags: 0x40 | snTopicShort, TopicID: 0x6162, MsgID: 11, Data: []byte("ab")}, snRead(t, conn))
+
+	snWrite(t, conn, snPacket{Type: snPubrec, MsgID: 11})
+	require.Equal(t, packets.Pubrec, s.next(t).FixedHeader.Type)
+	writeTestPacket(sc, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pubrel, Qos: 1}, PacketID: 11})
+	require.Equal(t, snPacket{Type: snPubrel, MsgID: 11}, snRead(t, conn))
+	snWrite(t, conn, snPacket{Type: snPubcomp, MsgID: 11})
+	require.Equal(t, packets.Pubcomp, s.next(t).FixedHeader.Type)
+
+	// a client which no longer knows a topic id has it registered again.
+	publish("c/d", 1, 12)
+	require.Equal(t, snPacket{Type: snPublish, Flags: 0x20, TopicID: 1, MsgID: 12, Data: []byte("c/d")}, snRead(t, conn))
+	snWrite(t, conn, snPacket{Type: snPuback, TopicID: 1, MsgID: 12, ReturnCode: snRejectedTopicID})
+	require.Equal(t, packets.Puback, s.next(t).FixedHeader.Type)
+
+	publish("c/d", 0, 0)
+	require.Equal(t, snPacket{Type: snRegister, TopicID: 2, MsgID: 2, TopicName: "c/d"}, snRead(t, conn))
+
+	// a rejected registration drops the waiting messages.
+	snWrite(t, conn, snPacket{Type: snRegack, TopicID: 2, MsgID: 2, ReturnCode: snRejectedCongestion})
+
+	l.RLock()
+	c := l.clients[conn.LocalAddr().String()]
+	l.RUnlock()
+	require.Eventually(t, func() bool {
+		c.Lock()
+		defer c.Unlock()
+		return len(c.registering) == 0
+	}, time.Second, time.Millisecond)
+
+	publish("c/d", 0, 0)
+	require.Equal(t, snPacket{Type: snRegister, TopicID: 3, MsgID: 3, TopicName: "c/d"}, snRead(t, conn))
+}
+
+func TestMQTTSNSleep(t *testing.T) {
+	s := newSNTestServer(packets.Accepted)
+	log := new(logger.Mock)
+	l := newTestMQTTSN(t, s.establish, MQTTSNOptions{SleepBuffer: 2})
+	l.SetLogger(log)
+	conn := dialSN(t, l)
+	sc := connectSN(t, conn, s, "sensor")
+
+	snWrite(t, conn, snPacket{Type: snDisconnect, Duration: 60})
+	require.Equal(t, snPacket{Type: snDisconnect}, snRead(t, conn))
+
+	l.RLock()
+	c := l.clients[conn.LocalAddr().String()]
+	l.RUnlock()
+
+	for i := 0; i < 3; i++ {
+		writeTestPacket(sc, packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Publish},
+			TopicName:   "ab",
+			Payload:     []byte{byte(i)},
+		})
+	}
+
+	require.Eventually(t, func() bool {
+		_, ok := log.Find("mqtt-sn sleep buffer full, message dropped")
+		return ok
+	}, time.Second, time.Millisecond)
+
+	c.Lock()
+	require.Equal(t, snStateAsleep, c.state)
+	require.Equal(t, time.Minute, c.sleep)
+	require.Len(t, c.buffered, 2)
+	c.Unlock()
+
+	// a client may not wake from a different address.
+	other := dialSN(t, l)
+	snWrite(t, other, snPacket{Type: snPingreq, ClientID: "sensor"})
+	require.Eventually(t, func() bool {
+		_, ok := log.Find("mqtt-sn wake from unknown client")
+		return ok
+	}, time.Second, time.Millisecond)
+
+	c.Lock()
+	require.Equal(t, snStateAsleep, c.state)
+	require.Len(t, c.buffered, 2)
+	c.Unlock()
+
+	l.RLock()
+	require.NotContains(t, l.clients, other.LocalAddr().String())
+	l.RUnlock()
+
+	snWrite(t, conn, snPacket{Type: snPingreq, ClientID: "sensor"})
+	require.Equal(t, snPacket{Type: snPublish, Flags: snTopicShort, TopicID: 0x6162, Data: []byte{0}}, snRead(t, conn))
+	require.Equal(t, snPacket{Type: snPublish, Flags: snTopicShort, TopicID: 0x6162, Data: []byte{1}}, snRead(t, conn))
+	require.Equal(t, snPacket{Type: snPingresp}, snRead(t, conn))
+
+	c.Lock()
+	require.Equal(t, snStateAsleep, c.state)
+	require.Empty(t, c.buffered)
+	c.Unlock()
+
+	// a client connecting again without a clean session resumes its session.
+	snWrite(t, conn, snPacket{Type: snConnect, Duration: 30, ClientID: "sensor"})
+	require.Equal(t, snPacket{Type: snConnack, ReturnCode: snAccepted}, snRead(t, conn))
+
+	c.Lock()
+	require.Equal(t, snStateActive, c.state)
+	c.Unlock()
+
+	snWrite(t, conn, snPacket{Type: snPingreq})
+	require.Equal(t, snPacket{Type: snPingresp}, snRead(t, conn))
+	require.Empty(t, s.packets)
+}
+
+func TestMQTTSNWakeRegister(t *testing.T) {
+	s := newSNTestServer(packets.Accepted)
+	l := newTestMQTTSN(t, s.establish, MQTTSNOptions{})
+	conn := dialSN(t, l)
+	sc := connectSN(t, conn, s, "sensor")
+
+	snWrite(t, conn, snPacket{Type: snDisconnect, Duration: 60})
+	require.Equal(t, snPacket{Type: snDisconnect}, snRead(t, conn))
+
+	writeTestPacket(sc, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish},
+		TopicName:   "c/d",
+	})
+
+	l.RLock()
+	c := l.clients[conn.LocalAddr().String()]
+	l.RUnlock()
+	require.Eventually(t, func() bool {
+		c.Lock()
+		defer c.Unlock()
+		return len(c.buffered) == 1
+	}, time.Second, time.Millisecond)
+
+	// the pingresp is sent once the client has registered the topics.
+	snWrite(t, conn, snPacket{Type: snPingreq, ClientID: "sensor"})
+	require.Equal(t, snPacket{Type: snRegister, TopicID: 1, MsgID: 1, TopicName: "c/d"}, snRead(t, conn))
+	snWrite(t, conn, snPacket{Type: snRegack, TopicID: 1, MsgID: 1, ReturnCode: snAccepted})
+	require.Equal(t, snPacket{Type: snPublish, TopicID: 1, Data: []byte{}}, snRead(t, conn))
+	require.Equal(t, snPacket{Type: snPingresp}, snRead(t, conn))
+}
+
+func TestMQTTSNWakeUnknown(t *testing.T) {
+	log := new(logger.Mock)
+	l := newTestMQTTSN(t, MockEstablisher, MQTTSNOptions{})
+	l.SetLogger(log)
+	conn := dialSN(t, l)
+
+	snWrite(t, conn, snPacket{Type: snPingreq, ClientID: "sensor"})
+	require.Eventually(t, func() bool {
+		_, ok := log.Find("mqtt-sn wake from unknown client")
+		return ok
+	}, time.Second, time.Millisecond)
+}
+
+func TestMQTTSNDisconnect(t *testing.T) {
+	s := newSNTestServer(packets.Accepted)
+	l := newTestMQTTSN(t, s.establish, MQTTSNOptions{})
+	conn := dialSN(t, l)
+	connectSN(t, conn, s, "sensor")
+
+	snWrite(t, conn, snPacket{Type: snDisconnect})
+	require.Equal(t, snPacket{Type: snDisconnect}, snRead(t, conn))
+	require.Equal(t, packets.Disconnect, s.next(t).FixedHeader.Type)
+
+	require.Eventually(t, func() bool {
+		l.RLock()
+		defer l.RUnlock()
+		return len(l.clients) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestMQTTSNServerDisconnect(t *testing.T) {
+	s := newSNTestServer(packets.Accepted)
+	l := newTestMQTTSN(t, s.establish, MQTTSNOptions{})
+	conn := dialSN(t, l)
+	sc := connectSN(t, conn, s, "sensor")
+
+	sc.Close()
+	require.Equal(t, snPacket{Type: snDisconnect}, snRead(t, conn))
+	require.Eventually(t, func() bool {
+		l.RLock()
+		defer l.RUnlock()
+		return len(l.clients) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestMQTTSNReconnect(t *testing.T) {
+	s := newSNTestServer(packets.Accepted)
+	l := newTestMQTTSN(t, s.establish, MQTTSNOptions{})
+	conn := dialSN(t, l)
+	connectSN(t, conn, s, "sensor")
+
+	l.RLock()
+	old := l.clients[conn.LocalAddr().String()]
+	l.RUnlock()
+
+	snWrite(t, conn, snPacket{Type: snConnect, Flags: snFlagCleanSession, Duration: 30, ClientID: "sensor"})
+	// the old connection is disconnected and the new connection is made concurrently.
+	require.ElementsMatch(t, []byte{packets.Disconnect, packets.Connect}, []byte{s.next(t).FixedHeader.Type, s.next(t).FixedHeader.Type})
+	require.Equal(t, snPacket{Type: snConnack, ReturnCode: snAccepted}, snRead(t, conn))
+
+	l.RLock()
+	require.True(t, old != l.clients[conn.LocalAddr().String()])
+	l.RUnlock()
+}
+
+func TestMQTTSNUnknownClient(t *testing.T) {
+	log := new(logger.Mock)
+	l := newTestMQTTSN(t, MockEstablisher, MQTTSNOptions{})
+	l.SetLogger(log)
+	conn := dialSN(t, l)
+
+	snWrite(t, conn, snPacket{Type: snRegister, MsgID: 1, TopicName: "a/b"})
+	require.Eventually(t, func() bool {
+		_, ok := log.Find("mqtt-sn packet from unknown client")
+		return ok
+	}, time.Second, time.Millisecond)
+}
+
+func TestMQTTSNWillUpdate(t *testing.T) {
+	s := newSNTestServer(packets.Accepted)
+	l := newTestMQTTSN(t, s.establish, MQTTSNOptions{})
+	conn := dialSN(t, l)
+	connectSN(t, conn, s, "sensor")
+
+	snWrite(t, conn, snPacket{Type: snWillTopicUpd, TopicName: "a/b"})
+	require.Equal(t, snPacket{Type: snWillTopicResp, ReturnCode: snRejectedNotSupported}, snRead(t, conn))
+
+	snWrite(t, conn, snPacket{Type: snWillMsgUpd, Data: []byte("x")})
+	require.Equal(t, snPacket{Type: snWillMsgResp, ReturnCode: snRejectedNotSupported}, snRead(t, conn))
+}
+
+// snAuth is an auth controller which records the clients it authenticates and
+// which are disconnected.
+type snAuth struct {
+	auth.Allow
+	sync.Mutex
+	authenticated []auth.Client
+	disconnected  []auth.Client
+}
+
+func (a *snAuth) AuthenticateClient(cl auth.Client, password []byte) bool {
+	a.Lock()
+	defer a.Unlock()
+	a.authenticated = append(a.authenticated, cl)
+	return true
+}
+
+func (a *snAuth) ClientACL(cl auth.Client, access auth.Access) bool {
+	return true
+}
+
+func (a *snAuth) ClientDisconnected(cl auth.Client) {
+	a.Lock()
+	defer a.Unlock()
+	a.disconnected = append(a.disconnected, cl)
+}
+
+type snPublished struct {
+	cl      auth.Client
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+func newSNPublisher(l *MQTTSN) chan snPublished {
+	p := make(chan snPublished, 4)
+	l.SetPublisher(func(cl auth.Client, topic string, payload []byte, retain bool) bool {
+		p <- snPublished{cl, topic, payload, retain}
+		return true
+	})
+	return p
+}
+
+func TestMQTTSNPublishMinusOne(t *testing.T) {
+	ac := new(snAuth)
+	l := newTestMQTTSN(t, MockEstablisher, MQTTSNOptions{
+		PredefinedTopics: map[uint16]string{
+			7: "sensors/temperature",
+		},
+		AllowAnonymousQosMinusOne: true,
+	})
+	l.SetConfig(&Config{Auth: ac})
+	p := newSNPublisher(l)
+	conn := dialSN(t, l)
+
+	snWrite(t, conn, snPacket{Type: snPublish, Flags: 0x60 | snFlagRetain | snTopicPredefined, TopicID: 7, Data: []byte("21.5")})
+	pub := <-p
+	require.Equal(t, conn.LocalAddr().String(), pub.cl.Remote)
+	require.Equal(t, "sn1", pub.cl.Listener)
+	require.Empty(t, pub.cl.ID)
+	require.NotEmpty(t, pub.cl.ConnID)
+	require.Equal(t, "sensors/temperature", pub.topic)
+	require.Equal(t, []byte("21.5"), pub.payload)
+	require.True(t, pub.retain)
+
+	// each publish is authenticated by the auth controller of the listener.
+	ac.Lock()
+	require.Equal(t, []auth.Client{pub.cl}, ac.authenticated)
+	require.Equal(t, []auth.Client{pub.cl}, ac.disconnected)
+	ac.Unlock()
+
+	snWrite(t, conn, snPacket{Type: snPublish, Flags: 0x60 | snTopicShort, TopicID: 0x6162, Data: []byte("x")})
+	require.Equal(t, "ab", (<-p).topic)
+
+	// unknown predefined topics and normal topic ids are dropped.
+	snWrite(t, conn, snPacket{Type: snPublish, Flags: 0x60 | snTopicPredefined, TopicID: 8})
+	snWrite(t, conn, snPacket{Type: snPublish, Flags: 0x60, TopicID: 1})
+
+	// publishes are dropped if not authenticated.
+	l.SetConfig(&Config{Auth: new(auth.Disallow)})
+	snWrite(t, conn, snPacket{Type: snPublish, Flags: 0x60 | snTopicShort, TopicID: 0x6162})
+
+	time.Sleep(10 * time.Millisecond)
+	require.Empty(t, p)
+}
+
+func TestMQTTSNPublishMinusOneUnconnected(t *testing.T) {
+	log := new(logger.Mock)
+	l := newTestMQTTSN(t, MockEstablisher, MQTTSNOptions{})
+	l.SetLogger(log)
+	p := newSNPublisher(l)
+	conn := dialSN(t, l)
+
+	snWrite(t, conn, snPacket{Type: snPublish, Flags: 0x60 | snTopicShort, TopicID: 0x6162, Data: []byte("x")})
+	require.Eventually(t, func() bool {
+		_, ok := log.Find("mqtt-sn qos -1 publish from unconnected client")
+		return ok
+	}, time.Second, time.Millisecond)
+	require.Empty(t, p)
+}
+
+func TestMQTTSNPublishMinusOneConnected(t *testing.T) {
+	s := newSNTestServer(packets.Accepted)
+	l := newTestMQTTSN(t, s.establish, MQTTSNOptions{})
+	p := newSNPublisher(l)
+	conn := dialSN(t, l)
+	connectSN(t, conn, s, "sensor")
+
+	// a connected client publishes as itself.
+	snWrite(t, conn, snPacket{Type: snPublish, Flags: 0x60 | snTopicShort, TopicID: 0x6162, Data: []byte("x")})
+	require.Equal(t, snPublished{
+		cl:      auth.Client{ID: "sensor", Remote: conn.LocalAddr().String(), Listener: "sn1"},
+		topic:   "ab",
+		payload: []byte("x"),
+	}, <-p)
+
+	// publishes are checked against the acls of the listener.
+	l.SetConfig(&Config{Auth: new(auth.Disallow)})
+	snWrite(t, conn, snPacket{Type: snPublish, Flags: 0x60 | snTopicShort, TopicID: 0x6162})
+
+	time.Sleep(10 * time.Millisecond)
+	require.Empty(t, p)
+}
+
+func TestMQTTSNSupervise(t *testing.T) {
+	s := newSNTestServer(packets.Accepted)
+	l := NewMQTTSN("sn1", "127.0.0.1:0")
+	l.supervise = time.Millisecond
+	require.NoError(t, l.Listen(nil))
+	go l.Serve(s.establish)
+	defer l.Close(MockCloser)
+
+	conn := dialSN(t, l)
+	connectSN(t, conn, s, "sensor")
+
+	l.RLock()
+	c := l.clients[conn.LocalAddr().String()]
+	l.RUnlock()
+
+	c.Lock()
+	c.seen = time.Now().Add(-time.Minute)
+	c.Unlock()
+
+	require.Eventually(t, func() bool {
+		l.RLock()
+		defer l.RUnlock()
+		return len(l.clients) == 0
+	}, time.Second, time.Millisecond)
+
+	// the connection is closed without a disconnect, so the will is sent.
+	time.Sleep(10 * time.Millisecond)
+	require.Empty(t, s.packets)
+}
+
+func TestSNClientExpired(t *testing.T) {
+	now := time.Now()
+	c := &snClient{
+		state:     snStateActive,
+		keepalive: 10 * time.Second,
+		sleep:     time.Minute,
+		seen:      now,
+	}
+
+	require.False(t, c.expired(now.Add(15*time.Second)))
+	require.True(t, c.expired(now.Add(16*time.Second)))
+
+	c.state = snStateAsleep
+	require.False(t, c.expired(now.Add(90*time.Second)))
+	require.True(t, c.expired(now.Add(91*time.Second)))
+
+	c.state = snStateWillTopic
+	require.False(t, c.expired(now.Add(mqttsnConnectTimeout)))
+	require.True(t, c.expired(now.Add(mqttsnConnectTimeout+time.Second)))
+
+	c.state = snStateActive
+	c.keepalive = 0
+	require.False(t, c.expired(now.Add(time.Hour)))
+}
+
+func TestReadMQTTPacket(t *testing.T) {
+	var buf bytes.Buffer
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b",
+		PacketID:    3,
+		Payload:     []byte("hello"),
+	}
+	require.NoError(t, pk.PublishEncode(&buf))
+
+	read, err := readMQTTPacket(bufio.NewReader(&buf))
+	require.NoError(t, err)
+	require.Equal(t, "a/b", read.TopicName)
+	require.Equal(t, uint16(3), read.PacketID)
+	require.Equal(t, []byte("hello"), read.Payload)
+
+	_, err = readMQTTPacket(bufio.NewReader(bytes.NewReader([]byte{packets.Pingresp << 4, 0})))
+	require.NoError(t, err)
+}
+
+func TestReadMQTTPacketInvalid(t *testing.T) {
+	tt := []struct {
+		b   []byte
+		err error
+	}{
+		{b: []byte{}, err: io.EOF},
+		{b: []byte{packets.Connack<<4 | 1, 2, 0, 0}, err: packets.ErrInvalidFlags},
+		{b: []byte{packets.Publish << 4, 0xFF, 0xFF, 0xFF, 0xFF}, err: packets.ErrOversizedLengthIndicator},
+		{b: []byte{packets.Publish << 4}, err: io.EOF},
+		{b: []byte{packets.Puback << 4, 2, 0}, err: io.ErrUnexpectedEOF},
+		{b: []byte{packets.Connect << 4, 0}, err: ErrInvalidMQTTPacket},
+	}
+
+	for _, tx := range tt {
+		_, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(tx.b)))
+		require.ErrorIs(t, err, tx.err, "%v", tx.b)
+	}
+}
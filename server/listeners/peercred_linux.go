@@ -0,0 +1,43 @@
+//go:build linux
+
+package listeners
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+)
+
+// peerCredentials returns the credentials of the process at the other end of a
+// unix socket connection.
+func peerCredentials(conn net.Conn) (*auth.PeerCredentials, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, ErrPeerCredentialsUnsupported
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if credErr != nil {
+		return nil, credErr
+	}
+
+	return &auth.PeerCredentials{
+		PID: cred.Pid,
+		UID: cred.Uid,
+		GID: cred.Gid,
+	}, nil
+}
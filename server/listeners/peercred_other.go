@@ -0,0 +1,15 @@
+//go:build !linux
+
+package listeners
+
+import (
+	"net"
+
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+)
+
+// peerCredentials returns ErrPeerCredentialsUnsupported, as peer credentials
+// are only read on linux.
+func peerCredentials(conn net.Conn) (*auth.PeerCredentials, error) {
+	return nil, ErrPeerCredentialsUnsupported
+}
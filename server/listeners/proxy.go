@@ -0,0 +1,644 @@
+package listeners
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultProxyHeaderTimeout is how long a trusted upstream has to send a
+	// PROXY protocol header if no timeout is configured.
+	defaultProxyHeaderTimeout = 5 * time.Second
+
+	// proxyV1MaxLength is the maximum length of a v1 header, including the CRLF.
+	proxyV1MaxLength = 107
+)
+
+// PROXY protocol v2 TLV types.
+const (
+	ProxyTLVALPN      byte = 0x01 // the application protocol negotiated with the client.
+	ProxyTLVAuthority byte = 0x02 // the host name sent by the client, such as the tls SNI.
+	ProxyTLVCRC32C    byte = 0x03 // a checksum of the header.
+	ProxyTLVNoop      byte = 0x04 // padding, which is ignored.
+	ProxyTLVUniqueID  byte = 0x05 // an opaque id of the connection.
+	ProxyTLVSSL       byte = 0x20 // details of the tls connection with the client.
+	ProxyTLVNetNS     byte = 0x30 // the network namespace of the connection.
+
+	proxySubtypeSSLVersion byte = 0x21 // the tls version.
+	proxySubtypeSSLCN      byte = 0x22 // the common name of the client certificate.
+	proxySubtypeSSLCipher  byte = 0x23 // the cipher suite.
+	proxySubtypeSSLSigAlg  byte = 0x24 // the signature algorithm of the client certificate.
+	proxySubtypeSSLKeyAlg  byte = 0x25 // the key algorithm of the client certificate.
+)
+
+// Flags of the client field of a PROXY protocol v2 tls TLV.
+const (
+	ProxyClientSSL      byte = 0x01 // the client connected over tls.
+	ProxyClientCertConn byte = 0x02 // the client presented a certificate on this connection.
+	ProxyClientCertSess byte = 0x04 // the client presented a certificate during the tls session.
+)
+
+var (
+	// ErrInvalidProxyHeader indicates that a PROXY protocol header was malformed.
+	ErrInvalidProxyHeader = errors.New("invalid proxy protocol header")
+
+	// ErrProxyChecksum indicates that the checksum of a PROXY protocol v2
+	// header did not match its contents.
+	ErrProxyChecksum = errors.New("proxy protocol header checksum mismatch")
+
+	// ErrInvalidTrustedProxy indicates that a trusted proxy was not an ip
+	// address or CIDR range.
+	ErrInvalidTrustedProxy = errors.New("invalid trusted proxy address")
+
+	// ErrNoTrustedProxies indicates that the PROXY protocol or forwarded headers
+	// were enabled without any trusted upstreams.
+	ErrNoTrustedProxies = errors.New("proxy protocol and forwarded headers require trusted proxies")
+
+	// proxyV1Signature is the prefix of a PROXY protocol v1 header.
+	proxyV1Signature = []byte("PROXY ")
+
+	// proxyV2Signature is the prefix of a PROXY protocol v2 header.
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// Proxy configures how a listener finds the original address of clients which
+// connect through a proxy or load balancer.
+type Proxy struct {
+	// Trusted are the ip addresses or CIDR ranges of upstreams which are trusted
+	// to report the addresses of clients. It must not be empty if ProxyProtocol
+	// or ForwardedHeaders is set.
+	Trusted []string
+
+	// ProxyProtocol parses PROXY protocol v1 and v2 headers sent by trusted
+	// upstreams before any other data. Connections from trusted upstreams
+	// without a header are used unchanged.
+	ProxyProtocol bool
+
+	// ForwardedHeaders uses the Forwarded or X-Forwarded-For headers of
+	// websocket requests made by trusted upstreams.
+	ForwardedHeaders bool
+
+	// HeaderTimeout is how long a trusted upstream has to send a PROXY protocol
+	// header. The default is 5 seconds.
+	HeaderTimeout time.Duration
+}
+
+// ProxyHeader contains the values of a PROXY protocol header.
+type ProxyHeader struct {
+	Version     int        // the version of the protocol, 1 or 2.
+	Local       bool       // true if the upstream made the connection itself, such as for a health check.
+	Source      net.Addr   // the address of the client, if known.
+	Destination net.Addr   // the address the client connected to, if known.
+	TLVs        []ProxyTLV // the v2 type-length-values sent with the header.
+	TLS         *ProxyTLS  // details of the tls connection with the client, if sent.
+}
+
+// ProxyTLV is a type-length-value sent with a PROXY protocol v2 header.
+type ProxyTLV struct {
+	Type  byte   // the type of the value.
+	Value []byte // the value.
+}
+
+// ProxyTLS contains details of the tls connection between a client and an
+// upstream which terminated tls, sent in a PROXY protocol v2 header.
+type ProxyTLS struct {
+	Client     byte   // the ProxyClient flags of the connection.
+	Verified   bool   // true if the client presented a certificate which was verified.
+	Version    string // the tls version, such as TLSv1.3.
+	CommonName string // the common name of the client certificate.
+	Cipher     string // the cipher suite.
+	SigAlg     string // the signature algorithm of the client certificate.
+	KeyAlg     string // the key algorithm of the client certificate.
+}
+
+// TLV returns the value of the first TLV of a type, and true if it was sent.
+func (h *ProxyHeader) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+// proxyPolicy decides which upstreams are trusted to report client addresses.
+type proxyPolicy struct {
+	opts    Proxy        // configuration settings for the policy.
+	trusted []*net.IPNet // the trusted upstreams.
+}
+
+// newProxyPolicy returns a proxy policy for the configured trusted upstreams.
+func newProxyPolicy(opts Proxy) (*proxyPolicy, error) {
+	if (opts.ProxyProtocol || opts.ForwardedHeaders) && len(opts.Trusted) == 0 {
+		return nil, ErrNoTrustedProxies
+	}
+
+	p := &proxyPolicy{opts: opts}
+	if p.opts.HeaderTimeout <= 0 {
+		p.opts.HeaderTimeout = defaultProxyHeaderTimeout
+	}
+
+	for _, s := range opts.Trusted {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("%w: %s", ErrInvalidTrustedProxy, s)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+
+			p.trusted = append(p.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidTrustedProxy, s)
+		}
+
+		p.trusted = append(p.trusted, ipnet)
+	}
+
+	return p, nil
+}
+
+// trusts returns true if an upstream ip address is trusted.
+func (p *proxyPolicy) trusts(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, ipnet := range p.trusted {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// trustsAddr returns true if the ip address of an upstream net.Addr is trusted.
+func (p *proxyPolicy) trustsAddr(addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return p.trusts(a.IP)
+	case *net.UDPAddr:
+		return p.trusts(a.IP)
+	}
+
+	return false
+}
+
+// listenProxy listens on a network address, reading PROXY protocol headers
+// from trusted upstreams before any tls handshake.
+func listenProxy(network, address string, policy *proxyPolicy, tlsConfig *tls.Config) (net.Listener, error) {
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	var pl net.Listener = &proxyListener{Listener: ln, policy: policy}
+	if tlsConfig != nil {
+		pl = tls.NewListener(pl, tlsConfig)
+	}
+
+	return pl, nil
+}
+
+// proxyListener is a net.Listener which reads PROXY protocol headers from
+// connections made by trusted upstreams.
+type proxyListener struct {
+	net.Listener
+	policy *proxyPolicy // the upstreams trusted to send headers.
+}
+
+// Accept waits for the next connection. The header is read when the connection
+// is first used, so a slow upstream does not block other connections.
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !l.policy.trustsAddr(conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	return &proxyConn{
+		Conn:    conn,
+		r:       bufio.NewReader(conn),
+		timeout: l.policy.opts.HeaderTimeout,
+	}, nil
+}
+
+// proxyConn is a connection from a trusted upstream which may begin with a
+// PROXY protocol header. The addresses of the connection are those sent in
+// the header.
+type proxyConn struct {
+	net.Conn
+	r       *bufio.Reader // buffers the connection while the header is read.
+	timeout time.Duration // how long the upstream has to send the header.
+	once    sync.Once     // ensures the header is only read once.
+	header  *ProxyHeader  // the header sent by the upstream, if any.
+	err     error         // an error reading the header.
+}
+
+// readHeader reads the PROXY protocol header, if any, on first use.
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.header, c.err = readProxyHeader(c.r)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+// Read reads data following the PROXY protocol header.
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.r.Read(p)
+}
+
+// RemoteAddr returns the address of the client sent in the PROXY protocol
+// header, or the address of the upstream if no client address was sent.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to, sent in the PROXY
+// protocol header, or the local address of the connection.
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.header != nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+
+	return c.Conn.LocalAddr()
+}
+
+// ProxyHeader returns the PROXY protocol header sent by the upstream, or nil
+// if no header was sent.
+func (c *proxyConn) ProxyHeader() *ProxyHeader {
+	c.readHeader()
+	return c.header
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header. If the data does not
+// begin with a header, nil is returned and no data is consumed.
+func readProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch b[0] {
+	case proxyV1Signature[0]:
+		if b, err = r.Peek(len(proxyV1Signature)); err == nil && bytes.Equal(b, proxyV1Signature) {
+			return readProxyV1(r)
+		}
+	case proxyV2Signature[0]:
+		if b, err = r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(b, proxyV2Signature) {
+			return readProxyV2(r)
+		}
+	}
+
+	return nil, nil
+}
+
+// readProxyV1 reads a human readable PROXY protocol v1 header.
+func readProxyV1(r *bufio.Reader) (*ProxyHeader, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 header too long", ErrInvalidProxyHeader)
+	}
+
+	fields := strings.Split(string(line[len(proxyV1Signature):len(line)-2]), " ")
+	h := &ProxyHeader{Version: 1}
+	if fields[0] == "UNKNOWN" {
+		return h, nil
+	}
+
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidProxyHeader, line)
+	}
+
+	src, err := parseProxyV1Addr(fields[0], fields[1], fields[3])
+	if err != nil {
+		return nil, err
+	}
+
+	dst, err := parseProxyV1Addr(fields[0], fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+
+	h.Source, h.Destination = src, dst
+	return h, nil
+}
+
+// parseProxyV1Addr parses an address and port of a v1 header.
+func parseProxyV1Addr(proto, addr, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil || (proto == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("%w: address %q", ErrInvalidProxyHeader, addr)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: port %q", ErrInvalidProxyHeader, port)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readProxyV2 reads a binary PROXY protocol v2 header.
+func readProxyV2(r *bufio.Reader) (*ProxyHeader, error) {
+	fixed := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+
+	verCmd, family := fixed[12], fixed[13]
+	if verCmd>>4 != 2 || verCmd&0x0f > 1 {
+		return nil, fmt.Errorf("%w: version and command %#x", ErrInvalidProxyHeader, verCmd)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	h := &ProxyHeader{
+		Version: 2,
+		Local:   verCmd&0x0f == 0,
+	}
+
+	var n int
+	switch family >> 4 {
+	case 0x1: // AF_INET
+		n = 12
+	case 0x2: // AF_INET6
+		n = 36
+	case 0x3: // AF_UNIX
+		n = 216
+	default: // AF_UNSPEC, which has no addresses or TLVs to read.
+		n = len(body)
+	}
+
+	if len(body) < n {
+		return nil, fmt.Errorf("%w: address block too short", ErrInvalidProxyHeader)
+	}
+
+	if !h.Local {
+		h.Source, h.Destination = parseProxyV2Addrs(family, body[:n])
+	}
+
+	tlvs, err := parseProxyTLVs(body[n:])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tlv := range tlvs {
+		switch tlv.Type {
+		case ProxyTLVCRC32C:
+			if err := checkProxyCRC32C(fixed, body, tlv.Value); err != nil {
+				return nil, err
+			}
+		case ProxyTLVSSL:
+			if h.TLS, err = parseProxyTLS(tlv.Value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	h.TLVs = tlvs
+	return h, nil
+}
+
+// parseProxyV2Addrs returns the source and destination addresses of a v2
+// address block.
+func parseProxyV2Addrs(family byte, b []byte) (net.Addr, net.Addr) {
+	ipAddrs := func(size int) (net.IP, net.IP, int, int) {
+		return net.IP(append([]byte{}, b[:size]...)),
+			net.IP(append([]byte{}, b[size:2*size]...)),
+			int(binary.BigEndian.Uint16(b[2*size:])),
+			int(binary.BigEndian.Uint16(b[2*size+2:]))
+	}
+
+	switch family {
+	case 0x11, 0x21: // TCP over IPv4 or IPv6
+		src, dst, sp, dp := ipAddrs(len(b)/2 - 2)
+		return &net.TCPAddr{IP: src, Port: sp}, &net.TCPAddr{IP: dst, Port: dp}
+	case 0x12, 0x22: // UDP over IPv4 or IPv6
+		src, dst, sp, dp := ipAddrs(len(b)/2 - 2)
+		return &net.UDPAddr{IP: src, Port: sp}, &net.UDPAddr{IP: dst, Port: dp}
+	case 0x31, 0x32: // stream or datagram unix sockets
+		network := "unix"
+		if family == 0x32 {
+			network = "unixgram"
+		}
+		return &net.UnixAddr{Name: unixName(b[:108]), Net: network}, &net.UnixAddr{Name: unixName(b[108:]), Net: network}
+	}
+
+	return nil, nil
+}
+
+// unixName returns a nul terminated unix socket path.
+func unixName(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+
+	return string(b)
+}
+
+// parseProxyTLVs parses a sequence of type-length-values.
+func parseProxyTLVs(b []byte) ([]ProxyTLV, error) {
+	var tlvs []ProxyTLV
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, fmt.Errorf("%w: truncated tlv", ErrInvalidProxyHeader)
+		}
+
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+n {
+			return nil, fmt.Errorf("%w: truncated tlv", ErrInvalidProxyHeader)
+		}
+
+		if b[0] != ProxyTLVNoop {
+			tlvs = append(tlvs, ProxyTLV{Type: b[0], Value: b[3 : 3+n]})
+		}
+		b = b[3+n:]
+	}
+
+	return tlvs, nil
+}
+
+// parseProxyTLS parses the value of a tls TLV, which contains the client flags,
+// the verification result, and sub-TLVs describing the connection.
+func parseProxyTLS(b []byte) (*ProxyTLS, error) {
+	if len(b) < 5 {
+		return nil, fmt.Errorf("%w: truncated tls tlv", ErrInvalidProxyHeader)
+	}
+
+	s := &ProxyTLS{Client: b[0]}
+	s.Verified = s.Client&(ProxyClientCertConn|ProxyClientCertSess) > 0 && binary.BigEndian.Uint32(b[1:5]) == 0
+
+	subs, err := parseProxyTLVs(b[5:])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sub := range subs {
+		switch sub.Type {
+		case proxySubtypeSSLVersion:
+			s.Version = string(sub.Value)
+		case proxySubtypeSSLCN:
+			s.CommonName = string(sub.Value)
+		case proxySubtypeSSLCipher:
+			s.Cipher = string(sub.Value)
+		case proxySubtypeSSLSigAlg:
+			s.SigAlg = string(sub.Value)
+		case proxySubtypeSSLKeyAlg:
+			s.KeyAlg = string(sub.Value)
+		}
+	}
+
+	return s, nil
+}
+
+// checkProxyCRC32C verifies the checksum of a v2 header, which is calculated
+// over the whole header with the checksum value set to zero.
+func checkProxyCRC32C(fixed, body, sum []byte) error {
+	if len(sum) != 4 {
+		return fmt.Errorf("%w: crc32c length %d", ErrInvalidProxyHeader, len(sum))
+	}
+
+	want := binary.BigEndian.Uint32(sum)
+	zero := [4]byte{}
+	copy(sum, zero[:])
+	defer binary.BigEndian.PutUint32(sum, want)
+
+	table := crc32.MakeTable(crc32.Castagnoli)
+	got := crc32.Update(crc32.Checksum(fixed, table), table, body)
+	if got != want {
+		return ErrProxyChecksum
+	}
+
+	return nil
+}
+
+// forwardedAddr returns the address of the client which made a request through
+// trusted upstreams, using the Forwarded header, or the X-Forwarded-For header
+// if there is no Forwarded header. The addresses are checked from the nearest
+// upstream, and the first untrusted address is the client. It returns nil if
+// the request was not made by a trusted upstream or no address was forwarded.
+func (p *proxyPolicy) forwardedAddr(r *http.Request) net.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || !p.trusts(net.ParseIP(host)) {
+		return nil
+	}
+
+	var hops []string
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		for _, value := range values {
+			for _, element := range strings.Split(value, ",") {
+				hops = append(hops, forwardedFor(element))
+			}
+		}
+	} else {
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(value, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+	}
+
+	var addr *net.TCPAddr
+	for i := len(hops) - 1; i >= 0; i-- {
+		a := parseForwardedHop(hops[i])
+		if a == nil {
+			break // unknown or obfuscated hops cannot be traced further.
+		}
+
+		addr = a
+		if !p.trusts(a.IP) {
+			break
+		}
+	}
+
+	if addr == nil {
+		return nil
+	}
+
+	return addr
+}
+
+// forwardedFor returns the value of the for parameter of a Forwarded element.
+func forwardedFor(element string) string {
+	for _, pair := range strings.Split(element, ";") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+			return strings.Trim(kv[1], `"`)
+		}
+	}
+
+	return ""
+}
+
+// parseForwardedHop parses an ip address with an optional port, such as
+// 192.0.2.1, 192.0.2.1:4711, 2001:db8::1 or [2001:db8::1]:4711.
+func parseForwardedHop(hop string) *net.TCPAddr {
+	if ip := net.ParseIP(strings.Trim(hop, "[]")); ip != nil {
+		return &net.TCPAddr{IP: ip}
+	}
+
+	host, port, err := net.SplitHostPort(hop)
+	if err != nil {
+		return nil
+	}
+
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(p)}
+}
@@ -0,0 +1,656 @@
+package listeners
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// proxyV2Header builds a PROXY protocol v2 header.
+func proxyV2Header(cmd, family byte, addrs []byte, tlvs ...ProxyTLV) []byte {
+	body := append([]byte{}, addrs...)
+	for _, tlv := range tlvs {
+		body = append(body, tlv.Type, byte(len(tlv.Value)>>8), byte(len(tlv.Value)))
+		body = append(body, tlv.Value...)
+	}
+
+	b := append([]byte{}, proxyV2Signature...)
+	b = append(b, 0x20|cmd, family, byte(len(body)>>8), byte(len(body)))
+	return append(b, body...)
+}
+
+// proxyV2IPv4 returns the address block of a v2 header for tcp over ipv4.
+func proxyV2IPv4(src, dst string, sp, dp uint16) []byte {
+	b := append(net.ParseIP(src).To4(), net.ParseIP(dst).To4()...)
+	return append(b, byte(sp>>8), byte(sp), byte(dp>>8), byte(dp))
+}
+
+// proxyTLSValue returns the value of a tls TLV.
+func proxyTLSValue(client byte, verify uint32, subs ...ProxyTLV) []byte {
+	b := []byte{client, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[1:], verify)
+	for _, sub := range subs {
+		b = append(b, sub.Type, byte(len(sub.Value)>>8), byte(len(sub.Value)))
+		b = append(b, sub.Value...)
+	}
+
+	return b
+}
+
+func readTestHeader(t *testing.T, header []byte) (*ProxyHeader, []byte, error) {
+	r := bufio.NewReader(bytes.NewReader(append(header, 0x10, 0x00)))
+	h, err := readProxyHeader(r)
+	rest, _ := io.ReadAll(r)
+	return h, rest, err
+}
+
+func TestNewProxyPolicy(t *testing.T) {
+	p, err := newProxyPolicy(Proxy{Trusted: []string{"10.0.0.1", "2001:db8::1", "192.168.0.0/16"}})
+	require.NoError(t, err)
+	require.Equal(t, defaultProxyHeaderTimeout, p.opts.HeaderTimeout)
+	require.True(t, p.trusts(net.ParseIP("10.0.0.1")))
+	require.False(t, p.trusts(net.ParseIP("10.0.0.2")))
+	require.True(t, p.trusts(net.ParseIP("2001:db8::1")))
+	require.True(t, p.trusts(net.ParseIP("192.168.4.20")))
+	require.False(t, p.trusts(nil))
+
+	require.True(t, p.trustsAddr(&net.TCPAddr{IP: net.ParseIP("10.0.0.1")}))
+	require.True(t, p.trustsAddr(&net.UDPAddr{IP: net.ParseIP("10.0.0.1")}))
+	require.False(t, p.trustsAddr(&net.UnixAddr{Name: "/tmp/sock"}))
+}
+
+func TestNewProxyPolicyNoTrusted(t *testing.T) {
+	p, err := newProxyPolicy(Proxy{HeaderTimeout: time.Second})
+	require.NoError(t, err)
+	require.Equal(t, time.Second, p.opts.HeaderTimeout)
+	require.False(t, p.trusts(net.ParseIP("203.0.113.1")))
+	require.False(t, p.trusts(nil))
+
+	_, err = newProxyPolicy(Proxy{ProxyProtocol: true})
+	require.ErrorIs(t, err, ErrNoTrustedProxies)
+
+	_, err = newProxyPolicy(Proxy{ForwardedHeaders: true})
+	require.ErrorIs(t, err, ErrNoTrustedProxies)
+
+	_, err = (&Config{Proxy: &Proxy{ProxyProtocol: true}}).proxyPolicy()
+	require.ErrorIs(t, err, ErrNoTrustedProxies)
+}
+
+func TestNewProxyPolicyInvalid(t *testing.T) {
+	_, err := newProxyPolicy(Proxy{Trusted: []string{"proxy.local"}})
+	require.ErrorIs(t, err, ErrInvalidTrustedProxy)
+
+	_, err = newProxyPolicy(Proxy{Trusted: []string{"10.0.0.0/33"}})
+	require.ErrorIs(t, err, ErrInvalidTrustedProxy)
+
+	_, err = (&Config{Proxy: &Proxy{Trusted: []string{"invalid"}}}).proxyPolicy()
+	require.ErrorIs(t, err, ErrInvalidTrustedProxy)
+}
+
+func TestReadProxyHeaderNone(t *testing.T) {
+	h, rest, err := readTestHeader(t, nil)
+	require.NoError(t, err)
+	require.Nil(t, h)
+	require.Equal(t, []byte{0x10, 0x00}, rest)
+
+	h, rest, err = readTestHeader(t, []byte("PROX"))
+	require.NoError(t, err)
+	require.Nil(t, h)
+	require.Equal(t, []byte{'P', 'R', 'O', 'X', 0x10, 0x00}, rest)
+}
+
+func TestReadProxyV1(t *testing.T) {
+	h, rest, err := readTestHeader(t, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 1883\r\n"))
+	require.NoError(t, err)
+	require.Equal(t, &ProxyHeader{
+		Version:     1,
+		Source:      &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 56324},
+		Destination: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1883},
+	}, h)
+	require.Equal(t, []byte{0x10, 0x00}, rest)
+
+	h, _, err = readTestHeader(t, []byte("PROXY TCP6 2001:db8::7 2001:db8::1 56324 1883\r\n"))
+	require.NoError(t, err)
+	require.Equal(t, "[2001:db8::7]:56324", h.Source.String())
+
+	h, rest, err = readTestHeader(t, []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"))
+	require.NoError(t, err)
+	require.Equal(t, &ProxyHeader{Version: 1}, h)
+	require.Equal(t, []byte{0x10, 0x00}, rest)
+}
+
+func TestReadProxyV1Invalid(t *testing.T) {
+	headers := []string{
+		"PROXY TCP4 203.0.113.7 10.0.0.1 56324\r\n",
+		"PROXY UDP4 203.0.113.7 10.0.0.1 56324 1883\r\n",
+		"PROXY TCP4 2001:db8::7 10.0.0.1 56324 1883\r\n",
+		"PROXY TCP4 203.0.113.7 10.0.0.1 56324 65536\r\n",
+		"PROXY TCP4 203.0.113.7 10.0.0.1 x 1883\r\n",
+		"PROXY TCP4 203.0.113.7 10.0.0.1 56324 1883\n",
+		"PROXY " + strings.Repeat("A", proxyV1MaxLength) + "\r\n",
+	}
+
+	for _, header := range headers {
+		_, _, err := readTestHeader(t, []byte(header))
+		require.ErrorIs(t, err, ErrInvalidProxyHeader, header)
+	}
+
+	_, _, err := readTestHeader(t, []byte("PROXY TCP4"))
+	require.Error(t, err)
+}
+
+func TestReadProxyV2(t *testing.T) {
+	header := proxyV2Header(1, 0x11, proxyV2IPv4("203.0.113.7", "10.0.0.1", 56324, 1883),
+		ProxyTLV{Type: ProxyTLVALPN, Value: []byte("mqtt")},
+		ProxyTLV{Type: ProxyTLVNoop, Value: []byte{0, 0}},
+		ProxyTLV{Type: ProxyTLVSSL, Value: proxyTLSValue(ProxyClientSSL|ProxyClientCertConn, 0,
+			ProxyTLV{Type: proxySubtypeSSLVersion, Value: []byte("TLSv1.3")},
+			ProxyTLV{Type: proxySubtypeSSLCN, Value: []byte("device-1")},
+			ProxyTLV{Type: proxySubtypeSSLCipher, Value: []byte("TLS_AES_128_GCM_SHA256")},
+			ProxyTLV{Type: proxySubtypeSSLSigAlg, Value: []byte("SHA256")},
+			ProxyTLV{Type: proxySubtypeSSLKeyAlg, Value: []byte("RSA2048")},
+		)},
+		ProxyTLV{Type: 0xEA, Value: []byte{0x01, 'v', 'p', 'c', 'e'}},
+	)
+
+	h, rest, err := readTestHeader(t, header)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x10, 0x00}, rest)
+	require.Equal(t, 2, h.Version)
+	require.False(t, h.Local)
+	require.Equal(t, "203.0.113.7:56324", h.Source.String())
+	require.Equal(t, "10.0.0.1:1883", h.Destination.String())
+	require.Len(t, h.TLVs, 3)
+
+	alpn, ok := h.TLV(ProxyTLVALPN)
+	require.True(t, ok)
+	require.Equal(t, []byte("mqtt"), alpn)
+
+	vpce, ok := h.TLV(0xEA)
+	require.True(t, ok)
+	require.Equal(t, []byte{0x01, 'v', 'p', 'c', 'e'}, vpce)
+
+	_, ok = h.TLV(ProxyTLVUniqueID)
+	require.False(t, ok)
+
+	require.Equal(t, &ProxyTLS{
+		Client:     ProxyClientSSL | ProxyClientCertConn,
+		Verified:   true,
+		Version:    "TLSv1.3",
+		CommonName: "device-1",
+		Cipher:     "TLS_AES_128_GCM_SHA256",
+		SigAlg:     "SHA256",
+		KeyAlg:     "RSA2048",
+	}, h.TLS)
+}
+
+func TestReadProxyV2TLSNotVerified(t *testing.T) {
+	header := proxyV2Header(1, 0x11, proxyV2IPv4("203.0.113.7", "10.0.0.1", 56324, 1883),
+		ProxyTLV{Type: ProxyTLVSSL, Value: proxyTLSValue(ProxyClientSSL|ProxyClientCertConn, 1)},
+	)
+
+	h, _, err := readTestHeader(t, header)
+	require.NoError(t, err)
+	require.False(t, h.TLS.Verified)
+
+	header = proxyV2Header(1, 0x11, proxyV2IPv4("203.0.113.7", "10.0.0.1", 56324, 1883),
+		ProxyTLV{Type: ProxyTLVSSL, Value: proxyTLSValue(ProxyClientSSL, 0)},
+	)
+
+	h, _, err = readTestHeader(t, header)
+	require.NoError(t, err)
+	require.False(t, h.TLS.Verified)
+}
+
+func TestReadProxyV2Families(t *testing.T) {
+	addrs := append(net.ParseIP("2001:db8::7"), net.ParseIP("2001:db8::1")...)
+	addrs = append(addrs, 0xdc, 0x04, 0x07, 0x5b)
+	h, _, err := readTestHeader(t, proxyV2Header(1, 0x21, addrs))
+	require.NoError(t, err)
+	require.Equal(t, "[2001:db8::7]:56324", h.Source.String())
+	require.Equal(t, "[2001:db8::1]:1883", h.Destination.String())
+
+	h, _, err = readTestHeader(t, proxyV2Header(1, 0x12, proxyV2IPv4("203.0.113.7", "10.0.0.1", 56324, 1883)))
+	require.NoError(t, err)
+	require.Equal(t, &net.UDPAddr{IP: net.ParseIP("203.0.113.7").To4(), Port: 56324}, h.Source)
+
+	unix := make([]byte, 216)
+	copy(unix, "/run/client.sock")
+	copy(unix[108:], "/run/mqtt.sock")
+	h, _, err = readTestHeader(t, proxyV2Header(1, 0x31, unix))
+	require.NoError(t, err)
+	require.Equal(t, &net.UnixAddr{Name: "/run/client.sock", Net: "unix"}, h.Source)
+	require.Equal(t, &net.UnixAddr{Name: "/run/mqtt.sock", Net: "unix"}, h.Destination)
+
+	h, _, err = readTestHeader(t, proxyV2Header(1, 0x32, unix))
+	require.NoError(t, err)
+	require.Equal(t, "unixgram", h.Source.Network())
+
+	h, rest, err := readTestHeader(t, proxyV2Header(1, 0x00, []byte{0xff, 0xff}))
+	require.NoError(t, err)
+	require.Nil(t, h.Source)
+	require.Equal(t, []byte{0x10, 0x00}, rest)
+}
+
+func TestReadProxyV2Local(t *testing.T) {
+	h, _, err := readTestHeader(t, proxyV2Header(0, 0x11, proxyV2IPv4("10.0.0.2", "10.0.0.1", 40000, 1883)))
+	require.NoError(t, err)
+	require.True(t, h.Local)
+	require.Nil(t, h.Source)
+	require.Nil(t, h.Destination)
+}
+
+func TestReadProxyV2CRC32C(t *testing.T) {
+	header := proxyV2Header(1, 0x11, proxyV2IPv4("203.0.113.7", "10.0.0.1", 56324, 1883),
+		ProxyTLV{Type: ProxyTLVCRC32C, Value: make([]byte, 4)},
+	)
+
+	sum := crc32.Checksum(header, crc32.MakeTable(crc32.Castagnoli))
+	binary.BigEndian.PutUint32(header[len(header)-4:], sum)
+	h, _, err := readTestHeader(t, header)
+	require.NoError(t, err)
+
+	value, ok := h.TLV(ProxyTLVCRC32C)
+	require.True(t, ok)
+	require.Equal(t, sum, binary.BigEndian.Uint32(value))
+
+	binary.BigEndian.PutUint32(header[len(header)-4:], sum+1)
+	_, _, err = readTestHeader(t, header)
+	require.ErrorIs(t, err, ErrProxyChecksum)
+}
+
+func TestReadProxyV2Invalid(t *testing.T) {
+	ipv4 := proxyV2IPv4("203.0.113.7", "10.0.0.1", 56324, 1883)
+
+	bad := proxyV2Header(1, 0x11, ipv4)
+	bad[12] = 0x11 // version 1.
+	_, _, err := readTestHeader(t, bad)
+	require.ErrorIs(t, err, ErrInvalidProxyHeader)
+
+	bad = proxyV2Header(2, 0x11, ipv4) // unknown command.
+	_, _, err = readTestHeader(t, bad)
+	require.ErrorIs(t, err, ErrInvalidProxyHeader)
+
+	_, _, err = readTestHeader(t, proxyV2Header(1, 0x21, ipv4)) // ipv6 with an ipv4 block.
+	require.ErrorIs(t, err, ErrInvalidProxyHeader)
+
+	_, _, err = readTestHeader(t, proxyV2Header(1, 0x11, append(ipv4, ProxyTLVALPN, 0x00))) // truncated tlv.
+	require.ErrorIs(t, err, ErrInvalidProxyHeader)
+
+	_, _, err = readTestHeader(t, proxyV2Header(1, 0x11, append(ipv4, ProxyTLVALPN, 0x00, 0x04, 'm'))) // short tlv.
+	require.ErrorIs(t, err, ErrInvalidProxyHeader)
+
+	_, _, err = readTestHeader(t, proxyV2Header(1, 0x11, ipv4, ProxyTLV{Type: ProxyTLVSSL, Value: []byte{1}}))
+	require.ErrorIs(t, err, ErrInvalidProxyHeader)
+
+	_, _, err = readTestHeader(t, proxyV2Header(1, 0x11, ipv4, ProxyTLV{Type: ProxyTLVSSL, Value: append(proxyTLSValue(1, 0), 0x21)}))
+	require.ErrorIs(t, err, ErrInvalidProxyHeader)
+
+	_, _, err = readTestHeader(t, proxyV2Header(1, 0x11, ipv4, ProxyTLV{Type: ProxyTLVCRC32C, Value: []byte{1}}))
+	require.ErrorIs(t, err, ErrInvalidProxyHeader)
+
+	header := proxyV2Header(1, 0x11, ipv4)
+	_, err = readProxyHeader(bufio.NewReader(bytes.NewReader(header[:len(header)-1])))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestProxyConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go func() {
+		c2.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 1883\r\n"))
+		c2.Write([]byte{0x10, 0x00})
+	}()
+
+	conn := &proxyConn{Conn: c1, r: bufio.NewReader(c1), timeout: time.Second}
+	require.Equal(t, "203.0.113.7:56324", conn.RemoteAddr().String())
+	require.Equal(t, "10.0.0.1:1883", conn.LocalAddr().String())
+	require.Equal(t, 1, conn.ProxyHeader().Version)
+
+	b := make([]byte, 2)
+	_, err := io.ReadFull(conn, b)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x10, 0x00}, b)
+}
+
+func TestProxyConnNoHeader(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go func() {
+		c2.Write([]byte{0x10, 0x00})
+	}()
+
+	conn := &proxyConn{Conn: c1, r: bufio.NewReader(c1), timeout: time.Second}
+	require.Nil(t, conn.ProxyHeader())
+	require.Equal(t, c1.RemoteAddr(), conn.RemoteAddr())
+	require.Equal(t, c1.LocalAddr(), conn.LocalAddr())
+
+	b := make([]byte, 2)
+	_, err := io.ReadFull(conn, b)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x10, 0x00}, b)
+}
+
+func TestProxyConnTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	conn := &proxyConn{Conn: c1, r: bufio.NewReader(c1), timeout: time.Millisecond}
+	_, err := conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
+
+// proxyTCP starts a TCP listener which reads PROXY protocol headers and returns
+// the connections it establishes.
+func proxyTCP(t *testing.T, config *Config) (*TCP, chan net.Conn) {
+	l := NewTCP("t1", "127.0.0.1:0")
+	l.SetConfig(config)
+	require.NoError(t, l.Listen(nil))
+
+	established := make(chan net.Conn, 1)
+	go l.Serve(func(id string, c net.Conn, ac auth.Controller) error {
+		established <- c
+		return nil
+	})
+
+	t.Cleanup(func() {
+		l.Close(MockCloser)
+	})
+
+	return l, established
+}
+
+func TestTCPProxyProtocol(t *testing.T) {
+	l, established := proxyTCP(t, &Config{
+		Auth:  new(auth.Allow),
+		Proxy: &Proxy{Trusted: []string{"127.0.0.1"}, ProxyProtocol: true},
+	})
+
+	client, err := net.Dial("tcp", l.listen.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write(proxyV2Header(1, 0x11, proxyV2IPv4("203.0.113.7", "10.0.0.1", 56324, 1883)))
+	require.NoError(t, err)
+
+	conn := <-established
+	require.Equal(t, "203.0.113.7:56324", conn.RemoteAddr().String())
+	require.Equal(t, 2, conn.(*proxyConn).ProxyHeader().Version)
+}
+
+func TestTCPProxyProtocolUntrusted(t *testing.T) {
+	l, established := proxyTCP(t, &Config{
+		Auth:  new(auth.Allow),
+		Proxy: &Proxy{Trusted: []string{"10.0.0.0/8"}, ProxyProtocol: true},
+	})
+
+	client, err := net.Dial("tcp", l.listen.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	header := []byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 1883\r\n")
+	_, err = client.Write(header)
+	require.NoError(t, err)
+
+	conn := <-established
+	require.Equal(t, client.LocalAddr().String(), conn.RemoteAddr().String())
+
+	b := make([]byte, len(header))
+	_, err = io.ReadFull(conn, b)
+	require.NoError(t, err)
+	require.Equal(t, header, b)
+}
+
+func TestTCPProxyProtocolTLS(t *testing.T) {
+	l, established := proxyTCP(t, &Config{
+		Auth:  new(auth.Allow),
+		TLS:   &TLS{Certificate: testCertificate, PrivateKey: testPrivateKey},
+		Proxy: &Proxy{Trusted: []string{"127.0.0.1"}, ProxyProtocol: true},
+	})
+
+	raw, err := net.Dial("tcp", l.listen.Addr().String())
+	require.NoError(t, err)
+	defer raw.Close()
+	_, err = raw.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 8883\r\n"))
+	require.NoError(t, err)
+
+	client := tls.Client(raw, &tls.Config{InsecureSkipVerify: true})
+	go client.Handshake()
+
+	conn := <-established
+	require.Equal(t, "203.0.113.7:56324", conn.RemoteAddr().String())
+
+	tc, ok := conn.(*tls.Conn)
+	require.True(t, ok)
+	require.NoError(t, tc.Handshake())
+}
+
+func TestTCPListenProxyInvalid(t *testing.T) {
+	l := NewTCP("t1", "127.0.0.1:0")
+	l.SetConfig(&Config{
+		Auth:  new(auth.Allow),
+		Proxy: &Proxy{Trusted: []string{"invalid"}, ProxyProtocol: true},
+	})
+	require.ErrorIs(t, l.Listen(nil), ErrInvalidTrustedProxy)
+
+	l.SetConfig(&Config{
+		Auth:  new(auth.Allow),
+		Proxy: &Proxy{ProxyProtocol: true},
+	})
+	require.ErrorIs(t, l.Listen(nil), ErrNoTrustedProxies)
+}
+
+func TestForwardedAddr(t *testing.T) {
+	p, err := newProxyPolicy(Proxy{Trusted: []string{"10.0.0.0/8", "2001:db8:ffff::/48"}})
+	require.NoError(t, err)
+
+	tt := []struct {
+		desc    string
+		remote  string
+		headers map[string][]string
+		want    string
+	}{
+		{
+			desc:    "x-forwarded-for",
+			remote:  "10.0.0.1:40000",
+			headers: map[string][]string{"X-Forwarded-For": {"203.0.113.7"}},
+			want:    "203.0.113.7:0",
+		},
+		{
+			desc:    "x-forwarded-for skips trusted hops",
+			remote:  "10.0.0.1:40000",
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.1, 203.0.113.7", "10.0.0.2"}},
+			want:    "203.0.113.7:0",
+		},
+		{
+			desc:    "x-forwarded-for all trusted",
+			remote:  "10.0.0.1:40000",
+			headers: map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}},
+			want:    "10.0.0.3:0",
+		},
+		{
+			desc:    "forwarded",
+			remote:  "10.0.0.1:40000",
+			headers: map[string][]string{"Forwarded": {`for=198.51.100.1, for="[2001:db8:cafe::17]:4711";proto=https, For=10.0.0.2`}},
+			want:    "[2001:db8:cafe::17]:4711",
+		},
+		{
+			desc:   "forwarded preferred",
+			remote: "10.0.0.1:40000",
+			headers: map[string][]string{
+				"Forwarded":       {"for=203.0.113.7:5000"},
+				"X-Forwarded-For": {"198.51.100.1"},
+			},
+			want: "203.0.113.7:5000",
+		},
+		{
+			desc:    "obfuscated hop",
+			remote:  "10.0.0.1:40000",
+			headers: map[string][]string{"Forwarded": {"for=203.0.113.7, for=_hidden"}},
+		},
+		{
+			desc:    "untrusted upstream",
+			remote:  "198.51.100.1:40000",
+			headers: map[string][]string{"X-Forwarded-For": {"203.0.113.7"}},
+		},
+		{
+			desc:   "no headers",
+			remote: "10.0.0.1:40000",
+		},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tx.remote
+			for k, values := range tx.headers {
+				for _, v := range values {
+					r.Header.Add(k, v)
+				}
+			}
+
+			addr := p.forwardedAddr(r)
+			if tx.want == "" {
+				require.Nil(t, addr)
+				return
+			}
+
+			require.Equal(t, tx.want, addr.String())
+		})
+	}
+}
+
+func TestParseForwardedHop(t *testing.T) {
+	require.Equal(t, "192.0.2.1:0", parseForwardedHop("192.0.2.1").String())
+	require.Equal(t, "192.0.2.1:4711", parseForwardedHop("192.0.2.1:4711").String())
+	require.Equal(t, "[2001:db8::1]:0", parseForwardedHop("2001:db8::1").String())
+	require.Equal(t, "[2001:db8::1]:0", parseForwardedHop("[2001:db8::1]").String())
+	require.Equal(t, "[2001:db8::1]:4711", parseForwardedHop("[2001:db8::1]:4711").String())
+	require.Nil(t, parseForwardedHop("unknown"))
+	require.Nil(t, parseForwardedHop("host:4711"))
+	require.Nil(t, parseForwardedHop("192.0.2.1:port"))
+}
+
+func TestWebsocketForwardedHeaders(t *testing.T) {
+	l := NewWebsocket("t1", testPort)
+	l.SetConfig(&Config{
+		Auth:  new(auth.Allow),
+		Proxy: &Proxy{Trusted: []string{"127.0.0.1"}, ForwardedHeaders: true},
+	})
+	require.NoError(t, l.Listen(nil))
+
+	e := make(chan net.Conn, 1)
+	l.establish = func(id string, c net.Conn, ac auth.Controller) error {
+		e <- c
+		return nil
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(l.handler))
+	defer s.Close()
+
+	u := "ws" + strings.TrimPrefix(s.URL, "http")
+	ws, _, err := websocket.DefaultDialer.Dial(u, http.Header{"X-Forwarded-For": {"203.0.113.7"}})
+	require.NoError(t, err)
+	defer ws.Close()
+
+	require.Equal(t, "203.0.113.7:0", (<-e).RemoteAddr().String())
+}
+
+func TestWebsocketListenProxyInvalid(t *testing.T) {
+	l := NewWebsocket("t1", testPort)
+	l.SetConfig(&Config{
+		Auth:  new(auth.Allow),
+		Proxy: &Proxy{Trusted: []string{"invalid"}},
+	})
+	require.ErrorIs(t, l.Listen(nil), ErrInvalidTrustedProxy)
+}
+
+func TestWebsocketProxyProtocol(t *testing.T) {
+	l := NewWebsocket("t1", "127.0.0.1:0")
+	l.SetConfig(&Config{
+		Auth:  new(auth.Allow),
+		Proxy: &Proxy{Trusted: []string{"127.0.0.1"}, ProxyProtocol: true},
+	})
+	require.NoError(t, l.Listen(nil))
+
+	// serve on a known port, as the listener chooses its own.
+	ln, err := listenProxy("tcp", "127.0.0.1:0", l.proxy, nil)
+	require.NoError(t, err)
+	l.address = ln.Addr().String()
+	ln.Close()
+
+	e := make(chan net.Conn, 1)
+	o := make(chan bool)
+	go func() {
+		l.Serve(func(id string, c net.Conn, ac auth.Controller) error {
+			e <- c
+			return nil
+		})
+		o <- true
+	}()
+
+	var raw net.Conn
+	require.Eventually(t, func() bool {
+		raw, err = net.Dial("tcp", l.address)
+		return err == nil
+	}, time.Second, time.Millisecond)
+	defer raw.Close()
+
+	_, err = raw.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 80\r\n"))
+	require.NoError(t, err)
+
+	d := websocket.Dialer{
+		NetDial: func(network, addr string) (net.Conn, error) {
+			return raw, nil
+		},
+	}
+	ws, _, err := d.Dial("ws://"+l.address, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	require.Equal(t, "203.0.113.7:56324", (<-e).RemoteAddr().String())
+
+	l.Close(MockCloser)
+	<-o
+}
+
+func TestWsConnRemoteAddr(t *testing.T) {
+	c1, _ := net.Pipe()
+	ws := &wsConn{Conn: c1, c: new(websocket.Conn)}
+	require.Equal(t, c1.RemoteAddr(), ws.RemoteAddr())
+
+	ws.remote = &net.TCPAddr{IP: net.ParseIP("203.0.113.7")}
+	require.Equal(t, "203.0.113.7:0", ws.RemoteAddr().String())
+}
+
+func BenchmarkReadProxyV2(b *testing.B) {
+	header := proxyV2Header(1, 0x11, proxyV2IPv4("203.0.113.7", "10.0.0.1", 56324, 1883),
+		ProxyTLV{Type: ProxyTLVSSL, Value: proxyTLSValue(ProxyClientSSL, 0,
+			ProxyTLV{Type: proxySubtypeSSLVersion, Value: []byte("TLSv1.3")},
+		)},
+	)
+
+	r := bufio.NewReader(nil)
+	for n := 0; n < b.N; n++ {
+		r.Reset(bytes.NewReader(header))
+		readProxyHeader(r)
+	}
+}
@@ -0,0 +1,300 @@
+package listeners
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/mochi-co/mqtt/server/logger"
+)
+
+// ErrCertificateRevoked indicates that a client certificate has been revoked.
+var ErrCertificateRevoked = errors.New("certificate revoked")
+
+// OCSPFunc checks the revocation status of a client certificate with its
+// issuer, for example by querying an OCSP responder. A non-nil error refuses
+// the certificate.
+type OCSPFunc func(cert, issuer *x509.Certificate) error
+
+// RevocationOptions contains configuration settings for a revocation checker.
+type RevocationOptions struct {
+	// CRLFiles are the paths of PEM or DER encoded certificate revocation lists.
+	// A CRL applies to the certificates of the CA which signed it.
+	CRLFiles []string
+
+	// ReloadInterval is how often the CRL files are read again. If 0, the files
+	// are only read by Reload.
+	ReloadInterval time.Duration
+
+	// OCSP is called to check each verified client certificate after the CRLs.
+	OCSP OCSPFunc
+}
+
+// Revocation refuses client certificates which have been revoked by CRL files
+// or an OCSP check during the tls handshake. The CRLs are matched to issuers
+// using the verified certificate chains of clients, so no CA file is needed.
+// It is the only revocation checker of a listener, and is used for both
+// TLSConfig and CertManager listeners.
+type Revocation struct {
+	sync.RWMutex
+	opts     RevocationOptions              // configuration settings for the checker.
+	crls     []*pkix.CertificateList        // the loaded revocation lists.
+	raw      []byte                         // the contents of the loaded files.
+	loaded   bool                           // true once the files have been loaded.
+	issuers  map[string]*x509.Certificate   // issuers seen in verified chains, keyed on raw subject.
+	revoked  map[string]map[string]struct{} // revoked serials, keyed on issuer raw subject.
+	reloaded reloadFuncs                    // functions called when the revocation lists change.
+	log      logger.Logger                  // a logger for reload events.
+	done     chan struct{}                  // closed to stop reloading.
+	end      sync.Once                      // ensures reloading is only stopped once.
+	wg       sync.WaitGroup                 // waits for the reloader to exit.
+}
+
+// NewRevocation returns a new revocation checker, loading the configured CRL
+// files. If the files are reloaded periodically, Close should be called when
+// the checker is no longer used.
+func NewRevocation(opts RevocationOptions) (*Revocation, error) {
+	r := &Revocation{
+		opts:    opts,
+		issuers: make(map[string]*x509.Certificate),
+		revoked: make(map[string]map[string]struct{}),
+		log:     new(logger.Nop),
+		done:    make(chan struct{}),
+	}
+
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	if opts.ReloadInterval > 0 {
+		r.wg.Add(1)
+		go r.reload()
+	}
+
+	return r, nil
+}
+
+// SetLogger sets the logger used to report reloads and reload failures.
+func (r *Revocation) SetLogger(log logger.Logger) {
+	r.Lock()
+	r.log = log
+	r.Unlock()
+}
+
+// Reload reads the CRL files. If any file is invalid, an error is returned and
+// the existing revocation lists remain in use. If the files have changed, the
+// functions registered with OnReload are called.
+func (r *Revocation) Reload() error {
+	var raw []byte
+	var crls []*pkix.CertificateList
+	for _, path := range r.opts.CRLFiles {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		crl, err := x509.ParseCRL(b) // ParseRevocationList is not available in go1.18.
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		if crl.HasExpired(time.Now()) {
+			r.logger().Warn("certificate revocation list has expired", "file", path)
+		}
+
+		raw = append(raw, b...)
+		crls = append(crls, crl)
+	}
+
+	r.Lock()
+	if r.loaded && bytes.Equal(raw, r.raw) {
+		r.Unlock()
+		return nil
+	}
+
+	r.crls = crls
+	r.raw = raw
+	r.loaded = true
+	r.revoked = make(map[string]map[string]struct{})
+	r.Unlock()
+
+	r.reloaded.call()
+
+	return nil
+}
+
+// OnReload registers a function which is called when the revocation lists
+// change, and returns a function which unregisters it.
+func (r *Revocation) OnReload(fn func()) func() {
+	return r.reloaded.add(fn)
+}
+
+// reloadFuncs holds the functions registered to be called on a reload.
+type reloadFuncs struct {
+	sync.Mutex
+	fns []*func()
+}
+
+// add registers a function and returns a function which unregisters it.
+func (r *reloadFuncs) add(fn func()) func() {
+	r.Lock()
+	defer r.Unlock()
+	h := &fn
+	r.fns = append(r.fns, h)
+
+	return func() {
+		r.Lock()
+		defer r.Unlock()
+		for i, f := range r.fns {
+			if f == h {
+				r.fns = append(r.fns[:i:i], r.fns[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// call calls each registered function.
+func (r *reloadFuncs) call() {
+	r.Lock()
+	fns := r.fns
+	r.Unlock()
+
+	for _, fn := range fns {
+		(*fn)()
+	}
+}
+
+// Close stops reloading the CRL files.
+func (r *Revocation) Close() {
+	r.end.Do(func() {
+		close(r.done)
+	})
+	r.wg.Wait()
+}
+
+// Wrap returns a copy of a tls config which refuses revoked client
+// certificates. Configs returned by GetConfigForClient are also wrapped.
+func (r *Revocation) Wrap(tc *tls.Config) *tls.Config {
+	tc = tc.Clone()
+
+	verify := tc.VerifyPeerCertificate
+	tc.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		if verify != nil {
+			if err := verify(rawCerts, chains); err != nil {
+				return err
+			}
+		}
+
+		return r.VerifyPeerCertificate(rawCerts, chains)
+	}
+
+	if get := tc.GetConfigForClient; get != nil {
+		tc.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			c, err := get(hello)
+			if err != nil || c == nil {
+				return c, err
+			}
+
+			return r.Wrap(c), nil
+		}
+	}
+
+	return tc
+}
+
+// VerifyPeerCertificate returns an error if any certificate in the verified
+// chains of a client has been revoked. It may be used as the
+// VerifyPeerCertificate function of a tls.Config.
+func (r *Revocation) VerifyPeerCertificate(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+	for _, chain := range chains {
+		for i := 0; i < len(chain)-1; i++ {
+			if r.revokedBy(chain[i+1], chain[i]) {
+				return fmt.Errorf("%w: serial %s", ErrCertificateRevoked, chain[i].SerialNumber)
+			}
+		}
+	}
+
+	if r.opts.OCSP != nil && len(chains) > 0 && len(chains[0]) > 1 {
+		if err := r.opts.OCSP(chains[0][0], chains[0][1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Revoked returns true if a certificate has been revoked by a loaded CRL. The
+// issuer of the certificate must have been seen in a verified chain.
+func (r *Revocation) Revoked(cert *x509.Certificate) bool {
+	r.RLock()
+	issuer, ok := r.issuers[string(cert.RawIssuer)]
+	r.RUnlock()
+
+	return ok && r.revokedBy(issuer, cert)
+}
+
+// revokedBy returns true if a certificate has been revoked by a CRL signed by
+// its issuer. The serials revoked by each issuer are found on first use.
+func (r *Revocation) revokedBy(issuer, cert *x509.Certificate) bool {
+	key := string(issuer.RawSubject)
+	r.RLock()
+	serials, ok := r.revoked[key]
+	r.RUnlock()
+
+	if !ok {
+		r.Lock()
+		serials, ok = r.revoked[key]
+		if !ok {
+			serials = make(map[string]struct{})
+			for _, crl := range r.crls {
+				if issuer.CheckCRLSignature(crl) != nil {
+					continue
+				}
+
+				for _, rc := range crl.TBSCertList.RevokedCertificates {
+					serials[rc.SerialNumber.String()] = struct{}{}
+				}
+			}
+
+			r.revoked[key] = serials
+			r.issuers[key] = issuer
+		}
+		r.Unlock()
+	}
+
+	_, ok = serials[cert.SerialNumber.String()]
+	return ok
+}
+
+// reload reads the CRL files periodically until the checker is closed.
+func (r *Revocation) reload() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.opts.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.Reload(); err != nil {
+				r.logger().Error("failed to reload certificate revocation lists", "error", err)
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// logger returns the logger of the checker.
+func (r *Revocation) logger() logger.Logger {
+	r.RLock()
+	defer r.RUnlock()
+	return r.log
+}
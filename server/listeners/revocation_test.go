@@ -0,0 +1,214 @@
+package listeners
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// revocationFixture contains a CA, a client certificate, and tls configs for
+// verifying the client.
+type revocationFixture struct {
+	ca         *testCA
+	clientCert *x509.Certificate
+	crlFile    string
+	server     *tls.Config
+	client     *tls.Config
+}
+
+func newRevocationFixture(t *testing.T) *revocationFixture {
+	dir := t.TempDir()
+	ca := newTestCA(t, "ca")
+	serverPEM, serverKey, _ := ca.issue(t, "server", false, "mochi.local")
+	clientPEM, clientKey, clientCert := ca.issue(t, "client", true)
+
+	serverPair, err := tls.X509KeyPair(serverPEM, serverKey)
+	require.NoError(t, err)
+	clientPair, err := tls.X509KeyPair(clientPEM, clientKey)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	return &revocationFixture{
+		ca:         ca,
+		clientCert: clientCert,
+		crlFile:    writeCertFile(t, dir, "ca.crl", ca.crl(t)),
+		server: &tls.Config{
+			Certificates: []tls.Certificate{serverPair},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		},
+		client: &tls.Config{
+			Certificates: []tls.Certificate{clientPair},
+			RootCAs:      pool,
+			ServerName:   "mochi.local",
+		},
+	}
+}
+
+// revoke writes a CRL revoking the client certificate.
+func (f *revocationFixture) revoke(t *testing.T) {
+	require.NoError(t, ioutil.WriteFile(f.crlFile, f.ca.crl(t, f.clientCert), 0600))
+}
+
+func TestNewRevocationErrors(t *testing.T) {
+	dir := t.TempDir()
+	_, err := NewRevocation(RevocationOptions{CRLFiles: []string{filepath.Join(dir, "missing")}})
+	require.Error(t, err)
+
+	_, err = NewRevocation(RevocationOptions{CRLFiles: []string{writeCertFile(t, dir, "invalid.crl", []byte("invalid"))}})
+	require.Error(t, err)
+}
+
+func TestRevocationHandshake(t *testing.T) {
+	f := newRevocationFixture(t)
+	r, err := NewRevocation(RevocationOptions{CRLFiles: []string{f.crlFile}})
+	require.NoError(t, err)
+
+	var reloads int64
+	r.OnReload(func() {
+		atomic.AddInt64(&reloads, 1)
+	})
+
+	_, err = handshake(t, r.Wrap(f.server), f.client)
+	require.NoError(t, err)
+	require.False(t, r.Revoked(f.clientCert))
+
+	// reloading unchanged files does not notify.
+	require.NoError(t, r.Reload())
+	require.Equal(t, int64(0), atomic.LoadInt64(&reloads))
+
+	f.revoke(t)
+	require.NoError(t, r.Reload())
+	require.Equal(t, int64(1), atomic.LoadInt64(&reloads))
+	require.True(t, r.Revoked(f.clientCert))
+
+	_, err = handshake(t, r.Wrap(f.server), f.client)
+	require.ErrorIs(t, err, ErrCertificateRevoked)
+}
+
+func TestRevocationRevokedUnknownIssuer(t *testing.T) {
+	f := newRevocationFixture(t)
+	f.revoke(t)
+	r, err := NewRevocation(RevocationOptions{CRLFiles: []string{f.crlFile}})
+	require.NoError(t, err)
+	require.False(t, r.Revoked(f.clientCert))
+}
+
+func TestRevocationOtherIssuer(t *testing.T) {
+	f := newRevocationFixture(t)
+	other := newTestCA(t, "other")
+	other.serial = f.clientCert.SerialNumber.Int64() - 1
+	_, _, cert := other.issue(t, "client", true)
+	r, err := NewRevocation(RevocationOptions{
+		CRLFiles: []string{writeCertFile(t, t.TempDir(), "other.crl", other.crl(t, cert))},
+	})
+	require.NoError(t, err)
+
+	// the serial is revoked by another ca.
+	require.Equal(t, 0, cert.SerialNumber.Cmp(f.clientCert.SerialNumber))
+	_, err = handshake(t, r.Wrap(f.server), f.client)
+	require.NoError(t, err)
+}
+
+func TestRevocationOCSP(t *testing.T) {
+	f := newRevocationFixture(t)
+	errOCSP := errors.New("ocsp revoked")
+
+	var checked string
+	r, err := NewRevocation(RevocationOptions{
+		OCSP: func(cert, issuer *x509.Certificate) error {
+			checked = cert.Subject.CommonName + "/" + issuer.Subject.CommonName
+			return errOCSP
+		},
+	})
+	require.NoError(t, err)
+
+	_, err = handshake(t, r.Wrap(f.server), f.client)
+	require.ErrorIs(t, err, errOCSP)
+	require.Equal(t, "client/ca", checked)
+}
+
+func TestRevocationWrapChainsVerify(t *testing.T) {
+	f := newRevocationFixture(t)
+	r, err := NewRevocation(RevocationOptions{})
+	require.NoError(t, err)
+
+	errVerify := errors.New("verify")
+	f.server.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		return errVerify
+	}
+
+	_, err = handshake(t, r.Wrap(f.server), f.client)
+	require.ErrorIs(t, err, errVerify)
+}
+
+func TestRevocationWrapCertManager(t *testing.T) {
+	f := newRevocationFixture(t)
+	dir := t.TempDir()
+	m, err := NewCertManager(CertManagerOptions{
+		Certificates: []CertificateFile{testCertFiles(t, f.ca, dir, "server", "mochi.local")},
+		ClientCAFile: writeCertFile(t, dir, "ca.pem", f.ca.pem),
+	})
+	require.NoError(t, err)
+
+	f.revoke(t)
+	r, err := NewRevocation(RevocationOptions{CRLFiles: []string{f.crlFile}})
+	require.NoError(t, err)
+
+	tc, err := (&Config{CertManager: m, Revocation: r}).tlsConfig()
+	require.NoError(t, err)
+
+	_, err = handshake(t, tc, f.client)
+	require.ErrorIs(t, err, ErrCertificateRevoked)
+
+	// the revocation checker is the only revoker of the listener.
+	require.Equal(t, []Revoker{r}, (&Config{CertManager: m, Revocation: r}).revokers())
+	require.Empty(t, (&Config{CertManager: m}).revokers())
+}
+
+func TestRevocationReloadInterval(t *testing.T) {
+	f := newRevocationFixture(t)
+	r, err := NewRevocation(RevocationOptions{
+		CRLFiles:       []string{f.crlFile},
+		ReloadInterval: time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer r.Close()
+
+	reloaded := make(chan struct{}, 1)
+	r.OnReload(func() {
+		select {
+		case reloaded <- struct{}{}:
+		default:
+		}
+	})
+
+	f.revoke(t)
+	select {
+	case <-reloaded:
+	case <-time.After(time.Second):
+		t.Fatal("crl not reloaded")
+	}
+}
+
+func BenchmarkRevocationVerifyPeerCertificate(b *testing.B) {
+	ca := newTestCA(b, "ca")
+	_, _, cert := ca.issue(b, "client", true)
+	r, _ := NewRevocation(RevocationOptions{
+		CRLFiles: []string{writeCertFile(b, b.TempDir(), "ca.crl", ca.crl(b))},
+	})
+
+	chains := [][]*x509.Certificate{{cert, ca.cert}}
+	for n := 0; n < b.N; n++ {
+		r.VerifyPeerCertificate(nil, chains)
+	}
+}
@@ -7,18 +7,22 @@ import (
 	"sync/atomic"
 
 	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/logger"
 	"github.com/mochi-co/mqtt/server/system"
 )
 
 // TCP is a listener for establishing client connections on basic TCP protocol.
 type TCP struct {
 	sync.RWMutex
-	id       string       // the internal id of the listener.
-	protocol string       // the TCP protocol to use.
-	address  string       // the network address to bind to.
-	listen   net.Listener // a net.Listener which will listen for new clients.
-	config   *Config      // configuration values for the listener.
-	end      uint32       // ensure the close methods are only called once.
+	id       string        // the internal id of the listener.
+	protocol string        // the TCP protocol to use.
+	address  string        // the network address to bind to.
+	listen   net.Listener  // a net.Listener which will listen for new clients.
+	config   *Config       // configuration values for the listener.
+	log      logger.Logger // a logger for listener events.
+	err      error         // the error which stopped the listener serving, if any.
+	limiter  *connLimiter  // the connection limits of the listener, if any.
+	end      uint32        // ensure the close methods are only called once.
 }
 
 // NewTCP initialises and returns a new TCP listener, listening on an address.
@@ -31,6 +35,7 @@ func NewTCP(id, address string) *TCP {
 			Auth: new(auth.Allow),
 			TLS:  new(TLS),
 		},
+		log: new(logger.Nop),
 	}
 }
 
@@ -50,6 +55,13 @@ func (l *TCP) SetConfig(config *Config) {
 	l.Unlock()
 }
 
+// SetLogger sets the logger used by the listener.
+func (l *TCP) SetLogger(log logger.Logger) {
+	l.Lock()
+	l.log = log
+	l.Unlock()
+}
+
 // ID returns the id of the listener.
 func (l *TCP) ID() string {
 	l.RLock()
@@ -58,25 +70,38 @@ func (l *TCP) ID() string {
 	return id
 }
 
+// Identity returns the identity mapping of the listener.
+func (l *TCP) Identity() *Identity {
+	l.RLock()
+	defer l.RUnlock()
+	return l.config.Identity
+}
+
+// Revokers returns the certificate revocation checkers of the listener.
+func (l *TCP) Revokers() []Revoker {
+	l.RLock()
+	defer l.RUnlock()
+	return l.config.revokers()
+}
+
 // Listen starts listening on the listener's network address.
 func (l *TCP) Listen(s *system.Info) error {
-	var err error
-
-	// The following logic is deprecated in favour of passing through the tls.Config
-	// value directly, however it remains in order to provide backwards compatibility.
-	// It will be removed someday, so use the preferred method (l.config.TLSConfig).
-	if l.config.TLS != nil && len(l.config.TLS.Certificate) > 0 && len(l.config.TLS.PrivateKey) > 0 {
-		var cert tls.Certificate
-		cert, err = tls.X509KeyPair(l.config.TLS.Certificate, l.config.TLS.PrivateKey)
-		if err != nil {
-			return err
-		}
+	tlsConfig, err := l.config.tlsConfig()
+	if err != nil {
+		return err
+	}
 
-		l.listen, err = tls.Listen(l.protocol, l.address, &tls.Config{
-			Certificates: []tls.Certificate{cert},
-		})
-	} else if l.config.TLSConfig != nil {
-		l.listen, err = tls.Listen(l.protocol, l.address, l.config.TLSConfig)
+	proxy, err := l.config.proxyPolicy()
+	if err != nil {
+		return err
+	}
+
+	l.limiter = newConnLimiter(l.config.Limits, s)
+
+	if proxy != nil && proxy.opts.ProxyProtocol {
+		l.listen, err = listenProxy(l.protocol, l.address, proxy, tlsConfig)
+	} else if tlsConfig != nil {
+		l.listen, err = tls.Listen(l.protocol, l.address, tlsConfig)
 	} else {
 		l.listen, err = net.Listen(l.protocol, l.address)
 	}
@@ -98,17 +123,60 @@ func (l *TCP) Serve(establish EstablishFunc) {
 
 		conn, err := l.listen.Accept()
 		if err != nil {
+			if atomic.LoadUint32(&l.end) == 0 {
+				l.log.Error("listener stopped accepting connections", "listener", l.id, "error", err)
+				l.Lock()
+				l.err = err
+				l.Unlock()
+			}
 			return
 		}
 
+		if !l.limiter.allow() {
+			l.log.Debug("connection rejected", "listener", l.id, "reason", "accept rate")
+			conn.Close()
+			continue
+		}
+
 		if atomic.LoadUint32(&l.end) == 0 {
 			go func() {
+				// The remote address of a proxied connection is not known until
+				// its header is read, so it is checked outside the accept loop.
+				remote := conn.RemoteAddr().String()
+				release, ok := l.limiter.acquire(remote)
+				if !ok {
+					l.log.Debug("connection rejected", "listener", l.id, "remote", remote, "reason", "connection limit")
+					conn.Close()
+					return
+				}
+				defer release()
+
+				l.log.Debug("connection accepted", "listener", l.id, "remote", remote)
 				_ = establish(l.id, conn, l.config.Auth)
 			}()
 		}
 	}
 }
 
+// Addr returns the network address the listener is bound to, or nil if it is
+// not listening.
+func (l *TCP) Addr() net.Addr {
+	l.RLock()
+	defer l.RUnlock()
+	if l.listen == nil {
+		return nil
+	}
+
+	return l.listen.Addr()
+}
+
+// ServeErr returns the error which stopped the listener serving, if any.
+func (l *TCP) ServeErr() error {
+	l.RLock()
+	defer l.RUnlock()
+	return l.err
+}
+
 // Close closes the listener and any client connections.
 func (l *TCP) Close(closeClients CloseFunc) {
 	l.Lock()
@@ -2,11 +2,15 @@ package listeners
 
 import (
 	"errors"
+	"io"
 	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/logger"
+	"github.com/mochi-co/mqtt/server/system"
 	"github.com/stretchr/testify/require"
 )
 
@@ -50,6 +54,15 @@ func BenchmarkTCPSetConfig(b *testing.B) {
 	}
 }
 
+func TestTCPSetLogger(t *testing.T) {
+	l := NewTCP("t1", testPort)
+	require.Equal(t, new(logger.Nop), l.log)
+
+	log := new(logger.Mock)
+	l.SetLogger(log)
+	require.Equal(t, log, l.log)
+}
+
 func TestTCPID(t *testing.T) {
 	l := NewTCP("t1", testPort)
 	require.Equal(t, "t1", l.ID())
@@ -62,6 +75,25 @@ func BenchmarkTCPID(b *testing.B) {
 	}
 }
 
+func TestTCPIdentity(t *testing.T) {
+	l := NewTCP("t1", testPort)
+	require.Nil(t, l.Identity())
+
+	id := &Identity{Username: IdentityCommonName}
+	l.SetConfig(&Config{Identity: id})
+	require.Equal(t, id, l.Identity())
+}
+
+func TestTCPRevokers(t *testing.T) {
+	l := NewTCP("t1", testPort)
+	require.Empty(t, l.Revokers())
+
+	r, err := NewRevocation(RevocationOptions{})
+	require.NoError(t, err)
+	l.SetConfig(&Config{Revocation: r})
+	require.Equal(t, []Revoker{r}, l.Revokers())
+}
+
 func TestTCPListen(t *testing.T) {
 	l := NewTCP("t1", testPort)
 	err := l.Listen(nil)
@@ -111,6 +143,42 @@ func TestTCPListenTLSInvalid(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestTCPServeAcceptErrorLog(t *testing.T) {
+	l := NewTCP("t1", testPort)
+	log := new(logger.Mock)
+	l.SetLogger(log)
+	err := l.Listen(nil)
+	require.NoError(t, err)
+
+	o := make(chan bool)
+	go func() {
+		l.Serve(MockEstablisher)
+		o <- true
+	}()
+
+	time.Sleep(time.Millisecond)
+	l.listen.Close() // close the underlying listener without closing the listener.
+	<-o
+
+	e, ok := log.Find("listener stopped accepting connections")
+	require.True(t, ok)
+	require.Equal(t, logger.LevelError, e.Level)
+	require.Error(t, l.ServeErr())
+}
+
+func TestTCPAddr(t *testing.T) {
+	l := NewTCP("t1", "127.0.0.1:0")
+	require.Nil(t, l.Addr())
+
+	err := l.Listen(nil)
+	require.NoError(t, err)
+	defer l.Close(MockCloser)
+
+	addr, ok := l.Addr().(*net.TCPAddr)
+	require.True(t, ok)
+	require.NotZero(t, addr.Port)
+}
+
 func TestTCPServeAndClose(t *testing.T) {
 	l := NewTCP("t1", testPort)
 	err := l.Listen(nil)
@@ -128,6 +196,7 @@ func TestTCPServeAndClose(t *testing.T) {
 	})
 	require.Equal(t, true, closed)
 	<-o
+	require.NoError(t, l.ServeErr())
 }
 
 func TestTCPServeTLSAndClose(t *testing.T) {
@@ -205,6 +274,85 @@ func TestTCPEstablishThenError(t *testing.T) {
 	<-o
 }
 
+// serveLimitedTCP serves a TCP listener with connection limits, holding each
+// established connection open until the test ends.
+func serveLimitedTCP(t *testing.T, limits *Limits) (*TCP, *system.Info, chan bool) {
+	info := new(system.Info)
+	l := NewTCP("t1", "127.0.0.1:0")
+	l.SetConfig(&Config{
+		Auth:   new(auth.Allow),
+		Limits: limits,
+	})
+	require.NoError(t, l.Listen(info))
+
+	hold := make(chan bool)
+	established := make(chan bool, 4)
+	go l.Serve(func(id string, c net.Conn, ac auth.Controller) error {
+		established <- true
+		<-hold
+		return nil
+	})
+
+	t.Cleanup(func() {
+		close(hold)
+		l.Close(MockCloser)
+	})
+
+	return l, info, established
+}
+
+// requireClosed asserts that a connection is closed by the listener.
+func requireClosed(t *testing.T, conn net.Conn) {
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err := conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestTCPMaxConnections(t *testing.T) {
+	l, info, established := serveLimitedTCP(t, &Limits{MaxConnections: 1})
+
+	c1, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c1.Close()
+	<-established
+
+	c2, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c2.Close()
+	requireClosed(t, c2)
+	require.Equal(t, int64(1), atomic.LoadInt64(&info.ConnectionsRejected))
+}
+
+func TestTCPMaxConnectionsPerIP(t *testing.T) {
+	l, info, established := serveLimitedTCP(t, &Limits{MaxConnectionsPerIP: 1})
+
+	c1, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c1.Close()
+	<-established
+
+	c2, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c2.Close()
+	requireClosed(t, c2)
+	require.Equal(t, int64(1), atomic.LoadInt64(&info.ConnectionsIPLimited))
+}
+
+func TestTCPAcceptRate(t *testing.T) {
+	l, info, established := serveLimitedTCP(t, &Limits{AcceptRate: 0.001})
+
+	c1, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c1.Close()
+	<-established
+
+	c2, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c2.Close()
+	requireClosed(t, c2)
+	require.Equal(t, int64(1), atomic.LoadInt64(&info.ConnectionsRateLimited))
+}
+
 func TestTCPEstablishButEnding(t *testing.T) {
 	l := NewTCP("t1", testPort)
 	err := l.Listen(nil)
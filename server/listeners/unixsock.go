@@ -0,0 +1,273 @@
+package listeners
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/logger"
+	"github.com/mochi-co/mqtt/server/system"
+)
+
+const (
+	// defaultSocketMode is the default permissions of a unix socket file.
+	defaultSocketMode os.FileMode = 0660
+)
+
+var (
+	// ErrSocketInUse indicates that another process is listening on a unix socket.
+	ErrSocketInUse = errors.New("unix socket is in use")
+
+	// ErrNotSocket indicates that the path of a unix socket is another type of file.
+	ErrNotSocket = errors.New("path exists and is not a unix socket")
+
+	// ErrPeerCredentialsUnsupported indicates that the credentials of unix
+	// socket peers cannot be read on this platform.
+	ErrPeerCredentialsUnsupported = errors.New("peer credentials not supported")
+)
+
+// UnixSocket is a listener for establishing client connections on a unix
+// domain socket. The credentials of the connecting process are passed to the
+// auth controller where the platform supports them.
+type UnixSocket struct {
+	sync.RWMutex
+	id      string        // the internal id of the listener.
+	path    string        // the path of the socket file.
+	mode    os.FileMode   // the permissions of the socket file.
+	uid     int           // the owner of the socket file, or -1 to leave unchanged.
+	gid     int           // the group of the socket file, or -1 to leave unchanged.
+	listen  net.Listener  // a net.Listener which will listen for new clients.
+	config  *Config       // configuration values for the listener.
+	log     logger.Logger // a logger for listener events.
+	err     error         // the error which stopped the listener serving, if any.
+	limiter *connLimiter  // the connection limits of the listener, if any.
+	end     uint32        // ensure the close methods are only called once.
+}
+
+// unixConn is a unix socket connection with the credentials of the peer process.
+type unixConn struct {
+	net.Conn
+	creds *auth.PeerCredentials // the credentials of the peer, or nil if unknown.
+}
+
+// PeerCredentials returns the credentials of the process which connected.
+func (c *unixConn) PeerCredentials() *auth.PeerCredentials {
+	return c.creds
+}
+
+// NewUnixSocket initialises and returns a new unix socket listener, listening
+// on a socket file path.
+func NewUnixSocket(id, path string) *UnixSocket {
+	return &UnixSocket{
+		id:   id,
+		path: path,
+		mode: defaultSocketMode,
+		uid:  -1,
+		gid:  -1,
+		config: &Config{ // default configuration.
+			Auth: new(auth.Allow),
+		},
+		log: new(logger.Nop),
+	}
+}
+
+// SetConfig sets the configuration values for the listener config.
+func (l *UnixSocket) SetConfig(config *Config) {
+	l.Lock()
+	if config != nil {
+		l.config = config
+
+		// If a config has been passed without an auth controller,
+		// it may be a mistake, so disallow all traffic.
+		if l.config.Auth == nil {
+			l.config.Auth = new(auth.Disallow)
+		}
+	}
+
+	l.Unlock()
+}
+
+// SetLogger sets the logger used by the listener.
+func (l *UnixSocket) SetLogger(log logger.Logger) {
+	l.Lock()
+	l.log = log
+	l.Unlock()
+}
+
+// SetPermissions sets the permissions of the socket file, applied when the
+// listener starts listening. The default is 0660.
+func (l *UnixSocket) SetPermissions(mode os.FileMode) {
+	l.Lock()
+	l.mode = mode
+	l.Unlock()
+}
+
+// SetOwner sets the owner and group of the socket file, applied when the
+// listener starts listening. A value of -1 leaves the owner or group unchanged.
+func (l *UnixSocket) SetOwner(uid, gid int) {
+	l.Lock()
+	l.uid = uid
+	l.gid = gid
+	l.Unlock()
+}
+
+// ID returns the id of the listener.
+func (l *UnixSocket) ID() string {
+	l.RLock()
+	id := l.id
+	l.RUnlock()
+	return id
+}
+
+// Listen starts listening on the socket file. A stale socket file left by a
+// previous process is removed, but an error is returned if the socket is in
+// use or the path is not a socket.
+func (l *UnixSocket) Listen(s *system.Info) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if err := removeStaleSocket(l.path); err != nil {
+		return err
+	}
+
+	l.limiter = newConnLimiter(l.config.Limits, s)
+
+	var err error
+	l.listen, err = net.Listen("unix", l.path)
+	if err != nil {
+		return err
+	}
+
+	// The socket file is removed by Close rather than the net.Listener, so that
+	// a file replaced by another process is not removed.
+	l.listen.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := os.Chmod(l.path, l.mode); err != nil {
+		l.listen.Close()
+		return err
+	}
+
+	if l.uid != -1 || l.gid != -1 {
+		if err := os.Chown(l.path, l.uid, l.gid); err != nil {
+			l.listen.Close()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Serve starts waiting for new unix socket connections, and calls the
+// establish connection callback for any received.
+func (l *UnixSocket) Serve(establish EstablishFunc) {
+	for {
+		if atomic.LoadUint32(&l.end) == 1 {
+			return
+		}
+
+		conn, err := l.listen.Accept()
+		if err != nil {
+			if atomic.LoadUint32(&l.end) == 0 {
+				l.log.Error("listener stopped accepting connections", "listener", l.id, "error", err)
+				l.Lock()
+				l.err = err
+				l.Unlock()
+			}
+			return
+		}
+
+		if !l.limiter.allow() {
+			l.log.Debug("connection rejected", "listener", l.id, "path", l.path, "reason", "accept rate")
+			conn.Close()
+			continue
+		}
+
+		release, ok := l.limiter.acquire("")
+		if !ok {
+			l.log.Debug("connection rejected", "listener", l.id, "path", l.path, "reason", "connection limit")
+			conn.Close()
+			continue
+		}
+
+		creds, err := peerCredentials(conn)
+		if err != nil && !errors.Is(err, ErrPeerCredentialsUnsupported) {
+			l.log.Warn("failed to read peer credentials", "listener", l.id, "error", err)
+		}
+
+		l.log.Debug("connection accepted", "listener", l.id, "path", l.path)
+
+		if atomic.LoadUint32(&l.end) == 0 {
+			go func() {
+				defer release()
+				_ = establish(l.id, &unixConn{Conn: conn, creds: creds}, l.config.Auth)
+			}()
+		} else {
+			release()
+		}
+	}
+}
+
+// Addr returns the network address the listener is bound to, or nil if it is
+// not listening.
+func (l *UnixSocket) Addr() net.Addr {
+	l.RLock()
+	defer l.RUnlock()
+	if l.listen == nil {
+		return nil
+	}
+
+	return l.listen.Addr()
+}
+
+// ServeErr returns the error which stopped the listener serving, if any.
+func (l *UnixSocket) ServeErr() error {
+	l.RLock()
+	defer l.RUnlock()
+	return l.err
+}
+
+// Close closes the listener and any client connections, and removes the
+// socket file.
+func (l *UnixSocket) Close(closeClients CloseFunc) {
+	l.Lock()
+	defer l.Unlock()
+
+	if atomic.CompareAndSwapUint32(&l.end, 0, 1) {
+		closeClients(l.id)
+	}
+
+	if l.listen != nil {
+		err := l.listen.Close()
+		if err != nil {
+			return
+		}
+		os.Remove(l.path)
+	}
+}
+
+// removeStaleSocket removes a socket file if no process is listening on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return ErrNotSocket
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return ErrSocketInUse
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,227 @@
+package listeners
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/logger"
+	"github.com/mochi-co/mqtt/server/system"
+	"github.com/stretchr/testify/require"
+)
+
+func testSocketPath(t *testing.T) string {
+	return filepath.Join(t.TempDir(), "mqtt.sock")
+}
+
+func TestNewUnixSocket(t *testing.T) {
+	l := NewUnixSocket("t1", "/tmp/mqtt.sock")
+	require.Equal(t, "t1", l.id)
+	require.Equal(t, "/tmp/mqtt.sock", l.path)
+	require.Equal(t, defaultSocketMode, l.mode)
+	require.Equal(t, -1, l.uid)
+	require.Equal(t, -1, l.gid)
+	require.Equal(t, new(auth.Allow), l.config.Auth)
+}
+
+func TestUnixSocketSetConfig(t *testing.T) {
+	l := NewUnixSocket("t1", "/tmp/mqtt.sock")
+
+	l.SetConfig(&Config{
+		Auth: new(auth.Allow),
+	})
+	require.Equal(t, new(auth.Allow), l.config.Auth)
+
+	// Switch to disallow on bad config set.
+	l.SetConfig(new(Config))
+	require.Equal(t, new(auth.Disallow), l.config.Auth)
+}
+
+func TestUnixSocketSetLogger(t *testing.T) {
+	l := NewUnixSocket("t1", "/tmp/mqtt.sock")
+	log := new(logger.Mock)
+	l.SetLogger(log)
+	require.Equal(t, log, l.log)
+}
+
+func TestUnixSocketID(t *testing.T) {
+	l := NewUnixSocket("t1", "/tmp/mqtt.sock")
+	require.Equal(t, "t1", l.ID())
+}
+
+func TestUnixSocketListen(t *testing.T) {
+	path := testSocketPath(t)
+	l := NewUnixSocket("t1", path)
+	require.Nil(t, l.Addr())
+	l.SetPermissions(0600)
+	l.SetOwner(os.Getuid(), os.Getgid())
+	require.NoError(t, l.Listen(nil))
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NotZero(t, fi.Mode()&os.ModeSocket)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	require.Equal(t, path, l.Addr().String())
+
+	l.Close(MockCloser)
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestUnixSocketListenStale(t *testing.T) {
+	path := testSocketPath(t)
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l := NewUnixSocket("t1", path)
+	require.NoError(t, l.Listen(nil))
+	l.Close(MockCloser)
+}
+
+func TestUnixSocketListenInUse(t *testing.T) {
+	path := testSocketPath(t)
+	active, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	defer active.Close()
+
+	l := NewUnixSocket("t1", path)
+	require.ErrorIs(t, l.Listen(nil), ErrSocketInUse)
+}
+
+func TestUnixSocketListenNotSocket(t *testing.T) {
+	path := testSocketPath(t)
+	require.NoError(t, ioutil.WriteFile(path, []byte("data"), 0600))
+
+	l := NewUnixSocket("t1", path)
+	require.ErrorIs(t, l.Listen(nil), ErrNotSocket)
+
+	_, err := os.Stat(path)
+	require.NoError(t, err)
+}
+
+func TestUnixSocketServeAndClose(t *testing.T) {
+	l := NewUnixSocket("t1", testSocketPath(t))
+	require.NoError(t, l.Listen(nil))
+
+	o := make(chan bool)
+	go func() {
+		l.Serve(MockEstablisher)
+		o <- true
+	}()
+
+	time.Sleep(time.Millisecond)
+	var closed bool
+	l.Close(func(id string) {
+		closed = true
+	})
+	require.True(t, closed)
+	<-o
+}
+
+func TestUnixSocketLimits(t *testing.T) {
+	info := new(system.Info)
+	path := testSocketPath(t)
+	l := NewUnixSocket("t1", path)
+	l.SetConfig(&Config{
+		Auth:   new(auth.Allow),
+		Limits: &Limits{MaxConnections: 1, MaxConnectionsPerIP: 1},
+	})
+	require.NoError(t, l.Listen(info))
+
+	hold := make(chan bool)
+	established := make(chan bool, 2)
+	go l.Serve(func(id string, c net.Conn, ac auth.Controller) error {
+		established <- true
+		<-hold
+		return nil
+	})
+	defer l.Close(MockCloser)
+	defer close(hold)
+
+	c1, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	defer c1.Close()
+	<-established
+
+	c2, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	defer c2.Close()
+	requireClosed(t, c2)
+	require.Equal(t, int64(1), atomic.LoadInt64(&info.ConnectionsRejected))
+	require.Equal(t, int64(0), atomic.LoadInt64(&info.ConnectionsIPLimited))
+}
+
+func TestUnixSocketServeAcceptErrorLog(t *testing.T) {
+	l := NewUnixSocket("t1", testSocketPath(t))
+	log := new(logger.Mock)
+	l.SetLogger(log)
+	require.NoError(t, l.Listen(nil))
+
+	o := make(chan bool)
+	go func() {
+		l.Serve(MockEstablisher)
+		o <- true
+	}()
+
+	time.Sleep(time.Millisecond)
+	l.listen.Close() // close the underlying listener without closing the listener.
+	<-o
+
+	e, ok := log.Find("listener stopped accepting connections")
+	require.True(t, ok)
+	require.Equal(t, logger.LevelError, e.Level)
+	require.Error(t, l.ServeErr())
+}
+
+func TestUnixSocketEstablishPeerCredentials(t *testing.T) {
+	path := testSocketPath(t)
+	l := NewUnixSocket("t1", path)
+	l.SetConfig(&Config{Auth: new(auth.Disallow)})
+	require.NoError(t, l.Listen(nil))
+
+	type established struct {
+		id    string
+		creds *auth.PeerCredentials
+		ac    auth.Controller
+	}
+
+	e := make(chan established)
+	go l.Serve(func(id string, c net.Conn, ac auth.Controller) error {
+		e <- established{id, c.(*unixConn).PeerCredentials(), ac}
+		return nil
+	})
+
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	got := <-e
+	require.Equal(t, "t1", got.id)
+	require.Equal(t, new(auth.Disallow), got.ac)
+
+	if runtime.GOOS == "linux" {
+		require.Equal(t, &auth.PeerCredentials{
+			PID: int32(os.Getpid()),
+			UID: uint32(os.Getuid()),
+			GID: uint32(os.Getgid()),
+		}, got.creds)
+	} else {
+		require.Nil(t, got.creds)
+	}
+
+	l.Close(MockCloser)
+}
+
+func TestPeerCredentialsNotUnix(t *testing.T) {
+	c, _ := net.Pipe()
+	_, err := peerCredentials(c)
+	require.ErrorIs(t, err, ErrPeerCredentialsUnsupported)
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,37 +14,98 @@ import (
 	"github.com/gorilla/websocket"
 
 	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/logger"
 	"github.com/mochi-co/mqtt/server/system"
 )
 
 var (
 	// ErrInvalidMessage indicates that a message payload was not valid.
 	ErrInvalidMessage = errors.New("message type not binary")
+)
+
+// WebsocketOptions contains settings for accepting websocket connections.
+type WebsocketOptions struct {
+	// Path is the request path websocket connections are accepted on. If empty,
+	// connections are accepted on any path.
+	Path string
+
+	// AllowedOrigins are the origins, such as https://example.com, which may
+	// open connections from a browser. A "*" allows any origin. If empty, all
+	// origins are allowed. Requests without an Origin header are always allowed.
+	AllowedOrigins []string
 
-	// wsUpgrader is used to upgrade the incoming http/tcp connection to a
-	// websocket compliant connection.
-	wsUpgrader = &websocket.Upgrader{
-		Subprotocols: []string{"mqtt"},
-		CheckOrigin:  func(r *http.Request) bool { return true },
+	// CheckOrigin returns true if a request may open a connection. If set, it is
+	// used instead of AllowedOrigins.
+	CheckOrigin func(r *http.Request) bool
+
+	// ReadBufferSize and WriteBufferSize are the sizes of the connection
+	// buffers in bytes. If 0, the buffers allocated by the http server are used.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// EnableCompression negotiates permessage-deflate compression with clients
+	// which support it.
+	EnableCompression bool
+}
+
+// upgrader returns a websocket upgrader for the options.
+func (o WebsocketOptions) upgrader() *websocket.Upgrader {
+	check := o.CheckOrigin
+	if check == nil {
+		check = o.allowOrigin
 	}
-)
+
+	return &websocket.Upgrader{
+		Subprotocols:      []string{"mqtt"},
+		CheckOrigin:       check,
+		ReadBufferSize:    o.ReadBufferSize,
+		WriteBufferSize:   o.WriteBufferSize,
+		EnableCompression: o.EnableCompression,
+	}
+}
+
+// allowOrigin returns true if the origin of a request is allowed.
+func (o WebsocketOptions) allowOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(o.AllowedOrigins) == 0 {
+		return true
+	}
+
+	for _, allowed := range o.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+
+	return false
+}
 
 // Websocket is a listener for establishing websocket connections.
 type Websocket struct {
 	sync.RWMutex
-	id        string        // the internal id of the listener.
-	address   string        // the network address to bind to.
-	config    *Config       // configuration values for the listener.
-	listen    *http.Server  // an http server for serving websocket connections.
-	establish EstablishFunc // the server's establish connection handler.
-	end       uint32        // ensure the close methods are only called once.
+	id        string              // the internal id of the listener.
+	address   string              // the network address to bind to.
+	config    *Config             // configuration values for the listener.
+	listen    *http.Server        // an http server for serving websocket connections.
+	ln        net.Listener        // the network listener the http server is bound to.
+	err       error               // the error which stopped the listener serving, if any.
+	establish EstablishFunc       // the server's establish connection handler.
+	proxy     *proxyPolicy        // the upstreams trusted to report client addresses.
+	opts      WebsocketOptions    // settings for accepting websocket connections.
+	upgrader  *websocket.Upgrader // upgrades http requests to websocket connections.
+	log       logger.Logger       // a logger for listener events.
+	limiter   *connLimiter        // the connection limits of the listener, if any.
+	end       uint32              // ensure the close methods are only called once.
 }
 
 // wsConn is a websocket connection which satisfies the net.Conn interface.
 // Inspired by
 type wsConn struct {
 	net.Conn
-	c *websocket.Conn
+	c      *websocket.Conn
+	state  *tls.ConnectionState // the tls state of the http request, if any.
+	remote net.Addr             // the client address forwarded by a trusted proxy, if any.
+	header http.Header          // the headers of the upgrade request.
 }
 
 // Read reads the next span of bytes from the websocket connection and returns
@@ -72,6 +134,32 @@ func (ws *wsConn) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+// ConnectionState returns the tls state of the connection, including the
+// certificates presented by the client.
+func (ws *wsConn) ConnectionState() tls.ConnectionState {
+	if ws.state == nil {
+		return tls.ConnectionState{}
+	}
+
+	return *ws.state
+}
+
+// RemoteAddr returns the address of the client, as forwarded by a trusted proxy
+// if known.
+func (ws *wsConn) RemoteAddr() net.Addr {
+	if ws.remote != nil {
+		return ws.remote
+	}
+
+	return ws.Conn.RemoteAddr()
+}
+
+// Header returns the headers of the http request which opened the connection,
+// including any cookies.
+func (ws *wsConn) Header() http.Header {
+	return ws.header
+}
+
 // Close signals the underlying websocket conn to close.
 func (ws *wsConn) Close() error {
 	return ws.Conn.Close()
@@ -86,9 +174,20 @@ func NewWebsocket(id, address string) *Websocket {
 			Auth: new(auth.Allow),
 			TLS:  new(TLS),
 		},
+		log:      new(logger.Nop),
+		upgrader: WebsocketOptions{}.upgrader(),
 	}
 }
 
+// SetOptions sets the settings for accepting websocket connections. It must be
+// called before the listener is served.
+func (l *Websocket) SetOptions(opts WebsocketOptions) {
+	l.Lock()
+	l.opts = opts
+	l.upgrader = opts.upgrader()
+	l.Unlock()
+}
+
 // SetConfig sets the configuration values for the listener config.
 func (l *Websocket) SetConfig(config *Config) {
 	l.Lock()
@@ -105,6 +204,13 @@ func (l *Websocket) SetConfig(config *Config) {
 	l.Unlock()
 }
 
+// SetLogger sets the logger used by the listener.
+func (l *Websocket) SetLogger(log logger.Logger) {
+	l.Lock()
+	l.log = log
+	l.Unlock()
+}
+
 // ID returns the id of the listener.
 func (l *Websocket) ID() string {
 	l.RLock()
@@ -113,54 +219,146 @@ func (l *Websocket) ID() string {
 	return id
 }
 
+// Identity returns the identity mapping of the listener.
+func (l *Websocket) Identity() *Identity {
+	l.RLock()
+	defer l.RUnlock()
+	return l.config.Identity
+}
+
+// Revokers returns the certificate revocation checkers of the listener.
+func (l *Websocket) Revokers() []Revoker {
+	l.RLock()
+	defer l.RUnlock()
+	return l.config.revokers()
+}
+
 // Listen starts listening on the listener's network address.
 func (l *Websocket) Listen(s *system.Info) error {
+	path := l.opts.Path
+	if path == "" {
+		path = "/"
+	}
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", l.handler)
+	mux.HandleFunc(path, l.handler)
 	l.listen = &http.Server{
 		Addr:    l.address,
 		Handler: mux,
 	}
 
-	// The following logic is deprecated in favour of passing through the tls.Config
-	// value directly, however it remains in order to provide backwards compatibility.
-	// It will be removed someday, so use the preferred method (l.config.TLSConfig).
-	if l.config.TLS != nil && len(l.config.TLS.Certificate) > 0 && len(l.config.TLS.PrivateKey) > 0 {
-		cert, err := tls.X509KeyPair(l.config.TLS.Certificate, l.config.TLS.PrivateKey)
-		if err != nil {
-			return err
-		}
+	tlsConfig, err := l.config.tlsConfig()
+	if err != nil {
+		return err
+	}
+	l.listen.TLSConfig = tlsConfig
 
-		l.listen.TLSConfig = &tls.Config{
-			Certificates: []tls.Certificate{cert},
-		}
-	} else {
-		l.listen.TLSConfig = l.config.TLSConfig
+	l.proxy, err = l.config.proxyPolicy()
+	if err != nil {
+		return err
 	}
 
+	l.limiter = newConnLimiter(l.config.Limits, s)
+
 	return nil
 }
 
+// handler upgrades an http request to a websocket connection and establishes
+// it as a client.
 func (l *Websocket) handler(w http.ResponseWriter, r *http.Request) {
-	c, err := wsUpgrader.Upgrade(w, r, nil)
+	l.RLock()
+	establish, proxy, limiter := l.establish, l.proxy, l.limiter
+	l.RUnlock()
+
+	if establish == nil {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	var forwarded net.Addr
+	remote := r.RemoteAddr
+	if proxy != nil && proxy.opts.ForwardedHeaders {
+		if forwarded = proxy.forwardedAddr(r); forwarded != nil {
+			remote = forwarded.String()
+		}
+	}
+
+	// Connections over the limits are refused before they are upgraded.
+	if !limiter.allow() {
+		l.log.Debug("connection rejected", "listener", l.id, "remote", remote, "reason", "accept rate")
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	release, ok := limiter.acquire(remote)
+	if !ok {
+		l.log.Debug("connection rejected", "listener", l.id, "remote", remote, "reason", "connection limit")
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	c, err := l.upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		l.log.Warn("websocket upgrade failed", "listener", l.id, "remote", r.RemoteAddr, "error", err)
 		return
 	}
 	defer c.Close()
 
-	l.establish(l.id, &wsConn{c.UnderlyingConn(), c}, l.config.Auth)
+	ws := &wsConn{Conn: c.UnderlyingConn(), c: c, state: r.TLS, header: r.Header, remote: forwarded}
+
+	l.log.Debug("connection accepted", "listener", l.id, "remote", ws.RemoteAddr().String())
+	establish(l.id, ws, l.config.Auth)
 }
 
 // Serve starts waiting for new Websocket connections, and calls the connection
 // establishment callback for any received.
 func (l *Websocket) Serve(establish EstablishFunc) {
+	l.Lock()
 	l.establish = establish
+	l.Unlock()
 
-	if l.listen.TLSConfig != nil {
-		l.listen.ListenAndServeTLS("", "")
+	var ln net.Listener
+	var err error
+	if l.proxy != nil && l.proxy.opts.ProxyProtocol {
+		// PROXY protocol headers are read before the tls handshake.
+		ln, err = listenProxy("tcp", l.address, l.proxy, nil)
 	} else {
-		l.listen.ListenAndServe()
+		ln, err = net.Listen("tcp", l.address)
+	}
+
+	if err == nil {
+		l.Lock()
+		l.ln = ln
+		l.Unlock()
+		err = serveHTTP(l.listen, ln)
+	}
+
+	if err != nil {
+		l.log.Error("listener stopped serving", "listener", l.id, "error", err)
+		l.Lock()
+		l.err = err
+		l.Unlock()
+	}
+}
+
+// Addr returns the network address the listener is bound to, or nil if it is
+// not serving.
+func (l *Websocket) Addr() net.Addr {
+	l.RLock()
+	defer l.RUnlock()
+	if l.ln == nil {
+		return nil
 	}
+
+	return l.ln.Addr()
+}
+
+// ServeErr returns the error which stopped the listener serving, if any.
+func (l *Websocket) ServeErr() error {
+	l.RLock()
+	defer l.RUnlock()
+	return l.err
 }
 
 // Close closes the listener and any client connections.
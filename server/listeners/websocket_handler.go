@@ -0,0 +1,97 @@
+package listeners
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/mochi-co/mqtt/server/logger"
+	"github.com/mochi-co/mqtt/server/system"
+)
+
+// WebsocketHandler is a listener which accepts websocket connections as an
+// http.Handler, so the MQTT endpoint can be mounted on an existing http server.
+// Requests are refused until the listener is added to a server and served.
+type WebsocketHandler struct {
+	ws   *Websocket    // upgrades requests and establishes connections.
+	done chan struct{} // closed when the listener is closed.
+	end  sync.Once     // ensures the listener is only closed once.
+}
+
+// NewWebsocketHandler initialises and returns a new websocket handler listener.
+func NewWebsocketHandler(id string, opts WebsocketOptions) *WebsocketHandler {
+	ws := NewWebsocket(id, "")
+	ws.SetOptions(opts)
+
+	return &WebsocketHandler{
+		ws:   ws,
+		done: make(chan struct{}),
+	}
+}
+
+// SetConfig sets the configuration values for the listener config. The tls
+// settings are not used, as tls is provided by the http server.
+func (l *WebsocketHandler) SetConfig(config *Config) {
+	l.ws.SetConfig(config)
+}
+
+// SetLogger sets the logger used by the listener.
+func (l *WebsocketHandler) SetLogger(log logger.Logger) {
+	l.ws.SetLogger(log)
+}
+
+// ID returns the id of the listener.
+func (l *WebsocketHandler) ID() string {
+	return l.ws.ID()
+}
+
+// Identity returns the identity mapping of the listener.
+func (l *WebsocketHandler) Identity() *Identity {
+	return l.ws.Identity()
+}
+
+// Listen prepares the listener. The handler does not open a network address.
+func (l *WebsocketHandler) Listen(s *system.Info) error {
+	proxy, err := l.ws.config.proxyPolicy()
+	if err != nil {
+		return err
+	}
+
+	l.ws.Lock()
+	l.ws.proxy = proxy
+	l.ws.Unlock()
+
+	return nil
+}
+
+// Serve accepts websocket connections with the connection establishment
+// callback until the listener is closed.
+func (l *WebsocketHandler) Serve(establish EstablishFunc) {
+	l.ws.Lock()
+	l.ws.establish = establish
+	l.ws.Unlock()
+
+	<-l.done
+}
+
+// ServeHTTP upgrades a request to a websocket connection and establishes it as
+// a client. If a path is configured, requests for other paths are not found.
+func (l *WebsocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if l.ws.opts.Path != "" && r.URL.Path != l.ws.opts.Path {
+		http.NotFound(w, r)
+		return
+	}
+
+	l.ws.handler(w, r)
+}
+
+// Close stops accepting connections and closes any client connections.
+func (l *WebsocketHandler) Close(closeClients CloseFunc) {
+	l.end.Do(func() {
+		l.ws.Lock()
+		l.ws.establish = nil
+		l.ws.Unlock()
+		close(l.done)
+	})
+
+	closeClients(l.ws.ID())
+}
@@ -0,0 +1,117 @@
+package listeners
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewWebsocketHandler(t *testing.T) {
+	l := NewWebsocketHandler("t1", WebsocketOptions{Path: "/mqtt"})
+	require.Equal(t, "t1", l.ID())
+	require.Equal(t, "/mqtt", l.ws.opts.Path)
+	require.NotNil(t, l.done)
+}
+
+func TestWebsocketHandlerSetConfig(t *testing.T) {
+	l := NewWebsocketHandler("t1", WebsocketOptions{})
+	identity := &Identity{Username: IdentityCommonName}
+	l.SetConfig(&Config{
+		Auth:     new(auth.Allow),
+		Identity: identity,
+	})
+	require.Equal(t, new(auth.Allow), l.ws.config.Auth)
+	require.Equal(t, identity, l.Identity())
+
+	l.SetConfig(new(Config))
+	require.Equal(t, new(auth.Disallow), l.ws.config.Auth)
+}
+
+func TestWebsocketHandlerSetLogger(t *testing.T) {
+	l := NewWebsocketHandler("t1", WebsocketOptions{})
+	log := new(logger.Mock)
+	l.SetLogger(log)
+	require.Equal(t, log, l.ws.log)
+}
+
+func TestWebsocketHandlerListen(t *testing.T) {
+	l := NewWebsocketHandler("t1", WebsocketOptions{})
+	l.SetConfig(&Config{
+		Auth:  new(auth.Allow),
+		Proxy: &Proxy{Trusted: []string{"127.0.0.1"}, ForwardedHeaders: true},
+	})
+	require.NoError(t, l.Listen(nil))
+	require.NotNil(t, l.ws.proxy)
+
+	l.SetConfig(&Config{
+		Auth:  new(auth.Allow),
+		Proxy: &Proxy{Trusted: []string{"invalid"}},
+	})
+	require.ErrorIs(t, l.Listen(nil), ErrInvalidTrustedProxy)
+}
+
+func TestWebsocketHandlerServeHTTP(t *testing.T) {
+	l := NewWebsocketHandler("t1", WebsocketOptions{Path: "/mqtt"})
+	l.SetConfig(&Config{Auth: new(auth.Allow)})
+	require.NoError(t, l.Listen(nil))
+
+	mux := http.NewServeMux()
+	mux.Handle("/mqtt", l)
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+	u := "ws" + strings.TrimPrefix(s.URL, "http") + "/mqtt"
+
+	// refused until served.
+	_, resp, err := websocket.DefaultDialer.Dial(u, nil)
+	require.ErrorIs(t, err, websocket.ErrBadHandshake)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	e := make(chan net.Conn, 1)
+	o := make(chan bool)
+	go func() {
+		l.Serve(func(id string, c net.Conn, ac auth.Controller) error {
+			e <- c
+			return nil
+		})
+		o <- true
+	}()
+
+	var ws *websocket.Conn
+	require.Eventually(t, func() bool {
+		ws, _, err = websocket.DefaultDialer.Dial(u, http.Header{"Authorization": {"Bearer token"}})
+		return err == nil
+	}, time.Second, time.Millisecond)
+	defer ws.Close()
+	require.Equal(t, "Bearer token", (<-e).(*wsConn).Header().Get("Authorization"))
+
+	var closed bool
+	l.Close(func(id string) {
+		closed = true
+	})
+	require.True(t, closed)
+	<-o
+
+	_, resp, err = websocket.DefaultDialer.Dial(u, nil)
+	require.ErrorIs(t, err, websocket.ErrBadHandshake)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	// closing again only closes clients.
+	l.Close(MockCloser)
+}
+
+func TestWebsocketHandlerServeHTTPPath(t *testing.T) {
+	l := NewWebsocketHandler("t1", WebsocketOptions{Path: "/mqtt"})
+	w := httptest.NewRecorder()
+	l.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/other", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -1,26 +1,40 @@
 package listeners
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/gorilla/websocket"
 
 	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/logger"
+	"github.com/mochi-co/mqtt/server/system"
 	"github.com/stretchr/testify/require"
 )
 
 func TestWsConnClose(t *testing.T) {
 	r, _ := net.Pipe()
-	ws := &wsConn{r, new(websocket.Conn)}
+	ws := &wsConn{Conn: r, c: new(websocket.Conn)}
 	err := ws.Close()
 	require.NoError(t, err)
 }
 
+func TestWsConnConnectionState(t *testing.T) {
+	ws := &wsConn{c: new(websocket.Conn)}
+	require.Empty(t, ws.ConnectionState().PeerCertificates)
+
+	certs := []*x509.Certificate{testIdentityCert()}
+	ws.state = &tls.ConnectionState{PeerCertificates: certs}
+	require.Equal(t, certs, ws.ConnectionState().PeerCertificates)
+}
+
 func TestNewWebsocket(t *testing.T) {
 	l := NewWebsocket("t1", testPort)
 	require.Equal(t, "t1", l.id)
@@ -57,6 +71,15 @@ func BenchmarkWebsocketSetConfig(b *testing.B) {
 	}
 }
 
+func TestWebsocketSetLogger(t *testing.T) {
+	l := NewWebsocket("t1", testPort)
+	require.Equal(t, new(logger.Nop), l.log)
+
+	log := new(logger.Mock)
+	l.SetLogger(log)
+	require.Equal(t, log, l.log)
+}
+
 func TestWebsocketID(t *testing.T) {
 	l := NewWebsocket("t1", testPort)
 	require.Equal(t, "t1", l.ID())
@@ -69,6 +92,25 @@ func BenchmarkWebsocketID(b *testing.B) {
 	}
 }
 
+func TestWebsocketIdentity(t *testing.T) {
+	l := NewWebsocket("t1", testPort)
+	require.Nil(t, l.Identity())
+
+	id := &Identity{ClientID: IdentitySANURI}
+	l.SetConfig(&Config{Identity: id})
+	require.Equal(t, id, l.Identity())
+}
+
+func TestWebsocketRevokers(t *testing.T) {
+	l := NewWebsocket("t1", testPort)
+	require.Empty(t, l.Revokers())
+
+	r, err := NewRevocation(RevocationOptions{})
+	require.NoError(t, err)
+	l.SetConfig(&Config{Revocation: r})
+	require.Equal(t, []Revoker{r}, l.Revokers())
+}
+
 func TestWebsocketListen(t *testing.T) {
 	l := NewWebsocket("t1", testPort)
 	require.Nil(t, l.listen)
@@ -135,6 +177,39 @@ func TestWebsocketServeAndClose(t *testing.T) {
 	<-o
 }
 
+func TestWebsocketAddr(t *testing.T) {
+	l := NewWebsocket("t1", "127.0.0.1:0")
+	require.Nil(t, l.Addr())
+	require.NoError(t, l.Listen(nil))
+
+	o := make(chan bool)
+	go func() {
+		l.Serve(MockEstablisher)
+		o <- true
+	}()
+
+	require.Eventually(t, func() bool {
+		return l.Addr() != nil
+	}, time.Second, time.Millisecond)
+
+	l.Close(MockCloser)
+	<-o
+	require.NoError(t, l.ServeErr())
+}
+
+func TestWebsocketServeErr(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	l := NewWebsocket("t1", ln.Addr().String())
+	require.NoError(t, l.Listen(nil))
+
+	l.Serve(MockEstablisher) // the address is in use, so serving stops immediately.
+	require.Error(t, l.ServeErr())
+	require.Nil(t, l.Addr())
+}
+
 func TestWebsocketServeTLSAndClose(t *testing.T) {
 	l := NewWebsocket("t1", testPort)
 	l.SetConfig(&Config{
@@ -179,3 +254,154 @@ func TestWebsocketUpgrade(t *testing.T) {
 	ws.Close()
 
 }
+
+func TestWebsocketLimits(t *testing.T) {
+	info := new(system.Info)
+	l := NewWebsocket("t1", testPort)
+	l.SetConfig(&Config{
+		Auth:   new(auth.Allow),
+		Limits: &Limits{MaxConnections: 1, AcceptRate: 0.001, AcceptBurst: 2},
+	})
+	require.NoError(t, l.Listen(info))
+	l.establish = MockEstablisher
+
+	// the only connection slot is taken.
+	release, ok := l.limiter.acquire("127.0.0.1:1")
+	require.True(t, ok)
+	defer release()
+
+	w := httptest.NewRecorder()
+	l.handler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Equal(t, int64(1), atomic.LoadInt64(&info.ConnectionsRejected))
+
+	w = httptest.NewRecorder()
+	l.handler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	w = httptest.NewRecorder()
+	l.handler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Equal(t, int64(1), atomic.LoadInt64(&info.ConnectionsRateLimited))
+}
+
+func TestWsConnHeader(t *testing.T) {
+	header := http.Header{"Cookie": {"session=abc"}}
+	ws := &wsConn{c: new(websocket.Conn), header: header}
+	require.Equal(t, header, ws.Header())
+}
+
+func TestWebsocketSetOptions(t *testing.T) {
+	l := NewWebsocket("t1", testPort)
+	require.True(t, l.upgrader.CheckOrigin(httptest.NewRequest(http.MethodGet, "/", nil)))
+
+	l.SetOptions(WebsocketOptions{
+		Path:              "/mqtt",
+		ReadBufferSize:    512,
+		WriteBufferSize:   1024,
+		EnableCompression: true,
+	})
+	require.Equal(t, "/mqtt", l.opts.Path)
+	require.Equal(t, 512, l.upgrader.ReadBufferSize)
+	require.Equal(t, 1024, l.upgrader.WriteBufferSize)
+	require.True(t, l.upgrader.EnableCompression)
+	require.Equal(t, []string{"mqtt"}, l.upgrader.Subprotocols)
+}
+
+func TestWebsocketOptionsAllowOrigin(t *testing.T) {
+	request := func(origin string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		return r
+	}
+
+	opts := WebsocketOptions{AllowedOrigins: []string{"https://example.com/", "http://localhost:8080"}}
+	require.True(t, opts.allowOrigin(request("")))
+	require.True(t, opts.allowOrigin(request("https://example.com")))
+	require.True(t, opts.allowOrigin(request("HTTPS://EXAMPLE.COM")))
+	require.True(t, opts.allowOrigin(request("http://localhost:8080")))
+	require.False(t, opts.allowOrigin(request("https://evil.example")))
+	require.False(t, opts.allowOrigin(request("http://example.com")))
+
+	opts = WebsocketOptions{AllowedOrigins: []string{"*"}}
+	require.True(t, opts.allowOrigin(request("https://evil.example")))
+
+	opts = WebsocketOptions{}
+	require.True(t, opts.allowOrigin(request("https://evil.example")))
+}
+
+func TestWebsocketOptionsCheckOrigin(t *testing.T) {
+	opts := WebsocketOptions{
+		AllowedOrigins: []string{"*"},
+		CheckOrigin: func(r *http.Request) bool {
+			return false
+		},
+	}
+
+	require.False(t, opts.upgrader().CheckOrigin(httptest.NewRequest(http.MethodGet, "/", nil)))
+}
+
+func TestWebsocketUpgradeOriginRefused(t *testing.T) {
+	l := NewWebsocket("t1", testPort)
+	l.SetOptions(WebsocketOptions{AllowedOrigins: []string{"https://example.com"}})
+	l.Listen(nil)
+	l.establish = MockEstablisher
+
+	s := httptest.NewServer(http.HandlerFunc(l.handler))
+	defer s.Close()
+
+	u := "ws" + strings.TrimPrefix(s.URL, "http")
+	_, resp, err := websocket.DefaultDialer.Dial(u, http.Header{"Origin": {"https://evil.example"}})
+	require.ErrorIs(t, err, websocket.ErrBadHandshake)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestWebsocketUpgradeNotServing(t *testing.T) {
+	l := NewWebsocket("t1", testPort)
+	l.Listen(nil)
+
+	w := httptest.NewRecorder()
+	l.handler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestWebsocketUpgradeCompression(t *testing.T) {
+	l := NewWebsocket("t1", testPort)
+	l.SetOptions(WebsocketOptions{EnableCompression: true})
+	l.Listen(nil)
+
+	e := make(chan net.Conn, 1)
+	l.establish = func(id string, c net.Conn, ac auth.Controller) error {
+		e <- c
+		return nil
+	}
+
+	s := httptest.NewServer(http.HandlerFunc(l.handler))
+	defer s.Close()
+
+	d := websocket.Dialer{EnableCompression: true}
+	u := "ws" + strings.TrimPrefix(s.URL, "http")
+	ws, resp, err := d.Dial(u, http.Header{"Cookie": {"session=abc"}})
+	require.NoError(t, err)
+	defer ws.Close()
+
+	require.Contains(t, resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate")
+	require.Equal(t, "session=abc", (<-e).(*wsConn).Header().Get("Cookie"))
+}
+
+func TestWebsocketListenPath(t *testing.T) {
+	l := NewWebsocket("t1", testPort)
+	l.SetOptions(WebsocketOptions{Path: "/mqtt"})
+	require.NoError(t, l.Listen(nil))
+	l.establish = MockEstablisher
+
+	w := httptest.NewRecorder()
+	l.listen.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/other", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	l.listen.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/mqtt", nil))
+	require.Equal(t, http.StatusBadRequest, w.Code) // not a websocket request.
+}
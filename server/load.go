@@ -0,0 +1,93 @@
+package server
+
+import (
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/mochi-co/mqtt/server/system"
+)
+
+// loadCounters are the system info counters for which load averages are
+// published, keyed on their path under $SYS/broker/load/.
+var loadCounters = map[string]func(info *system.Info) *int64{
+	"messages/received": func(info *system.Info) *int64 { return &info.MessagesRecv },
+	"messages/sent":     func(info *system.Info) *int64 { return &info.MessagesSent },
+	"publish/received":  func(info *system.Info) *int64 { return &info.PublishRecv },
+	"publish/sent":      func(info *system.Info) *int64 { return &info.PublishSent },
+	"publish/dropped":   func(info *system.Info) *int64 { return &info.PublishDropped },
+	"bytes/received":    func(info *system.Info) *int64 { return &info.BytesRecv },
+	"bytes/sent":        func(info *system.Info) *int64 { return &info.BytesSent },
+	"connections":       func(info *system.Info) *int64 { return &info.ConnectionsTotal },
+	"sockets":           func(info *system.Info) *int64 { return &info.SocketsTotal },
+}
+
+// loadAverages maintains the 1, 5 and 15 minute load averages of the server
+// counters. It is only accessed by the $SYS topic publisher.
+type loadAverages struct {
+	last     time.Time                      // the time of the last update.
+	averages map[string]*system.LoadAverage // load averages keyed on loadCounters path.
+}
+
+// newLoadAverages returns a new instance of loadAverages, using the current
+// values of the system info counters as the baseline.
+func newLoadAverages(info *system.Info, now time.Time) *loadAverages {
+	l := &loadAverages{
+		last:     now,
+		averages: make(map[string]*system.LoadAverage, len(loadCounters)),
+	}
+
+	for path, counter := range loadCounters {
+		l.averages[path] = system.NewLoadAverage(atomic.LoadInt64(counter(info)))
+	}
+
+	return l
+}
+
+// update samples the system info counters into the load averages.
+func (l *loadAverages) update(info *system.Info, now time.Time) {
+	elapsed := now.Sub(l.last)
+	l.last = now
+	for path, counter := range loadCounters {
+		l.averages[path].Update(atomic.LoadInt64(counter(info)), elapsed)
+	}
+}
+
+// topics adds the load average $SYS topics and values to a map.
+func (l *loadAverages) topics(topics map[string]string) {
+	for path, avg := range l.averages {
+		prefix := "$SYS/broker/load/" + path
+		topics[prefix+"/1min"] = formatLoad(avg.Min1.Rate())
+		topics[prefix+"/5min"] = formatLoad(avg.Min5.Rate())
+		topics[prefix+"/15min"] = formatLoad(avg.Min15.Rate())
+	}
+}
+
+// formatLoad formats a load average rate to two decimal places.
+func formatLoad(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+// runtimeTopics adds the go runtime memory, goroutine and garbage collection
+// $SYS topics and values to a map.
+func runtimeTopics(topics map[string]string) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	var lastPause uint64
+	if m.NumGC > 0 {
+		lastPause = m.PauseNs[(m.NumGC+255)%256]
+	}
+
+	topics["$SYS/broker/runtime/goroutines"] = strconv.Itoa(runtime.NumGoroutine())
+	topics["$SYS/broker/runtime/heap/alloc"] = strconv.FormatUint(m.HeapAlloc, 10)
+	topics["$SYS/broker/runtime/heap/inuse"] = strconv.FormatUint(m.HeapInuse, 10)
+	topics["$SYS/broker/runtime/heap/sys"] = strconv.FormatUint(m.HeapSys, 10)
+	topics["$SYS/broker/runtime/heap/objects"] = strconv.FormatUint(m.HeapObjects, 10)
+	topics["$SYS/broker/runtime/memory/sys"] = strconv.FormatUint(m.Sys, 10)
+	topics["$SYS/broker/runtime/gc/count"] = strconv.FormatUint(uint64(m.NumGC), 10)
+	topics["$SYS/broker/runtime/gc/pause/total"] = strconv.FormatUint(m.PauseTotalNs, 10)
+	topics["$SYS/broker/runtime/gc/pause/last"] = strconv.FormatUint(lastPause, 10)
+	topics["$SYS/broker/runtime/gc/next"] = strconv.FormatUint(m.NextGC, 10)
+}
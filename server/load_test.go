@@ -0,0 +1,103 @@
+package server
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-co/mqtt/server/persistence"
+	"github.com/mochi-co/mqtt/server/system"
+)
+
+func TestNewLoadAverages(t *testing.T) {
+	now := time.Now()
+	l := newLoadAverages(&system.Info{MessagesRecv: 10}, now)
+	require.Equal(t, now, l.last)
+	require.Len(t, l.averages, len(loadCounters))
+}
+
+func TestLoadAveragesUpdate(t *testing.T) {
+	now := time.Now()
+	info := &system.Info{MessagesRecv: 10}
+	l := newLoadAverages(info, now)
+
+	info.MessagesRecv = 70
+	info.SocketsTotal = 30
+	l.update(info, now.Add(time.Minute))
+	require.Equal(t, now.Add(time.Minute), l.last)
+	require.InDelta(t, 37.93, l.averages["messages/received"].Min1.Rate(), 0.01)
+	require.InDelta(t, 18.96, l.averages["sockets"].Min1.Rate(), 0.01)
+	require.Equal(t, 0.0, l.averages["bytes/sent"].Min1.Rate())
+}
+
+func TestLoadAveragesTopics(t *testing.T) {
+	now := time.Now()
+	info := new(system.Info)
+	l := newLoadAverages(info, now)
+	info.PublishSent = 60
+	l.update(info, now.Add(time.Minute))
+
+	topics := make(map[string]string)
+	l.topics(topics)
+	require.Len(t, topics, len(loadCounters)*3)
+	require.Equal(t, "37.93", topics["$SYS/broker/load/publish/sent/1min"])
+	require.Equal(t, "10.88", topics["$SYS/broker/load/publish/sent/5min"])
+	require.Equal(t, "3.87", topics["$SYS/broker/load/publish/sent/15min"])
+	require.Equal(t, "0.00", topics["$SYS/broker/load/connections/1min"])
+}
+
+func TestRuntimeTopics(t *testing.T) {
+	topics := make(map[string]string)
+	runtimeTopics(topics)
+
+	for _, topic := range []string{
+		"$SYS/broker/runtime/goroutines",
+		"$SYS/broker/runtime/heap/alloc",
+		"$SYS/broker/runtime/heap/inuse",
+		"$SYS/broker/runtime/heap/sys",
+		"$SYS/broker/runtime/heap/objects",
+		"$SYS/broker/runtime/memory/sys",
+		"$SYS/broker/runtime/gc/count",
+		"$SYS/broker/runtime/gc/pause/total",
+		"$SYS/broker/runtime/gc/pause/last",
+		"$SYS/broker/runtime/gc/next",
+	} {
+		v, ok := topics[topic]
+		require.True(t, ok, topic)
+		_, err := strconv.ParseUint(v, 10, 64)
+		require.NoError(t, err, topic)
+	}
+
+	n, _ := strconv.Atoi(topics["$SYS/broker/runtime/goroutines"])
+	require.True(t, n > 0)
+}
+
+func TestServerPublishSysTopicsLoad(t *testing.T) {
+	s := New()
+	s.load.last = s.load.last.Add(-time.Minute)
+	s.System.MessagesRecv = 60
+
+	s.publishSysTopics()
+
+	msgs := s.Topics.Messages("$SYS/broker/load/messages/received/1min")
+	require.Len(t, msgs, 1)
+	v, err := strconv.ParseFloat(string(msgs[0].Payload), 64)
+	require.NoError(t, err)
+	require.InDelta(t, 37.93, v, 0.1)
+
+	require.Len(t, s.Topics.Messages("$SYS/broker/runtime/goroutines"), 1)
+}
+
+func TestServerLoadServerInfoResetsLoad(t *testing.T) {
+	s := New()
+	s.loadServerInfo(persistence.ServerInfo{
+		Info: system.Info{
+			MessagesRecv: 1000,
+		},
+	})
+
+	s.load.update(s.System, s.load.last.Add(time.Minute))
+	require.Equal(t, 0.0, s.load.averages["messages/received"].Min1.Rate())
+}
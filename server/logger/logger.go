@@ -0,0 +1,190 @@
+// package logger provides a structured, levelled logging interface for the
+// server and its components.
+package logger
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// Level is the severity of a log entry. The values match those of log/slog.
+type Level int
+
+const (
+	LevelDebug Level = -4 // detailed diagnostic information.
+	LevelInfo  Level = 0  // general operational information.
+	LevelWarn  Level = 4  // recoverable problems which may need attention.
+	LevelError Level = 8  // failures which could not be handled.
+)
+
+// String returns the name of the log level.
+func (l Level) String() string {
+	switch {
+	case l >= LevelError:
+		return "ERROR"
+	case l >= LevelWarn:
+		return "WARN"
+	case l >= LevelInfo:
+		return "INFO"
+	default:
+		return "DEBUG"
+	}
+}
+
+// Logger is an interface for structured loggers. Each method receives a message
+// and a list of alternating key-value pairs, such as "client_id", "abc". The method
+// signatures match those of *slog.Logger, so a slog logger may be used directly.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// Loggable is implemented by components which can receive a logger, such as
+// listeners and persistent stores. The server passes its logger to any listener
+// or store which satisfies the interface.
+type Loggable interface {
+	SetLogger(l Logger)
+}
+
+// Nop is a logger which discards all log entries. It is the default logger.
+type Nop struct{}
+
+// Debug discards a debug log entry.
+func (*Nop) Debug(msg string, args ...interface{}) {}
+
+// Info discards an info log entry.
+func (*Nop) Info(msg string, args ...interface{}) {}
+
+// Warn discards a warn log entry.
+func (*Nop) Warn(msg string, args ...interface{}) {}
+
+// Error discards an error log entry.
+func (*Nop) Error(msg string, args ...interface{}) {}
+
+// Std is a logger which writes entries as key=value lines to a standard
+// library *log.Logger, discarding any entries below the minimum level.
+type Std struct {
+	out   *log.Logger // the destination logger.
+	level Level       // the minimum level to write.
+}
+
+// NewStd returns a new Std logger writing to l. If l is nil, the standard
+// library default logger is used.
+func NewStd(l *log.Logger, level Level) *Std {
+	if l == nil {
+		l = log.Default()
+	}
+
+	return &Std{
+		out:   l,
+		level: level,
+	}
+}
+
+// Debug writes a debug log entry.
+func (l *Std) Debug(msg string, args ...interface{}) {
+	l.write(LevelDebug, msg, args)
+}
+
+// Info writes an info log entry.
+func (l *Std) Info(msg string, args ...interface{}) {
+	l.write(LevelInfo, msg, args)
+}
+
+// Warn writes a warn log entry.
+func (l *Std) Warn(msg string, args ...interface{}) {
+	l.write(LevelWarn, msg, args)
+}
+
+// Error writes an error log entry.
+func (l *Std) Error(msg string, args ...interface{}) {
+	l.write(LevelError, msg, args)
+}
+
+// write formats and writes a log entry if the level is enabled.
+func (l *Std) write(level Level, msg string, args []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		b.WriteByte(' ')
+		if i+1 == len(args) {
+			fmt.Fprintf(&b, "!BADKEY=%v", args[i])
+			break
+		}
+		fmt.Fprintf(&b, "%v=%v", args[i], args[i+1])
+	}
+
+	l.out.Print(b.String())
+}
+
+// Entry is a single log entry captured by the Mock logger.
+type Entry struct {
+	Level Level         // the level of the entry.
+	Msg   string        // the log message.
+	Args  []interface{} // the key-value pairs of the entry.
+}
+
+// Value returns the value for a key in the entry, if it exists.
+func (e Entry) Value(key string) (interface{}, bool) {
+	for i := 0; i+1 < len(e.Args); i += 2 {
+		if e.Args[i] == key {
+			return e.Args[i+1], true
+		}
+	}
+	return nil, false
+}
+
+// Mock is a logger which records all entries in memory, for use with testing.
+type Mock struct {
+	sync.Mutex
+	Entries []Entry // the recorded entries.
+}
+
+// Debug records a debug log entry.
+func (l *Mock) Debug(msg string, args ...interface{}) {
+	l.record(LevelDebug, msg, args)
+}
+
+// Info records an info log entry.
+func (l *Mock) Info(msg string, args ...interface{}) {
+	l.record(LevelInfo, msg, args)
+}
+
+// Warn records a warn log entry.
+func (l *Mock) Warn(msg string, args ...interface{}) {
+	l.record(LevelWarn, msg, args)
+}
+
+// Error records an error log entry.
+func (l *Mock) Error(msg string, args ...interface{}) {
+	l.record(LevelError, msg, args)
+}
+
+// record appends a log entry.
+func (l *Mock) record(level Level, msg string, args []interface{}) {
+	l.Lock()
+	l.Entries = append(l.Entries, Entry{Level: level, Msg: msg, Args: args})
+	l.Unlock()
+}
+
+// Find returns the first recorded entry with a message, if it exists.
+func (l *Mock) Find(msg string) (Entry, bool) {
+	l.Lock()
+	defer l.Unlock()
+	for _, e := range l.Entries {
+		if e.Msg == msg {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
@@ -0,0 +1,83 @@
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLevelString(t *testing.T) {
+	require.Equal(t, "DEBUG", LevelDebug.String())
+	require.Equal(t, "INFO", LevelInfo.String())
+	require.Equal(t, "WARN", LevelWarn.String())
+	require.Equal(t, "ERROR", LevelError.String())
+}
+
+func TestNop(t *testing.T) {
+	var l Logger = new(Nop)
+	l.Debug("test", "key", "value")
+	l.Info("test")
+	l.Warn("test")
+	l.Error("test")
+}
+
+func TestNewStd(t *testing.T) {
+	l := NewStd(nil, LevelInfo)
+	require.NotNil(t, l.out)
+	require.Equal(t, LevelInfo, l.level)
+}
+
+func TestStd(t *testing.T) {
+	buf := new(bytes.Buffer)
+	var l Logger = NewStd(log.New(buf, "", 0), LevelInfo)
+
+	l.Debug("hidden", "client_id", "mochi")
+	require.Empty(t, buf.String())
+
+	l.Info("client connected", "client_id", "mochi", "listener", "t1")
+	require.Equal(t, "INFO client connected client_id=mochi listener=t1\n", buf.String())
+	buf.Reset()
+
+	l.Warn("odd", "key")
+	require.Equal(t, "WARN odd !BADKEY=key\n", buf.String())
+	buf.Reset()
+
+	l.Error("failed", "error", errors.New("test"))
+	require.Equal(t, "ERROR failed error=test\n", buf.String())
+}
+
+func BenchmarkStd(b *testing.B) {
+	l := NewStd(log.New(new(bytes.Buffer), "", 0), LevelInfo)
+	for n := 0; n < b.N; n++ {
+		l.Info("client connected", "client_id", "mochi", "listener", "t1")
+	}
+}
+
+func TestMock(t *testing.T) {
+	l := new(Mock)
+	l.Debug("a", "client_id", "mochi")
+	l.Info("b")
+	l.Warn("c")
+	l.Error("d", "error", "test")
+	require.Len(t, l.Entries, 4)
+
+	e, ok := l.Find("a")
+	require.True(t, ok)
+	require.Equal(t, LevelDebug, e.Level)
+	v, ok := e.Value("client_id")
+	require.True(t, ok)
+	require.Equal(t, "mochi", v)
+
+	_, ok = e.Value("missing")
+	require.False(t, ok)
+
+	e, ok = l.Find("d")
+	require.True(t, ok)
+	require.Equal(t, LevelError, e.Level)
+
+	_, ok = l.Find("missing")
+	require.False(t, ok)
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"sync/atomic"
+
+	"github.com/mochi-co/mqtt/server/internal/packets"
+	"github.com/mochi-co/mqtt/server/metrics"
+)
+
+// serverMetrics contains broker metrics which are not part of system.Info.
+type serverMetrics struct {
+	packetsRecv     [16]int64          // the number of packets received, indexed by packet type.
+	packetsSent     [16]int64          // the number of packets sent, indexed by packet type.
+	hookErrors      int64              // the number of errors returned by event hooks.
+	storeErrors     int64              // the number of errors returned by the persistent store.
+	publishLatency  *metrics.Histogram // the time taken to process inbound publish packets.
+	deliveryLatency *metrics.Histogram // the time taken for qos messages to be acknowledged.
+}
+
+// newServerMetrics returns a new instance of serverMetrics.
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		publishLatency:  metrics.NewHistogram(),
+		deliveryLatency: metrics.NewHistogram(),
+	}
+}
+
+// packetTypes are the packet types exposed in the packet metrics, in order.
+var packetTypes = func() []byte {
+	types := make([]byte, 0, len(packets.Names))
+	for t := range packets.Names {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return types[i] < types[j]
+	})
+	return types
+}()
+
+// MetricsHandler returns an http.Handler which writes the broker metrics in the
+// Prometheus text exposition format. It is automatically provided to any listener
+// implementing listeners.MetricsServer, such as listeners.HTTPStats.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", metrics.ContentType)
+		mw := metrics.NewWriter(w)
+		s.writeMetrics(mw)
+		if err := mw.Flush(); err != nil {
+			s.Log.Warn("failed to write metrics", "error", err)
+		}
+	})
+}
+
+// writeMetrics writes all broker metrics to a metrics writer.
+func (s *Server) writeMetrics(w *metrics.Writer) {
+	metrics.WriteInfo(w, s.System)
+
+	name := metrics.Namespace + "listener_clients_connected"
+	w.Header(name, metrics.TypeGauge, "The number of clients connected to each listener.")
+	for _, l := range s.ListListeners() {
+		w.Sample(name, float64(l.Clients), "listener", l.ID)
+	}
+
+	name = metrics.Namespace + "packets_received_total"
+	w.Header(name, metrics.TypeCounter, "The total number of packets received, by packet type.")
+	for _, t := range packetTypes {
+		w.Sample(name, float64(atomic.LoadInt64(&s.metrics.packetsRecv[t])), "type", packets.Names[t])
+	}
+
+	name = metrics.Namespace + "packets_sent_total"
+	w.Header(name, metrics.TypeCounter, "The total number of packets sent, by packet type.")
+	for _, t := range packetTypes {
+		w.Sample(name, float64(atomic.LoadInt64(&s.metrics.packetsSent[t])), "type", packets.Names[t])
+	}
+
+	var maxInflight int
+	for _, cl := range s.Clients.GetAll() {
+		if n := cl.Inflight.Len(); n > maxInflight {
+			maxInflight = n
+		}
+	}
+	w.Gauge(metrics.Namespace+"client_inflight_max", "The largest number of inflight messages held by a single client.", float64(maxInflight))
+	w.Gauge(metrics.Namespace+"inline_queue_depth", "The number of directly published messages waiting to be delivered.", float64(len(s.inline.pub)))
+
+	w.Gauge(metrics.Namespace+"retained_bytes", "The total size of all retained message payloads in bytes.", float64(s.Topics.RetainedBytes()))
+
+	w.Counter(metrics.Namespace+"hook_errors_total", "The total number of errors returned by event hooks.", float64(atomic.LoadInt64(&s.metrics.hookErrors)))
+	w.Counter(metrics.Namespace+"store_errors_total", "The total number of errors returned by the persistent store.", float64(atomic.LoadInt64(&s.metrics.storeErrors)))
+
+	w.Histogram(metrics.Namespace+"publish_processing_seconds", "The time taken to process inbound publish packets and queue them to subscribers.", s.metrics.publishLatency)
+	w.Histogram(metrics.Namespace+"qos_delivery_seconds", "The time taken for qos messages to be acknowledged by clients.", s.metrics.deliveryLatency)
+}
@@ -0,0 +1,241 @@
+// package metrics provides a lightweight writer for the Prometheus text exposition
+// format, and a concurrency-safe histogram, without depending on a client library.
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mochi-co/mqtt/server/system"
+)
+
+const (
+	// ContentType is the content type of the Prometheus text exposition format.
+	ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+	// Namespace is the prefix applied to all broker metric names.
+	Namespace = "mochi_"
+)
+
+// Metric types used in the TYPE line of a metric family.
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+)
+
+// DefaultLatencyBuckets are histogram buckets in seconds suitable for measuring
+// message processing and delivery latency, from 100 microseconds to 10 seconds.
+var DefaultLatencyBuckets = []float64{
+	0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10,
+}
+
+// Histogram counts observed values into cumulative buckets. It is safe for
+// concurrent use.
+type Histogram struct {
+	sum     uint64    // the float64 bits of the sum of all observed values.
+	count   uint64    // the number of observed values.
+	counts  []uint64  // the number of values observed in each bucket, non-cumulative.
+	buckets []float64 // the sorted upper bounds of each bucket.
+}
+
+// NewHistogram returns a new histogram with the given bucket upper bounds. If no
+// buckets are given, DefaultLatencyBuckets are used.
+func NewHistogram(buckets ...float64) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+
+	b := make([]float64, len(buckets))
+	copy(b, buckets)
+	sort.Float64s(b)
+
+	return &Histogram{
+		buckets: b,
+		counts:  make([]uint64, len(b)),
+	}
+}
+
+// Observe adds a value to the histogram.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.buckets) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sum, old, sum) {
+			break
+		}
+	}
+
+	atomic.AddUint64(&h.count, 1)
+}
+
+// Count returns the number of observed values.
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+// Sum returns the sum of all observed values.
+func (h *Histogram) Sum() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&h.sum))
+}
+
+// Writer writes metric families in the Prometheus text exposition format.
+// The first write error is retained and returned by Flush.
+type Writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+// NewWriter returns a new Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w: bufio.NewWriter(w),
+	}
+}
+
+// Header writes the HELP and TYPE lines of a metric family.
+func (w *Writer) Header(name, typ, help string) {
+	w.write("# HELP " + name + " " + escapeHelp(help) + "\n")
+	w.write("# TYPE " + name + " " + typ + "\n")
+}
+
+// Sample writes a single sample of a metric. Labels are given as alternating
+// name and value pairs.
+func (w *Writer) Sample(name string, v float64, labels ...string) {
+	w.write(name + formatLabels(labels) + " " + formatFloat(v) + "\n")
+}
+
+// Counter writes a complete counter metric family with a single sample.
+func (w *Writer) Counter(name, help string, v float64) {
+	w.Header(name, TypeCounter, help)
+	w.Sample(name, v)
+}
+
+// Gauge writes a complete gauge metric family with a single sample.
+func (w *Writer) Gauge(name, help string, v float64) {
+	w.Header(name, TypeGauge, help)
+	w.Sample(name, v)
+}
+
+// Histogram writes a complete histogram metric family.
+func (w *Writer) Histogram(name, help string, h *Histogram) {
+	w.Header(name, TypeHistogram, help)
+
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		w.Sample(name+"_bucket", float64(cumulative), "le", formatFloat(le))
+	}
+
+	count := h.Count()
+	w.Sample(name+"_bucket", float64(count), "le", "+Inf")
+	w.Sample(name+"_sum", h.Sum())
+	w.Sample(name+"_count", float64(count))
+}
+
+// Flush writes any buffered data to the underlying writer, returning the first
+// error encountered while writing.
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+
+	return w.w.Flush()
+}
+
+// write writes a string to the buffer if no previous error has occurred.
+func (w *Writer) write(s string) {
+	if w.err != nil {
+		return
+	}
+
+	_, w.err = w.w.WriteString(s)
+}
+
+// WriteInfo writes every counter and value of a system.Info as metric families.
+func WriteInfo(w *Writer, info *system.Info) {
+	w.Header(Namespace+"info", TypeGauge, "Information about the broker.")
+	w.Sample(Namespace+"info", 1, "version", info.Version)
+
+	w.Gauge(Namespace+"started_timestamp_seconds", "The time the broker started in unix seconds.", load(&info.Started))
+	w.Gauge(Namespace+"uptime_seconds", "The number of seconds the broker has been online.", load(&info.Uptime))
+	w.Counter(Namespace+"bytes_received_total", "The total number of bytes received in all packets.", load(&info.BytesRecv))
+	w.Counter(Namespace+"bytes_sent_total", "The total number of bytes sent to clients.", load(&info.BytesSent))
+	w.Gauge(Namespace+"clients_connected", "The number of currently connected clients.", load(&info.ClientsConnected))
+	w.Gauge(Namespace+"clients_disconnected", "The number of disconnected persistent session clients.", load(&info.ClientsDisconnected))
+	w.Gauge(Namespace+"clients_max", "The maximum number of clients that have been concurrently connected.", load(&info.ClientsMax))
+	w.Gauge(Namespace+"clients", "The number of known clients, connected and disconnected.", load(&info.ClientsTotal))
+	w.Counter(Namespace+"connections_total", "The total number of client connections.", load(&info.ConnectionsTotal))
+	w.Counter(Namespace+"sockets_total", "The total number of network connections accepted, including failed attempts.", load(&info.SocketsTotal))
+	w.Counter(Namespace+"connections_rejected_total", "The total number of connections rejected because a listener or the server was at its maximum connections.", load(&info.ConnectionsRejected))
+	w.Counter(Namespace+"connections_rate_limited_total", "The total number of connections rejected because a listener was over its accept rate.", load(&info.ConnectionsRateLimited))
+	w.Counter(Namespace+"connections_ip_limited_total", "The total number of connections rejected because their source address was at its maximum connections.", load(&info.ConnectionsIPLimited))
+	w.Counter(Namespace+"messages_received_total", "The total number of packets received.", load(&info.MessagesRecv))
+	w.Counter(Namespace+"messages_sent_total", "The total number of packets sent.", load(&info.MessagesSent))
+	w.Counter(Namespace+"publish_dropped_total", "The total number of inflight publish messages which were dropped.", load(&info.PublishDropped))
+	w.Counter(Namespace+"publish_received_total", "The total number of publish packets received.", load(&info.PublishRecv))
+	w.Counter(Namespace+"publish_sent_total", "The total number of publish packets sent.", load(&info.PublishSent))
+	w.Gauge(Namespace+"retained_messages", "The number of messages currently retained.", load(&info.Retained))
+	w.Gauge(Namespace+"inflight_messages", "The number of messages currently inflight.", load(&info.Inflight))
+	w.Gauge(Namespace+"subscriptions", "The number of filter subscriptions.", load(&info.Subscriptions))
+}
+
+// load atomically loads an int64 counter as a float64.
+func load(v *int64) float64 {
+	return float64(atomic.LoadInt64(v))
+}
+
+// formatFloat formats a sample value.
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// formatLabels formats alternating label name and value pairs. A trailing name
+// without a value is ignored.
+func formatLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(labels[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+// labelEscaper escapes label values.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// escapeHelp escapes the text of a HELP line.
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,165 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mochi-co/mqtt/server/system"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewHistogram(t *testing.T) {
+	h := NewHistogram(1, 0.5, 2)
+	require.Equal(t, []float64{0.5, 1, 2}, h.buckets)
+	require.Len(t, h.counts, 3)
+
+	h = NewHistogram()
+	require.Equal(t, DefaultLatencyBuckets, h.buckets)
+}
+
+func TestHistogramObserve(t *testing.T) {
+	h := NewHistogram(1, 2)
+	h.Observe(0.5)
+	h.Observe(1)
+	h.Observe(1.5)
+	h.Observe(3)
+
+	require.Equal(t, []uint64{2, 1}, h.counts)
+	require.Equal(t, uint64(4), h.Count())
+	require.Equal(t, 6.0, h.Sum())
+}
+
+func TestHistogramObserveConcurrent(t *testing.T) {
+	h := NewHistogram()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				h.Observe(0.25)
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, uint64(1000), h.Count())
+	require.Equal(t, 250.0, h.Sum())
+}
+
+func BenchmarkHistogramObserve(b *testing.B) {
+	h := NewHistogram()
+	for n := 0; n < b.N; n++ {
+		h.Observe(0.003)
+	}
+}
+
+func TestWriterCounter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Counter("mochi_test_total", "A test\\counter.\nSecond line.", 3)
+	require.NoError(t, w.Flush())
+	require.Equal(t, "# HELP mochi_test_total A test\\\\counter.\\nSecond line.\n"+
+		"# TYPE mochi_test_total counter\n"+
+		"mochi_test_total 3\n", buf.String())
+}
+
+func TestWriterGauge(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Gauge("mochi_test", "A test gauge.", 1.5)
+	require.NoError(t, w.Flush())
+	require.Equal(t, "# HELP mochi_test A test gauge.\n"+
+		"# TYPE mochi_test gauge\n"+
+		"mochi_test 1.5\n", buf.String())
+}
+
+func TestWriterSampleLabels(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Sample("mochi_test", 1, "a", "b", "c", "d\"e\\f\ng")
+	w.Sample("mochi_test", 2, "dangling")
+	require.NoError(t, w.Flush())
+	require.Equal(t, `mochi_test{a="b",c="d\"e\\f\ng"} 1`+"\n"+
+		"mochi_test 2\n", buf.String())
+}
+
+func TestWriterHistogram(t *testing.T) {
+	h := NewHistogram(0.1, 1)
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Histogram("mochi_latency_seconds", "Latency.", h)
+	require.NoError(t, w.Flush())
+	require.Equal(t, "# HELP mochi_latency_seconds Latency.\n"+
+		"# TYPE mochi_latency_seconds histogram\n"+
+		`mochi_latency_seconds_bucket{le="0.1"} 1`+"\n"+
+		`mochi_latency_seconds_bucket{le="1"} 2`+"\n"+
+		`mochi_latency_seconds_bucket{le="+Inf"} 3`+"\n"+
+		"mochi_latency_seconds_sum 5.55\n"+
+		"mochi_latency_seconds_count 3\n", buf.String())
+}
+
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("test")
+}
+
+func TestWriterFlushError(t *testing.T) {
+	w := NewWriter(errWriter{})
+	w.Gauge("mochi_test", "A test gauge.", 1)
+	require.Error(t, w.Flush())
+
+	w = NewWriter(errWriter{})
+	w.write(strings.Repeat("a", 8192)) // exceed the buffer to fail early.
+	w.Gauge("mochi_test", "A test gauge.", 1)
+	require.Error(t, w.Flush())
+}
+
+func TestFormatFloat(t *testing.T) {
+	require.Equal(t, "+Inf", formatFloat(math.Inf(1)))
+	require.Equal(t, "-Inf", formatFloat(math.Inf(-1)))
+	require.Equal(t, "NaN", formatFloat(math.NaN()))
+	require.Equal(t, "1e+06", formatFloat(1000000))
+	require.Equal(t, "0.25", formatFloat(0.25))
+}
+
+func TestWriteInfo(t *testing.T) {
+	info := &system.Info{
+		Version:                "1.2.3",
+		BytesRecv:              10,
+		ClientsConnected:       2,
+		Subscriptions:          4,
+		ConnectionsRateLimited: 3,
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	WriteInfo(w, info)
+	require.NoError(t, w.Flush())
+
+	out := buf.String()
+	require.Contains(t, out, `mochi_info{version="1.2.3"} 1`+"\n")
+	require.Contains(t, out, "# TYPE mochi_bytes_received_total counter\nmochi_bytes_received_total 10\n")
+	require.Contains(t, out, "# TYPE mochi_clients_connected gauge\nmochi_clients_connected 2\n")
+	require.Contains(t, out, "mochi_subscriptions 4\n")
+	require.Contains(t, out, "# TYPE mochi_connections_rate_limited_total counter\nmochi_connections_rate_limited_total 3\n")
+	require.Equal(t, 22, strings.Count(out, "# TYPE "))
+}
+
+func BenchmarkWriteInfo(b *testing.B) {
+	info := new(system.Info)
+	for n := 0; n < b.N; n++ {
+		w := NewWriter(new(bytes.Buffer))
+		WriteInfo(w, info)
+		w.Flush()
+	}
+}
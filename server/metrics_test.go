@@ -0,0 +1,164 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-co/mqtt/server/events"
+	"github.com/mochi-co/mqtt/server/internal/clients"
+	"github.com/mochi-co/mqtt/server/internal/packets"
+	"github.com/mochi-co/mqtt/server/listeners"
+	"github.com/mochi-co/mqtt/server/persistence"
+)
+
+func TestServerMetricsHandler(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.Listener = "t1"
+	cl.Inflight.Set(1, clients.InflightMessage{Packet: packets.Packet{PacketID: 1}})
+	cl.Inflight.Set(2, clients.InflightMessage{Packet: packets.Packet{PacketID: 2}})
+	s.Clients.Add(cl)
+	s.Listeners.Add(listeners.NewMockListener("t1", ":1882"))
+	require.NoError(t, s.SetRetained("a/b", []byte("hello")))
+	s.System.Version = "test"
+
+	w := httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+
+	out := w.Body.String()
+	require.Contains(t, out, `mochi_info{version="test"} 1`+"\n")
+	require.Contains(t, out, "mochi_retained_messages 1\n")
+	require.Contains(t, out, `mochi_listener_clients_connected{listener="t1"} 1`+"\n")
+	require.Contains(t, out, `mochi_packets_received_total{type="PUBLISH"} 0`+"\n")
+	require.Contains(t, out, `mochi_packets_sent_total{type="CONNACK"} 0`+"\n")
+	require.Contains(t, out, "mochi_client_inflight_max 2\n")
+	require.Contains(t, out, "mochi_inline_queue_depth 0\n")
+	require.Contains(t, out, "mochi_retained_bytes 5\n")
+	require.Contains(t, out, "mochi_hook_errors_total 0\n")
+	require.Contains(t, out, "mochi_store_errors_total 0\n")
+	require.Contains(t, out, "# TYPE mochi_publish_processing_seconds histogram\n")
+	require.Contains(t, out, "# TYPE mochi_qos_delivery_seconds histogram\n")
+}
+
+func TestServerMetricsPackets(t *testing.T) {
+	s, cl, r, w := setupClient()
+	s.Clients.Add(cl)
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Pingreq,
+		},
+	})
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+	<-recv
+
+	require.Equal(t, int64(1), s.metrics.packetsRecv[packets.Pingreq])
+	require.Equal(t, int64(1), s.metrics.packetsSent[packets.Pingresp])
+}
+
+func TestServerMetricsPublishLatency(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	s.Clients.Add(cl)
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: "a/b",
+		Payload:   []byte("hello"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), s.metrics.publishLatency.Count())
+}
+
+func TestServerMetricsDeliveryLatency(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	s.onQosComplete(cl, clients.InflightMessage{Sent: 1})
+	require.Equal(t, uint64(1), s.metrics.deliveryLatency.Count())
+
+	s.onQosComplete(cl, clients.InflightMessage{})
+	require.Equal(t, uint64(1), s.metrics.deliveryLatency.Count())
+}
+
+func TestServerMetricsHookErrors(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	s.Clients.Add(cl)
+	s.Events.OnProcessMessage = func(cl events.Client, pk events.Packet) (events.Packet, error) {
+		return pk, errors.New("test")
+	}
+	s.Events.OnPacketRead = func(cl events.Client, pk events.Packet, n int) error {
+		if pk.FixedHeader.Type == packets.Pingreq {
+			return ErrRejectPacket
+		}
+		return nil
+	}
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: "a/b",
+		Payload:   []byte("hello"),
+	})
+	require.NoError(t, err)
+
+	err = s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Pingreq,
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), s.metrics.hookErrors)
+}
+
+func TestServerMetricsStoreErrors(t *testing.T) {
+	s := New()
+	s.Store = &persistence.MockStore{
+		Fail: map[string]bool{
+			"write_retained": true,
+		},
+	}
+
+	require.NoError(t, s.SetRetained("a/b", []byte("hello")))
+	require.Equal(t, int64(1), s.metrics.storeErrors)
+}
+
+// metricsListener is a mock listener which implements listeners.MetricsServer.
+type metricsListener struct {
+	*listeners.MockListener
+	handler http.Handler
+}
+
+func (l *metricsListener) SetMetricsHandler(h http.Handler) {
+	l.handler = h
+}
+
+func TestServerAddListenerMetricsHandler(t *testing.T) {
+	s := New()
+	l := &metricsListener{MockListener: listeners.NewMockListener("t1", ":1882")}
+	err := s.AddListener(l, nil)
+	require.NoError(t, err)
+	require.NotNil(t, l.handler)
+
+	w := httptest.NewRecorder()
+	l.handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Contains(t, w.Body.String(), "mochi_packets_received_total")
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/asdine/storm/v3"
 	"go.etcd.io/bbolt"
 
+	"github.com/mochi-co/mqtt/server/logger"
 	"github.com/mochi-co/mqtt/server/persistence"
 )
 
@@ -30,6 +31,7 @@ type Store struct {
 	path        string         // the path on which to store the db file.
 	opts        *bbolt.Options // options for configuring the boltdb instance.
 	db          *storm.DB      // the boltdb instance.
+	log         logger.Logger  // a logger for storage events.
 	inflightTTL int64          // the number of seconds an inflight message should be retained before being dropped.
 }
 
@@ -48,9 +50,16 @@ func New(path string, opts *bbolt.Options) *Store {
 	return &Store{
 		path: path,
 		opts: opts,
+		log:  new(logger.Nop),
 	}
 }
 
+// SetLogger sets the logger used by the store. Unless you have a good reason,
+// you should allow this to be called by the server (in AddStore) instead of directly.
+func (s *Store) SetLogger(log logger.Logger) {
+	s.log = log
+}
+
 // SetInflightTTL sets the number of seconds an inflight message should be kept
 // before being dropped, in the event it is not delivered. Unless you have a good reason,
 // you should allow this to be called by the server (in AddStore) instead of directly.
@@ -63,15 +72,21 @@ func (s *Store) Open() error {
 	var err error
 	s.db, err = storm.Open(s.path, storm.BoltOptions(0600, s.opts), storm.Codec(sgob.Codec))
 	if err != nil {
+		s.log.Error("failed to open bolt store", "path", s.path, "error", err)
 		return err
 	}
 
+	s.log.Debug("bolt store opened", "path", s.path)
+
 	return nil
 }
 
 // Close closes the boltdb instance.
 func (s *Store) Close() {
-	s.db.Close()
+	err := s.db.Close()
+	if err != nil {
+		s.log.Warn("failed to close bolt store", "path", s.path, "error", err)
+	}
 }
 
 // WriteServerInfo writes the server info to the boltdb instance.
@@ -285,14 +300,20 @@ func (s *Store) ClearExpiredInflight(expiry int64) error {
 		return err
 	}
 
+	var deleted int
 	for _, m := range v {
 		if m.Created < expiry || m.Created == 0 {
 			err := s.db.DeleteStruct(&persistence.Message{ID: m.ID})
 			if err != nil {
 				return err
 			}
+			deleted++
 		}
 	}
 
+	if deleted > 0 {
+		s.log.Debug("cleared expired inflight messages", "count", deleted)
+	}
+
 	return nil
 }
@@ -8,6 +8,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"go.etcd.io/bbolt"
 
+	"github.com/mochi-co/mqtt/server/logger"
 	"github.com/mochi-co/mqtt/server/persistence"
 	"github.com/mochi-co/mqtt/server/system"
 )
@@ -55,6 +56,14 @@ func TestSetInflightTTL(t *testing.T) {
 	require.Equal(t, int64(5), s.inflightTTL)
 }
 
+func TestSetLogger(t *testing.T) {
+	s := New("", nil)
+	var l logger.Loggable = s
+	log := new(logger.Mock)
+	l.SetLogger(log)
+	require.Equal(t, log, s.log)
+}
+
 func TestOpen(t *testing.T) {
 	s := New(tmpPath, nil)
 	err := s.Open()
@@ -65,8 +74,13 @@ func TestOpen(t *testing.T) {
 
 func TestOpenFailure(t *testing.T) {
 	s := New("..", nil)
+	log := new(logger.Mock)
+	s.SetLogger(log)
 	err := s.Open()
 	require.Error(t, err)
+
+	_, ok := log.Find("failed to open bolt store")
+	require.True(t, ok)
 }
 
 func TestWriteAndRetrieveServerInfo(t *testing.T) {
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -18,6 +19,7 @@ import (
 	"github.com/mochi-co/mqtt/server/internal/utils"
 	"github.com/mochi-co/mqtt/server/listeners"
 	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/logger"
 	"github.com/mochi-co/mqtt/server/persistence"
 	"github.com/mochi-co/mqtt/server/system"
 )
@@ -34,6 +36,10 @@ var (
 	// ErrListenerIDExists indicates that a listener with the same id already exists.
 	ErrListenerIDExists = errors.New("listener id already exists")
 
+	// ErrInvalidMigrationTarget indicates that clients could not be migrated to
+	// a listener because it does not exist or is the listener being removed.
+	ErrInvalidMigrationTarget = errors.New("invalid listener migration target")
+
 	// ErrReadConnectInvalid indicates that the connection packet was invalid.
 	ErrReadConnectInvalid = errors.New("connect packet was not valid")
 
@@ -62,6 +68,30 @@ var (
 	// ErrConnectionFailed indicates that a client connection attempt failed for other reasons.
 	ErrConnectionFailed = errors.New("connection attempt failed")
 
+	// ErrInflightRetriesExhausted indicates that an inflight message was dropped because
+	// the maximum number of resend attempts was reached.
+	ErrInflightRetriesExhausted = errors.New("inflight message resends exhausted")
+
+	// ErrInflightExpired indicates that an inflight message was dropped because it
+	// existed for longer than the inflight TTL.
+	ErrInflightExpired = errors.New("inflight message expired")
+
+	// ErrInflightQueueFull indicates that a message was dropped because the client
+	// already had the maximum number of inflight messages queued.
+	ErrInflightQueueFull = errors.New("inflight message queue full")
+
+	// ErrCredentialsExpired indicates that a client was disconnected because
+	// the credentials it connected with have expired.
+	ErrCredentialsExpired = errors.New("client credentials expired")
+
+	// ErrMaxConnections indicates that a client was refused because the server
+	// had reached its maximum number of connections.
+	ErrMaxConnections = errors.New("server connection limit reached")
+
+	// ErrClientIDMismatch indicates that a client connected with a client id
+	// which does not match the identity of its certificate.
+	ErrClientIDMismatch = errors.New("client id does not match certificate identity")
+
 	// SysTopicInterval is the number of milliseconds between $SYS topic publishes.
 	SysTopicInterval time.Duration = 30000
 
@@ -76,7 +106,9 @@ var (
 // Server is an MQTT broker server. It should be created with server.New()
 // in order to ensure all the internal fields are correctly populated.
 type Server struct {
+	connections          int64                // the number of connections being established or connected; first for atomic alignment.
 	inline               inlineMessages       // channels for direct publishing.
+	inspect              packetInspection     // client ids which trigger the packet event hooks.
 	Events               events.Events        // overrideable event hooks.
 	Store                persistence.Store    // a persistent storage backend if desired.
 	Options              *Options             // configurable server options.
@@ -84,6 +116,15 @@ type Server struct {
 	Clients              *clients.Clients     // clients which are known to the broker.
 	Topics               *topics.Index        // an index of topic filter subscriptions and retained messages.
 	System               *system.Info         // values about the server commonly found in $SYS topics.
+	Log                  logger.Logger        // a structured logger for server events.
+	metrics              *serverMetrics       // counters and histograms exposed by the metrics handler.
+	listenerStats        *listenerStatsIndex  // aggregate traffic counters for each listener.
+	load                 *loadAverages        // load averages of the system info counters.
+	gateway              *gatewayStreams      // http clients streaming messages from the gateway.
+	owners               *listenerOwners      // the listeners which took over the clients of removed listeners.
+	revocations          *listenerRevocations // unregisters the revocation reload functions of listeners.
+	serving              bool                 // true once the listeners have been served.
+	servingMu            sync.Mutex           // serialises adding listeners with serving them.
 	bytepool             *circ.BytesPool      // a byte pool for incoming and outgoing packets.
 	sysTicker            *time.Ticker         // the interval ticker for sending updating $SYS topics.
 	inflightExpiryTicker *time.Ticker         // the interval ticker for cleaning up expired messages.
@@ -101,6 +142,25 @@ type Options struct {
 
 	// InflightTTL specifies the duration that a queued inflight message should exist before being purged.
 	InflightTTL int64
+
+	// MaxInflight is the maximum number of outbound inflight messages which may be queued
+	// for a client. QoS messages beyond this limit are dropped. 0 is unlimited.
+	MaxInflight int
+
+	// MaxConnections is the maximum number of concurrent connections to the
+	// server across all listeners, including connections which have not yet
+	// sent a CONNECT packet. Connections over the limit are sent a server
+	// unavailable CONNACK and closed before their CONNECT is read. 0 is unlimited.
+	MaxConnections int
+
+	// ClientEvents enables the publishing of JSON client event messages to
+	// $SYS/brokers/clients/<clientid>/connected, disconnected, subscribed and
+	// unsubscribed. Subscribing to the events is subject to the normal ACLs.
+	ClientEvents bool
+
+	// Logger is a structured logger used by the server, clients, listeners and stores.
+	// A *slog.Logger satisfies the interface. If nil, nothing is logged.
+	Logger logger.Logger
 }
 
 // inlineMessages contains channels for handling inline (direct) publishing.
@@ -109,6 +169,13 @@ type inlineMessages struct {
 	pub  chan packets.Packet // a channel of packets to publish to clients
 }
 
+// packetInspection contains the client ids for which the OnPacketRead and
+// OnPacketSent event hooks should be triggered.
+type packetInspection struct {
+	sync.RWMutex
+	clients map[string]bool // enabled client ids; if nil, all clients are inspected.
+}
+
 // New returns a new instance of MQTT server with no options.
 // This method has been deprecated and will be removed in a future release.
 // Please use NewServer instead.
@@ -126,6 +193,10 @@ func NewServer(opts *Options) *Server {
 		opts.InflightTTL = defaultInflightTTL
 	}
 
+	if opts.Logger == nil {
+		opts.Logger = new(logger.Nop)
+	}
+
 	s := &Server{
 		done:     make(chan bool),
 		bytepool: circ.NewBytesPool(opts.BufferSize),
@@ -142,10 +213,18 @@ func NewServer(opts *Options) *Server {
 			done: make(chan bool),
 			pub:  make(chan packets.Packet, 4096),
 		},
-		Events:  events.Events{},
-		Options: opts,
+		Events:        events.Events{},
+		Options:       opts,
+		Log:           opts.Logger,
+		metrics:       newServerMetrics(),
+		listenerStats: newListenerStatsIndex(),
+		gateway:       newGatewayStreams(),
+		owners:        newListenerOwners(),
+		revocations:   newListenerRevocations(),
 	}
 
+	s.load = newLoadAverages(s.System, time.Now())
+
 	// Expose server stats using the system listener so it can be used in the
 	// dashboard and other more experimental listeners.
 	s.Listeners = listeners.New(s.System)
@@ -158,9 +237,13 @@ func NewServer(opts *Options) *Server {
 func (s *Server) AddStore(p persistence.Store) error {
 	s.Store = p
 	s.Store.SetInflightTTL(s.Options.InflightTTL)
+	if l, ok := p.(logger.Loggable); ok {
+		l.SetLogger(s.Log)
+	}
 
 	err := s.Store.Open()
 	if err != nil {
+		s.Log.Error("failed to open store", "error", err)
 		return err
 	}
 
@@ -169,37 +252,148 @@ func (s *Server) AddStore(p persistence.Store) error {
 
 // AddListener adds a new network listener to the server.
 func (s *Server) AddListener(listener listeners.Listener, config *listeners.Config) error {
+	if config != nil {
+		listener.SetConfig(config)
+	}
+
+	if l, ok := listener.(logger.Loggable); ok {
+		l.SetLogger(s.Log)
+	}
+
+	if l, ok := listener.(listeners.MetricsServer); ok {
+		l.SetMetricsHandler(s.MetricsHandler())
+	}
+
+	if l, ok := listener.(listeners.GatewayServer); ok {
+		l.SetGatewayHandler(s.GatewayHandler)
+	}
+
+	if l, ok := listener.(listeners.Publisher); ok {
+		l.SetPublisher(s.publishFrom)
+	}
+
+	s.servingMu.Lock()
+	defer s.servingMu.Unlock()
+
 	if _, ok := s.Listeners.Get(listener.ID()); ok {
 		return ErrListenerIDExists
 	}
 
-	if config != nil {
-		listener.SetConfig(config)
+	// Clients left over from a removed listener with the same id keep their
+	// owner, rather than being counted and closed with the new listener.
+	var stale []*clients.Client
+	for _, cl := range s.Clients.GetByListener(listener.ID()) {
+		if atomic.LoadUint32(&cl.State.Done) == 0 {
+			stale = append(stale, cl)
+		}
 	}
+	s.owners.pin(listener.ID(), stale)
 
 	s.Listeners.Add(listener)
-	err := listener.Listen(s.System)
+	err := s.Listeners.Listen(listener.ID())
 	if err != nil {
+		s.Listeners.Delete(listener.ID())
+		s.Log.Error("failed to start listener", "listener", listener.ID(), "error", err)
 		return err
 	}
 
+	if l, ok := listener.(listeners.RevocationChecker); ok {
+		lid := listener.ID()
+		for _, r := range l.Revokers() {
+			r := r
+			s.revocations.add(lid, r.OnReload(func() {
+				s.disconnectRevoked(lid, r)
+			}))
+		}
+	}
+
+	// Listeners added after the server has started are served immediately.
+	if s.serving {
+		s.Listeners.Serve(listener.ID(), s.EstablishConnection)
+	}
+
+	s.Log.Info("listener added", "listener", listener.ID())
+
 	return nil
 }
 
+// RemoveListener closes a listener and removes it from the server. If migrateTo
+// is the id of another listener, the connected clients of the removed listener
+// are kept connected and are owned by that listener from then on. Otherwise they
+// are disconnected. Clients which cannot outlive their listener, such as those
+// of an MQTT-SN gateway, are disconnected either way.
+func (s *Server) RemoveListener(id, migrateTo string) error {
+	if _, ok := s.Listeners.Get(id); !ok {
+		return listeners.ErrListenerNotFound
+	}
+
+	closer := s.closeListenerClients
+	if migrateTo != "" {
+		if _, ok := s.Listeners.Get(migrateTo); !ok || migrateTo == id {
+			return ErrInvalidMigrationTarget
+		}
+
+		closer = func(lid string) {
+			s.owners.migrate(lid, migrateTo)
+		}
+	}
+
+	err := s.Listeners.Remove(id, closer)
+	if err != nil {
+		return err
+	}
+
+	s.revocations.remove(id)
+
+	if migrateTo == "" {
+		s.owners.forget(id)
+	}
+
+	s.Log.Info("listener removed", "listener", id, "migrated_to", migrateTo)
+
+	return nil
+}
+
+// disconnectRevoked disconnects the clients of a listener which connected with
+// a certificate that has been revoked.
+func (s *Server) disconnectRevoked(lid string, r listeners.Revoker) {
+	for _, cl := range s.Clients.GetByListener(lid) {
+		if atomic.LoadUint32(&cl.State.Done) == 1 {
+			continue
+		}
+
+		for _, cert := range cl.PeerCertificates {
+			if r.Revoked(cert) {
+				s.Log.Warn("disconnecting client with revoked certificate", "client_id", cl.ID, "listener", lid, "serial", cert.SerialNumber.String())
+				cl.Stop(listeners.ErrCertificateRevoked)
+				break
+			}
+		}
+	}
+}
+
 // Serve starts the event loops responsible for establishing client connections
 // on all attached listeners, and publishing the system topics.
 func (s *Server) Serve() error {
 	if s.Store != nil {
 		err := s.readStore()
 		if err != nil {
+			s.Log.Error("failed to read store", "error", err)
 			return err
 		}
 	}
 
-	go s.eventLoop()                            // spin up event loop for issuing $SYS values and closing server.
-	go s.inlineClient()                         // spin up inline client for direct message publishing.
+	s.Log.Info("mochi mqtt server started", "version", Version)
+
+	go s.eventLoop()    // spin up event loop for issuing $SYS values and closing server.
+	go s.inlineClient() // spin up inline client for direct message publishing.
+
+	s.servingMu.Lock()
+	s.serving = true
 	s.Listeners.ServeAll(s.EstablishConnection) // start listening on all listeners.
-	s.publishSysTopics()                        // begin publishing $SYS system values.
+	s.servingMu.Unlock()
+
+	s.publishSysTopics() // begin publishing $SYS system values.
 
 	return nil
 }
@@ -268,9 +462,11 @@ func (s *Server) onError(cl events.Client, err error) error {
 	// below are ordinary consequences of closing the connection.
 	// If one of these ordinary conditions stops the connection,
 	// then the client closed or broke the connection.
-	if s.Events.OnError != nil &&
-		!errors.Is(err, io.EOF) {
-		s.Events.OnError(cl, err)
+	if !errors.Is(err, io.EOF) {
+		s.Log.Warn("client error", "client_id", cl.ID, "listener", cl.Listener, "remote", cl.Remote, "error", err)
+		if s.Events.OnError != nil {
+			s.Events.OnError(cl, err)
+		}
 	}
 
 	return err
@@ -283,12 +479,120 @@ func (s *Server) onStorage(cl events.Clientlike, err error) {
 		return
 	}
 
-	_ = s.onError(cl.Info(), fmt.Errorf("storage: %w", err))
+	atomic.AddInt64(&s.metrics.storeErrors, 1)
+	info := cl.Info()
+	s.Log.Error("storage error", "client_id", info.ID, "error", err)
+	if s.Events.OnError != nil {
+		s.Events.OnError(info, fmt.Errorf("storage: %w", err))
+	}
+}
+
+// onQosDropped is a pass-through method which triggers the OnQosDropped
+// event hook (if applicable) when an inflight message is abandoned.
+func (s *Server) onQosDropped(cl events.Clientlike, pk packets.Packet, reason error) {
+	s.Log.Warn("qos message dropped", "client_id", cl.Info().ID, "packet_id", pk.PacketID, "topic", pk.TopicName, "reason", reason)
+	if s.Events.OnQosDropped != nil {
+		s.Events.OnQosDropped(cl.Info(), events.Packet(pk), reason)
+	}
+}
+
+// onQosComplete is a pass-through method which triggers the OnQosComplete
+// event hook (if applicable) when an inflight message is acknowledged.
+func (s *Server) onQosComplete(cl *clients.Client, in clients.InflightMessage) {
+	var latency time.Duration
+	if in.SentNano > 0 {
+		latency = time.Since(time.Unix(0, in.SentNano))
+	} else if in.Sent > 0 {
+		latency = time.Since(time.Unix(in.Sent, 0))
+	}
+
+	if latency > 0 {
+		s.metrics.deliveryLatency.Observe(latency.Seconds())
+	}
+
+	if s.Events.OnQosComplete == nil {
+		return
+	}
+
+	s.Events.OnQosComplete(cl.Info(), in.Packet.PacketID, in.Packet.TopicName, latency)
+}
+
+// InspectPackets enables the OnPacketRead and OnPacketSent event hooks for the
+// given client ids. By default the hooks are triggered for every client, but once
+// any client id has been enabled they are only triggered for enabled clients.
+func (s *Server) InspectPackets(ids ...string) {
+	s.inspect.Lock()
+	defer s.inspect.Unlock()
+	if s.inspect.clients == nil {
+		s.inspect.clients = make(map[string]bool)
+	}
+
+	for _, id := range ids {
+		s.inspect.clients[id] = true
+	}
+}
+
+// UninspectPackets disables the OnPacketRead and OnPacketSent event hooks for
+// the given client ids. If no ids are given, the hooks are restored to trigger
+// for every client.
+func (s *Server) UninspectPackets(ids ...string) {
+	s.inspect.Lock()
+	defer s.inspect.Unlock()
+	if len(ids) == 0 {
+		s.inspect.clients = nil
+		return
+	}
+
+	for _, id := range ids {
+		delete(s.inspect.clients, id)
+	}
+}
+
+// inspecting returns true if the packet event hooks should be triggered for a client.
+func (s *Server) inspecting(cl *clients.Client) bool {
+	s.inspect.RLock()
+	defer s.inspect.RUnlock()
+	return s.inspect.clients == nil || s.inspect.clients[cl.ID]
+}
+
+// onPacketRead is a pass-through method which triggers the OnPacketRead
+// event hook (if applicable) for an inbound packet.
+func (s *Server) onPacketRead(cl *clients.Client, pk packets.Packet) error {
+	atomic.AddInt64(&s.metrics.packetsRecv[pk.FixedHeader.Type&0x0f], 1)
+	if s.Events.OnPacketRead == nil || !s.inspecting(cl) {
+		return nil
+	}
+
+	err := s.Events.OnPacketRead(cl.Info(), events.Packet(pk), pk.FixedHeader.Size())
+	if err != nil && !errors.Is(err, ErrRejectPacket) {
+		atomic.AddInt64(&s.metrics.hookErrors, 1)
+	}
+
+	if err != nil {
+		s.Log.Debug("packet rejected", "client_id", cl.ID, "packet_type", packets.Names[pk.FixedHeader.Type], "error", err)
+	}
+
+	return err
+}
+
+// onPacketSent is a pass-through method which triggers the OnPacketSent
+// event hook (if applicable) for an outbound packet.
+func (s *Server) onPacketSent(cl *clients.Client, pk packets.Packet, n int) {
+	atomic.AddInt64(&s.metrics.packetsSent[pk.FixedHeader.Type&0x0f], 1)
+	if s.Events.OnPacketSent == nil || !s.inspecting(cl) {
+		return
+	}
+
+	s.Events.OnPacketSent(cl.Info(), events.Packet(pk), n)
 }
 
 // EstablishConnection establishes a new client when a listener
 // accepts a new connection.
 func (s *Server) EstablishConnection(lid string, c net.Conn, ac auth.Controller) error {
+	atomic.AddInt64(&s.System.SocketsTotal, 1)
+	connections := atomic.AddInt64(&s.connections, 1)
+	defer atomic.AddInt64(&s.connections, -1)
+
 	xbr := s.bytepool.Get() // Get byte buffer from pools for receiving packet data.
 	xbw := s.bytepool.Get() // and for sending.
 	defer s.bytepool.Put(xbr)
@@ -299,11 +603,24 @@ func (s *Server) EstablishConnection(lid string, c net.Conn, ac auth.Controller)
 		circ.NewWriterFromSlice(s.Options.BufferBlockSize, xbw),
 		s.System,
 	)
+	cl.Log = s.Log
+	ls := s.listenerStats.Get(lid)
+	cl.ListenerStats = &ls.Stats
 
 	cl.Start()
 	defer cl.ClearBuffers()
 	defer cl.Stop(nil)
 
+	// Connections over the limit are refused before the connect packet is read,
+	// so they hold no resources while waiting for it.
+	if s.Options.MaxConnections > 0 && connections > int64(s.Options.MaxConnections) {
+		atomic.AddInt64(&s.System.ConnectionsRejected, 1)
+		if err := s.ackConnection(cl, packets.CodeConnectServerUnavailable, false); err != nil {
+			return s.onError(cl.Info(), fmt.Errorf("invalid connection send ack: %w", err))
+		}
+		return s.onError(cl.Info(), ErrMaxConnections)
+	}
+
 	pk, err := s.readConnectionPacket(cl)
 	if err != nil {
 		return s.onError(cl.Info(), fmt.Errorf("read connection: %w", err))
@@ -319,20 +636,52 @@ func (s *Server) EstablishConnection(lid string, c net.Conn, ac auth.Controller)
 
 	cl.Identify(lid, pk, ac) // Set client identity values from the connection packet.
 
-	if !ac.Authenticate(pk.Username, pk.Password) {
+	if code, err := s.mapIdentity(lid, cl, &pk); err != nil {
+		s.Log.Warn("client certificate identity rejected", "client_id", cl.ID, "listener", lid, "remote", cl.Info().Remote, "error", err)
+		if err := s.ackConnection(cl, code, false); err != nil {
+			return s.onError(cl.Info(), fmt.Errorf("invalid connection send ack: %w", err))
+		}
+		return s.onError(cl.Info(), fmt.Errorf("map certificate identity: %w", err))
+	}
+
+	if err := s.onPacketRead(cl, pk); err != nil {
+		if err := s.ackConnection(cl, packets.CodeConnectNotAuthorised, false); err != nil {
+			return s.onError(cl.Info(), fmt.Errorf("invalid connection send ack: %w", err))
+		}
+		return s.onError(cl.Info(), fmt.Errorf("inspect connection packet: %w", err))
+	}
+
+	if !cl.AC.AuthenticateClient(cl.AuthInfo(), pk.Password) {
+		s.Log.Warn("client authentication failed", "client_id", cl.ID, "listener", lid, "remote", cl.Info().Remote, "username", string(pk.Username))
 		if err := s.ackConnection(cl, packets.CodeConnectBadAuthValues, false); err != nil {
 			return s.onError(cl.Info(), fmt.Errorf("invalid connection send ack: %w", err))
 		}
 		return s.onError(cl.Info(), ErrConnectionFailed)
 	}
 
+	if d, ok := cl.AC.(auth.Disconnector); ok {
+		defer d.ClientDisconnected(cl.AuthInfo())
+	}
+
 	atomic.AddInt64(&s.System.ConnectionsTotal, 1)
+	atomic.AddInt64(&ls.ConnectionsTotal, 1)
 	atomic.AddInt64(&s.System.ClientsConnected, 1)
 	defer atomic.AddInt64(&s.System.ClientsConnected, -1)
 	defer atomic.AddInt64(&s.System.ClientsDisconnected, 1)
 
+	if ex, ok := cl.AC.(auth.Expirer); ok {
+		if expires := ex.ClientExpiry(cl.AuthInfo()); !expires.IsZero() {
+			expiry := time.AfterFunc(time.Until(expires), func() {
+				s.Log.Info("client credentials expired", "client_id", cl.ID, "listener", lid, "username", string(pk.Username))
+				cl.Stop(ErrCredentialsExpired)
+			})
+			defer expiry.Stop()
+		}
+	}
+
 	sessionPresent := s.inheritClientSession(pk, cl)
 	s.Clients.Add(cl)
+	defer s.owners.release(cl)
 
 	err = s.ackConnection(cl, ackCode, sessionPresent)
 	if err != nil {
@@ -357,10 +706,14 @@ func (s *Server) EstablishConnection(lid string, c net.Conn, ac auth.Controller)
 		}))
 	}
 
+	s.Log.Info("client connected", "client_id", cl.ID, "listener", lid, "remote", cl.Info().Remote, "username", string(cl.Username), "clean_session", cl.CleanSession, "session_present", sessionPresent)
+
 	if s.Events.OnConnect != nil {
 		s.Events.OnConnect(cl.Info(), events.Packet(pk))
 	}
 
+	s.onClientConnected(cl, sessionPresent)
+
 	if err := cl.Read(s.processPacket); err != nil {
 		s.sendLWT(cl)
 		cl.Stop(err)
@@ -369,13 +722,19 @@ func (s *Server) EstablishConnection(lid string, c net.Conn, ac auth.Controller)
 	err = cl.StopCause() // Determine true cause of stop.
 
 	if cl.CleanSession {
+		cl.Lock()
 		s.clearAbandonedInflights(cl)
+		cl.Unlock()
 	}
 
+	s.Log.Info("client disconnected", "client_id", cl.ID, "listener", lid, "remote", cl.Info().Remote, "error", err)
+
 	if s.Events.OnDisconnect != nil {
 		s.Events.OnDisconnect(cl.Info(), err)
 	}
 
+	s.onClientDisconnected(cl, err)
+
 	return err
 }
 
@@ -390,6 +749,42 @@ func (s *Server) ackConnection(cl *clients.Client, ack byte, present bool) error
 	})
 }
 
+// mapIdentity sets the username and client id of a client from its certificate
+// if the listener it connected to has an identity mapping. The connect packet is
+// updated to match, and a connack return code is returned if the client is refused.
+func (s *Server) mapIdentity(lid string, cl *clients.Client, pk *packets.Packet) (byte, error) {
+	l, ok := s.Listeners.Get(lid)
+	if !ok {
+		return packets.Accepted, nil
+	}
+
+	im, ok := l.(listeners.IdentityMapper)
+	if !ok {
+		return packets.Accepted, nil
+	}
+
+	username, clientID, err := im.Identity().Map(cl.PeerCertificates)
+	if err != nil {
+		return packets.CodeConnectNotAuthorised, err
+	}
+
+	if username != "" {
+		cl.Username = []byte(username)
+		pk.Username = cl.Username
+	}
+
+	if clientID != "" {
+		if pk.ClientIdentifier != "" && pk.ClientIdentifier != clientID {
+			return packets.CodeConnectBadClientID, ErrClientIDMismatch
+		}
+
+		cl.ID = clientID
+		pk.ClientIdentifier = clientID
+	}
+
+	return packets.Accepted, nil
+}
+
 // inheritClientSession inherits the state of an existing client sharing the same
 // connection ID. If cleanSession is true, the state of any previously existing client
 // session is abandoned.
@@ -437,10 +832,11 @@ func (s *Server) unsubscribeClient(cl *clients.Client) {
 
 // writeClient writes packets to a client connection.
 func (s *Server) writeClient(cl *clients.Client, pk packets.Packet) error {
-	_, err := cl.WritePacket(pk)
+	n, err := cl.WritePacket(pk)
 	if err != nil {
 		return fmt.Errorf("write: %w", err)
 	}
+	s.onPacketSent(cl, pk, n)
 
 	return nil
 }
@@ -448,6 +844,13 @@ func (s *Server) writeClient(cl *clients.Client, pk packets.Packet) error {
 // processPacket processes an inbound packet for a client. Since the method is
 // typically called as a goroutine, errors are primarily for test checking purposes.
 func (s *Server) processPacket(cl *clients.Client, pk packets.Packet) error {
+	if err := s.onPacketRead(cl, pk); err != nil {
+		if errors.Is(err, ErrRejectPacket) {
+			return nil
+		}
+		return err
+	}
+
 	switch pk.FixedHeader.Type {
 	case packets.Connect:
 		return s.processConnect(cl, pk)
@@ -556,29 +959,31 @@ func (*inlineMessages) Info() events.Client {
 
 // processPublish processes a Publish packet.
 func (s *Server) processPublish(cl *clients.Client, pk packets.Packet) error {
+	s.publishPacket(cl, pk)
+	return nil
+}
+
+// publishPacket publishes a packet from a client, and returns true if it was
+// published. Packets which are denied or rejected are dropped silently.
+func (s *Server) publishPacket(cl *clients.Client, pk packets.Packet) bool {
+	start := time.Now()
 	if len(pk.TopicName) >= 4 && pk.TopicName[0:4] == "$SYS" {
-		return nil // Clients can't publish to $SYS topics, so fail silently as per spec.
+		return false // Clients can't publish to $SYS topics, so fail silently as per spec.
 	}
 
-	if !cl.AC.ACL(cl.Username, pk.TopicName, true) {
-		return nil
+	if !cl.AC.ClientACL(cl.AuthInfo(), auth.Access{
+		Topic:  pk.TopicName,
+		Write:  true,
+		Qos:    pk.FixedHeader.Qos,
+		Retain: pk.FixedHeader.Retain,
+	}) {
+		s.Log.Debug("publish denied by acl", "client_id", cl.ID, "topic", pk.TopicName)
+		return false
 	}
 
-	// if an OnProcessMessage hook exists, potentially modify the packet.
-	if s.Events.OnProcessMessage != nil {
-		pkx, err := s.Events.OnProcessMessage(cl.Info(), events.Packet(pk))
-		if err == nil {
-			pk = packets.Packet(pkx) // Only use the new package changes if there's no errors.
-		} else {
-			// If the ErrRejectPacket is return, abandon processing the packet.
-			if err == ErrRejectPacket {
-				return nil
-			}
-
-			if s.Events.OnError != nil {
-				s.Events.OnError(cl.Info(), err)
-			}
-		}
+	pk, ok := s.onProcessMessage(cl.Info(), pk)
+	if !ok {
+		return false
 	}
 
 	if pk.FixedHeader.Retain {
@@ -602,17 +1007,50 @@ func (s *Server) processPublish(cl *clients.Client, pk packets.Packet) error {
 		s.onError(cl.Info(), s.writeClient(cl, ack))
 	}
 
-	// if an OnMessage hook exists, potentially modify the packet.
+	pk = s.onMessage(cl.Info(), pk)
+
+	// write packet to the byte buffers of any clients with matching topic filters.
+	s.publishToSubscribers(pk)
+	s.metrics.publishLatency.Observe(time.Since(start).Seconds())
+
+	return true
+}
+
+// onProcessMessage calls the OnProcessMessage hook, if it exists, which may
+// modify a published packet. It returns false if the hook rejected the packet.
+func (s *Server) onProcessMessage(cl events.Client, pk packets.Packet) (packets.Packet, bool) {
+	if s.Events.OnProcessMessage == nil {
+		return pk, true
+	}
+
+	pkx, err := s.Events.OnProcessMessage(cl, events.Packet(pk))
+	if err == nil {
+		return packets.Packet(pkx), true // Only use the new package changes if there's no errors.
+	}
+
+	// If the ErrRejectPacket is return, abandon processing the packet.
+	if err == ErrRejectPacket {
+		return pk, false
+	}
+
+	atomic.AddInt64(&s.metrics.hookErrors, 1)
+	if s.Events.OnError != nil {
+		s.Events.OnError(cl, err)
+	}
+
+	return pk, true
+}
+
+// onMessage calls the OnMessage hook, if it exists, which may modify a
+// published packet before it is sent to subscribers.
+func (s *Server) onMessage(cl events.Client, pk packets.Packet) packets.Packet {
 	if s.Events.OnMessage != nil {
-		if pkx, err := s.Events.OnMessage(cl.Info(), events.Packet(pk)); err == nil {
+		if pkx, err := s.Events.OnMessage(cl, events.Packet(pk)); err == nil {
 			pk = packets.Packet(pkx)
 		}
 	}
 
-	// write packet to the byte buffers of any clients with matching topic filters.
-	s.publishToSubscribers(pk)
-
-	return nil
+	return pk
 }
 
 // retainMessage adds a message to a topic, and if a persistent store is provided,
@@ -622,6 +1060,10 @@ func (s *Server) retainMessage(cl events.Clientlike, pk packets.Packet) {
 	r := s.Topics.RetainMessage(out)
 	atomic.AddInt64(&s.System.Retained, r)
 
+	if r != 0 && s.Events.OnRetainMessage != nil {
+		s.Events.OnRetainMessage(cl.Info(), events.Packet(out), r)
+	}
+
 	if s.Store != nil {
 		id := "ret_" + out.TopicName
 		if r == 1 {
@@ -657,6 +1099,13 @@ func (s *Server) publishToSubscribers(pk packets.Packet) {
 			}
 
 			if out.FixedHeader.Qos > 0 { // If QoS required, save to inflight index.
+				if s.Options.MaxInflight > 0 && client.Inflight.Len() >= s.Options.MaxInflight {
+					atomic.AddInt64(&s.System.PublishDropped, 1)
+					client.NoteDropped()
+					s.onQosDropped(client, out, ErrInflightQueueFull)
+					continue
+				}
+
 				if out.PacketID == 0 {
 					out.PacketID = uint16(client.NextPacketID())
 				}
@@ -665,11 +1114,13 @@ func (s *Server) publishToSubscribers(pk packets.Packet) {
 				// the client at some point, one way or another. Store the publish
 				// packet in the client's inflight queue and attempt to redeliver
 				// if an appropriate ack is not received (or if the client is offline).
-				sent := time.Now().Unix()
+				now := time.Now()
+				sent := now.Unix()
 				q := client.Inflight.Set(out.PacketID, clients.InflightMessage{
-					Packet:  out,
-					Created: time.Now().Unix(),
-					Sent:    sent,
+					Packet:   out,
+					Created:  sent,
+					Sent:     sent,
+					SentNano: now.UnixNano(),
 				})
 				if q {
 					atomic.AddInt64(&s.System.Inflight, 1)
@@ -690,13 +1141,21 @@ func (s *Server) publishToSubscribers(pk packets.Packet) {
 			s.onError(client.Info(), s.writeClient(client, out))
 		}
 	}
+
+	if pk.AllowClients == nil {
+		if dropped := s.gateway.publish(pk); dropped > 0 {
+			atomic.AddInt64(&s.System.PublishDropped, dropped)
+		}
+	}
 }
 
 // processPuback processes a Puback packet.
 func (s *Server) processPuback(cl *clients.Client, pk packets.Packet) error {
+	in, _ := cl.Inflight.Get(pk.PacketID)
 	q := cl.Inflight.Delete(pk.PacketID)
 	if q {
 		atomic.AddInt64(&s.System.Inflight, -1)
+		s.onQosComplete(cl, in)
 	}
 	if s.Store != nil {
 		s.onStorage(cl, s.Store.DeleteInflight(persistentID(cl, pk)))
@@ -749,9 +1208,11 @@ func (s *Server) processPubrel(cl *clients.Client, pk packets.Packet) error {
 
 // processPubcomp processes a Pubcomp packet.
 func (s *Server) processPubcomp(cl *clients.Client, pk packets.Packet) error {
+	in, _ := cl.Inflight.Get(pk.PacketID)
 	q := cl.Inflight.Delete(pk.PacketID)
 	if q {
 		atomic.AddInt64(&s.System.Inflight, -1)
+		s.onQosComplete(cl, in)
 	}
 	if s.Store != nil {
 		s.onStorage(cl, s.Store.DeleteInflight(persistentID(cl, pk)))
@@ -763,7 +1224,11 @@ func (s *Server) processPubcomp(cl *clients.Client, pk packets.Packet) error {
 func (s *Server) processSubscribe(cl *clients.Client, pk packets.Packet) error {
 	retCodes := make([]byte, len(pk.Topics))
 	for i := 0; i < len(pk.Topics); i++ {
-		if !cl.AC.ACL(cl.Username, pk.Topics[i], false) {
+		if !cl.AC.ClientACL(cl.AuthInfo(), auth.Access{
+			Topic: pk.Topics[i],
+			Qos:   pk.Qoss[i],
+		}) {
+			s.Log.Debug("subscribe denied by acl", "client_id", cl.ID, "filter", pk.Topics[i])
 			retCodes[i] = packets.ErrSubAckNetworkError
 		} else {
 			r := s.Topics.Subscribe(pk.Topics[i], cl.ID, pk.Qoss[i])
@@ -775,6 +1240,7 @@ func (s *Server) processSubscribe(cl *clients.Client, pk packets.Packet) error {
 			}
 			cl.NoteSubscription(pk.Topics[i], pk.Qoss[i])
 			retCodes[i] = pk.Qoss[i]
+			s.onClientSubscription(cl, "subscribed", pk.Topics[i], pk.Qoss[i])
 
 			if s.Store != nil {
 				s.onStorage(cl, s.Store.WriteSubscription(persistence.Subscription{
@@ -823,6 +1289,7 @@ func (s *Server) processUnsubscribe(cl *clients.Client, pk packets.Packet) error
 				s.Events.OnUnsubscribe(pk.Topics[i], cl.Info())
 			}
 			atomic.AddInt64(&s.System.Subscriptions, -1)
+			s.onClientSubscription(cl, "unsubscribed", pk.Topics[i], 0)
 		}
 		cl.ForgetSubscription(pk.Topics[i])
 	}
@@ -862,7 +1329,8 @@ func (s *Server) publishSysTopics() {
 		},
 	}
 
-	uptime := time.Now().Unix() - atomic.LoadInt64(&s.System.Started)
+	now := time.Now()
+	uptime := now.Unix() - atomic.LoadInt64(&s.System.Started)
 	atomic.StoreInt64(&s.System.Uptime, uptime)
 	topics := map[string]string{
 		"$SYS/broker/version":                   s.System.Version,
@@ -875,6 +1343,9 @@ func (s *Server) publishSysTopics() {
 		"$SYS/broker/clients/maximum":           atomicItoa(&s.System.ClientsMax),
 		"$SYS/broker/clients/total":             atomicItoa(&s.System.ClientsTotal),
 		"$SYS/broker/connections/total":         atomicItoa(&s.System.ConnectionsTotal),
+		"$SYS/broker/connections/rejected":      atomicItoa(&s.System.ConnectionsRejected),
+		"$SYS/broker/connections/rate_limited":  atomicItoa(&s.System.ConnectionsRateLimited),
+		"$SYS/broker/connections/ip_limited":    atomicItoa(&s.System.ConnectionsIPLimited),
 		"$SYS/broker/messages/received":         atomicItoa(&s.System.MessagesRecv),
 		"$SYS/broker/messages/sent":             atomicItoa(&s.System.MessagesSent),
 		"$SYS/broker/messages/publish/dropped":  atomicItoa(&s.System.PublishDropped),
@@ -885,6 +1356,23 @@ func (s *Server) publishSysTopics() {
 		"$SYS/broker/subscriptions/count":       atomicItoa(&s.System.Subscriptions),
 	}
 
+	s.load.update(s.System, now)
+	s.load.topics(topics)
+	runtimeTopics(topics)
+
+	for _, l := range s.ListListeners() {
+		prefix := "$SYS/broker/listeners/" + l.ID
+		topics[prefix+"/clients/connected"] = strconv.Itoa(l.Clients)
+		topics[prefix+"/connections/total"] = strconv.FormatInt(l.ConnectionsTotal, 10)
+		topics[prefix+"/load/bytes/received"] = strconv.FormatInt(l.BytesRecv, 10)
+		topics[prefix+"/load/bytes/sent"] = strconv.FormatInt(l.BytesSent, 10)
+		topics[prefix+"/messages/received"] = strconv.FormatInt(l.MessagesRecv, 10)
+		topics[prefix+"/messages/sent"] = strconv.FormatInt(l.MessagesSent, 10)
+		topics[prefix+"/messages/publish/dropped"] = strconv.FormatInt(l.PublishDropped, 10)
+		topics[prefix+"/messages/publish/received"] = strconv.FormatInt(l.PublishRecv, 10)
+		topics[prefix+"/messages/publish/sent"] = strconv.FormatInt(l.PublishSent, 10)
+	}
+
 	for topic, payload := range topics {
 		pk.TopicName = topic
 		pk.Payload = []byte(payload)
@@ -914,7 +1402,9 @@ func (s *Server) ResendClientInflight(cl *clients.Client, force bool) error {
 			cl.Inflight.Delete(tk.Packet.PacketID)
 			if tk.Packet.FixedHeader.Type == packets.Publish {
 				atomic.AddInt64(&s.System.PublishDropped, 1)
+				cl.NoteDropped()
 			}
+			s.onQosDropped(cl, tk.Packet, ErrInflightRetriesExhausted)
 
 			if s.Store != nil {
 				s.onStorage(cl, s.Store.DeleteInflight(persistentID(cl, tk.Packet)))
@@ -934,11 +1424,13 @@ func (s *Server) ResendClientInflight(cl *clients.Client, force bool) error {
 
 		tk.Resends++
 		tk.Sent = nt
+		tk.SentNano = time.Now().UnixNano()
 		cl.Inflight.Set(tk.Packet.PacketID, tk)
-		_, err := cl.WritePacket(tk.Packet)
+		n, err := cl.WritePacket(tk.Packet)
 		if err != nil {
 			return err
 		}
+		s.onPacketSent(cl, tk.Packet, n)
 
 		if s.Store != nil {
 			s.onStorage(cl, s.Store.WriteInflight(persistence.Message{
@@ -958,6 +1450,7 @@ func (s *Server) ResendClientInflight(cl *clients.Client, force bool) error {
 
 // Close attempts to gracefully shutdown the server, all listeners, clients, and stores.
 func (s *Server) Close() error {
+	s.Log.Info("mochi mqtt server closing")
 	close(s.done)
 	s.Listeners.CloseAll(s.closeListenerClients)
 
@@ -968,28 +1461,132 @@ func (s *Server) Close() error {
 	return nil
 }
 
-// closeListenerClients closes all clients on the specified listener.
+// closeListenerClients closes all clients on the specified listener, including
+// any clients migrated to it from removed listeners.
 func (s *Server) closeListenerClients(listener string) {
-	clients := s.Clients.GetByListener(listener)
-	for _, cl := range clients {
-		cl.Stop(ErrServerShutdown)
+	for _, cl := range s.Clients.GetAll() {
+		if s.owners.owner(cl) == listener {
+			cl.Stop(ErrServerShutdown)
+		}
+	}
+}
+
+// listenerOwners maps the ids of removed listeners to the listeners which took
+// over their connected clients. The owner of a client is found by looking up its
+// listener, unless the client was pinned to an owner because its listener id
+// has since been reused.
+type listenerOwners struct {
+	sync.RWMutex
+	internal map[string]string
+	pinned   map[*clients.Client]string
+}
+
+// newListenerOwners returns a new instance of listenerOwners.
+func newListenerOwners() *listenerOwners {
+	return &listenerOwners{
+		internal: make(map[string]string),
+		pinned:   make(map[*clients.Client]string),
+	}
+}
+
+// owner returns the id of the listener which owns a client.
+func (o *listenerOwners) owner(cl *clients.Client) string {
+	o.RLock()
+	defer o.RUnlock()
+	if to, ok := o.pinned[cl]; ok {
+		return to
+	}
+
+	if to, ok := o.internal[cl.Listener]; ok {
+		return to
+	}
+
+	return cl.Listener
+}
+
+// migrate passes the clients owned by a listener to another listener.
+func (o *listenerOwners) migrate(from, to string) {
+	o.Lock()
+	defer o.Unlock()
+	for k, v := range o.internal {
+		if v == from {
+			o.internal[k] = to
+		}
+	}
+	for cl, v := range o.pinned {
+		if v == from {
+			o.pinned[cl] = to
+		}
 	}
+	o.internal[from] = to
+}
+
+// forget removes a listener and any listeners or clients it owned.
+func (o *listenerOwners) forget(id string) {
+	o.Lock()
+	defer o.Unlock()
+	delete(o.internal, id)
+	for k, v := range o.internal {
+		if v == id {
+			delete(o.internal, k)
+		}
+	}
+	for cl, v := range o.pinned {
+		if v == id {
+			delete(o.pinned, cl)
+		}
+	}
+}
+
+// pin fixes the owner of the clients of a removed listener before its id is
+// reused, and forgets the removed listener.
+func (o *listenerOwners) pin(id string, cls []*clients.Client) {
+	o.Lock()
+	defer o.Unlock()
+	to, ok := o.internal[id]
+	if !ok {
+		return
+	}
+
+	for _, cl := range cls {
+		if _, ok := o.pinned[cl]; !ok {
+			o.pinned[cl] = to
+		}
+	}
+	delete(o.internal, id)
+}
+
+// release removes a disconnected client.
+func (o *listenerOwners) release(cl *clients.Client) {
+	o.Lock()
+	defer o.Unlock()
+	delete(o.pinned, cl)
 }
 
 // sendLWT issues an LWT message to a topic when a client disconnects.
 func (s *Server) sendLWT(cl *clients.Client) error {
-	if cl.LWT.Topic != "" {
-		err := s.processPublish(cl, packets.Packet{
+	cl.RLock()
+	lwt := cl.LWT
+	cl.RUnlock()
+
+	if lwt.Topic != "" {
+		pk := packets.Packet{
 			FixedHeader: packets.FixedHeader{
 				Type:   packets.Publish,
-				Retain: cl.LWT.Retain,
-				Qos:    cl.LWT.Qos,
+				Retain: lwt.Retain,
+				Qos:    lwt.Qos,
 			},
-			TopicName: cl.LWT.Topic,
-			Payload:   cl.LWT.Message,
-		})
-		if err != nil {
-			return s.onError(cl.Info(), fmt.Errorf("send lwt: %s %w; %+v", cl.ID, err, cl.LWT))
+			TopicName: lwt.Topic,
+			Payload:   lwt.Message,
+		}
+
+		if !s.publishPacket(cl, pk) {
+			s.Log.Debug("will not published", "client_id", cl.ID, "topic", lwt.Topic)
+			return nil
+		}
+
+		if s.Events.OnWillSent != nil {
+			s.Events.OnWillSent(cl.Info(), events.Packet(pk))
 		}
 	}
 
@@ -1036,6 +1633,7 @@ func (s *Server) loadServerInfo(v persistence.ServerInfo) {
 	version := s.System.Version
 	s.System = &v.Info
 	s.System.Version = version
+	s.load = newLoadAverages(s.System, time.Now())
 }
 
 // loadSubscriptions restores subscriptions from the datastore.
@@ -1099,20 +1697,24 @@ func (s *Server) clearExpiredInflights(dt int64) {
 	expiry := dt - s.Options.InflightTTL
 
 	for _, client := range s.Clients.GetAll() {
-		deleted := client.Inflight.ClearExpired(expiry)
-		atomic.AddInt64(&s.System.Inflight, deleted*-1)
+		deleted := client.Inflight.DeleteExpired(expiry)
+		atomic.AddInt64(&s.System.Inflight, int64(len(deleted))*-1)
+		for _, in := range deleted {
+			s.onQosDropped(client, in.Packet, ErrInflightExpired)
+		}
 	}
 
 	if s.Store != nil {
-		s.Store.ClearExpiredInflight(expiry)
+		s.onStorage(&s.inline, s.Store.ClearExpiredInflight(expiry))
 	}
 }
 
 // clearAbandonedInflights deletes all inflight messages for a disconnected user (eg. with a clean session).
 func (s *Server) clearAbandonedInflights(cl *clients.Client) {
 	for i := range cl.Inflight.GetAll() {
-		cl.Inflight.Delete(i)
-		atomic.AddInt64(&s.System.Inflight, -1)
+		if cl.Inflight.Delete(i) { // only count inflights which were not already cleared.
+			atomic.AddInt64(&s.System.Inflight, -1)
+		}
 	}
 }
 
@@ -1121,8 +1723,42 @@ func (s *Server) resendPendingInflights() {
 	for _, client := range s.Clients.GetAll() {
 		err := s.ResendClientInflight(client, false)
 		if err != nil {
-			// TODO add log-level debugging.
+			s.Log.Debug("failed to resend inflight messages", "client_id", client.ID, "error", err)
 			continue
 		}
 	}
 }
+
+// listenerRevocations holds the functions which unregister the revocation
+// reload functions of each listener, so that removed listeners are forgotten by
+// their revocation checkers.
+type listenerRevocations struct {
+	sync.Mutex
+	internal map[string][]func()
+}
+
+// newListenerRevocations returns a new instance of listenerRevocations.
+func newListenerRevocations() *listenerRevocations {
+	return &listenerRevocations{
+		internal: make(map[string][]func()),
+	}
+}
+
+// add records a function which unregisters a reload function of a listener.
+func (r *listenerRevocations) add(id string, unregister func()) {
+	r.Lock()
+	defer r.Unlock()
+	r.internal[id] = append(r.internal[id], unregister)
+}
+
+// remove unregisters all reload functions of a listener.
+func (r *listenerRevocations) remove(id string) {
+	r.Lock()
+	fns := r.internal[id]
+	delete(r.internal, id)
+	r.Unlock()
+
+	for _, fn := range fns {
+		fn()
+	}
+}
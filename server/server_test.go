@@ -1,10 +1,15 @@
 package server
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
 	"net"
 	"strconv"
 	"sync"
@@ -21,6 +26,7 @@ import (
 	"github.com/mochi-co/mqtt/server/internal/topics"
 	"github.com/mochi-co/mqtt/server/listeners"
 	"github.com/mochi-co/mqtt/server/listeners/auth"
+	"github.com/mochi-co/mqtt/server/logger"
 	"github.com/mochi-co/mqtt/server/persistence"
 	"github.com/mochi-co/mqtt/server/system"
 )
@@ -126,6 +132,27 @@ func BenchmarkNewServer(b *testing.B) {
 	}
 }
 
+func TestNewServerLogger(t *testing.T) {
+	s := NewServer(nil)
+	require.Equal(t, new(logger.Nop), s.Log)
+
+	log := new(logger.Mock)
+	s = NewServer(&Options{
+		Logger: log,
+	})
+	require.Equal(t, log, s.Log)
+
+	m := listeners.NewMockListener("t1", defaultPort)
+	err := s.AddListener(m, nil)
+	require.NoError(t, err)
+	require.Equal(t, log, m.Log)
+
+	e, ok := log.Find("listener added")
+	require.True(t, ok)
+	v, _ := e.Value("listener")
+	require.Equal(t, "t1", v)
+}
+
 func TestServerAddStore(t *testing.T) {
 	s := New()
 	require.NotNil(t, s)
@@ -185,6 +212,107 @@ func TestServerAddListener(t *testing.T) {
 	require.Equal(t, ErrListenerIDExists, err)
 }
 
+// testRevoker is a revocation checker which revokes certificates by serial.
+type testRevoker struct {
+	sync.Mutex
+	revoked  map[int64]bool
+	reloaded []func()
+}
+
+func (r *testRevoker) Revoked(cert *x509.Certificate) bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.revoked[cert.SerialNumber.Int64()]
+}
+
+func (r *testRevoker) OnReload(fn func()) func() {
+	r.Lock()
+	defer r.Unlock()
+	i := len(r.reloaded)
+	r.reloaded = append(r.reloaded, fn)
+
+	return func() {
+		r.Lock()
+		r.reloaded[i] = nil
+		r.Unlock()
+	}
+}
+
+// registered returns the number of registered reload functions.
+func (r *testRevoker) registered() int {
+	r.Lock()
+	defer r.Unlock()
+	n := 0
+	for _, fn := range r.reloaded {
+		if fn != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *testRevoker) revoke(serial int64) {
+	r.Lock()
+	r.revoked[serial] = true
+	fns := r.reloaded
+	r.Unlock()
+
+	for _, fn := range fns {
+		if fn != nil {
+			fn()
+		}
+	}
+}
+
+// revokingListener is a mock listener with a certificate revocation checker.
+type revokingListener struct {
+	*listeners.MockListener
+	revoker *testRevoker
+}
+
+func (l *revokingListener) Revokers() []listeners.Revoker {
+	return []listeners.Revoker{l.revoker}
+}
+
+func TestServerAddListenerDisconnectRevoked(t *testing.T) {
+	s := New()
+	r := &testRevoker{revoked: map[int64]bool{}}
+	err := s.AddListener(&revokingListener{
+		MockListener: listeners.NewMockListener("tls", defaultPort),
+		revoker:      r,
+	}, nil)
+	require.NoError(t, err)
+
+	cl1, _, _ := setupServerClient(s)
+	cl1.ID = "cl1"
+	cl1.Listener = "tls"
+	cl1.PeerCertificates = []*x509.Certificate{{SerialNumber: big.NewInt(1)}}
+	s.Clients.Add(cl1)
+
+	cl2, _, _ := setupServerClient(s)
+	cl2.ID = "cl2"
+	cl2.Listener = "tls"
+	cl2.PeerCertificates = []*x509.Certificate{{SerialNumber: big.NewInt(2)}}
+	s.Clients.Add(cl2)
+
+	cl3, _, _ := setupServerClient(s)
+	cl3.ID = "cl3"
+	cl3.Listener = "tcp"
+	cl3.PeerCertificates = []*x509.Certificate{{SerialNumber: big.NewInt(1)}}
+	s.Clients.Add(cl3)
+
+	r.revoke(1)
+	require.Equal(t, uint32(1), atomic.LoadUint32(&cl1.State.Done))
+	require.ErrorIs(t, cl1.StopCause(), listeners.ErrCertificateRevoked)
+	require.Equal(t, uint32(0), atomic.LoadUint32(&cl2.State.Done))
+	require.Equal(t, uint32(0), atomic.LoadUint32(&cl3.State.Done))
+
+	// removed listeners are unregistered from their revocation checkers.
+	require.Equal(t, 1, r.registered())
+	require.NoError(t, s.RemoveListener("tls", ""))
+	require.Equal(t, 0, r.registered())
+}
+
 func TestServerAddListenerFailure(t *testing.T) {
 	s := New()
 	require.NotNil(t, s)
@@ -192,6 +320,21 @@ func TestServerAddListenerFailure(t *testing.T) {
 	m.ErrListen = true
 	err := s.AddListener(m, nil)
 	require.Error(t, err)
+
+	// the listener is not kept, so it can be added again.
+	_, ok := s.Listeners.Get("t1")
+	require.False(t, ok)
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t1", ":1882"), nil))
+}
+
+func TestServerAddListenerFailureRevoker(t *testing.T) {
+	s := New()
+	r := &testRevoker{revoked: map[int64]bool{}}
+	m := listeners.NewMockListener("tls", defaultPort)
+	m.ErrListen = true
+	err := s.AddListener(&revokingListener{MockListener: m, revoker: r}, nil)
+	require.Error(t, err)
+	require.Equal(t, 0, r.registered())
 }
 
 func BenchmarkServerAddListener(b *testing.B) {
@@ -523,6 +666,52 @@ func TestServerEventOnDisconnectOnError(t *testing.T) {
 	require.Nil(t, clw.W)
 }
 
+func TestServerEstablishConnectionLog(t *testing.T) {
+	log := new(logger.Mock)
+	s := NewServer(&Options{Logger: log})
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 17, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			2,     // Packet Flags - clean session
+			0, 45, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+		})
+		w.Write([]byte{byte(packets.Disconnect << 4), 0})
+	}()
+
+	go func() {
+		_, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	require.ErrorIs(t, <-o, ErrClientDisconnect)
+	w.Close()
+
+	e, ok := log.Find("client connected")
+	require.True(t, ok)
+	require.Equal(t, logger.LevelInfo, e.Level)
+	v, _ := e.Value("client_id")
+	require.Equal(t, "mochi", v)
+
+	e, ok = log.Find("client disconnected")
+	require.True(t, ok)
+	v, _ = e.Value("error")
+	require.ErrorIs(t, v.(error), ErrClientDisconnect)
+}
+
 func TestServerEstablishConnectionInheritSession(t *testing.T) {
 	s := New()
 
@@ -789,6 +978,285 @@ func TestServerEstablishConnectionBadAuth(t *testing.T) {
 	require.Equal(t, int64(0), s.bytepool.InUse())
 }
 
+// expiringAuth is an auth controller which allows all connections until an expiry time.
+type expiringAuth struct {
+	auth.Allow
+	expires time.Time
+}
+
+func (a *expiringAuth) ClientExpiry(cl auth.Client) time.Time {
+	return a.expires
+}
+
+func TestServerEstablishConnectionCredentialsExpired(t *testing.T) {
+	tt := []struct {
+		desc string
+		ac   func(ex *expiringAuth) auth.Controller
+	}{
+		{desc: "controller", ac: func(ex *expiringAuth) auth.Controller { return ex }},
+		{desc: "wrapped", ac: func(ex *expiringAuth) auth.Controller { return auth.Wrap(ex) }},
+	}
+
+	for _, tx := range tt {
+		t.Run(tx.desc, func(t *testing.T) {
+			testServerEstablishConnectionCredentialsExpired(t, tx.ac(&expiringAuth{
+				expires: time.Now().Add(20 * time.Millisecond),
+			}))
+		})
+	}
+}
+
+func testServerEstablishConnectionCredentialsExpired(t *testing.T, ac auth.Controller) {
+	s := New()
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, ac)
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 17, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			2,     // Packet Flags - clean session
+			0, 45, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+		})
+	}()
+
+	go func() {
+		ioutil.ReadAll(w)
+	}()
+
+	errx := <-o
+	w.Close()
+	require.ErrorIs(t, errx, ErrCredentialsExpired)
+	require.Equal(t, int64(0), s.bytepool.InUse())
+}
+
+// identityListener is a mock listener with a certificate identity mapping.
+type identityListener struct {
+	*listeners.MockListener
+	identity *listeners.Identity
+}
+
+func (l *identityListener) Identity() *listeners.Identity {
+	return l.identity
+}
+
+// certConn is a connection with client certificates.
+type certConn struct {
+	net.Conn
+	certs []*x509.Certificate
+}
+
+func (c *certConn) ConnectionState() tls.ConnectionState {
+	return tls.ConnectionState{PeerCertificates: c.certs}
+}
+
+func newIdentityServer() *Server {
+	s := New()
+	s.Listeners.Add(&identityListener{
+		MockListener: listeners.NewMockListener("tls", ":1883"),
+		identity: &listeners.Identity{
+			Username: listeners.IdentitySANDNS,
+			ClientID: listeners.IdentityCommonName,
+		},
+	})
+	return s
+}
+
+func newIdentityConn(c net.Conn) *certConn {
+	return &certConn{
+		Conn: c,
+		certs: []*x509.Certificate{{
+			Subject:  pkix.Name{CommonName: "mochi"},
+			DNSNames: []string{"device.mochi.local"},
+		}},
+	}
+}
+
+func TestServerMapIdentity(t *testing.T) {
+	s := newIdentityServer()
+	r, _ := net.Pipe()
+
+	cl := clients.NewClient(newIdentityConn(r), circ.NewReader(256, 8), circ.NewWriter(256, 8), s.System)
+	pk := packets.Packet{Username: []byte("ignored")}
+	cl.Identify("tls", pk, new(auth.Allow))
+
+	code, err := s.mapIdentity("tls", cl, &pk)
+	require.NoError(t, err)
+	require.Equal(t, packets.Accepted, code)
+	require.Equal(t, "mochi", cl.ID)
+	require.Equal(t, "mochi", pk.ClientIdentifier)
+	require.Equal(t, []byte("device.mochi.local"), cl.Username)
+	require.Equal(t, []byte("device.mochi.local"), pk.Username)
+
+	pk.ClientIdentifier = "other"
+	code, err = s.mapIdentity("tls", cl, &pk)
+	require.ErrorIs(t, err, ErrClientIDMismatch)
+	require.Equal(t, packets.CodeConnectBadClientID, code)
+
+	code, err = s.mapIdentity("tcp", cl, &pk)
+	require.NoError(t, err)
+	require.Equal(t, packets.Accepted, code)
+}
+
+func TestServerMapIdentityNoCertificate(t *testing.T) {
+	s := newIdentityServer()
+	r, _ := net.Pipe()
+
+	cl := clients.NewClient(r, circ.NewReader(256, 8), circ.NewWriter(256, 8), s.System)
+	pk := packets.Packet{ClientIdentifier: "mochi"}
+	cl.Identify("tls", pk, new(auth.Allow))
+
+	code, err := s.mapIdentity("tls", cl, &pk)
+	require.ErrorIs(t, err, listeners.ErrNoPeerCertificate)
+	require.Equal(t, packets.CodeConnectNotAuthorised, code)
+}
+
+func TestServerEstablishConnectionCertificateIdentity(t *testing.T) {
+	s := newIdentityServer()
+	ac := new(recordingAuth)
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tls", newIdentityConn(r), auth.Wrap(ac))
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 17, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			2,     // Packet Flags - clean session
+			0, 45, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+		})
+		w.Write([]byte{byte(packets.Disconnect << 4), 0})
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	errx := <-o
+	require.ErrorIs(t, errx, ErrClientDisconnect)
+	w.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Connack << 4), 2,
+		0, packets.Accepted,
+	}, <-recv)
+
+	require.Len(t, ac.authed, 1)
+	require.Equal(t, "mochi", ac.authed[0].ID)
+	require.Equal(t, []byte("device.mochi.local"), ac.authed[0].Username)
+	require.Len(t, ac.authed[0].PeerCertificates, 1)
+}
+
+func TestServerEstablishConnectionCertificateIdentityMismatch(t *testing.T) {
+	s := newIdentityServer()
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tls", newIdentityConn(r), new(auth.Allow))
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 17, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			2,     // Packet Flags - clean session
+			0, 45, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'o', 't', 'h', 'e', 'r', // Client ID
+		})
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	errx := <-o
+	require.ErrorIs(t, errx, ErrClientIDMismatch)
+	w.Close()
+
+	require.Equal(t, []byte{
+		byte(packets.Connack << 4), 2,
+		0, packets.CodeConnectBadClientID,
+	}, <-recv)
+	require.Equal(t, int64(0), s.bytepool.InUse())
+}
+
+func TestServerEstablishConnectionPacketReadReject(t *testing.T) {
+	s := New()
+	s.Events.OnPacketRead = func(cl events.Client, pk events.Packet, n int) error {
+		return ErrRejectPacket
+	}
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 17, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			2,     // Packet Flags - clean session
+			0, 45, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+		})
+	}()
+
+	// Receive the Connack
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	errx := <-o
+	time.Sleep(time.Millisecond)
+	r.Close()
+	require.ErrorIs(t, errx, ErrRejectPacket)
+	require.Equal(t, []byte{
+		byte(packets.Connack << 4), 2,
+		0, packets.CodeConnectNotAuthorised,
+	}, <-recv)
+
+	_, ok := s.Clients.Get("mochi")
+	require.False(t, ok)
+}
+
 func TestServerEstablishConnectionPromptSendLWT(t *testing.T) {
 	s := New()
 
@@ -829,6 +1297,49 @@ func TestServerEstablishConnectionPromptSendLWT(t *testing.T) {
 	require.Nil(t, clw.W)
 }
 
+func TestServerEventOnWillSent(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.LWT = clients.LWT{
+		Topic:   "a/b/c",
+		Message: []byte("goodbye"),
+		Retain:  true,
+	}
+
+	var hook packetHook
+	s.Events.OnWillSent = hook.onConnect
+
+	var retained int64
+	s.Events.OnRetainMessage = func(cl events.Client, pk events.Packet, r int64) {
+		retained = r
+	}
+
+	err := s.sendLWT(cl)
+	require.NoError(t, err)
+	require.Equal(t, "mochi", hook.client.ID)
+	require.Equal(t, "a/b/c", hook.packet.TopicName)
+	require.Equal(t, []byte("goodbye"), hook.packet.Payload)
+	require.Equal(t, int64(1), retained)
+}
+
+func TestServerEventOnWillSentDenied(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.AC = new(auth.Disallow)
+	cl.LWT = clients.LWT{
+		Topic:   "a/b/c",
+		Message: []byte("goodbye"),
+		Retain:  true,
+	}
+
+	sent := false
+	s.Events.OnWillSent = func(cl events.Client, pk events.Packet) {
+		sent = true
+	}
+
+	require.NoError(t, s.sendLWT(cl))
+	require.False(t, sent)
+	require.Empty(t, s.Topics.Messages("a/b/c"))
+}
+
 func TestServerEstablishConnectionReadConnectionPacketErr(t *testing.T) {
 	s := New()
 
@@ -861,6 +1372,38 @@ func TestServerEstablishConnectionReadConnectionPacketErr(t *testing.T) {
 	require.Equal(t, int64(0), s.bytepool.InUse())
 }
 
+func TestServerEstablishConnectionMaxConnections(t *testing.T) {
+	s := NewServer(&Options{MaxConnections: 1})
+	atomic.AddInt64(&s.connections, 1) // another client is connected.
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
+
+	// the connection is refused without waiting for a connect packet.
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	require.ErrorIs(t, <-o, ErrMaxConnections)
+	r.Close()
+	require.Equal(t, []byte{
+		byte(packets.Connack << 4), 2,
+		0, packets.CodeConnectServerUnavailable,
+	}, <-recv)
+
+	require.Equal(t, 0, s.Clients.Len())
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.System.ConnectionsRejected))
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.connections))
+}
+
 // TestServerEstablishConnectionClearBuffersAfterUse ensures that the r/w buffers
 // for a client have been set to nil when the client disconnects so that they dont
 // leak (otherwise the reference to the buffers remains). We only need to check if
@@ -1006,6 +1549,111 @@ func TestServerProcessPingreq(t *testing.T) {
 	}, <-recv)
 }
 
+func TestServerEventOnPacketSent(t *testing.T) {
+	s, cl, r, w := setupClient()
+
+	go func() {
+		_, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	var sent events.Packet
+	var size int
+	s.Events.OnPacketSent = func(cl events.Client, pk events.Packet, n int) {
+		sent = pk
+		size = n
+	}
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Pingreq,
+		},
+	})
+	require.NoError(t, err)
+	w.Close()
+
+	require.Equal(t, packets.Pingresp, sent.FixedHeader.Type)
+	require.Equal(t, 2, size)
+}
+
+func TestServerEventOnPacketRead(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	s.Clients.Add(cl)
+	s.Topics.Subscribe("a/b/c", cl.ID, 0)
+
+	var size int
+	s.Events.OnPacketRead = func(cl events.Client, pk events.Packet, n int) error {
+		size = n
+		return ErrRejectPacket
+	}
+
+	var hook packetHook
+	s.Events.OnMessage = hook.onPacket
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:      packets.Publish,
+			Remaining: 12,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, 14, size)
+	require.Empty(t, hook.client.ID) // packet was rejected before processing.
+}
+
+func TestServerEventOnPacketReadError(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	s.Events.OnPacketRead = func(cl events.Client, pk events.Packet, n int) error {
+		return errTestStop
+	}
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Pingreq,
+		},
+	})
+	require.ErrorIs(t, err, errTestStop)
+}
+
+func TestServerInspectPackets(t *testing.T) {
+	s, cl, _, _ := setupClient()
+
+	var cnt int
+	s.Events.OnPacketRead = func(cl events.Client, pk events.Packet, n int) error {
+		cnt++
+		return ErrRejectPacket
+	}
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Pingreq,
+		},
+	}
+
+	require.NoError(t, s.processPacket(cl, pk))
+	require.Equal(t, 1, cnt)
+
+	s.InspectPackets("other")
+	require.NoError(t, s.processPacket(cl, pk))
+	require.Equal(t, 1, cnt)
+
+	s.InspectPackets(cl.ID)
+	require.NoError(t, s.processPacket(cl, pk))
+	require.Equal(t, 2, cnt)
+
+	s.UninspectPackets(cl.ID)
+	require.NoError(t, s.processPacket(cl, pk))
+	require.Equal(t, 2, cnt)
+
+	s.UninspectPackets()
+	require.NoError(t, s.processPacket(cl, pk))
+	require.Equal(t, 3, cnt)
+}
+
 func TestServerProcessPingreqError(t *testing.T) {
 	s, cl, _, _ := setupClient()
 
@@ -1214,95 +1862,200 @@ func TestServerProcessPublishOfflineQueuing(t *testing.T) {
 	require.Equal(t, "qos1", queued[1].Packet.TopicName)
 	require.Equal(t, "qos2", queued[2].Packet.TopicName)
 
-	// Reconnect the receiving client and get queued messages.
+	// Reconnect the receiving client and get queued messages.
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 18, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			0,     // Packet Flags
+			0, 45, // Keepalive
+			0, 6, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', '2', // Client ID
+		})
+		w.Write([]byte{byte(packets.Disconnect << 4), 0})
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	clw, ok := s.Clients.Get("mochi2")
+	require.Equal(t, true, ok)
+	clw.Stop(errTestStop)
+
+	errx := <-o
+	require.ErrorIs(t, errx, ErrClientDisconnect)
+	ret := <-recv
+
+	wanted := []byte{
+		byte(packets.Connack << 4), 2,
+		1, packets.Accepted,
+		byte(packets.Publish<<4 | 1<<1 | 1<<3), 13,
+		0, 4,
+		'q', 'o', 's', '1',
+		0, 1,
+		'h', 'e', 'l', 'l', 'o',
+		byte(packets.Publish<<4 | 2<<1 | 1<<3), 13,
+		0, 4,
+		'q', 'o', 's', '2',
+		0, 2,
+		'h', 'e', 'l', 'l', 'o',
+	}
+
+	require.Equal(t, len(wanted), len(ret))
+	require.Equal(t, true, (ret[4] == byte(packets.Publish<<4|1<<1|1<<3) || ret[4] == byte(packets.Publish<<4|2<<1|1<<3)))
+
+	w.Close()
+}
+
+func TestServerProcessPublishSystemPrefix(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	s.Clients.Add(cl)
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: "$SYS/stuff",
+		Payload:   []byte("hello"),
+	})
+
+	require.NoError(t, err)
+	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.BytesSent))
+}
+
+func TestServerProcessPublishBadACL(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.AC = new(auth.Disallow)
+	s.Clients.Add(cl)
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+	})
+
+	require.NoError(t, err)
+}
+
+// recordingAuth is a client auth controller which records ACL checks.
+type recordingAuth struct {
+	authed   []auth.Client
+	clients  []auth.Client
+	accesses []auth.Access
+}
+
+func (a *recordingAuth) AuthenticateClient(cl auth.Client, password []byte) bool {
+	a.authed = append(a.authed, cl)
+	return true
+}
+
+func (a *recordingAuth) ClientACL(cl auth.Client, access auth.Access) bool {
+	a.clients = append(a.clients, cl)
+	a.accesses = append(a.accesses, access)
+	return !access.Retain
+}
+
+// disconnectingAuth is a client auth controller which records disconnections.
+type disconnectingAuth struct {
+	recordingAuth
+	disconnected []auth.Client
+}
+
+func (a *disconnectingAuth) ClientDisconnected(cl auth.Client) {
+	a.disconnected = append(a.disconnected, cl)
+}
+
+func TestServerEstablishConnectionClientDisconnected(t *testing.T) {
+	s := New()
+	ac := new(disconnectingAuth)
+
 	r, w := net.Pipe()
 	o := make(chan error)
 	go func() {
-		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+		o <- s.EstablishConnection("tcp", r, auth.Wrap(ac))
 	}()
 
 	go func() {
 		w.Write([]byte{
-			byte(packets.Connect << 4), 18, // Fixed header
+			byte(packets.Connect << 4), 17, // Fixed header
 			0, 4, // Protocol Name - MSB+LSB
 			'M', 'Q', 'T', 'T', // Protocol Name
 			4,     // Protocol Version
-			0,     // Packet Flags
+			2,     // Packet Flags - clean session
 			0, 45, // Keepalive
-			0, 6, // Client ID - MSB+LSB
-			'm', 'o', 'c', 'h', 'i', '2', // Client ID
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+			byte(packets.Disconnect << 4), 0,
 		})
-		w.Write([]byte{byte(packets.Disconnect << 4), 0})
 	}()
 
-	recv := make(chan []byte)
 	go func() {
-		buf, err := ioutil.ReadAll(w)
-		if err != nil {
-			panic(err)
-		}
-		recv <- buf
+		ioutil.ReadAll(w)
 	}()
 
-	clw, ok := s.Clients.Get("mochi2")
-	require.Equal(t, true, ok)
-	clw.Stop(errTestStop)
-
-	errx := <-o
-	require.ErrorIs(t, errx, ErrClientDisconnect)
-	ret := <-recv
-
-	wanted := []byte{
-		byte(packets.Connack << 4), 2,
-		1, packets.Accepted,
-		byte(packets.Publish<<4 | 1<<1 | 1<<3), 13,
-		0, 4,
-		'q', 'o', 's', '1',
-		0, 1,
-		'h', 'e', 'l', 'l', 'o',
-		byte(packets.Publish<<4 | 2<<1 | 1<<3), 13,
-		0, 4,
-		'q', 'o', 's', '2',
-		0, 2,
-		'h', 'e', 'l', 'l', 'o',
-	}
-
-	require.Equal(t, len(wanted), len(ret))
-	require.Equal(t, true, (ret[4] == byte(packets.Publish<<4|1<<1|1<<3) || ret[4] == byte(packets.Publish<<4|2<<1|1<<3)))
-
+	<-o
 	w.Close()
+	require.Len(t, ac.authed, 1)
+	require.Len(t, ac.disconnected, 1)
+	require.NotEmpty(t, ac.disconnected[0].ConnID)
+	require.Equal(t, ac.authed[0].ConnID, ac.disconnected[0].ConnID)
 }
 
-func TestServerProcessPublishSystemPrefix(t *testing.T) {
+func TestServerProcessPublishClientACL(t *testing.T) {
 	s, cl, _, _ := setupClient()
+	ac := new(recordingAuth)
+	cl.AC = ac
+	cl.Listener = "tcp1"
 	s.Clients.Add(cl)
 
 	err := s.processPacket(cl, packets.Packet{
 		FixedHeader: packets.FixedHeader{
-			Type: packets.Publish,
+			Type:   packets.Publish,
+			Retain: true,
 		},
-		TopicName: "$SYS/stuff",
+		TopicName: "a/b/c",
 		Payload:   []byte("hello"),
 	})
 
 	require.NoError(t, err)
-	require.Equal(t, int64(0), atomic.LoadInt64(&s.System.BytesSent))
+	require.Equal(t, []auth.Access{{Topic: "a/b/c", Write: true, Retain: true}}, ac.accesses)
+	require.Equal(t, cl.ID, ac.clients[0].ID)
+	require.Equal(t, "tcp1", ac.clients[0].Listener)
+	require.Empty(t, s.Topics.Messages("a/b/c"))
 }
 
-func TestServerProcessPublishBadACL(t *testing.T) {
+func TestServerProcessSubscribeClientACL(t *testing.T) {
 	s, cl, _, _ := setupClient()
-	cl.AC = new(auth.Disallow)
-	s.Clients.Add(cl)
+	ac := new(recordingAuth)
+	cl.AC = ac
 
 	err := s.processPacket(cl, packets.Packet{
 		FixedHeader: packets.FixedHeader{
-			Type: packets.Publish,
+			Type: packets.Subscribe,
 		},
-		TopicName: "a/b/c",
-		Payload:   []byte("hello"),
+		PacketID: 10,
+		Topics:   []string{"a/b/c", "d/e/f"},
+		Qoss:     []byte{0, 2},
 	})
 
 	require.NoError(t, err)
+	require.Equal(t, []auth.Access{{Topic: "a/b/c"}, {Topic: "d/e/f", Qos: 2}}, ac.accesses)
 }
 
 func TestServerProcessPublishWriteAckError(t *testing.T) {
@@ -1932,6 +2685,59 @@ func TestServerProcessPubcomp(t *testing.T) {
 	require.Equal(t, false, ok)
 }
 
+func TestServerEventOnQosComplete(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.Inflight.Set(11, clients.InflightMessage{
+		Packet:   packets.Packet{PacketID: 11, TopicName: "a/b/c"},
+		SentNano: time.Now().Add(-time.Second).UnixNano(),
+	})
+	cl.Inflight.Set(12, clients.InflightMessage{
+		Packet: packets.Packet{PacketID: 12, TopicName: "d/e/f"},
+		Sent:   time.Now().Unix(),
+	})
+
+	var ids []uint16
+	var topics []string
+	var latencies []time.Duration
+	s.Events.OnQosComplete = func(cl events.Client, id uint16, topic string, latency time.Duration) {
+		ids = append(ids, id)
+		topics = append(topics, topic)
+		latencies = append(latencies, latency)
+	}
+
+	err := s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:      packets.Puback,
+			Remaining: 2,
+		},
+		PacketID: 11,
+	})
+	require.NoError(t, err)
+
+	err = s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:      packets.Pubcomp,
+			Remaining: 2,
+		},
+		PacketID: 12,
+	})
+	require.NoError(t, err)
+
+	// Acks for unknown packet ids should not trigger the hook.
+	err = s.processPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:      packets.Puback,
+			Remaining: 2,
+		},
+		PacketID: 13,
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, []uint16{11, 12}, ids)
+	require.Equal(t, []string{"a/b/c", "d/e/f"}, topics)
+	require.True(t, latencies[0] >= time.Second)
+}
+
 func TestServerProcessSubscribeInvalid(t *testing.T) {
 	s, cl, _, _ := setupClient()
 
@@ -2689,6 +3495,40 @@ func TestServerResendClientInflightDropMessage(t *testing.T) {
 	require.Equal(t, int64(1), atomic.LoadInt64(&s.System.PublishDropped))
 }
 
+func TestServerEventOnQosDroppedResends(t *testing.T) {
+	s := New()
+	r, _ := net.Pipe()
+	cl := clients.NewClient(r, circ.NewReader(128, 8), circ.NewWriter(128, 8), new(system.Info))
+	cl.ID = "mochi"
+
+	cl.Inflight.Set(11, clients.InflightMessage{
+		Packet: packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type: packets.Publish,
+				Qos:  1,
+			},
+			TopicName: "a/b/c",
+			PacketID:  11,
+		},
+		Sent:    time.Now().Unix(),
+		Resends: inflightMaxResends,
+	})
+
+	var dropped events.Packet
+	var reason error
+	s.Events.OnQosDropped = func(cl events.Client, pk events.Packet, err error) {
+		dropped = pk
+		reason = err
+	}
+
+	err := s.ResendClientInflight(cl, true)
+	require.NoError(t, err)
+	r.Close()
+
+	require.Equal(t, uint16(11), dropped.PacketID)
+	require.ErrorIs(t, reason, ErrInflightRetriesExhausted)
+}
+
 func TestServerResendClientInflightError(t *testing.T) {
 	s := New()
 	require.NotNil(t, s)
@@ -2742,6 +3582,71 @@ func TestServerClearExpiredInflights(t *testing.T) {
 	require.Equal(t, int64(-2), s.System.Inflight)
 }
 
+func TestServerEventOnQosDroppedExpired(t *testing.T) {
+	n := time.Now().Unix()
+
+	s := New()
+	s.Options.InflightTTL = 2
+
+	r, _ := net.Pipe()
+	cl := clients.NewClient(r, circ.NewReader(128, 8), circ.NewWriter(128, 8), new(system.Info))
+	cl.Inflight.Set(1, clients.InflightMessage{
+		Packet:  packets.Packet{PacketID: 1},
+		Created: n - 1,
+	})
+	cl.Inflight.Set(3, clients.InflightMessage{
+		Packet:  packets.Packet{PacketID: 3},
+		Created: n - 3,
+	})
+	s.Clients.Add(cl)
+
+	var dropped []uint16
+	s.Events.OnQosDropped = func(cl events.Client, pk events.Packet, err error) {
+		require.ErrorIs(t, err, ErrInflightExpired)
+		dropped = append(dropped, pk.PacketID)
+	}
+
+	s.clearExpiredInflights(n)
+	require.Equal(t, []uint16{3}, dropped)
+}
+
+func TestServerPublishToSubscribersMaxInflight(t *testing.T) {
+	s, cl, r, w := setupClient()
+	s.Options.MaxInflight = 1
+	s.Clients.Add(cl)
+	s.Topics.Subscribe("a/b/c", cl.ID, 1)
+
+	go func() {
+		_, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	var reason error
+	s.Events.OnQosDropped = func(cl events.Client, pk events.Packet, err error) {
+		reason = err
+	}
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: "a/b/c",
+		Payload:   []byte("hello"),
+	}
+
+	s.publishToSubscribers(pk)
+	s.publishToSubscribers(pk)
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+
+	require.Equal(t, 1, cl.Inflight.Len())
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.System.PublishDropped))
+	require.Equal(t, int64(1), atomic.LoadInt64(&cl.Stats.PublishDropped))
+	require.ErrorIs(t, reason, ErrInflightQueueFull)
+}
+
 func TestServerClearAbandonedInflights(t *testing.T) {
 	s := New()
 	require.NotNil(t, s)
@@ -2777,3 +3682,302 @@ func TestServerClearAbandonedInflights(t *testing.T) {
 	require.Len(t, cl2.Inflight.GetAll(), 2)
 	require.Equal(t, int64(-2), s.System.Inflight)
 }
+
+func TestServerMemoryListener(t *testing.T) {
+	s := New()
+	mem := listeners.NewMemory("mem")
+	require.NoError(t, s.AddListener(mem, nil))
+	require.NoError(t, s.Serve())
+	defer s.Close()
+
+	conn, err := mem.Dial()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte{
+		byte(packets.Connect << 4), 17, // Fixed header
+		0, 4, // Protocol Name - MSB+LSB
+		'M', 'Q', 'T', 'T', // Protocol Name
+		4,     // Protocol Version
+		2,     // Packet Flags - clean session
+		0, 45, // Keepalive
+		0, 5, // Client ID - MSB+LSB
+		'm', 'o', 'c', 'h', 'i', // Client ID
+	})
+	require.NoError(t, err)
+
+	_, err = conn.Write([]byte{
+		byte(packets.Subscribe<<4) | 2, 8, // Fixed header
+		0, 1, // Packet ID - LSB+MSB
+		0, 3, // Topic Name - LSB+MSB
+		'a', '/', 'b', // Topic Name
+		0, // QoS
+	})
+	require.NoError(t, err)
+
+	ack := make([]byte, 9)
+	_, err = io.ReadFull(conn, ack)
+	require.NoError(t, err)
+	require.Equal(t, []byte{
+		byte(packets.Connack << 4), 2, 0, packets.Accepted,
+		byte(packets.Suback << 4), 3, 0, 1, 0,
+	}, ack)
+
+	require.NoError(t, s.Publish("a/b", []byte("hi"), false))
+
+	pub := make([]byte, 9)
+	_, err = io.ReadFull(conn, pub)
+	require.NoError(t, err)
+	require.Equal(t, []byte{
+		byte(packets.Publish << 4), 7, // Fixed header
+		0, 3, // Topic Name - LSB+MSB
+		'a', '/', 'b', // Topic Name
+		'h', 'i', // Payload
+	}, pub)
+
+	cl, ok := s.Clients.Get("mochi")
+	require.True(t, ok)
+	require.Equal(t, "mem-1", cl.Info().Remote)
+}
+
+// connectMemory connects a client to a memory listener and reads its connack.
+func connectMemory(t *testing.T, mem *listeners.Memory, id string) net.Conn {
+	conn, err := mem.Dial()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Connect,
+		},
+		ProtocolName:     []byte("MQTT"),
+		ProtocolVersion:  4,
+		CleanSession:     true,
+		Keepalive:        30,
+		ClientIdentifier: id,
+	}
+	var buf bytes.Buffer
+	require.NoError(t, pk.ConnectEncode(&buf))
+	_, err = conn.Write(buf.Bytes())
+	require.NoError(t, err)
+
+	ack := make([]byte, 4)
+	_, err = io.ReadFull(conn, ack)
+	require.NoError(t, err)
+	require.Equal(t, []byte{byte(packets.Connack << 4), 2, 0, packets.Accepted}, ack)
+	return conn
+}
+
+func TestServerAddListenerServing(t *testing.T) {
+	s := New()
+	require.NoError(t, s.Serve())
+	defer s.Close()
+
+	mem := listeners.NewMemory("mem")
+	require.NoError(t, s.AddListener(mem, nil))
+	connectMemory(t, mem, "mochi")
+
+	info, ok := s.GetListener("mem")
+	require.True(t, ok)
+	require.Equal(t, listeners.StateServing, info.State)
+	require.Equal(t, "mem", info.Address)
+	require.Equal(t, 1, info.Clients)
+}
+
+func TestServerRemoveListener(t *testing.T) {
+	s := New()
+	mem := listeners.NewMemory("mem")
+	require.NoError(t, s.AddListener(mem, nil))
+	require.NoError(t, s.Serve())
+	defer s.Close()
+
+	conn := connectMemory(t, mem, "mochi")
+	cl, ok := s.Clients.Get("mochi")
+	require.True(t, ok)
+
+	require.NoError(t, s.RemoveListener("mem", ""))
+	require.ErrorIs(t, cl.StopCause(), ErrServerShutdown)
+	_, err := io.ReadAll(conn)
+	require.NoError(t, err)
+
+	_, ok = s.Listeners.Get("mem")
+	require.False(t, ok)
+	_, err = mem.Dial()
+	require.ErrorIs(t, err, listeners.ErrListenerClosed)
+}
+
+func TestServerRemoveListenerMigrate(t *testing.T) {
+	s := New()
+	mem1 := listeners.NewMemory("mem1")
+	mem2 := listeners.NewMemory("mem2")
+	mem3 := listeners.NewMemory("mem3")
+	require.NoError(t, s.AddListener(mem1, nil))
+	require.NoError(t, s.AddListener(mem2, nil))
+	require.NoError(t, s.AddListener(mem3, nil))
+	require.NoError(t, s.Serve())
+	defer s.Close()
+
+	connectMemory(t, mem1, "cl1")
+	connectMemory(t, mem2, "cl2")
+	cl1, _ := s.Clients.Get("cl1")
+
+	require.NoError(t, s.RemoveListener("mem1", "mem2"))
+	require.Equal(t, uint32(0), atomic.LoadUint32(&cl1.State.Done))
+	info, _ := s.GetListener("mem2")
+	require.Equal(t, 2, info.Clients)
+
+	// migrated clients move again with the listener which owns them.
+	require.NoError(t, s.RemoveListener("mem2", "mem3"))
+	require.Equal(t, uint32(0), atomic.LoadUint32(&cl1.State.Done))
+	require.Equal(t, []ListenerInfo{{ID: "mem3", Clients: 2, State: listeners.StateServing, Address: "mem3"}}, s.ListListeners())
+
+	require.NoError(t, s.RemoveListener("mem3", ""))
+	require.ErrorIs(t, cl1.StopCause(), ErrServerShutdown)
+	require.Empty(t, s.owners.internal)
+}
+
+func TestServerRemoveListenerMigrateReuseID(t *testing.T) {
+	s := New()
+	mem1 := listeners.NewMemory("mem1")
+	mem2 := listeners.NewMemory("mem2")
+	require.NoError(t, s.AddListener(mem1, nil))
+	require.NoError(t, s.AddListener(mem2, nil))
+	require.NoError(t, s.Serve())
+	defer s.Close()
+
+	connectMemory(t, mem1, "cl1")
+	cl1, _ := s.Clients.Get("cl1")
+	require.NoError(t, s.RemoveListener("mem1", "mem2"))
+
+	// the reused id does not take over the clients migrated from the old listener.
+	mem1b := listeners.NewMemory("mem1")
+	require.NoError(t, s.AddListener(mem1b, nil))
+	connectMemory(t, mem1b, "cl2")
+	cl2, _ := s.Clients.Get("cl2")
+	for _, info := range s.ListListeners() {
+		require.Equal(t, 1, info.Clients, info.ID)
+	}
+
+	require.NoError(t, s.RemoveListener("mem1", ""))
+	require.ErrorIs(t, cl2.StopCause(), ErrServerShutdown)
+	require.Equal(t, uint32(0), atomic.LoadUint32(&cl1.State.Done))
+
+	info, _ := s.GetListener("mem2")
+	require.Equal(t, 1, info.Clients)
+
+	require.NoError(t, s.RemoveListener("mem2", ""))
+	require.ErrorIs(t, cl1.StopCause(), ErrServerShutdown)
+	require.Empty(t, s.owners.internal)
+}
+
+func TestServerAddListenerConcurrentSameID(t *testing.T) {
+	s := New()
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- s.AddListener(listeners.NewMemory("mem"), nil)
+		}()
+	}
+
+	var failed int
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			require.ErrorIs(t, err, ErrListenerIDExists)
+			failed++
+		}
+	}
+	require.Equal(t, 1, failed)
+	require.Equal(t, 1, s.Listeners.Len())
+}
+
+func TestServerRemoveListenerInvalid(t *testing.T) {
+	s := New()
+	require.NoError(t, s.AddListener(listeners.NewMockListener("t1", ":1882"), nil))
+
+	require.ErrorIs(t, s.RemoveListener("t2", ""), listeners.ErrListenerNotFound)
+	require.ErrorIs(t, s.RemoveListener("t1", "t2"), ErrInvalidMigrationTarget)
+	require.ErrorIs(t, s.RemoveListener("t1", "t1"), ErrInvalidMigrationTarget)
+	require.Equal(t, 1, s.Listeners.Len())
+}
+
+func TestServerMQTTSN(t *testing.T) {
+	s := New()
+	sn := listeners.NewMQTTSN("sn", "127.0.0.1"+defaultPort)
+	sn.SetOptions(listeners.MQTTSNOptions{
+		PredefinedTopics: map[uint16]string{
+			7: "sensors/1",
+		},
+		AllowAnonymousQosMinusOne: true,
+	})
+	require.NoError(t, s.AddListener(sn, nil))
+	require.NoError(t, s.Serve())
+	defer s.Close()
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("udp", "127.0.0.1"+defaultPort)
+		require.NoError(t, err)
+		return conn
+	}
+
+	send := func(conn net.Conn, b []byte) {
+		_, err := conn.Write(b)
+		require.NoError(t, err)
+	}
+
+	recv := func(conn net.Conn) []byte {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		return buf[:n]
+	}
+
+	sub := dial()
+	defer sub.Close()
+	send(sub, []byte{9, 0x04, 0x04, 0x01, 0, 30, 's', 'u', 'b'}) // CONNECT, clean session.
+	require.Equal(t, []byte{3, 0x05, 0x00}, recv(sub))
+
+	send(sub, []byte{14, 0x12, 0x00, 0, 1, 's', 'e', 'n', 's', 'o', 'r', 's', '/', '+'}) // SUBSCRIBE sensors/+
+	require.Equal(t, []byte{8, 0x13, 0x00, 0, 0, 0, 1, 0x00}, recv(sub))
+
+	// qos -1 publishes are sent without connecting, if allowed.
+	anon := dial()
+	defer anon.Close()
+	send(anon, []byte{9, 0x0C, 0x61, 0, 7, 0, 0, 'h', 'i'}) // PUBLISH qos -1, predefined topic 7.
+	require.Equal(t, []byte{9, 0x0C, 0x01, 0, 7, 0, 0, 'h', 'i'}, recv(sub))
+
+	pub := dial()
+	defer pub.Close()
+	send(pub, []byte{9, 0x04, 0x04, 0x01, 0, 30, 'p', 'u', 'b'})
+	require.Equal(t, []byte{3, 0x05, 0x00}, recv(pub))
+
+	send(pub, []byte{15, 0x0A, 0, 0, 0, 1, 's', 'e', 'n', 's', 'o', 'r', 's', '/', '2'}) // REGISTER sensors/2
+	require.Equal(t, []byte{7, 0x0B, 0, 1, 0, 1, 0x00}, recv(pub))
+
+	send(pub, []byte{9, 0x0C, 0x20, 0, 1, 0, 2, 'o', 'k'}) // PUBLISH qos 1, topic 1.
+	require.Equal(t, []byte{7, 0x0D, 0, 1, 0, 2, 0x00}, recv(pub))
+
+	// the topic is registered with the subscriber before the message is sent.
+	require.Equal(t, []byte{15, 0x0A, 0, 1, 0, 1, 's', 'e', 'n', 's', 'o', 'r', 's', '/', '2'}, recv(sub))
+	send(sub, []byte{7, 0x0B, 0, 1, 0, 1, 0x00}) // REGACK
+	require.Equal(t, []byte{9, 0x0C, 0x00, 0, 1, 0, 0, 'o', 'k'}, recv(sub))
+
+	// messages are buffered while the subscriber sleeps.
+	send(sub, []byte{4, 0x18, 0, 60}) // DISCONNECT, sleep for 60 seconds.
+	require.Equal(t, []byte{2, 0x18}, recv(sub))
+
+	send(pub, []byte{9, 0x0C, 0x20, 0, 1, 0, 3, 'z', 'z'})
+	require.Equal(t, []byte{7, 0x0D, 0, 1, 0, 3, 0x00}, recv(pub))
+	time.Sleep(10 * time.Millisecond)
+
+	send(sub, []byte{5, 0x16, 's', 'u', 'b'}) // PINGREQ, awake.
+	require.Equal(t, []byte{9, 0x0C, 0x00, 0, 1, 0, 0, 'z', 'z'}, recv(sub))
+	require.Equal(t, []byte{2, 0x17}, recv(sub))
+
+	cl, ok := s.Clients.Get("sub")
+	require.True(t, ok)
+	require.Equal(t, sub.LocalAddr().String(), cl.Info().Remote)
+	require.Equal(t, "sn", cl.Info().Listener)
+}
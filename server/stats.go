@@ -0,0 +1,46 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/mochi-co/mqtt/server/internal/clients"
+)
+
+// listenerStats contains the aggregate traffic counters of all the clients
+// which have connected to a listener.
+type listenerStats struct {
+	clients.Stats          // traffic counters shared by the clients of the listener.
+	ConnectionsTotal int64 // the number of clients which have connected to the listener.
+}
+
+// listenerStatsIndex is a map of listenerStats keyed on listener id.
+type listenerStatsIndex struct {
+	sync.RWMutex
+	internal map[string]*listenerStats
+}
+
+// newListenerStatsIndex returns a new instance of listenerStatsIndex.
+func newListenerStatsIndex() *listenerStatsIndex {
+	return &listenerStatsIndex{
+		internal: make(map[string]*listenerStats),
+	}
+}
+
+// Get returns the stats for a listener, creating them if they don't exist.
+func (x *listenerStatsIndex) Get(id string) *listenerStats {
+	x.RLock()
+	ls, ok := x.internal[id]
+	x.RUnlock()
+	if ok {
+		return ls
+	}
+
+	x.Lock()
+	defer x.Unlock()
+	if ls, ok = x.internal[id]; !ok {
+		ls = new(listenerStats)
+		x.internal[id] = ls
+	}
+
+	return ls
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-co/mqtt/server/internal/packets"
+	"github.com/mochi-co/mqtt/server/listeners"
+	"github.com/mochi-co/mqtt/server/listeners/auth"
+)
+
+func TestListenerStatsIndexGet(t *testing.T) {
+	x := newListenerStatsIndex()
+	ls := x.Get("t1")
+	require.NotNil(t, ls)
+	require.Same(t, ls, x.Get("t1"))
+	require.NotSame(t, ls, x.Get("t2"))
+}
+
+func BenchmarkListenerStatsIndexGet(b *testing.B) {
+	x := newListenerStatsIndex()
+	for n := 0; n < b.N; n++ {
+		x.Get("t1")
+	}
+}
+
+func TestServerEstablishConnectionStats(t *testing.T) {
+	s := New()
+	s.Listeners.Add(listeners.NewMockListener("tcp", ":1882"))
+
+	r, w := net.Pipe()
+	o := make(chan error)
+	go func() {
+		o <- s.EstablishConnection("tcp", r, new(auth.Allow))
+	}()
+
+	go func() {
+		w.Write([]byte{
+			byte(packets.Connect << 4), 17, // Fixed header
+			0, 4, // Protocol Name - MSB+LSB
+			'M', 'Q', 'T', 'T', // Protocol Name
+			4,     // Protocol Version
+			2,     // Packet Flags - clean session
+			0, 45, // Keepalive
+			0, 5, // Client ID - MSB+LSB
+			'm', 'o', 'c', 'h', 'i', // Client ID
+		})
+		w.Write([]byte{
+			byte(packets.Publish << 4), 12, // Fixed header
+			0, 5, // Topic Name - LSB+MSB
+			'a', '/', 'b', '/', 'c', // Topic Name
+			'h', 'e', 'l', 'l', 'o', // Payload
+		})
+		w.Write([]byte{byte(packets.Disconnect << 4), 0})
+	}()
+
+	recv := make(chan []byte)
+	go func() {
+		buf, err := ioutil.ReadAll(w)
+		if err != nil {
+			panic(err)
+		}
+		recv <- buf
+	}()
+
+	require.ErrorIs(t, <-o, ErrClientDisconnect)
+	w.Close()
+	<-recv
+
+	require.Equal(t, int64(1), atomic.LoadInt64(&s.System.SocketsTotal))
+
+	cl, ok := s.Clients.Get("mochi")
+	require.True(t, ok)
+	require.Equal(t, int64(35), atomic.LoadInt64(&cl.Stats.BytesRecv))
+	require.Equal(t, int64(4), atomic.LoadInt64(&cl.Stats.BytesSent))
+	require.Equal(t, int64(3), atomic.LoadInt64(&cl.Stats.MessagesRecv))
+	require.Equal(t, int64(1), atomic.LoadInt64(&cl.Stats.MessagesSent))
+	require.Equal(t, int64(1), atomic.LoadInt64(&cl.Stats.PublishRecv))
+
+	info, ok := s.GetListener("tcp")
+	require.True(t, ok)
+	require.Equal(t, 0, info.Clients)
+	require.Equal(t, int64(1), info.ConnectionsTotal)
+	require.Equal(t, int64(35), info.BytesRecv)
+	require.Equal(t, int64(4), info.BytesSent)
+	require.Equal(t, int64(3), info.MessagesRecv)
+	require.Equal(t, int64(1), info.MessagesSent)
+	require.Equal(t, int64(1), info.PublishRecv)
+	require.Equal(t, int64(0), info.LastActivity)
+
+	client, ok := s.GetClient("mochi")
+	require.True(t, ok)
+	require.Equal(t, int64(35), client.BytesRecv)
+	require.True(t, client.LastActivity > 0)
+}
+
+func TestServerGetListener(t *testing.T) {
+	s, cl, _, _ := setupClient()
+	cl.Listener = "t1"
+	s.Clients.Add(cl)
+	s.Listeners.Add(listeners.NewMockListener("t1", ":1882"))
+
+	info, ok := s.GetListener("t1")
+	require.True(t, ok)
+	require.Equal(t, "t1", info.ID)
+	require.Equal(t, 1, info.Clients)
+
+	_, ok = s.GetListener("t2")
+	require.False(t, ok)
+}
+
+func TestServerPublishSysTopicsListeners(t *testing.T) {
+	s := New()
+	s.Listeners.Add(listeners.NewMockListener("t1", ":1882"))
+	ls := s.listenerStats.Get("t1")
+	ls.BytesRecv = 100
+	ls.PublishSent = 3
+	ls.ConnectionsTotal = 2
+
+	s.publishSysTopics()
+
+	for topic, want := range map[string]string{
+		"$SYS/broker/listeners/t1/clients/connected":        "0",
+		"$SYS/broker/listeners/t1/connections/total":        "2",
+		"$SYS/broker/listeners/t1/load/bytes/received":      "100",
+		"$SYS/broker/listeners/t1/load/bytes/sent":          "0",
+		"$SYS/broker/listeners/t1/messages/publish/sent":    "3",
+		"$SYS/broker/listeners/t1/messages/publish/dropped": "0",
+	} {
+		msgs := s.Topics.Messages(topic)
+		require.Len(t, msgs, 1, topic)
+		require.Equal(t, want, string(msgs[0].Payload), topic)
+	}
+}
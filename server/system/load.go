@@ -0,0 +1,70 @@
+package system
+
+import (
+	"math"
+	"time"
+)
+
+// EWMA is an exponentially weighted moving average of a per-minute rate,
+// calculated in the same manner as the load averages of mosquitto and unix.
+type EWMA struct {
+	window time.Duration // the time window over which the average decays.
+	rate   float64       // the current average rate per minute.
+}
+
+// NewEWMA returns a new EWMA which averages over a time window, such as 1, 5
+// or 15 minutes.
+func NewEWMA(window time.Duration) *EWMA {
+	return &EWMA{
+		window: window,
+	}
+}
+
+// Update adds a count of events which occurred over an elapsed interval to the average.
+func (e *EWMA) Update(count int64, elapsed time.Duration) {
+	if elapsed <= 0 {
+		return
+	}
+
+	sample := float64(count) * float64(time.Minute) / float64(elapsed)
+	alpha := 1 - math.Exp(-float64(elapsed)/float64(e.window))
+	e.rate += alpha * (sample - e.rate)
+}
+
+// Rate returns the current average rate per minute.
+func (e *EWMA) Rate() float64 {
+	return e.rate
+}
+
+// LoadAverage maintains 1, 5 and 15 minute load averages for a monotonically
+// increasing counter. It is not safe for concurrent use.
+type LoadAverage struct {
+	Min1  *EWMA // the 1 minute average rate.
+	Min5  *EWMA // the 5 minute average rate.
+	Min15 *EWMA // the 15 minute average rate.
+	last  int64 // the value of the counter at the last update.
+}
+
+// NewLoadAverage returns a new LoadAverage for a counter with an initial value.
+func NewLoadAverage(initial int64) *LoadAverage {
+	return &LoadAverage{
+		Min1:  NewEWMA(time.Minute),
+		Min5:  NewEWMA(5 * time.Minute),
+		Min15: NewEWMA(15 * time.Minute),
+		last:  initial,
+	}
+}
+
+// Update updates the load averages with the current value of the counter, which
+// has been sampled after an elapsed interval since the last update.
+func (l *LoadAverage) Update(value int64, elapsed time.Duration) {
+	count := value - l.last
+	if count < 0 {
+		count = 0 // the counter was reset, so don't record a negative rate.
+	}
+	l.last = value
+
+	l.Min1.Update(count, elapsed)
+	l.Min5.Update(count, elapsed)
+	l.Min15.Update(count, elapsed)
+}
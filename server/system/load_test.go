@@ -0,0 +1,75 @@
+package system
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewEWMA(t *testing.T) {
+	e := NewEWMA(time.Minute)
+	require.Equal(t, time.Minute, e.window)
+	require.Equal(t, 0.0, e.Rate())
+}
+
+func TestEWMAUpdate(t *testing.T) {
+	e := NewEWMA(time.Minute)
+	e.Update(60, 30*time.Second) // 120 per minute.
+
+	want := 120 * (1 - math.Exp(-0.5))
+	require.InDelta(t, want, e.Rate(), 0.0001)
+}
+
+func TestEWMAUpdateConverges(t *testing.T) {
+	e := NewEWMA(time.Minute)
+	for i := 0; i < 100; i++ {
+		e.Update(30, 30*time.Second)
+	}
+	require.InDelta(t, 60, e.Rate(), 0.0001)
+
+	for i := 0; i < 100; i++ {
+		e.Update(0, 30*time.Second)
+	}
+	require.InDelta(t, 0, e.Rate(), 0.0001)
+}
+
+func TestEWMAUpdateNoElapsed(t *testing.T) {
+	e := NewEWMA(time.Minute)
+	e.Update(60, 0)
+	require.Equal(t, 0.0, e.Rate())
+}
+
+func BenchmarkEWMAUpdate(b *testing.B) {
+	e := NewEWMA(time.Minute)
+	for n := 0; n < b.N; n++ {
+		e.Update(10, time.Second)
+	}
+}
+
+func TestNewLoadAverage(t *testing.T) {
+	l := NewLoadAverage(10)
+	require.Equal(t, int64(10), l.last)
+	require.Equal(t, time.Minute, l.Min1.window)
+	require.Equal(t, 5*time.Minute, l.Min5.window)
+	require.Equal(t, 15*time.Minute, l.Min15.window)
+}
+
+func TestLoadAverageUpdate(t *testing.T) {
+	l := NewLoadAverage(10)
+	l.Update(70, time.Minute)
+	require.Equal(t, int64(70), l.last)
+	require.InDelta(t, 60*(1-math.Exp(-1)), l.Min1.Rate(), 0.0001)
+	require.InDelta(t, 60*(1-math.Exp(-0.2)), l.Min5.Rate(), 0.0001)
+	require.InDelta(t, 60*(1-math.Exp(-1.0/15)), l.Min15.Rate(), 0.0001)
+	require.True(t, l.Min1.Rate() > l.Min5.Rate())
+	require.True(t, l.Min5.Rate() > l.Min15.Rate())
+}
+
+func TestLoadAverageUpdateReset(t *testing.T) {
+	l := NewLoadAverage(10)
+	l.Update(5, time.Minute)
+	require.Equal(t, int64(5), l.last)
+	require.Equal(t, 0.0, l.Min1.Rate())
+}